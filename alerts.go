@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ALERT_RULES_PATH     = "/etc/brick/clock/alert-rules.json"
+	ALERT_SILENCES_PATH  = "/etc/brick/clock/alert-silences.json"
+	ALERT_RESOLVED_LIMIT = 100
+
+	ALERT_STATE_PENDING  = "pending"
+	ALERT_STATE_FIRING   = "firing"
+	ALERT_STATE_RESOLVED = "resolved"
+
+	EVENT_ALERT_FIRING   = "alert.firing"
+	EVENT_ALERT_RESOLVED = "alert.resolved"
+)
+
+// AlertRule fires when Metric <Operator> Threshold holds for at least For
+type AlertRule struct {
+	Name        string  `json:"name"`
+	Metric      string  `json:"metric"`
+	Operator    string  `json:"operator"`
+	Threshold   float64 `json:"threshold"`
+	For         string  `json:"for"`
+	Severity    string  `json:"severity"`
+	Description string  `json:"description"`
+}
+
+type Alert struct {
+	Rule        string     `json:"rule"`
+	State       string     `json:"state"`
+	Severity    string     `json:"severity"`
+	Description string     `json:"description"`
+	Metric      string     `json:"metric"`
+	Operator    string     `json:"operator"`
+	Threshold   float64    `json:"threshold"`
+	Value       float64    `json:"value"`
+	ActiveSince time.Time  `json:"active_since"`
+	FiringSince *time.Time `json:"firing_since,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	Silenced    bool       `json:"silenced"`
+}
+
+// Silence suppresses notifications for a rule ("*" for all) until EndsAt
+type Silence struct {
+	ID        string    `json:"id"`
+	Rule      string    `json:"rule"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Comment   string    `json:"comment"`
+	CreatedBy string    `json:"created_by"`
+}
+
+type SetAlertRulesRequest struct {
+	Rules []AlertRule `json:"rules"`
+}
+
+type CreateSilenceRequest struct {
+	Rule     string `json:"rule"`
+	Duration string `json:"duration"`
+	Comment  string `json:"comment"`
+}
+
+// Metrics that rules can refer to, all derived from tracking and sources
+var alertMetrics = map[string]string{
+	"offset_ms":          "Absolute system clock offset from NTP time in milliseconds",
+	"last_offset_ms":     "Absolute offset of the last clock update in milliseconds",
+	"rms_offset_ms":      "Long-term average offset in milliseconds",
+	"root_delay_ms":      "Root delay to the stratum-1 source in milliseconds",
+	"root_dispersion_ms": "Root dispersion in milliseconds",
+	"skew_ppm":           "Estimated frequency error bound in ppm",
+	"stratum":            "Current stratum",
+	"reachable_sources":  "Number of sources with a non-zero reach register",
+	"synchronized":       "1 when chronyd reports the clock as synchronised, 0 otherwise",
+}
+
+var alertOperators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// Rules used when no rules file exists
+var defaultAlertRules = []AlertRule{
+	{Name: "high-offset", Metric: "offset_ms", Operator: ">", Threshold: 10, For: "5m", Severity: "warning", Description: "System clock offset above 10ms"},
+	{Name: "no-reachable-sources", Metric: "reachable_sources", Operator: "<", Threshold: 1, For: "5m", Severity: "critical", Description: "No NTP source is reachable"},
+	{Name: "high-stratum", Metric: "stratum", Operator: ">", Threshold: 4, For: "5m", Severity: "warning", Description: "Stratum above 4"},
+}
+
+var (
+	alertRules        []AlertRule
+	activeAlerts      = map[string]*Alert{}
+	resolvedAlerts    []Alert
+	alertSilences     []Silence
+	alertMutex        sync.RWMutex
+	alertRulesPath    = ALERT_RULES_PATH
+	alertSilencesPath = ALERT_SILENCES_PATH
+	alertEvalInterval = 15 * time.Second
+)
+
+func init() {
+	if v := os.Getenv("ALERT_RULES_PATH"); v != "" {
+		alertRulesPath = v
+	}
+	if v := os.Getenv("ALERT_SILENCES_PATH"); v != "" {
+		alertSilencesPath = v
+	}
+	if v := os.Getenv("ALERT_EVAL_INTERVAL"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			alertEvalInterval = parsed
+		}
+	}
+}
+
+// Helper to parse chrony values like "+0.000123456 seconds" into milliseconds
+func parseSecondsToMs(value string) (float64, bool) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return seconds * 1000, true
+}
+
+// Helper to parse chrony values like "0.010 ppm"
+func parseLeadingFloat(value string) (float64, bool) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	parsed, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return parsed, true
+}
+
+// Count sources whose octal reach register is non-zero
+func countReachableSources(sources []map[string]string) int {
+	count := 0
+	for _, source := range sources {
+		reach, err := strconv.ParseInt(source["reach"], 8, 64)
+		if err == nil && reach != 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// Derive alert metrics from tracking and sources data; missing metrics are omitted
+func collectAlertMetrics(tracking map[string]string, sources []map[string]string) map[string]float64 {
+	metrics := map[string]float64{}
+	if isTrackingSynchronized(tracking) {
+		metrics["synchronized"] = 1
+	} else {
+		metrics["synchronized"] = 0
+	}
+	metrics["reachable_sources"] = float64(countReachableSources(sources))
+
+	if tracking == nil || tracking["error"] != "" {
+		return metrics
+	}
+	msFields := map[string]string{
+		"offset_ms":          "System time",
+		"last_offset_ms":     "Last offset",
+		"rms_offset_ms":      "RMS offset",
+		"root_delay_ms":      "Root delay",
+		"root_dispersion_ms": "Root dispersion",
+	}
+	for metric, key := range msFields {
+		if v, ok := parseSecondsToMs(tracking[key]); ok {
+			metrics[metric] = math.Abs(v)
+		}
+	}
+	if v, ok := parseLeadingFloat(tracking["Skew"]); ok {
+		metrics["skew_ppm"] = v
+	}
+	if v, ok := parseLeadingFloat(tracking["Stratum"]); ok {
+		metrics["stratum"] = v
+	}
+	return metrics
+}
+
+func validateAlertRules(rules []AlertRule) error {
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if strings.TrimSpace(rule.Name) == "" {
+			return fmt.Errorf("rule name must not be empty")
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		seen[rule.Name] = true
+		if _, ok := alertMetrics[rule.Metric]; !ok {
+			return fmt.Errorf("rule %q: unknown metric %q", rule.Name, rule.Metric)
+		}
+		if _, ok := alertOperators[rule.Operator]; !ok {
+			return fmt.Errorf("rule %q: unknown operator %q", rule.Name, rule.Operator)
+		}
+		if rule.For != "" {
+			if d, err := time.ParseDuration(rule.For); err != nil || d < 0 {
+				return fmt.Errorf("rule %q: invalid for duration %q", rule.Name, rule.For)
+			}
+		}
+	}
+	return nil
+}
+
+func (rule AlertRule) forDuration() time.Duration {
+	d, _ := time.ParseDuration(rule.For)
+	return d
+}
+
+// Load alert rules from the rules file, falling back to the defaults
+func loadAlertRules() {
+	rules := defaultAlertRules
+	data, err := ioutil.ReadFile(alertRulesPath)
+	if err == nil {
+		var file SetAlertRulesRequest
+		if err := json.Unmarshal(data, &file); err != nil {
+			log.Printf("Error parsing %s: %v", alertRulesPath, err)
+		} else if err := validateAlertRules(file.Rules); err != nil {
+			log.Printf("Invalid alert rules in %s: %v", alertRulesPath, err)
+		} else {
+			rules = file.Rules
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading %s: %v", alertRulesPath, err)
+	}
+
+	alertMutex.Lock()
+	alertRules = rules
+	alertMutex.Unlock()
+}
+
+func saveAlertRules(rules []AlertRule) error {
+	data, err := json.MarshalIndent(SetAlertRulesRequest{Rules: rules}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(alertRulesPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(alertRulesPath, data, 0644)
+}
+
+// Load the silences kept by a previous run
+func loadAlertSilences() {
+	data, err := ioutil.ReadFile(alertSilencesPath)
+	if err == nil {
+		var loaded []Silence
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			log.Printf("Error parsing %s: %v", alertSilencesPath, err)
+		} else {
+			alertMutex.Lock()
+			alertSilences = loaded
+			alertMutex.Unlock()
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading %s: %v", alertSilencesPath, err)
+	}
+}
+
+// Persist silences so they survive a restart; caller must hold alertMutex
+func saveAlertSilencesLocked() error {
+	data, err := json.MarshalIndent(alertSilences, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(alertSilencesPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(alertSilencesPath, data, 0644)
+}
+
+// Check whether a rule is covered by an active silence; caller must hold alertMutex
+func isSilencedLocked(rule string, now time.Time) bool {
+	for _, s := range alertSilences {
+		if (s.Rule == "*" || s.Rule == rule) && !now.Before(s.StartsAt) && now.Before(s.EndsAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate every rule against the given metrics and update alert states
+func evaluateAlerts(metrics map[string]float64, now time.Time) {
+	var events []Event
+
+	alertMutex.Lock()
+	// Drop expired silences
+	var silences []Silence
+	for _, s := range alertSilences {
+		if now.Before(s.EndsAt) {
+			silences = append(silences, s)
+		}
+	}
+	if len(silences) != len(alertSilences) {
+		alertSilences = silences
+		if err := saveAlertSilencesLocked(); err != nil {
+			log.Printf("Error saving %s: %v", alertSilencesPath, err)
+		}
+	}
+
+	ruleNames := map[string]bool{}
+	for _, rule := range alertRules {
+		ruleNames[rule.Name] = true
+		value, ok := metrics[rule.Metric]
+		if !ok {
+			// No data: keep the current state until the metric is available again
+			continue
+		}
+		alert := activeAlerts[rule.Name]
+		silenced := isSilencedLocked(rule.Name, now)
+		if alertOperators[rule.Operator](value, rule.Threshold) {
+			if alert == nil {
+				alert = &Alert{
+					Rule:        rule.Name,
+					State:       ALERT_STATE_PENDING,
+					ActiveSince: now,
+				}
+				activeAlerts[rule.Name] = alert
+			}
+			alert.Severity = rule.Severity
+			alert.Description = rule.Description
+			alert.Metric = rule.Metric
+			alert.Operator = rule.Operator
+			alert.Threshold = rule.Threshold
+			alert.Value = value
+			alert.Silenced = silenced
+			if alert.State == ALERT_STATE_PENDING && now.Sub(alert.ActiveSince) >= rule.forDuration() {
+				firingSince := now
+				alert.State = ALERT_STATE_FIRING
+				alert.FiringSince = &firingSince
+				if !silenced {
+					events = append(events, Event{Type: EVENT_ALERT_FIRING, Data: alertEventData(*alert)})
+				}
+			}
+		} else if alert != nil {
+			alert.Value = value
+			alert.Silenced = silenced
+			if resolved := resolveAlertLocked(alert, now); resolved && !silenced {
+				events = append(events, Event{Type: EVENT_ALERT_RESOLVED, Data: alertEventData(*alert)})
+			}
+		}
+	}
+
+	// Alerts whose rule was removed are resolved quietly
+	for name, alert := range activeAlerts {
+		if !ruleNames[name] {
+			resolveAlertLocked(alert, now)
+		}
+	}
+	alertMutex.Unlock()
+
+	for _, event := range events {
+		emitEvent(event.Type, event.Data)
+	}
+}
+
+// Move an alert to the resolved list; reports whether it had been firing
+func resolveAlertLocked(alert *Alert, now time.Time) bool {
+	wasFiring := alert.State == ALERT_STATE_FIRING
+	delete(activeAlerts, alert.Rule)
+	if !wasFiring {
+		return false
+	}
+	resolvedAt := now
+	alert.State = ALERT_STATE_RESOLVED
+	alert.ResolvedAt = &resolvedAt
+	resolvedAlerts = append(resolvedAlerts, *alert)
+	if len(resolvedAlerts) > ALERT_RESOLVED_LIMIT {
+		resolvedAlerts = resolvedAlerts[len(resolvedAlerts)-ALERT_RESOLVED_LIMIT:]
+	}
+	return true
+}
+
+func alertEventData(alert Alert) map[string]interface{} {
+	return map[string]interface{}{
+		"rule":        alert.Rule,
+		"severity":    alert.Severity,
+		"description": alert.Description,
+		"metric":      alert.Metric,
+		"operator":    alert.Operator,
+		"threshold":   alert.Threshold,
+		"value":       alert.Value,
+	}
+}
+
+// Derive alert metrics from cache snapshots. Data kept from before a
+// failed refresh is stale, so chronyd not answering counts as
+// unsynchronised with no reachable sources.
+func snapshotAlertMetrics(snapshots map[*CachedData]CacheSnapshot) map[string]float64 {
+	tracking, _ := snapshots[trackingCache].Data.(map[string]string)
+	if err := snapshots[trackingCache].Err; err != nil {
+		tracking = map[string]string{"error": err.Error()}
+	}
+	sources, _ := snapshots[sourcesCache].Data.([]map[string]string)
+	if snapshots[sourcesCache].Err != nil {
+		sources = nil
+	}
+	return collectAlertMetrics(tracking, sources)
+}
+
+// Periodically evaluate alert rules against cached chrony data
+func startAlertEvaluator() {
+	loadAlertRules()
+	loadAlertSilences()
+	go func() {
+		for {
+			initializeCaches()
+			ctx, cancel := context.WithTimeout(context.Background(), backendRequestTimeout)
+			snapshots := snapshotCaches(ctx, trackingCache, sourcesCache)
+			cancel()
+			evaluateAlerts(snapshotAlertMetrics(snapshots), time.Now().UTC())
+			time.Sleep(alertEvalInterval)
+		}
+	}()
+}
+
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+
+	alertMutex.RLock()
+	alerts := make([]Alert, 0, len(activeAlerts))
+	for _, alert := range activeAlerts {
+		alerts = append(alerts, *alert)
+	}
+	var resolved []Alert
+	if r.URL.Query().Get("include_resolved") == "1" {
+		resolved = make([]Alert, len(resolvedAlerts))
+		copy(resolved, resolvedAlerts)
+	}
+	alertMutex.RUnlock()
+
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Rule < alerts[j].Rule })
+	response := map[string]interface{}{
+		"alerts": alerts,
+	}
+	if resolved != nil {
+		response["resolved"] = resolved
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleAlertRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		alertMutex.RLock()
+		rules := make([]AlertRule, len(alertRules))
+		copy(rules, alertRules)
+		alertMutex.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rules":   rules,
+			"metrics": alertMetrics,
+		})
+
+	case http.MethodPut:
+		var req SetAlertRulesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if req.Rules == nil {
+			req.Rules = []AlertRule{}
+		}
+		if err := validateAlertRules(req.Rules); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+			return
+		}
+		if err := saveAlertRules(req.Rules); err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save alert rules", err.Error())
+			return
+		}
+		alertMutex.Lock()
+		alertRules = req.Rules
+		alertMutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"rules": req.Rules})
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
+
+// Handles /alerts/silences and /alerts/silences/{id}
+func handleAlertSilences(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/alerts/silences"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		now := time.Now().UTC()
+		alertMutex.RLock()
+		silences := []Silence{}
+		for _, s := range alertSilences {
+			if now.Before(s.EndsAt) {
+				silences = append(silences, s)
+			}
+		}
+		alertMutex.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"silences": silences})
+
+	case id == "" && r.Method == http.MethodPost:
+		var req CreateSilenceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if req.Rule == "" {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "rule must be a rule name or \"*\"", nil)
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "duration must be a positive duration such as \"1h\"", nil)
+			return
+		}
+		createdBy, _ := requestClaims(r)["sub"].(string)
+		now := time.Now().UTC()
+		silence := Silence{
+			ID:        newID(),
+			Rule:      req.Rule,
+			StartsAt:  now,
+			EndsAt:    now.Add(duration),
+			Comment:   req.Comment,
+			CreatedBy: createdBy,
+		}
+		alertMutex.Lock()
+		alertSilences = append(alertSilences, silence)
+		err = saveAlertSilencesLocked()
+		if err != nil {
+			alertSilences = alertSilences[:len(alertSilences)-1]
+		} else if alert, ok := activeAlerts[req.Rule]; ok {
+			alert.Silenced = true
+		}
+		alertMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save silences", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(silence)
+
+	case id != "" && r.Method == http.MethodDelete:
+		alertMutex.Lock()
+		found := false
+		var err error
+		for i, s := range alertSilences {
+			if s.ID == id {
+				previous := alertSilences
+				alertSilences = append(alertSilences[:i:i], alertSilences[i+1:]...)
+				if err = saveAlertSilencesLocked(); err != nil {
+					alertSilences = previous
+				}
+				found = true
+				break
+			}
+		}
+		alertMutex.Unlock()
+		if !found {
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Silence not found", nil)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save silences", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"el/brick-clock/client"
+)
+
+// Evaluate only the given rules, starting without alerts or silences, and
+// collect the alert event types emitted
+func useTestAlerts(t *testing.T, rules []AlertRule, silences []Silence) *[]string {
+	t.Helper()
+	alertMutex.Lock()
+	savedRules, savedActive, savedResolved, savedSilences := alertRules, activeAlerts, resolvedAlerts, alertSilences
+	alertRules, activeAlerts, resolvedAlerts, alertSilences = rules, map[string]*Alert{}, nil, silences
+	alertMutex.Unlock()
+	var events []string
+	unsubscribe := subscribeEvents(func(e Event) {
+		if e.Type == EVENT_ALERT_FIRING || e.Type == EVENT_ALERT_RESOLVED {
+			events = append(events, e.Type)
+		}
+	})
+	t.Cleanup(func() {
+		unsubscribe()
+		alertMutex.Lock()
+		alertRules, activeAlerts, resolvedAlerts, alertSilences = savedRules, savedActive, savedResolved, savedSilences
+		alertMutex.Unlock()
+	})
+	return &events
+}
+
+func TestEvaluateAlerts(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+	offset := func(ms float64) map[string]float64 { return map[string]float64{"offset_ms": ms} }
+	rule := AlertRule{Name: "high-offset", Metric: "offset_ms", Operator: ">", Threshold: 10, For: "5m", Severity: "warning"}
+	immediate := rule
+	immediate.For = ""
+	silence := Silence{ID: "s1", Rule: rule.Name, StartsAt: start, EndsAt: start.Add(time.Hour)}
+
+	// state is the active alert's state after the step ("" for none);
+	// event is the alert event the step emits ("" for none)
+	type step struct {
+		at      time.Duration
+		metrics map[string]float64
+		state   string
+		event   string
+	}
+	tests := []struct {
+		name     string
+		rule     AlertRule
+		silences []Silence
+		steps    []step
+		resolved int
+	}{
+		{"pending until the for duration", rule, nil, []step{
+			{0, offset(20), ALERT_STATE_PENDING, ""},
+			{4 * time.Minute, offset(20), ALERT_STATE_PENDING, ""},
+			{5 * time.Minute, offset(20), ALERT_STATE_FIRING, EVENT_ALERT_FIRING},
+			{6 * time.Minute, offset(20), ALERT_STATE_FIRING, ""},
+		}, 0},
+		{"cleared while pending", rule, nil, []step{
+			{0, offset(20), ALERT_STATE_PENDING, ""},
+			{2 * time.Minute, offset(5), "", ""},
+			{3 * time.Minute, offset(20), ALERT_STATE_PENDING, ""},
+			{7 * time.Minute, offset(20), ALERT_STATE_PENDING, ""},
+		}, 0},
+		{"firing then resolved", rule, nil, []step{
+			{0, offset(20), ALERT_STATE_PENDING, ""},
+			{5 * time.Minute, offset(20), ALERT_STATE_FIRING, EVENT_ALERT_FIRING},
+			{6 * time.Minute, offset(5), "", EVENT_ALERT_RESOLVED},
+		}, 1},
+		{"missing metric keeps the state", rule, nil, []step{
+			{0, offset(20), ALERT_STATE_PENDING, ""},
+			{5 * time.Minute, map[string]float64{}, ALERT_STATE_PENDING, ""},
+			{6 * time.Minute, offset(20), ALERT_STATE_FIRING, EVENT_ALERT_FIRING},
+		}, 0},
+		{"no for duration fires at once", immediate, nil, []step{
+			{0, offset(20), ALERT_STATE_FIRING, EVENT_ALERT_FIRING},
+			{time.Minute, offset(5), "", EVENT_ALERT_RESOLVED},
+		}, 1},
+		{"silenced", rule, []Silence{silence}, []step{
+			{0, offset(20), ALERT_STATE_PENDING, ""},
+			{5 * time.Minute, offset(20), ALERT_STATE_FIRING, ""},
+			{6 * time.Minute, offset(5), "", ""},
+		}, 1},
+		{"silence expired", rule, []Silence{silence}, []step{
+			{0, offset(20), ALERT_STATE_PENDING, ""},
+			{time.Hour, offset(20), ALERT_STATE_FIRING, EVENT_ALERT_FIRING},
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := useTestAlerts(t, []AlertRule{tt.rule}, tt.silences)
+			for i, s := range tt.steps {
+				*events = nil
+				evaluateAlerts(s.metrics, start.Add(s.at))
+
+				alertMutex.RLock()
+				state := ""
+				if alert := activeAlerts[tt.rule.Name]; alert != nil {
+					state = alert.State
+					if alert.Silenced != (len(tt.silences) > 0 && s.at < time.Hour) {
+						t.Errorf("step %d: silenced = %v", i, alert.Silenced)
+					}
+				}
+				alertMutex.RUnlock()
+				if state != s.state {
+					t.Errorf("step %d (%v): state = %q, want %q", i, s.at, state, s.state)
+				}
+				if got := strings.Join(*events, ","); got != s.event {
+					t.Errorf("step %d (%v): events = %q, want %q", i, s.at, got, s.event)
+				}
+			}
+			if len(resolvedAlerts) != tt.resolved {
+				t.Errorf("resolved alerts = %d, want %d", len(resolvedAlerts), tt.resolved)
+			}
+		})
+	}
+}
+
+func TestAlertMetricsIgnoreStaleData(t *testing.T) {
+	tracking := map[string]string{"Reference ID": "CA760182 (202.118.1.130)", "Leap status": "Normal", "System time": "0.000000000 seconds slow of NTP time", "Stratum": "3"}
+	sources := []map[string]string{{"name": "202.118.1.130", "reach": "377"}}
+	healthy := map[*CachedData]CacheSnapshot{
+		trackingCache: {Data: tracking},
+		sourcesCache:  {Data: sources},
+	}
+	if metrics := snapshotAlertMetrics(healthy); metrics["synchronized"] != 1 || metrics["reachable_sources"] != 1 {
+		t.Fatalf("metrics = %v, want synchronized with one reachable source", metrics)
+	}
+
+	// A failed refresh keeps the last good data next to the error
+	failed := errors.New("chronyc: 506 Cannot talk to daemon")
+	dead := map[*CachedData]CacheSnapshot{
+		trackingCache: {Data: tracking, Err: failed},
+		sourcesCache:  {Data: sources, Err: failed},
+	}
+	metrics := snapshotAlertMetrics(dead)
+	if metrics["synchronized"] != 0 || metrics["reachable_sources"] != 0 {
+		t.Errorf("metrics with chronyd down = %v, want unsynchronised without reachable sources", metrics)
+	}
+	if _, ok := metrics["stratum"]; ok {
+		t.Errorf("metrics with chronyd down = %v, want no stale stratum", metrics)
+	}
+}
+
+func TestAlertSilencesSurviveRestart(t *testing.T) {
+	useTestAlerts(t, defaultAlertRules, nil)
+	c := newTestSDK(t, adminClaims())
+	ctx := context.Background()
+
+	silence, err := c.CreateSilence(ctx, client.SilenceRequest{Rule: "high-offset", Duration: "1h"})
+	if err != nil {
+		t.Fatalf("CreateSilence: %v", err)
+	}
+	alertMutex.Lock()
+	alertSilences = nil
+	alertMutex.Unlock()
+	loadAlertSilences()
+	silences, err := c.Silences(ctx)
+	if err != nil || len(silences) != 1 || silences[0].ID != silence.ID {
+		t.Fatalf("Silences after reloading = %+v, %v; want %s", silences, err, silence.ID)
+	}
+
+	if err := c.DeleteSilence(ctx, silence.ID); err != nil {
+		t.Fatalf("DeleteSilence: %v", err)
+	}
+	loadAlertSilences()
+	if silences, _ := c.Silences(ctx); len(silences) != 0 {
+		t.Errorf("Silences after deleting and reloading = %+v, want none", silences)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+)
+
+// Prefix of the versioned API; unversioned routes remain as legacy aliases
+const API_PREFIX = "/v1"
+
+// Error codes used in the error envelope
+const (
+	ERR_INVALID_JSON       = "invalid_json"
+	ERR_INVALID_REQUEST    = "invalid_request"
+	ERR_UNAUTHORIZED       = "unauthorized"
+	ERR_FORBIDDEN          = "forbidden"
+	ERR_NOT_FOUND          = "not_found"
+	ERR_METHOD_NOT_ALLOWED = "method_not_allowed"
+	ERR_INTERNAL           = "internal_error"
+	ERR_BACKEND            = "backend_error"
+	ERR_RESTART_FAILED     = "restart_failed"
+	ERR_BACKEND_TIMEOUT    = "backend_timeout"
+
+	ERR_PRECONDITION_FAILED   = "precondition_failed"
+	ERR_PRECONDITION_REQUIRED = "precondition_required"
+	ERR_CONFLICT              = "conflict"
+)
+
+// Error envelope returned by every endpoint
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+type contextKey string
+
+const requestIDContextKey contextKey = "request_id"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// Attach a request ID (taken from X-Request-ID when well-formed) to every request
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)))
+	})
+}
+
+func requestIDFromRequest(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// Write an error envelope with the given status code
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorBody{
+			Code:      code,
+			Message:   message,
+			Details:   details,
+			RequestID: requestIDFromRequest(r),
+		},
+	})
+}
+
+// Fallback for paths that match no registered route
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No route for "+r.URL.Path, nil)
+}
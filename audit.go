@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_LOG_PATH      = "/var/log/brick/clock/audit.jsonl"
+	AUDIT_DEFAULT_LIMIT = 100
+	AUDIT_MAX_LIMIT     = 1000
+)
+
+// Audited actions
+const (
+	AUDIT_SERVERS_SET     = "servers.set"
+	AUDIT_SERVERS_DELETE  = "servers.delete"
+	AUDIT_SERVERS_DEFAULT = "servers.default"
+	AUDIT_SERVERS_PROFILE = "servers.profile"
+	AUDIT_SERVERS_SELECT  = "servers.select"
+	AUDIT_FAILOVER        = "servers.failover"
+	AUDIT_DISCOVERY       = "servers.discover"
+	AUDIT_SERVER_MODE_SET = "server_mode.set"
+	AUDIT_CLUSTER_SET     = "cluster.set"
+	AUDIT_CONFIG_SET      = "config.set"
+	AUDIT_CONFIG_CONFIRM  = "config.confirm"
+	AUDIT_CONFIG_REVERT   = "config.revert"
+	AUDIT_CONFIG_RESTORE  = "config.restore"
+
+	// Actor of changes the service makes on its own
+	AUDIT_SYSTEM_ACTOR = "system"
+)
+
+// Every audited action, as documented for the action filter of GET /audit
+var auditActions = []string{
+	AUDIT_SERVERS_SET, AUDIT_SERVERS_DELETE, AUDIT_SERVERS_DEFAULT, AUDIT_SERVERS_PROFILE,
+	AUDIT_SERVERS_SELECT, AUDIT_FAILOVER, AUDIT_DISCOVERY, AUDIT_SERVER_MODE_SET,
+	AUDIT_CLUSTER_SET, AUDIT_CONFIG_SET, AUDIT_CONFIG_CONFIRM, AUDIT_CONFIG_REVERT,
+	AUDIT_CONFIG_RESTORE,
+}
+
+// One line of the audit log
+type AuditEntry struct {
+	ID             string      `json:"id"`
+	Timestamp      time.Time   `json:"timestamp"`
+	Action         string      `json:"action"`
+	Actor          string      `json:"actor"`
+	SourceIP       string      `json:"source_ip"`
+	RequestID      string      `json:"request_id"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	Request        interface{} `json:"request,omitempty"`
+	Diff           string      `json:"diff,omitempty"`
+	Success        bool        `json:"success"`
+	RestartSuccess *bool       `json:"restart_success,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	Revision       int64       `json:"revision"`
+}
+
+var (
+	auditPath           = AUDIT_LOG_PATH
+	auditMaxSize  int64 = 10 * 1024 * 1024
+	auditMaxFiles       = 5
+	auditMutex    sync.Mutex
+)
+
+func init() {
+	if v := os.Getenv("AUDIT_LOG_PATH"); v != "" {
+		auditPath = v
+	}
+	if v := os.Getenv("AUDIT_MAX_SIZE"); v != "" {
+		if parsed, err := strconv.ParseInt(v, 10, 64); err == nil && parsed > 0 {
+			auditMaxSize = parsed
+		} else {
+			log.Printf("Invalid AUDIT_MAX_SIZE %q, using %d", v, auditMaxSize)
+		}
+	}
+	if v := os.Getenv("AUDIT_MAX_FILES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			auditMaxFiles = parsed
+		} else {
+			log.Printf("Invalid AUDIT_MAX_FILES %q, using %d", v, auditMaxFiles)
+		}
+	}
+}
+
+// Helper to read chrony.conf for before/after diffs; a missing file reads as empty
+func readChronyConf() string {
+	content, err := ioutil.ReadFile(chronyConfPath)
+	if err != nil {
+		return ""
+	}
+	return string(content)
+}
+
+// Helper to find the client address; requests over the Unix socket have none
+func sourceIP(r *http.Request) string {
+	if isLocalSocketRequest(r) {
+		return "unix"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Record a configuration change. The caller fills in Action, Request,
+// RestartSuccess and Error; before is chrony.conf as read prior to the change.
+func recordAudit(r *http.Request, entry AuditEntry, before string) {
+	entry.Actor, _ = requestClaims(r)["sub"].(string)
+	entry.SourceIP = sourceIP(r)
+	entry.RequestID = requestIDFromRequest(r)
+	entry.Method = r.Method
+	entry.Path = r.URL.Path
+	appendAudit(entry, before)
+}
+
+// Record a change the service made on its own, such as an automatic revert
+func recordSystemAudit(entry AuditEntry, before string) {
+	entry.Actor = AUDIT_SYSTEM_ACTOR
+	appendAudit(entry, before)
+}
+
+func appendAudit(entry AuditEntry, before string) {
+	entry.ID = newID()
+	entry.Timestamp = time.Now().UTC()
+	entry.Diff = unifiedDiff(before, readChronyConf(), chronyConfPath)
+	entry.Success = entry.Error == "" && (entry.RestartSuccess == nil || *entry.RestartSuccess)
+	entry.Revision = syncConfigRevision()
+
+	if err := appendAuditEntry(entry); err != nil {
+		// The change has already happened; make sure it is at least in the service log
+		log.Printf("Failed to write audit entry %s (%s by %q): %v", entry.ID, entry.Action, entry.Actor, err)
+	}
+}
+
+func appendAuditEntry(entry AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(auditPath), 0750); err != nil {
+		return err
+	}
+	if info, err := os.Stat(auditPath); err == nil && info.Size()+int64(len(line)) > auditMaxSize {
+		rotateAuditLocked()
+	}
+	f, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(line)
+	return err
+}
+
+// Shift audit.jsonl -> .1 -> .2 ...; the oldest file beyond auditMaxFiles is dropped
+func rotateAuditLocked() {
+	os.Remove(fmt.Sprintf("%s.%d", auditPath, auditMaxFiles))
+	for i := auditMaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", auditPath, i), fmt.Sprintf("%s.%d", auditPath, i+1))
+	}
+	if err := os.Rename(auditPath, auditPath+".1"); err != nil {
+		log.Printf("Failed to rotate audit log: %v", err)
+	}
+}
+
+// Audit log files from oldest to newest
+func auditFiles() []string {
+	var files []string
+	for i := auditMaxFiles; i >= 1; i-- {
+		path := fmt.Sprintf("%s.%d", auditPath, i)
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return append(files, auditPath)
+}
+
+// Filters accepted by GET /audit
+type auditFilter struct {
+	Actor     string
+	Action    string
+	RequestID string
+	Success   *bool
+	Since     time.Time
+	Until     time.Time
+}
+
+func (f auditFilter) matches(entry AuditEntry) bool {
+	if f.Actor != "" && entry.Actor != f.Actor {
+		return false
+	}
+	if f.Action != "" && entry.Action != f.Action {
+		return false
+	}
+	if f.RequestID != "" && entry.RequestID != f.RequestID {
+		return false
+	}
+	if f.Success != nil && entry.Success != *f.Success {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Timestamp.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Read matching entries, oldest first
+func readAuditEntries(filter auditFilter) ([]AuditEntry, error) {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	var entries []AuditEntry
+	for _, path := range auditFiles() {
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if filter.matches(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Query the audit log: ?actor=&action=&request_id=&success=&since=&until=&limit=,
+// newest first; ?format=jsonl exports every match oldest first as JSON Lines
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	query := r.URL.Query()
+	filter := auditFilter{
+		Actor:     query.Get("actor"),
+		Action:    query.Get("action"),
+		RequestID: query.Get("request_id"),
+	}
+	if v := query.Get("success"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "success must be true or false", nil)
+			return
+		}
+		filter.Success = &parsed
+	}
+	for name, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, name+" must be an RFC 3339 timestamp", nil)
+				return
+			}
+			*target = parsed
+		}
+	}
+	limit := AUDIT_DEFAULT_LIMIT
+	if v := query.Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > AUDIT_MAX_LIMIT {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, fmt.Sprintf("limit must be between 1 and %d", AUDIT_MAX_LIMIT), nil)
+			return
+		}
+		limit = parsed
+	}
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "jsonl" {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "format must be json or jsonl", nil)
+		return
+	}
+
+	entries, err := readAuditEntries(filter)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to read audit log", err.Error())
+		return
+	}
+
+	if format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"audit.jsonl\"")
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+		return
+	}
+
+	result := make([]AuditEntry, 0, limit)
+	for i := len(entries) - 1; i >= 0 && len(result) < limit; i-- {
+		result = append(result, entries[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": result,
+		"total":   len(entries),
+	})
+}
+
+// Line-based unified diff with three lines of context; empty when equal
+func unifiedDiff(before string, after string, name string) string {
+	if before == after {
+		return ""
+	}
+	a := strings.SplitAfter(before, "\n")
+	b := strings.SplitAfter(after, "\n")
+	if len(a) > 0 && a[len(a)-1] == "" {
+		a = a[:len(a)-1]
+	}
+	if len(b) > 0 && b[len(b)-1] == "" {
+		b = b[:len(b)-1]
+	}
+
+	// Longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type diffLine struct {
+		op   byte
+		text string
+		ai   int
+		bi   int
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i], i, j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, diffLine{'+', b[j], i, j})
+			j++
+		default:
+			lines = append(lines, diffLine{'-', a[i], i, j})
+			i++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	out.WriteString("--- a" + name + "\n+++ b" + name + "\n")
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk while changes are within 2*context lines of each other
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		end := start
+		for k := start; k < len(lines); k++ {
+			if lines[k].op != ' ' {
+				end = k
+			} else if k-end > 2*context {
+				break
+			}
+		}
+		to := end + context + 1
+		if to > len(lines) {
+			to = len(lines)
+		}
+		aCount, bCount := 0, 0
+		for _, l := range lines[from:to] {
+			if l.op != '+' {
+				aCount++
+			}
+			if l.op != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", lines[from].ai+1, aCount, lines[from].bi+1, bCount)
+		for _, l := range lines[from:to] {
+			out.WriteByte(l.op)
+			out.WriteString(strings.TrimSuffix(l.text, "\n"))
+			out.WriteByte('\n')
+		}
+		start = to
+	}
+	return out.String()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The action filter of GET /audit is documented from auditActions
+func TestAuditActionsListsEveryAction(t *testing.T) {
+	actions := []string{
+		AUDIT_SERVERS_SET, AUDIT_SERVERS_DELETE, AUDIT_SERVERS_DEFAULT, AUDIT_SERVERS_PROFILE,
+		AUDIT_SERVERS_SELECT, AUDIT_FAILOVER, AUDIT_DISCOVERY, AUDIT_SERVER_MODE_SET,
+		AUDIT_CLUSTER_SET, AUDIT_CONFIG_SET, AUDIT_CONFIG_CONFIRM, AUDIT_CONFIG_REVERT,
+		AUDIT_CONFIG_RESTORE,
+	}
+	for _, action := range actions {
+		if !containsString(auditActions, action) {
+			t.Errorf("action %q is missing from auditActions", action)
+		}
+	}
+	if len(auditActions) != len(actions) {
+		t.Errorf("auditActions = %v, want %d actions", auditActions, len(actions))
+	}
+
+	for _, op := range apiOperations {
+		if op.Method != "GET" || op.Path != "/audit" {
+			continue
+		}
+		for _, param := range op.Params {
+			if param.Name == "action" && !strings.Contains(param.Description, strings.Join(auditActions, ", ")) {
+				t.Errorf("action parameter description %q does not list every action", param.Description)
+			}
+		}
+	}
+}
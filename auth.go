@@ -0,0 +1,461 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	PUBLIC_KEY_PATH         = "/etc/brick/clock/public.pem"
+	JWKS_MIN_REFRESH_PERIOD = 30 * time.Second
+)
+
+// Signing algorithms accepted for incoming tokens
+var supportedSigningAlgs = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+// A key that can verify token signatures
+type verificationKey struct {
+	ID     string
+	Alg    string
+	Key    crypto.PublicKey
+	Source string
+}
+
+// JSON Web Key as found in a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Fingerprint of a watched file, used for hot reload
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Keys from every configured source; lookups see a consistent snapshot
+type keyStore struct {
+	mutex          sync.RWMutex
+	pemKeys        []verificationKey
+	fileKeys       []verificationKey
+	urlKeys        []verificationKey
+	pemStamp       fileStamp
+	pemMissing     bool
+	fileStamp      fileStamp
+	fileMissing    bool
+	lastURLRefresh time.Time
+	refreshMutex   sync.Mutex
+}
+
+var (
+	keys                = &keyStore{}
+	publicKeyPath       = PUBLIC_KEY_PATH
+	jwksPath            = ""
+	jwksURL             = ""
+	jwksRefreshInterval = 5 * time.Minute
+	keyReloadInterval   = 30 * time.Second
+	jwksHTTPClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	if v := os.Getenv("JWT_PUBLIC_KEY_PATH"); v != "" {
+		publicKeyPath = v
+	}
+	jwksPath = os.Getenv("JWKS_PATH")
+	jwksURL = os.Getenv("JWKS_URL")
+	if v := os.Getenv("JWKS_REFRESH_INTERVAL"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			jwksRefreshInterval = parsed
+		}
+	}
+	if v := os.Getenv("KEY_RELOAD_INTERVAL"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			keyReloadInterval = parsed
+		}
+	}
+}
+
+// Parse every public key in a PEM file (PKCS1 RSA or PKIX RSA/ECDSA/Ed25519)
+func parsePEMKeys(data []byte, source string) ([]verificationKey, error) {
+	var result []verificationKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if pub, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+			result = append(result, verificationKey{Key: pub, Source: source})
+			continue
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %v", err)
+		}
+		switch parsed.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			result = append(result, verificationKey{Key: parsed, Source: source})
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", parsed)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no PEM public key found")
+	}
+	return result, nil
+}
+
+func decodeJWKField(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// Convert a JWK into a public key
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeJWKField(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %v", err)
+		}
+		e, err := decodeJWKField(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e: %v", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeJWKField(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %v", err)
+		}
+		y, err := decodeJWKField(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %v", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", jwk.Crv)
+		}
+		return pub, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeJWKField(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+// Parse a JWKS document; keys that cannot be used for signatures are skipped
+func parseJWKS(data []byte, source string) ([]verificationKey, error) {
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+	var result []verificationKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping key %q from %s: %v", jwk.Kid, source, err)
+			continue
+		}
+		result = append(result, verificationKey{ID: jwk.Kid, Alg: jwk.Alg, Key: pub, Source: source})
+	}
+	return result, nil
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// Reload the PEM file and local JWKS file if they changed since the last load
+func (ks *keyStore) reloadFiles() {
+	if publicKeyPath != "" {
+		if stamp, err := statFile(publicKeyPath); err != nil {
+			ks.mutex.Lock()
+			if !ks.pemMissing {
+				log.Printf("WARNING: public key %s unavailable: %v", publicKeyPath, err)
+			}
+			ks.pemKeys = nil
+			ks.pemStamp = fileStamp{}
+			ks.pemMissing = true
+			ks.mutex.Unlock()
+		} else {
+			ks.mutex.RLock()
+			changed := stamp != ks.pemStamp
+			ks.mutex.RUnlock()
+			if changed {
+				data, err := ioutil.ReadFile(publicKeyPath)
+				if err == nil {
+					var loaded []verificationKey
+					if loaded, err = parsePEMKeys(data, publicKeyPath); err == nil {
+						ks.mutex.Lock()
+						ks.pemKeys = loaded
+						ks.pemStamp = stamp
+						ks.pemMissing = false
+						ks.mutex.Unlock()
+						log.Printf("Loaded %d key(s) from %s", len(loaded), publicKeyPath)
+					}
+				}
+				if err != nil {
+					log.Printf("WARNING: failed to load %s: %v", publicKeyPath, err)
+				}
+			}
+		}
+	}
+
+	if jwksPath != "" {
+		stamp, err := statFile(jwksPath)
+		if err != nil {
+			ks.mutex.Lock()
+			if !ks.fileMissing {
+				log.Printf("WARNING: JWKS file %s unavailable: %v", jwksPath, err)
+			}
+			ks.fileMissing = true
+			ks.mutex.Unlock()
+			return
+		}
+		ks.mutex.RLock()
+		changed := stamp != ks.fileStamp
+		ks.mutex.RUnlock()
+		if !changed {
+			return
+		}
+		data, err := ioutil.ReadFile(jwksPath)
+		if err == nil {
+			var loaded []verificationKey
+			if loaded, err = parseJWKS(data, jwksPath); err == nil {
+				ks.mutex.Lock()
+				ks.fileKeys = loaded
+				ks.fileStamp = stamp
+				ks.fileMissing = false
+				ks.mutex.Unlock()
+				log.Printf("Loaded %d key(s) from %s", len(loaded), jwksPath)
+			}
+		}
+		if err != nil {
+			log.Printf("WARNING: failed to load %s: %v", jwksPath, err)
+		}
+	}
+}
+
+// Fetch the remote JWKS; on failure the previously cached keys are kept
+func (ks *keyStore) refreshURL(force bool) {
+	if jwksURL == "" {
+		return
+	}
+	ks.refreshMutex.Lock()
+	defer ks.refreshMutex.Unlock()
+	if !force && time.Since(ks.lastURLRefresh) < JWKS_MIN_REFRESH_PERIOD {
+		return
+	}
+	ks.lastURLRefresh = time.Now()
+
+	resp, err := jwksHTTPClient.Get(jwksURL)
+	if err != nil {
+		log.Printf("WARNING: failed to fetch JWKS from %s: %v", jwksURL, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("WARNING: failed to fetch JWKS from %s: status %d", jwksURL, resp.StatusCode)
+		return
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("WARNING: failed to read JWKS from %s: %v", jwksURL, err)
+		return
+	}
+	loaded, err := parseJWKS(data, jwksURL)
+	if err != nil {
+		log.Printf("WARNING: %v (from %s)", err, jwksURL)
+		return
+	}
+	ks.mutex.Lock()
+	ks.urlKeys = loaded
+	ks.mutex.Unlock()
+}
+
+// Keys matching the token's kid, followed by keys without an ID
+func (ks *keyStore) candidates(kid string) []verificationKey {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	var matched, unnamed []verificationKey
+	for _, set := range [][]verificationKey{ks.urlKeys, ks.fileKeys, ks.pemKeys} {
+		for _, key := range set {
+			if key.ID == "" {
+				unnamed = append(unnamed, key)
+			} else if kid != "" && key.ID == kid {
+				matched = append(matched, key)
+			}
+		}
+	}
+	return append(matched, unnamed...)
+}
+
+func (ks *keyStore) hasKeyID(kid string) bool {
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+	for _, set := range [][]verificationKey{ks.urlKeys, ks.fileKeys} {
+		for _, key := range set {
+			if key.ID == kid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check that a key can be used with the token's algorithm
+func keyMatchesAlg(key verificationKey, alg string) bool {
+	if key.Alg != "" && key.Alg != alg {
+		return false
+	}
+	switch key.Key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(alg, "ES")
+	case ed25519.PublicKey:
+		return alg == "EdDSA"
+	}
+	return false
+}
+
+// Load keys and start background reload/refresh; a missing key is not fatal
+func initKeyStore() {
+	keys.reloadFiles()
+	keys.refreshURL(true)
+
+	keys.mutex.RLock()
+	total := len(keys.pemKeys) + len(keys.fileKeys) + len(keys.urlKeys)
+	keys.mutex.RUnlock()
+	if total == 0 {
+		log.Println("WARNING: no JWT verification keys loaded; authenticated requests will be rejected until keys are available")
+	}
+
+	go func() {
+		for {
+			time.Sleep(keyReloadInterval)
+			keys.reloadFiles()
+		}
+	}()
+	if jwksURL != "" {
+		go func() {
+			for {
+				time.Sleep(jwksRefreshInterval)
+				keys.refreshURL(true)
+			}
+		}()
+	}
+}
+
+// Verify a token's signature against the key store, then check its claims
+// against the configured policy
+func verifyToken(tokenStr string) (jwt.MapClaims, error) {
+	parser := &jwt.Parser{ValidMethods: supportedSigningAlgs, SkipClaimsValidation: true}
+
+	unverified, _, err := parser.ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		return nil, newAuthError(AUTH_TOKEN_MALFORMED, "malformed token: %v", err)
+	}
+	alg, _ := unverified.Header["alg"].(string)
+	kid, _ := unverified.Header["kid"].(string)
+	if !containsString(supportedSigningAlgs, alg) {
+		return nil, newAuthError(AUTH_ALGORITHM_UNSUPPORTED, "signing algorithm %q is not supported", alg)
+	}
+
+	// An unknown kid may mean the issuer rotated keys: refresh the remote set (rate limited)
+	if kid != "" && jwksURL != "" && !keys.hasKeyID(kid) {
+		keys.refreshURL(false)
+	}
+
+	tried := false
+	for _, key := range keys.candidates(kid) {
+		if !keyMatchesAlg(key, alg) {
+			continue
+		}
+		tried = true
+		token, err := parser.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+			return key.Key, nil
+		})
+		if err != nil || !token.Valid {
+			// A signature mismatch may still verify with another key
+			continue
+		}
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil, newAuthError(AUTH_TOKEN_MALFORMED, "invalid claims")
+		}
+		if err := authPolicy.validate(claims, time.Now()); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}
+	if tried {
+		return nil, newAuthError(AUTH_SIGNATURE_INVALID, "token signature is invalid")
+	}
+	if kid != "" {
+		return nil, newAuthError(AUTH_KEY_NOT_FOUND, "no key found for kid %q and alg %q", kid, alg)
+	}
+	return nil, newAuthError(AUTH_KEY_NOT_FOUND, "no key found for alg %q", alg)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// A JWKS endpoint whose key set can be rotated, counting fetches
+type testJWKS struct {
+	mutex   sync.Mutex
+	keys    []jsonWebKey
+	fetches int32
+}
+
+func (s *testJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.fetches, 1)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	json.NewEncoder(w).Encode(jsonWebKeySet{Keys: s.keys})
+}
+
+func (s *testJWKS) publish(keys ...jsonWebKey) {
+	s.mutex.Lock()
+	s.keys = keys
+	s.mutex.Unlock()
+}
+
+// Generate a P-256 key and its JWK
+func newTestECKey(t *testing.T, kid string) (*ecdsa.PrivateKey, jsonWebKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	coordinate := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	return key, jsonWebKey{
+		Kty: "EC", Kid: kid, Alg: "ES256", Crv: "P-256",
+		X: coordinate(key.X.FillBytes(make([]byte, 32))),
+		Y: coordinate(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "svc", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signed
+}
+
+// Serve the given JWKS as JWKS_URL with an empty key store
+func useTestJWKS(t *testing.T, jwks *testJWKS) {
+	t.Helper()
+	server := httptest.NewServer(jwks)
+	savedKeys, savedURL := keys, jwksURL
+	keys, jwksURL = &keyStore{}, server.URL
+	t.Cleanup(func() {
+		keys, jwksURL = savedKeys, savedURL
+		server.Close()
+	})
+}
+
+func authReason(err error) string {
+	var authErr *authError
+	if errors.As(err, &authErr) {
+		return authErr.Reason
+	}
+	return ""
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	jwks := &testJWKS{}
+	useTestJWKS(t, jwks)
+	oldKey, oldJWK := newTestECKey(t, "k1")
+	newKey, newJWK := newTestECKey(t, "k2")
+
+	jwks.publish(oldJWK)
+	keys.refreshURL(true)
+	if _, err := verifyToken(signES256(t, oldKey, "k1")); err != nil {
+		t.Fatalf("token for k1: %v", err)
+	}
+	if jwks.fetches != 1 {
+		t.Errorf("JWKS fetched %d times, want once: k1 was already known", jwks.fetches)
+	}
+
+	// The issuer rotates to k2 once the last fetch is old enough to repeat
+	jwks.publish(oldJWK, newJWK)
+	keys.lastURLRefresh = time.Now().Add(-JWKS_MIN_REFRESH_PERIOD)
+	if _, err := verifyToken(signES256(t, newKey, "k2")); err != nil {
+		t.Fatalf("token for rotated key k2: %v", err)
+	}
+	if jwks.fetches != 2 {
+		t.Errorf("JWKS fetched %d times, want a refresh for the unknown kid", jwks.fetches)
+	}
+
+	// A token signed by the old key under the new kid must not verify
+	if _, err := verifyToken(signES256(t, oldKey, "k2")); authReason(err) != AUTH_SIGNATURE_INVALID {
+		t.Errorf("k1 signature under kid k2 = %v, want %s", err, AUTH_SIGNATURE_INVALID)
+	}
+}
+
+func TestJWKSRefreshIsRateLimited(t *testing.T) {
+	jwks := &testJWKS{}
+	useTestJWKS(t, jwks)
+	_, knownJWK := newTestECKey(t, "k1")
+	unknownKey, _ := newTestECKey(t, "k9")
+
+	jwks.publish(knownJWK)
+	keys.refreshURL(true)
+
+	// Unknown kids inside the refresh period must not reach the issuer
+	for i := 0; i < 5; i++ {
+		if _, err := verifyToken(signES256(t, unknownKey, "k9")); authReason(err) != AUTH_KEY_NOT_FOUND {
+			t.Fatalf("unknown kid = %v, want %s", err, AUTH_KEY_NOT_FOUND)
+		}
+	}
+	if jwks.fetches != 1 {
+		t.Errorf("JWKS fetched %d times within %v, want once", jwks.fetches, JWKS_MIN_REFRESH_PERIOD)
+	}
+
+	// Once the period has passed, an unknown kid triggers one more fetch
+	keys.lastURLRefresh = time.Now().Add(-JWKS_MIN_REFRESH_PERIOD)
+	verifyToken(signES256(t, unknownKey, "k9"))
+	verifyToken(signES256(t, unknownKey, "k9"))
+	if jwks.fetches != 2 {
+		t.Errorf("JWKS fetched %d times after the period, want 2", jwks.fetches)
+	}
+}
+
+func TestJWKSFailedRefreshKeepsKeys(t *testing.T) {
+	jwks := &testJWKS{}
+	useTestJWKS(t, jwks)
+	key, jwk := newTestECKey(t, "k1")
+
+	jwks.publish(jwk)
+	keys.refreshURL(true)
+	jwksURL = "http://127.0.0.1:1/unreachable"
+	keys.refreshURL(true)
+	if _, err := verifyToken(signES256(t, key, "k1")); err != nil {
+		t.Errorf("token after a failed refresh: %v, want the cached key to still verify", err)
+	}
+}
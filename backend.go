@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failure of one status dataset, reported in the "errors" map of status responses
+type BackendError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+var (
+	// Longest a single chronyc invocation may run
+	chronycTimeout = 5 * time.Second
+	// Longest a request waits for backend data before answering without it
+	backendRequestTimeout = 10 * time.Second
+	chronycMaxConcurrent  = 4
+
+	// One token per running chronyc process
+	chronycSlots chan struct{}
+
+	errBackendTimeout = errors.New("backend timeout")
+)
+
+func init() {
+	if v := os.Getenv("CHRONYC_TIMEOUT"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			chronycTimeout = parsed
+		} else {
+			log.Printf("Invalid CHRONYC_TIMEOUT %q, using %s", v, chronycTimeout)
+		}
+	}
+	if v := os.Getenv("BACKEND_REQUEST_TIMEOUT"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			backendRequestTimeout = parsed
+		} else {
+			log.Printf("Invalid BACKEND_REQUEST_TIMEOUT %q, using %s", v, backendRequestTimeout)
+		}
+	}
+	if v := os.Getenv("CHRONYC_MAX_CONCURRENT"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			chronycMaxConcurrent = parsed
+		} else {
+			log.Printf("Invalid CHRONYC_MAX_CONCURRENT %q, using %d", v, chronycMaxConcurrent)
+		}
+	}
+	chronycSlots = make(chan struct{}, chronycMaxConcurrent)
+}
+
+// Helper to bound the backend work done on behalf of a request
+func backendContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), backendRequestTimeout)
+}
+
+// Run chronyc with the given arguments, waiting for a free slot first. The
+// process is killed when ctx ends or after chronycTimeout; either way the
+// error wraps errBackendTimeout (or context.Canceled if the caller gave up).
+func execChronyc(ctx context.Context, args []string) (string, error) {
+	select {
+	case chronycSlots <- struct{}{}:
+		defer func() { <-chronycSlots }()
+	case <-ctx.Done():
+		return "", contextError(ctx, fmt.Sprintf("no chronyc slot free for %q", strings.Join(args, " ")))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, chronycTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "chronyc", args...)
+	// Don't wait for children of a killed chronyc that still hold its output open
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return "", contextError(ctx, fmt.Sprintf("chronyc %q did not finish", strings.Join(args, " ")))
+	}
+	if err != nil {
+		// chronyc explains failures on its output, e.g. "506 Cannot talk to daemon"
+		if detail := strings.TrimSpace(string(output)); detail != "" {
+			err = fmt.Errorf("chronyc %q: %v: %s", strings.Join(args, " "), err, detail)
+		}
+		return string(output), err
+	}
+	return string(output), nil
+}
+
+// Helper to describe why ctx ended
+func contextError(ctx context.Context, what string) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("%s: %w", what, context.Canceled)
+	}
+	return fmt.Errorf("%w: %s", errBackendTimeout, what)
+}
+
+// Helper to classify a backend failure for the status "errors" map
+func backendError(err error) BackendError {
+	if errors.Is(err, errBackendTimeout) {
+		return BackendError{Code: ERR_BACKEND_TIMEOUT, Message: err.Error()}
+	}
+	return BackendError{Code: ERR_BACKEND, Message: err.Error()}
+}
+
+// Helper to recognise a timeout in the error string returned by runChronyc
+func isBackendTimeout(errStr string) bool {
+	return strings.HasPrefix(errStr, errBackendTimeout.Error()+":")
+}
+
+// Helper to collect the failures of the given snapshots, keyed by dataset name
+func snapshotErrors(snapshots map[*CachedData]CacheSnapshot) map[string]BackendError {
+	var failures map[string]BackendError
+	for cache, snapshot := range snapshots {
+		if snapshot.Err == nil {
+			continue
+		}
+		if failures == nil {
+			failures = map[string]BackendError{}
+		}
+		failures[cache.Name] = backendError(snapshot.Err)
+	}
+	return failures
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache of one dataset. Reads never wait for a refresh while the data is
+// less than two TTLs old: stale data is returned with its age and refreshed
+// in the background. Concurrent refreshes of a dataset are coalesced, and
+// chronyc datasets refreshed together share one chronyc invocation.
+type CachedData struct {
+	Name string
+	TTL  time.Duration
+
+	// chronyc datasets set command and parse; others set fetchData
+	command   string
+	marker    *regexp.Regexp
+	parse     func(output string, errStr string) interface{}
+	fetchData func() interface{}
+
+	mutex       sync.Mutex
+	data        interface{}
+	err         error
+	collectedAt time.Time
+	valid       bool
+	generation  int
+	lastRead    time.Time
+	inflight    chan struct{}
+}
+
+// Cached value with its age at the time of the read. Err is set when the
+// last fetch failed (Data then is the last good data) or the reader gave up
+// waiting for one; Live when the reader waited for the fetch that produced
+// Data.
+type CacheSnapshot struct {
+	Data        interface{}
+	Err         error
+	CollectedAt time.Time
+	Age         time.Duration
+	Stale       bool
+	Live        bool
+}
+
+// Freshness of one status section, returned in the "meta" object
+type DatasetMeta struct {
+	CollectedAt *time.Time `json:"collected_at"`
+	// Seconds since collected_at
+	Age    *float64 `json:"age"`
+	Stale  bool     `json:"stale"`
+	Source string   `json:"source"`
+	Error  string   `json:"error,omitempty"`
+}
+
+const (
+	DATASET_SOURCE_CACHE = "cache"
+	DATASET_SOURCE_LIVE  = "live"
+)
+
+// Global cache instances
+var (
+	trackingCache    *CachedData
+	sourcesCache     *CachedData
+	activityCache    *CachedData
+	serverModeCache  *CachedData
+	clientsCache     *CachedData
+	allCaches        []*CachedData
+	cacheInitialized bool
+	cacheMutex       sync.Mutex
+
+	cacheTTLs = map[string]time.Duration{
+		"tracking":    30 * time.Second,
+		"sources":     30 * time.Second,
+		"activity":    30 * time.Second,
+		"clients":     30 * time.Second,
+		"server_mode": 5 * time.Second,
+	}
+	// Datasets nobody read for this long are no longer refreshed in the background
+	cacheIdleTimeout = 5 * time.Minute
+)
+
+func init() {
+	for name := range cacheTTLs {
+		env := "CACHE_TTL_" + strings.ToUpper(name)
+		if v := os.Getenv(env); v != "" {
+			if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+				cacheTTLs[name] = parsed
+			} else {
+				log.Printf("Invalid %s %q, using %s", env, v, cacheTTLs[name])
+			}
+		}
+	}
+	if v := os.Getenv("CACHE_IDLE_TIMEOUT"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			cacheIdleTimeout = parsed
+		} else {
+			log.Printf("Invalid CACHE_IDLE_TIMEOUT %q, using %s", v, cacheIdleTimeout)
+		}
+	}
+}
+
+// Initialize caches
+func initializeCaches() {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if cacheInitialized {
+		return
+	}
+
+	trackingCache = &CachedData{
+		Name:    "tracking",
+		command: "tracking",
+		marker:  regexp.MustCompile(`^Reference ID\s*:`),
+		parse: func(output string, errStr string) interface{} {
+			if errStr != "" {
+				return map[string]string{"error": errStr}
+			}
+			return parseTrackingOutput(output)
+		},
+	}
+	sourcesCache = &CachedData{
+		Name:    "sources",
+		command: "sources",
+		marker:  regexp.MustCompile(`^(210 Number of sources|MS Name/IP address)`),
+		parse: func(output string, errStr string) interface{} {
+			if errStr != "" {
+				return []map[string]string{}
+			}
+			return parseSourcesOutput(output)
+		},
+	}
+	activityCache = &CachedData{
+		Name:    "activity",
+		command: "activity",
+		marker:  regexp.MustCompile(`^(200 OK$|\d+ sources online)`),
+		parse: func(output string, errStr string) interface{} {
+			if errStr != "" {
+				return map[string]string{"error": errStr}
+			}
+			return parseActivityOutput(output)
+		},
+	}
+	clientsCache = &CachedData{
+		Name:    "clients",
+		command: "clients",
+		marker:  regexp.MustCompile(`^Hostname\s+NTP`),
+		parse: func(output string, errStr string) interface{} {
+			if errStr != "" {
+				return []map[string]string{}
+			}
+			return parseClientsOutput(output)
+		},
+	}
+	serverModeCache = &CachedData{
+		Name: "server_mode",
+		fetchData: func() interface{} {
+			return getServerModeStatus()
+		},
+	}
+
+	allCaches = []*CachedData{trackingCache, sourcesCache, activityCache, clientsCache, serverModeCache}
+	for _, c := range allCaches {
+		c.TTL = cacheTTLs[c.Name]
+	}
+	cacheInitialized = true
+}
+
+// Invalidate all caches to force refresh
+func invalidateCaches() {
+	if !cacheInitialized {
+		return
+	}
+	for _, c := range allCaches {
+		c.Invalidate()
+	}
+}
+
+// Make the next read wait for fresh data; a fetch already in flight does not count
+func (c *CachedData) Invalidate() {
+	c.mutex.Lock()
+	c.valid = false
+	c.generation++
+	c.mutex.Unlock()
+}
+
+func (c *CachedData) Get(ctx context.Context) interface{} {
+	return c.Snapshot(ctx).Data
+}
+
+func (c *CachedData) Snapshot(ctx context.Context) CacheSnapshot {
+	return snapshotCaches(ctx, c)[c]
+}
+
+// Read several datasets at once. Missing or expired datasets are fetched
+// before returning, together with any stale ones; if everything is merely
+// stale the refresh runs in the background. When ctx ends first, whatever
+// data is cached is returned with a timeout error.
+func snapshotCaches(ctx context.Context, caches ...*CachedData) map[*CachedData]CacheSnapshot {
+	return readCaches(ctx, false, caches...)
+}
+
+// Read datasets like snapshotCaches; fresh waits for new data for all of them
+func readCaches(ctx context.Context, fresh bool, caches ...*CachedData) map[*CachedData]CacheSnapshot {
+	now := time.Now()
+	var missing, stale []*CachedData
+	for _, c := range caches {
+		c.mutex.Lock()
+		c.lastRead = now
+		age := now.Sub(c.collectedAt)
+		if fresh || !c.valid || age >= 2*c.TTL {
+			missing = append(missing, c)
+		} else if age >= c.TTL {
+			stale = append(stale, c)
+		}
+		c.mutex.Unlock()
+	}
+	abandoned := map[*CachedData]bool{}
+	waited := map[*CachedData]bool{}
+	if len(missing) > 0 {
+		for _, c := range append(missing, stale...) {
+			waited[c] = true
+		}
+		abandoned = refreshCaches(ctx, append(missing, stale...))
+	} else if len(stale) > 0 {
+		go refreshCaches(context.Background(), stale)
+	}
+
+	now = time.Now()
+	snapshots := make(map[*CachedData]CacheSnapshot, len(caches))
+	for _, c := range caches {
+		c.mutex.Lock()
+		snapshot := CacheSnapshot{
+			Data:        c.data,
+			Err:         c.err,
+			CollectedAt: c.collectedAt,
+			Age:         now.Sub(c.collectedAt),
+			Stale:       now.Sub(c.collectedAt) >= c.TTL,
+		}
+		c.mutex.Unlock()
+		if abandoned[c] {
+			snapshot.Err = contextError(ctx, "waiting for "+c.Name+" data")
+		} else {
+			// After a failed fetch the data is the cached one, not live
+			snapshot.Live = waited[c] && snapshot.Err == nil
+		}
+		snapshots[c] = snapshot
+	}
+	return snapshots
+}
+
+// Refresh caches, joining refreshes already in flight, and wait for them
+// until ctx ends. The fetch itself is shared and not tied to ctx; the
+// caches still being fetched when ctx ends are returned.
+func refreshCaches(ctx context.Context, caches []*CachedData) map[*CachedData]bool {
+	var started []*CachedData
+	waits := map[*CachedData]chan struct{}{}
+	for _, c := range caches {
+		c.mutex.Lock()
+		if c.inflight == nil {
+			c.inflight = make(chan struct{})
+			started = append(started, c)
+		}
+		waits[c] = c.inflight
+		c.mutex.Unlock()
+	}
+	if len(started) > 0 {
+		go fetchCaches(started)
+	}
+	abandoned := map[*CachedData]bool{}
+	for c, wait := range waits {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			// Datasets that finished meanwhile still count
+			select {
+			case <-wait:
+			default:
+				abandoned[c] = true
+			}
+		}
+	}
+	return abandoned
+}
+
+// Fetch the given caches (whose inflight channels the caller created)
+func fetchCaches(caches []*CachedData) {
+	var chronycCaches []*CachedData
+	var commands []string
+	for _, c := range caches {
+		if c.command == "" {
+			// Local reads don't wait for chronyc
+			c.store(c.generationNow(), c.fetchData(), nil)
+			continue
+		}
+		chronycCaches = append(chronycCaches, c)
+		commands = append(commands, c.command)
+	}
+	if len(commands) == 0 {
+		return
+	}
+
+	generations := map[*CachedData]int{}
+	for _, c := range chronycCaches {
+		generations[c] = c.generationNow()
+	}
+	// Fetches are shared by every waiting reader, so only chronycTimeout bounds them
+	results := runChronycBatch(context.Background(), commands)
+	for _, c := range chronycCaches {
+		result := results[c.command]
+		errStr := ""
+		if result.err != nil {
+			errStr = result.err.Error()
+		}
+		c.store(generations[c], c.parse(result.output, errStr), result.err)
+	}
+}
+
+func (c *CachedData) generationNow() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// Save fetched data and release the readers waiting for it. A failed fetch
+// only records its error: the last good data is kept with the time it was
+// collected, so readers see how old it is. Until a fetch succeeds, the
+// parsed failure is the data and there is no collection time.
+func (c *CachedData) store(generation int, data interface{}, err error) {
+	c.mutex.Lock()
+	c.err = err
+	if err == nil {
+		c.data = data
+		c.collectedAt = time.Now()
+	} else if c.collectedAt.IsZero() {
+		c.data = data
+	}
+	// Data fetched across an invalidation may predate the change, and failed
+	// fetches are retried by the next read rather than served for a TTL
+	c.valid = c.generation == generation && err == nil
+	close(c.inflight)
+	c.inflight = nil
+	c.mutex.Unlock()
+}
+
+type chronycResult struct {
+	output string
+	err    error
+}
+
+// Run several chronyc commands with a single "chronyc -m" and split the
+// output at each command's first line. Commands whose output cannot be
+// found (usually because they failed) are run again on their own, unless
+// the batch timed out: then they all fail with the timeout.
+func runChronycBatch(ctx context.Context, commands []string) map[string]chronycResult {
+	results := map[string]chronycResult{}
+	if len(commands) == 0 {
+		return results
+	}
+	if len(commands) == 1 {
+		output, err := execChronyc(ctx, commands)
+		if err != nil {
+			output = ""
+		}
+		results[commands[0]] = chronycResult{output: strings.TrimSpace(output), err: err}
+		return results
+	}
+
+	markers := map[string]*regexp.Regexp{}
+	for _, c := range allCaches {
+		if c.command != "" {
+			markers[c.command] = c.marker
+		}
+	}
+	output, err := execChronyc(ctx, append([]string{"-m"}, commands...))
+	if errors.Is(err, errBackendTimeout) || errors.Is(err, context.Canceled) {
+		for _, command := range commands {
+			results[command] = chronycResult{err: err}
+		}
+		return results
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+
+	// Start line of each command, in order
+	starts := make([]int, len(commands))
+	next := 0
+	for i, command := range commands {
+		starts[i] = -1
+		for j := next; j < len(lines); j++ {
+			if markers[command] != nil && markers[command].MatchString(strings.TrimSpace(lines[j])) {
+				starts[i] = j
+				next = j + 1
+				break
+			}
+		}
+	}
+	for i, command := range commands {
+		if starts[i] < 0 {
+			output, err := execChronyc(ctx, []string{command})
+			if err != nil {
+				output = ""
+			}
+			results[command] = chronycResult{output: strings.TrimSpace(output), err: err}
+			continue
+		}
+		end := len(lines)
+		for k := i + 1; k < len(commands); k++ {
+			if starts[k] >= 0 {
+				end = starts[k]
+				break
+			}
+		}
+		results[command] = chronycResult{output: strings.TrimSpace(strings.Join(lines[starts[i]:end], "\n"))}
+	}
+	return results
+}
+
+// Refresh datasets shortly before they expire, as long as someone reads them
+func startCacheRefresher() {
+	initializeCaches()
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			beatRefresher()
+			now := time.Now()
+			var due, halfway []*CachedData
+			for _, c := range allCaches {
+				c.mutex.Lock()
+				age := now.Sub(c.collectedAt)
+				if c.valid && c.inflight == nil && now.Sub(c.lastRead) < cacheIdleTimeout {
+					if age >= c.TTL-c.TTL/5 {
+						due = append(due, c)
+					} else if age >= c.TTL/2 {
+						halfway = append(halfway, c)
+					}
+				}
+				c.mutex.Unlock()
+			}
+			// Bring datasets past half their TTL along, so they stay in one batch
+			if len(due) > 0 {
+				refreshCaches(context.Background(), append(due, halfway...))
+			}
+		}
+	}()
+}
+
+// Freshness metadata for the response; never-collected data has no time or age
+func (s CacheSnapshot) Meta() DatasetMeta {
+	meta := DatasetMeta{Stale: s.Stale, Source: DATASET_SOURCE_CACHE}
+	if s.Live {
+		meta.Source = DATASET_SOURCE_LIVE
+	}
+	if !s.CollectedAt.IsZero() {
+		collectedAt := s.CollectedAt.UTC()
+		age := math.Round(s.Age.Seconds()*1000) / 1000
+		meta.CollectedAt = &collectedAt
+		meta.Age = &age
+	}
+	if s.Err != nil {
+		meta.Error = s.Err.Error()
+	}
+	return meta
+}
+
+// Read the given datasets for a status handler, honouring ?fresh=1 (which
+// needs PERM_STATUS_FRESH). Sets the Age header; returns false after writing
+// an error response.
+func readStatusCaches(w http.ResponseWriter, r *http.Request, caches ...*CachedData) (map[*CachedData]CacheSnapshot, bool) {
+	initializeCaches()
+	fresh := false
+	if v := r.URL.Query().Get("fresh"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "fresh must be a boolean", nil)
+			return nil, false
+		}
+		if parsed && !requirePermission(w, r, PERM_STATUS_FRESH) {
+			return nil, false
+		}
+		fresh = parsed
+	}
+
+	ctx, cancel := backendContext(r)
+	defer cancel()
+	snapshots := readCaches(ctx, fresh, caches...)
+	var all []CacheSnapshot
+	for _, snapshot := range snapshots {
+		all = append(all, snapshot)
+	}
+	setAgeHeader(w, all...)
+	return snapshots, true
+}
+
+// Helper to add the "meta" and "errors" objects of a status response
+func addStatusMeta(response map[string]interface{}, snapshots map[*CachedData]CacheSnapshot) {
+	meta := map[string]DatasetMeta{}
+	for cache, snapshot := range snapshots {
+		meta[cache.Name] = snapshot.Meta()
+	}
+	response["meta"] = meta
+	if failures := snapshotErrors(snapshots); failures != nil {
+		response["errors"] = failures
+	}
+}
+
+// Helper to report the age of the oldest dataset in a response (RFC 9111 Age header)
+func setAgeHeader(w http.ResponseWriter, snapshots ...CacheSnapshot) {
+	var oldest time.Duration
+	for _, snapshot := range snapshots {
+		if snapshot.Age > oldest {
+			oldest = snapshot.Age
+		}
+	}
+	w.Header().Set("Age", strconv.Itoa(int(oldest.Seconds())))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Store a fetch result the way fetchCaches does
+func storeTestFetch(c *CachedData, data interface{}, err error) {
+	c.mutex.Lock()
+	c.inflight = make(chan struct{})
+	c.mutex.Unlock()
+	c.store(c.generationNow(), data, err)
+}
+
+// Helper to list the fake chronyc invocations made by f
+func chronycCallsDuring(t *testing.T, f func()) []string {
+	t.Helper()
+	path := filepath.Join(os.Getenv("FAKE_CHRONYC_DIR"), ".calls")
+	os.Remove(path)
+	f()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// A cache whose fetches block until release is closed; entered receives
+// once per fetch
+func newBlockingCache(release chan struct{}, data string) (*CachedData, chan struct{}) {
+	entered := make(chan struct{}, 10)
+	return &CachedData{Name: "test", TTL: time.Minute, fetchData: func() interface{} {
+		entered <- struct{}{}
+		<-release
+		return data
+	}}, entered
+}
+
+func TestFailedFetchKeepsLastGoodData(t *testing.T) {
+	c := &CachedData{Name: "test", TTL: time.Minute}
+
+	// Until a fetch succeeds, the parsed failure is all there is
+	storeTestFetch(c, map[string]string{"error": "no reply"}, errors.New("no reply"))
+	if !c.collectedAt.IsZero() || c.err == nil || c.data.(map[string]string)["error"] != "no reply" {
+		t.Fatalf("after a first failure: data %v, err %v, collected %v", c.data, c.err, c.collectedAt)
+	}
+
+	storeTestFetch(c, map[string]string{"Stratum": "3"}, nil)
+	collected := c.collectedAt
+	if collected.IsZero() || c.err != nil || !c.valid {
+		t.Fatalf("after a success: err %v, collected %v, valid %v", c.err, collected, c.valid)
+	}
+
+	storeTestFetch(c, map[string]string{"error": "timeout"}, errors.New("timeout"))
+	if got := c.data.(map[string]string)["Stratum"]; got != "3" {
+		t.Errorf("data after a failure = %v, want the last good data", c.data)
+	}
+	if !c.collectedAt.Equal(collected) {
+		t.Errorf("collected at %v after a failure, want %v from the last success", c.collectedAt, collected)
+	}
+	if c.err == nil || c.err.Error() != "timeout" {
+		t.Errorf("err = %v, want the fetch error", c.err)
+	}
+	if c.valid {
+		t.Error("cache still valid after a failure, want the next read to retry")
+	}
+}
+
+func TestChronycBatchSplitsOutput(t *testing.T) {
+	commands := []string{"tracking", "sources", "activity", "clients"}
+	var results map[string]chronycResult
+	calls := chronycCallsDuring(t, func() {
+		results = runChronycBatch(context.Background(), commands)
+	})
+	if len(calls) != 1 || calls[0] != "-m tracking sources activity clients" {
+		t.Errorf("chronyc calls = %q, want one batched call", calls)
+	}
+	for _, command := range commands {
+		result := results[command]
+		if result.err != nil || result.output != strings.TrimSpace(testChronycOutput[command]) {
+			t.Errorf("%s: output %q, err %v; want its own canned output", command, result.output, result.err)
+		}
+	}
+}
+
+func TestConcurrentReadersShareOneFetch(t *testing.T) {
+	release := make(chan struct{})
+	c, entered := newBlockingCache(release, "fetched")
+
+	var wg sync.WaitGroup
+	snapshots := make([]CacheSnapshot, 5)
+	read := func(i int) {
+		defer wg.Done()
+		snapshots[i] = c.Snapshot(context.Background())
+	}
+	wg.Add(1)
+	go read(0)
+	<-entered
+	// The others find the fetch in flight and wait for it
+	for i := 1; i < len(snapshots); i++ {
+		wg.Add(1)
+		go read(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches := 1 + len(entered); fetches != 1 {
+		t.Errorf("%d fetches for %d concurrent readers, want 1", fetches, len(snapshots))
+	}
+	for i, snapshot := range snapshots {
+		if snapshot.Data != "fetched" || snapshot.Err != nil || !snapshot.Live {
+			t.Errorf("reader %d: %+v, want the live fetched data", i, snapshot)
+		}
+	}
+}
+
+func TestStaleDataIsServedWhileRefreshing(t *testing.T) {
+	release := make(chan struct{})
+	c, entered := newBlockingCache(release, "new")
+	c.data, c.valid = "old", true
+	c.collectedAt = time.Now().Add(-c.TTL - c.TTL/2)
+
+	done := make(chan CacheSnapshot)
+	go func() { done <- c.Snapshot(context.Background()) }()
+	select {
+	case snapshot := <-done:
+		if snapshot.Data != "old" || !snapshot.Stale || snapshot.Live {
+			t.Errorf("read of stale data = %+v, want the old data marked stale", snapshot)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read of stale data waited for the refresh")
+	}
+
+	// The refresh runs in the background and replaces the data
+	<-entered
+	c.mutex.Lock()
+	inflight := c.inflight
+	c.mutex.Unlock()
+	close(release)
+	<-inflight
+	if snapshot := c.Snapshot(context.Background()); snapshot.Data != "new" || snapshot.Stale {
+		t.Errorf("read after the refresh = %+v, want the new data", snapshot)
+	}
+}
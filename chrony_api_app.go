@@ -1,34 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
-	"time"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
-	"github.com/golang-jwt/jwt/v4"
 )
 
 const (
 	CHRONY_CONF_PATH = "/etc/chrony/chrony.conf"
-	DEFAULT_SERVERS  = "pool.ntp.org"
 	BUILD_INFO_PATH  = "/build-info.json"
 	STATUS_TRACKING    = 1
 	STATUS_SOURCES     = 2
 	STATUS_ACTIVITY    = 4
 	STATUS_CLIENTS     = 8
 	STATUS_SERVER_MODE = 16
-	STATUS_ALL         = STATUS_TRACKING | STATUS_SOURCES | STATUS_ACTIVITY | STATUS_CLIENTS | STATUS_SERVER_MODE
+	STATUS_HEALTH      = 32
+	STATUS_ALL         = STATUS_TRACKING | STATUS_SOURCES | STATUS_ACTIVITY | STATUS_CLIENTS | STATUS_SERVER_MODE | STATUS_HEALTH
 )
 
 // Build info structure
@@ -56,13 +52,18 @@ type SetServerModeRequest struct {
 	Enabled bool `json:"enabled"`
 }
 
+// Payload of GET /status; sections not selected by flags are omitted
 type StatusResponse struct {
-	Tracking      map[string]string   `json:"tracking"`
-	TrackingError string              `json:"tracking_error"`
-	Sources       []map[string]string `json:"sources"`
-	SourcesError  string              `json:"sources_error"`
-	Activity      map[string]string   `json:"activity"`
-	ActivityError string              `json:"activity_error"`
+	Tracking          map[string]string   `json:"tracking,omitempty"`
+	Sources           []map[string]string `json:"sources,omitempty"`
+	Activity          map[string]string   `json:"activity,omitempty"`
+	Clients           []map[string]string `json:"clients,omitempty"`
+	ServerModeEnabled bool                `json:"server_mode_enabled,omitempty"`
+	Health            *SyncHealth         `json:"health,omitempty"`
+	// Freshness of each included dataset, keyed by dataset name
+	Meta map[string]DatasetMeta `json:"meta"`
+	// Datasets that could not be read, keyed by dataset name
+	Errors map[string]BackendError `json:"errors,omitempty"`
 }
 
 type VersionResponse struct {
@@ -80,176 +81,18 @@ type SetServerModeResponse struct {
 	ServerModeEnabled bool `json:"server_mode_enabled"`
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
-}
-
-// Cache structures for lazy loading
-type CachedData struct {
-	Data      interface{}
-	Timestamp time.Time
-	TTL       time.Duration
-	mutex     sync.RWMutex
-	fetchData func() interface{}
-}
-
-func (c *CachedData) Get() interface{} {
-	c.mutex.RLock()
-	if time.Since(c.Timestamp) < c.TTL {
-		defer c.mutex.RUnlock()
-		return c.Data
-	}
-	c.mutex.RUnlock()
-	
-	// Only refresh when actually requested and stale
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	
-	// Double-check after acquiring write lock
-	if time.Since(c.Timestamp) < c.TTL {
-		return c.Data
-	}
-	
-	// Refresh data here
-	c.Data = c.fetchData()
-	c.Timestamp = time.Now()
-	return c.Data
-}
-
-// Global cache instances
-var (
-	trackingCache  *CachedData
-	sourcesCache   *CachedData
-	activityCache  *CachedData
-	serverModeCache *CachedData
-	clientsCache   *CachedData
-	cacheInitialized bool
-	cacheMutex     sync.Mutex
-)
-
-// Initialize caches
-func initializeCaches() {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-	
-	if cacheInitialized {
-		return
-	}
-	
-	// Initialize tracking cache (30 second TTL)
-	trackingCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	trackingCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"tracking"})
-		if err != "" {
-			return map[string]string{"error": err}
-		}
-		return parseTrackingOutput(output)
-	}
-	
-	// Initialize sources cache (30 second TTL)
-	sourcesCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	sourcesCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"sources"})
-		if err != "" {
-			return []map[string]string{}
-		}
-		return parseSourcesOutput(output)
-	}
-	
-	// Initialize activity cache (30 second TTL)
-	activityCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	activityCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"activity"})
-		if err != "" {
-			return map[string]string{"error": err}
-		}
-		return parseActivityOutput(output)
-	}
-	
-	// Initialize server mode cache (5 second TTL)
-	serverModeCache = &CachedData{
-		TTL: 5 * time.Second,
-	}
-	serverModeCache.fetchData = func() interface{} {
-		return getServerModeStatus()
-	}
-	
-	// Initialize clients cache (30 second TTL)
-	clientsCache = &CachedData{
-		TTL: 30 * time.Second,
-	}
-	clientsCache.fetchData = func() interface{} {
-		output, err := runChronyc([]string{"clients"})
-		if err != "" {
-			return []map[string]string{}
-		}
-		return parseClientsOutput(output)
-	}
-	
-	cacheInitialized = true
-}
-
-// Invalidate all caches to force refresh
-func invalidateCaches() {
-	if !cacheInitialized {
-		return
-	}
-	
-	// Invalidate tracking cache
-	if trackingCache != nil {
-		trackingCache.mutex.Lock()
-		trackingCache.Timestamp = time.Time{} // Force refresh
-		trackingCache.mutex.Unlock()
-	}
-	
-	// Invalidate sources cache
-	if sourcesCache != nil {
-		sourcesCache.mutex.Lock()
-		sourcesCache.Timestamp = time.Time{} // Force refresh
-		sourcesCache.mutex.Unlock()
-	}
-	
-	// Invalidate activity cache
-	if activityCache != nil {
-		activityCache.mutex.Lock()
-		activityCache.Timestamp = time.Time{} // Force refresh
-		activityCache.mutex.Unlock()
-	}
-	
-	// Invalidate server mode cache
-	if serverModeCache != nil {
-		serverModeCache.mutex.Lock()
-		serverModeCache.Timestamp = time.Time{} // Force refresh
-		serverModeCache.mutex.Unlock()
-	}
-	
-	// Invalidate clients cache
-	if clientsCache != nil {
-		clientsCache.mutex.Lock()
-		clientsCache.Timestamp = time.Time{} // Force refresh
-		clientsCache.mutex.Unlock()
-	}
-}
-
 // Helper function to run chronyc commands
-func runChronyc(args []string) (string, string) {
-	cmd := exec.Command("chronyc", args...)
-	output, err := cmd.CombinedOutput()
+func runChronyc(ctx context.Context, args []string) (string, string) {
+	output, err := execChronyc(ctx, args)
 	if err != nil {
 		return "", err.Error()
 	}
-	return strings.TrimSpace(string(output)), ""
+	return strings.TrimSpace(output), ""
 }
 
 // Helper to read/write allow directive in chrony.conf
 func getServerModeStatus() bool {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
+	content, err := ioutil.ReadFile(chronyConfPath)
 	if err != nil {
 		return false
 	}
@@ -265,12 +108,15 @@ func getServerModeStatus() bool {
 
 // Helper function to robustly restart chrony service in Alpine/docker environments
 func restartChrony() bool {
-	// Kill all running chronyd processes
-	killCmd := exec.Command("pkill", "chronyd")
+	// Kill all running chronyd processes. Not tied to any request: a client
+	// giving up must not leave chronyd stopped
+	ctx, cancel := context.WithTimeout(context.Background(), chronycTimeout)
+	defer cancel()
+	killCmd := exec.CommandContext(ctx, "pkill", "chronyd")
 	_ = killCmd.Run() // Ignore error if not running
 
 	// Start chronyd in the background
-	startCmd := exec.Command("chronyd", "-f", CHRONY_CONF_PATH)
+	startCmd := exec.Command("chronyd", "-f", chronyConfPath)
 	err := startCmd.Start()
 	if err != nil {
 		log.Printf("Failed to start chronyd: %v", err)
@@ -281,7 +127,7 @@ func restartChrony() bool {
 }
 
 func setServerModeStatus(enabled bool) bool {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
+	content, err := ioutil.ReadFile(chronyConfPath)
 	if err != nil {
 		return false
 	}
@@ -320,7 +166,7 @@ func setServerModeStatus(enabled bool) bool {
 	}
 	
 	newContent := strings.Join(newLines, "\n")
-	err = ioutil.WriteFile(CHRONY_CONF_PATH, []byte(newContent), 0644)
+	err = ioutil.WriteFile(chronyConfPath, []byte(newContent), 0644)
 	if err != nil {
 		return false
 	}
@@ -537,60 +383,22 @@ func getVersion() string {
 	return AppVersion
 }
 
-var publicKey *rsa.PublicKey
-
-func loadPublicKey(path string) *rsa.PublicKey {
-	pemData, err := ioutil.ReadFile(path)
-	if err != nil {
-		log.Fatalf("Failed to read public.pem: %v", err)
-	}
-	block, _ := pem.Decode(pemData)
-	if block == nil {
-		log.Fatalf("Failed to decode PEM block")
-	}
-	// Try PKCS1 first
-	pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
-	if err == nil {
-		return pub
-	}
-	// Try PKIX (most common for 'PUBLIC KEY')
-	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err == nil {
-		if rsaPub, ok := parsed.(*rsa.PublicKey); ok {
-			return rsaPub
-		}
-		log.Fatalf("Public key is not RSA")
-	}
-	log.Fatalf("Failed to parse public key: %v", err)
-	return nil
-}
-
 func getClaimsFromRequest(r *http.Request) (map[string]interface{}, error) {
+	if socketTrusted && isLocalSocketRequest(r) {
+		return localSocketClaims(), nil
+	}
 	authHeader := r.Header.Get("Authorization")
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return nil, fmt.Errorf("missing or invalid Authorization header")
+		return nil, newAuthError(AUTH_TOKEN_MISSING, "missing or invalid Authorization header")
 	}
 	tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return publicKey, nil
-	})
-	if err != nil || !token.Valid {
-		return nil, fmt.Errorf("invalid token: %v", err)
-	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("invalid claims")
-	}
-	return claims, nil
+	return verifyToken(tokenStr)
 }
 
 // API Handlers
 func handleVersion(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
@@ -609,7 +417,7 @@ func handleVersion(w http.ResponseWriter, r *http.Request) {
 
 func handleAppVersion(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
@@ -626,12 +434,10 @@ func handleAppVersion(w http.ResponseWriter, r *http.Request) {
 
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 
-	initializeCaches()
-
 	flags := STATUS_ALL
 	if flagStr := r.URL.Query().Get("flags"); flagStr != "" {
 		if parsed, err := strconv.Atoi(flagStr); err == nil {
@@ -639,10 +445,28 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Read the selected datasets together so expired ones share one chronyc run
+	var selected []*CachedData
+	for flag, cache := range map[int]*CachedData{
+		STATUS_TRACKING:    trackingCache,
+		STATUS_SOURCES:     sourcesCache,
+		STATUS_ACTIVITY:    activityCache,
+		STATUS_CLIENTS:     clientsCache,
+		STATUS_SERVER_MODE: serverModeCache,
+	} {
+		if flags&flag != 0 {
+			selected = append(selected, cache)
+		}
+	}
+	snapshots, ok := readStatusCaches(w, r, selected...)
+	if !ok {
+		return
+	}
+
 	response := make(map[string]interface{})
 
 	if flags&STATUS_TRACKING != 0 {
-		trackingData := trackingCache.Get()
+		trackingData := snapshots[trackingCache].Data
 		tracking, ok := trackingData.(map[string]string)
 		if !ok {
 			tracking = map[string]string{"error": "Failed to parse tracking data"}
@@ -651,7 +475,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if flags&STATUS_SOURCES != 0 {
-		sourcesData := sourcesCache.Get()
+		sourcesData := snapshots[sourcesCache].Data
 		sources, ok := sourcesData.([]map[string]string)
 		if !ok {
 			sources = []map[string]string{}
@@ -660,7 +484,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if flags&STATUS_ACTIVITY != 0 {
-		activityData := activityCache.Get()
+		activityData := snapshots[activityCache].Data
 		activity, ok := activityData.(map[string]string)
 		if !ok {
 			activity = map[string]string{"error": "Failed to parse activity data"}
@@ -669,7 +493,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if flags&STATUS_CLIENTS != 0 {
-		clientsData := clientsCache.Get()
+		clientsData := snapshots[clientsCache].Data
 		clients, ok := clientsData.([]map[string]string)
 		if !ok {
 			clients = []map[string]string{}
@@ -678,7 +502,7 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if flags&STATUS_SERVER_MODE != 0 {
-		serverModeData := serverModeCache.Get()
+		serverModeData := snapshots[serverModeCache].Data
 		enabled, ok := serverModeData.(bool)
 		if !ok {
 			enabled = false
@@ -686,21 +510,33 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 		response["server_mode_enabled"] = enabled
 	}
 
+	if flags&STATUS_HEALTH != 0 {
+		// Evaluated in the background from the same cached data
+		ctx, cancel := backendContext(r)
+		defer cancel()
+		current := currentHealth(ctx)
+		response["health"] = current
+	}
+
+	addStatusMeta(response, snapshots)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
 func handleTracking(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
-	// Initialize caches if not already done
-	initializeCaches()
-	
 	// Get tracking data from cache
-	trackingData := trackingCache.Get()
+	snapshots, ok := readStatusCaches(w, r, trackingCache)
+	if !ok {
+		return
+	}
+	snapshot := snapshots[trackingCache]
+	trackingData := snapshot.Data
 	tracking, ok := trackingData.(map[string]string)
 	if !ok {
 		tracking = map[string]string{"error": "Failed to parse tracking data"}
@@ -709,6 +545,7 @@ func handleTracking(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"tracking": tracking,
 	}
+	addStatusMeta(response, snapshots)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -716,15 +553,17 @@ func handleTracking(w http.ResponseWriter, r *http.Request) {
 
 func handleSources(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
-	// Initialize caches if not already done
-	initializeCaches()
-	
 	// Get sources data from cache
-	sourcesData := sourcesCache.Get()
+	snapshots, ok := readStatusCaches(w, r, sourcesCache)
+	if !ok {
+		return
+	}
+	snapshot := snapshots[sourcesCache]
+	sourcesData := snapshot.Data
 	sources, ok := sourcesData.([]map[string]string)
 	if !ok {
 		sources = []map[string]string{}
@@ -733,6 +572,7 @@ func handleSources(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"sources": sources,
 	}
+	addStatusMeta(response, snapshots)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -740,15 +580,17 @@ func handleSources(w http.ResponseWriter, r *http.Request) {
 
 func handleActivity(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
-	// Initialize caches if not already done
-	initializeCaches()
-	
 	// Get activity data from cache
-	activityData := activityCache.Get()
+	snapshots, ok := readStatusCaches(w, r, activityCache)
+	if !ok {
+		return
+	}
+	snapshot := snapshots[activityCache]
+	activityData := snapshot.Data
 	activity, ok := activityData.(map[string]string)
 	if !ok {
 		activity = map[string]string{"error": "Failed to parse activity data"}
@@ -757,6 +599,7 @@ func handleActivity(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"activity": activity,
 	}
+	addStatusMeta(response, snapshots)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -764,15 +607,17 @@ func handleActivity(w http.ResponseWriter, r *http.Request) {
 
 func handleClients(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 		return
 	}
 	
-	// Initialize caches if not already done
-	initializeCaches()
-	
 	// Get clients data from cache
-	clientsData := clientsCache.Get()
+	snapshots, ok := readStatusCaches(w, r, clientsCache)
+	if !ok {
+		return
+	}
+	snapshot := snapshots[clientsCache]
+	clientsData := snapshot.Data
 	clients, ok := clientsData.([]map[string]string)
 	if !ok {
 		clients = []map[string]string{}
@@ -781,22 +626,42 @@ func handleClients(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"clients": clients,
 	}
+	addStatusMeta(response, snapshots)
 	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// Helper to update server list in chrony.conf
+// Helper to check a server list before it is written to chrony.conf
+func validateServers(servers []string) []string {
+	var problems []string
+	for i, server := range servers {
+		if !hostPattern.MatchString(server) {
+			problems = append(problems, fmt.Sprintf("servers[%d] %q is not a valid host name or address", i, server))
+		} else if _, _, err := net.SplitHostPort(server); err == nil {
+			problems = append(problems, fmt.Sprintf("servers[%d] %q must not include a port", i, server))
+		}
+		if containsString(servers[:i], server) {
+			problems = append(problems, fmt.Sprintf("servers[%d] %q is listed twice", i, server))
+		}
+	}
+	return problems
+}
+
+// Helper to update server list in chrony.conf; existing server and pool
+// lines are replaced
 func updateChronyConfServers(servers []string) error {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
+	if problems := validateServers(servers); len(problems) > 0 {
+		return fmt.Errorf("invalid servers: %s", strings.Join(problems, "; "))
+	}
+	content, err := ioutil.ReadFile(chronyConfPath)
 	if err != nil {
 		return err
 	}
 	lines := strings.Split(string(content), "\n")
 	var newLines []string
 	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if !strings.HasPrefix(trimmed, "server ") {
+		if directive := directiveOf(line); directive != "server" && directive != "pool" {
 			newLines = append(newLines, line)
 		}
 	}
@@ -807,12 +672,12 @@ func updateChronyConfServers(servers []string) error {
 	// Ensure there's an empty line at the end
 	newLines = append(newLines, "")
 	newContent := strings.Join(newLines, "\n")
-	return ioutil.WriteFile(CHRONY_CONF_PATH, []byte(newContent), 0644)
+	return ioutil.WriteFile(chronyConfPath, []byte(newContent), 0644)
 }
 
-// Helper to read configured servers from chrony.conf
+// Helper to read configured servers and pools from chrony.conf
 func getConfiguredServers() []string {
-	content, err := ioutil.ReadFile(CHRONY_CONF_PATH)
+	content, err := ioutil.ReadFile(chronyConfPath)
 	if err != nil {
 		return []string{}
 	}
@@ -820,10 +685,9 @@ func getConfiguredServers() []string {
 	lines := strings.Split(string(content), "\n")
 	var servers []string
 	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, "server ") {
+		if directive := directiveOf(line); directive == "server" || directive == "pool" {
 			// Extract server name from "server pool.ntp.org iburst"
-			parts := strings.Fields(trimmed)
+			parts := strings.Fields(line)
 			if len(parts) >= 2 {
 				servers = append(servers, parts[1])
 			}
@@ -835,125 +699,132 @@ func getConfiguredServers() []string {
 func handleServers(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		_, err := getClaimsFromRequest(r)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
 		// Return configured servers from chrony.conf, not active sources
 		configuredServers := getConfiguredServers()
 		response := map[string]interface{}{
 			"servers": configuredServers,
 		}
+		setConfigETag(w)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	case http.MethodPut:
-		claims, err := getClaimsFromRequest(r)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-		if permissionCheckEnabled && !hasPermission(claims, "clock/servers") {
-			http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
-			return
-		}
 		var req SetServersRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
 			return
 		}
 		if len(req.Servers) == 0 {
-			http.Error(w, "servers must be a non-empty list", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "servers must be a non-empty list", nil)
+			return
+		}
+		if problems := validateServers(req.Servers); len(problems) > 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid servers", problems)
 			return
 		}
 		// Update chrony.conf with new servers
-		err = updateChronyConfServers(req.Servers)
+		change, ok := beginConfigChange(w, r)
+		if !ok {
+			return
+		}
+		defer change.release()
+		err := updateChronyConfServers(req.Servers)
 		if err != nil {
-			http.Error(w, "Failed to update chrony.conf: "+err.Error(), http.StatusInternalServerError)
+			recordAudit(r, AuditEntry{Action: AUDIT_SERVERS_SET, Request: req, Error: err.Error()}, change.before)
+			change.commit(w)
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to update configuration", err.Error())
 			return
 		}
 		// Restart chrony to apply the configuration changes
 		restartSuccess := restartChrony()
 		// Invalidate caches after configuration change
 		invalidateCaches()
+		recordAudit(r, AuditEntry{Action: AUDIT_SERVERS_SET, Request: req, RestartSuccess: &restartSuccess}, change.before)
+		change.commit(w)
+		emitEvent(EVENT_SERVERS_CHANGED, map[string]interface{}{
+			"servers":         req.Servers,
+			"restart_success": restartSuccess,
+		})
 		response := map[string]interface{}{
 			"result": req.Servers,
 			"restart_success": restartSuccess,
 		}
+		if !restartSuccess {
+			writeError(w, r, http.StatusBadGateway, ERR_RESTART_FAILED, "Configuration saved but the time service failed to restart", response)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	case http.MethodDelete:
-		claims, err := getClaimsFromRequest(r)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-		if permissionCheckEnabled && !hasPermission(claims, "clock/servers") {
-			http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
+		change, ok := beginConfigChange(w, r)
+		if !ok {
 			return
 		}
-		output, errStr := runChronyc([]string{"delete", "sources"})
+		defer change.release()
+		ctx, cancel := backendContext(r)
+		defer cancel()
+		output, errStr := runChronyc(ctx, []string{"delete", "sources"})
 		// Restart chrony to apply the configuration changes
 		restartSuccess := restartChrony()
 		// Invalidate caches after configuration change
 		invalidateCaches()
+		recordAudit(r, AuditEntry{Action: AUDIT_SERVERS_DELETE, RestartSuccess: &restartSuccess, Error: errStr}, change.before)
+		change.commit(w)
+		emitEvent(EVENT_SERVERS_CHANGED, map[string]interface{}{
+			"servers":         []string{},
+			"restart_success": restartSuccess,
+		})
 		response := map[string]interface{}{
 			"output": output,
 			"error":  errStr,
 			"restart_success": restartSuccess,
 		}
+		if isBackendTimeout(errStr) {
+			writeError(w, r, http.StatusGatewayTimeout, ERR_BACKEND_TIMEOUT, "The time service did not respond in time", response)
+			return
+		}
+		if errStr != "" {
+			writeError(w, r, http.StatusBadGateway, ERR_BACKEND, "Failed to delete sources", response)
+			return
+		}
+		if !restartSuccess {
+			writeError(w, r, http.StatusBadGateway, ERR_RESTART_FAILED, "The time service failed to restart", response)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 	}
 }
 
+// GET /servers/default shows the default server profile; PUT makes its
+// servers the configured servers
 func handleDefaultServers(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Persist default server to chrony.conf
-	err := updateChronyConfServers([]string{DEFAULT_SERVERS})
-	if err != nil {
-		http.Error(w, "Failed to update chrony.conf: "+err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Restart chrony to apply the configuration changes
-	restartSuccess := restartChrony()
-
-	// Invalidate caches after configuration change
-	invalidateCaches()
-
-	response := map[string]interface{}{
-		"result": []string{DEFAULT_SERVERS},
-		"restart_success": restartSuccess,
+	profile, _ := getServerProfile("")
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+	case http.MethodPut:
+		applyServerProfile(w, r, profile, AUDIT_SERVERS_DEFAULT)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
 }
 
 func handleServerMode(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		_, err := getClaimsFromRequest(r)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-		// No permission check for GET
 		// Initialize caches if not already done
 		initializeCaches()
 		
 		// Get server mode from cache
-		serverModeData := serverModeCache.Get()
+		ctx, cancel := backendContext(r)
+		defer cancel()
+		serverModeData := serverModeCache.Get(ctx)
 		enabled, ok := serverModeData.(bool)
 		if !ok {
 			enabled = false
@@ -962,124 +833,172 @@ func handleServerMode(w http.ResponseWriter, r *http.Request) {
 		response := ServerModeResponse{
 			ServerModeEnabled: enabled,
 		}
+		setConfigETag(w)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	case http.MethodPut:
-		claims, err := getClaimsFromRequest(r)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-		if permissionCheckEnabled && !hasPermission(claims, "clock/server_mode") {
-			http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
-			return
-		}
 		var req SetServerModeRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
 			return
 		}
 		
+		change, ok := beginConfigChange(w, r)
+		if !ok {
+			return
+		}
+		defer change.release()
 		success := setServerModeStatus(req.Enabled)
+		entry := AuditEntry{Action: AUDIT_SERVER_MODE_SET, Request: req}
+		if !success {
+			entry.Error = "failed to update configuration or restart the time service"
+		}
+		recordAudit(r, entry, change.before)
+		change.commit(w)
 		
 		// Invalidate server mode cache after change
 		if cacheInitialized && serverModeCache != nil {
-			serverModeCache.mutex.Lock()
-			serverModeCache.Timestamp = time.Time{} // Force refresh
-			serverModeCache.mutex.Unlock()
+			serverModeCache.Invalidate()
 		}
 		
+		emitEvent(EVENT_SERVER_MODE_CHANGED, map[string]interface{}{
+			"enabled": req.Enabled,
+			"success": success,
+		})
+		
 		response := SetServerModeResponse{
 			Success:           success,
 			ServerModeEnabled: req.Enabled,
 		}
+		if !success {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to apply server mode", response)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 		
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
 	}
 }
 
-var permissionCheckEnabled = true
+// Routes registered with the default mux, used to keep the OpenAPI spec complete
+var registeredRoutes []string
 
-func init() {
-	if os.Getenv("PERMISSION_CHECK") == "off" {
-		permissionCheckEnabled = false
-		log.Println("WARNING: Permission checks are DISABLED! Only authentication is enforced.")
-	} else {
-		permissionCheckEnabled = true
-	}
+// Each route is served under API_PREFIX and at its legacy unversioned path
+func registerRoute(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	registeredRoutes = append(registeredRoutes, pattern)
+	guarded := withRoutePolicy(pattern, handler)
+	http.Handle(pattern, guarded)
+	http.Handle(API_PREFIX+pattern, http.StripPrefix(API_PREFIX, guarded))
 }
 
-// Helper to check if a user has a permission in JWT claims
-func hasPermission(claims map[string]interface{}, perm string) bool {
-	perms, ok := claims["permissions"]
-	if !ok {
-		return false
-	}
-	// permissions can be []interface{} or []string
-	switch v := perms.(type) {
-	case []interface{}:
-		for _, p := range v {
-			if ps, ok := p.(string); ok && ps == perm {
-				return true
-			}
-		}
-	case []string:
-		for _, ps := range v {
-			if ps == perm {
-				return true
-			}
-		}
-	case string:
-		// fallback: comma-separated string
-		for _, ps := range strings.Split(v, ",") {
-			if strings.TrimSpace(ps) == perm {
-				return true
-			}
-		}
+func main() {
+	// Any argument selects a CLI subcommand; no arguments runs the server
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCLI(os.Args[1:]))
 	}
-	return false
+	serve()
 }
 
-// Example usage in a handler (replace in all sensitive handlers):
-//
-// claims := getClaimsFromRequest(r) // your JWT parsing logic
-// if permissionCheckEnabled && !hasPermission(claims, "clock/server-mode") {
-//     http.Error(w, "Forbidden: insufficient permissions", http.StatusForbidden)
-//     return
-// }
-// ...proceed with the action...
-
-func main() {
-	// Define routes - Hide chrony implementation details
-	publicKey = loadPublicKey("/etc/brick/clock/public.pem") // adjust path as needed
-	http.HandleFunc("/version", handleVersion)
-	http.HandleFunc("/status", handleStatus)
-	http.HandleFunc("/status/tracking", handleTracking)
-	http.HandleFunc("/status/sources", handleSources)
-	http.HandleFunc("/status/activity", handleActivity)
-	http.HandleFunc("/status/clients", handleClients)
-	http.HandleFunc("/servers", handleServers)
-	http.HandleFunc("/servers/default", handleDefaultServers)
-	http.HandleFunc("/server-mode", handleServerMode)
+func serve() {
+	initKeyStore()
+	loadRoles()
+	logAuthPolicy()
+	registerRoutes()
+	loadServerProfiles()
+	applyFirstBootProfile()
+	resumePendingConfirm()
 	
-	// Application version endpoint
-	http.HandleFunc("/app-version", handleAppVersion)
+	logOpenAPICoverage(registeredRoutes)
+	logRoutePolicyProblems(registeredRoutes)
 	
-	// Health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	// Keep status data warm
+	startCacheRefresher()
+	
+	// Background notifications
+	loadWebhooks()
+	startSyncWatcher()
+	startHealthMonitor()
+	startAlertEvaluator()
+	startServerSelection()
+	startFailover()
+	startDiscovery()
 	
 	port := "17003"
 	if envPort := os.Getenv("PORT"); envPort != "" {
 		port = envPort
 	}
 	
+	handler := withRequestID(http.DefaultServeMux)
+	startSocketListener(handler)
+	
 	fmt.Printf("Starting Brick Clock API server on port %s\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(http.ListenAndServe(":"+port, handler))
+}
+
+// Define routes - Hide chrony implementation details
+func registerRoutes() {
+	registerRoute("/version", handleVersion)
+	registerRoute("/whoami", handleWhoAmI)
+	registerRoute("/status", handleStatus)
+	registerRoute("/status/tracking", handleTracking)
+	registerRoute("/status/sources", handleSources)
+	registerRoute("/status/activity", handleActivity)
+	registerRoute("/status/clients", handleClients)
+	registerRoute("/status/health", handleHealthStatus)
+	registerRoute("/probe", handleProbe)
+	registerRoute("/servers", handleServers)
+	registerRoute("/servers/default", handleDefaultServers)
+	registerRoute("/servers/profiles", handleServerProfiles)
+	registerRoute("/servers/profiles/", handleServerProfile)
+	registerRoute("/servers/candidates", handleServerCandidates)
+	registerRoute("/servers/selection", handleServerSelection)
+	registerRoute("/servers/failover", handleFailover)
+	registerRoute("/servers/discovery", handleDiscovery)
+	registerRoute("/server-mode", handleServerMode)
+	registerRoute("/cluster", handleCluster)
+	registerRoute("/config", handleConfig)
+	registerRoute("/config/pending", handlePendingConfirm)
+	registerRoute("/config/confirm", handleConfirm)
+	registerRoute("/config/revisions", handleConfigRevisions)
+	registerRoute("/config/revisions/", handleConfigRevision)
+	
+	// Event stream
+	registerRoute("/events", handleEvents)
+	
+	// Webhook subscriptions
+	registerRoute("/webhooks", handleWebhooks)
+	registerRoute("/webhooks/", handleWebhook)
+	
+	// Alerting
+	registerRoute("/alerts", handleAlerts)
+	registerRoute("/alerts/rules", handleAlertRules)
+	registerRoute("/alerts/silences", handleAlertSilences)
+	registerRoute("/alerts/silences/", handleAlertSilences)
+	
+	// Application version endpoint
+	registerRoute("/app-version", handleAppVersion)
+	
+	// API documentation
+	registerRoute("/openapi.json", handleOpenAPI)
+	registerRoute("/docs", handleDocs)
+	
+	// Configuration audit log
+	registerRoute("/audit", handleAudit)
+	
+	// Health check endpoint
+	registerRoute("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+	
+	// Orchestrator probes
+	registerRoute("/livez", handleLivez)
+	registerRoute("/readyz", handleReadyz)
+	registerRoute("/syncz", handleSyncz)
+	
+	// Unknown paths get the JSON error envelope instead of the plain-text 404
+	http.HandleFunc("/", handleNotFound)
 } 
\ No newline at end of file
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Reasons reported in the details of a 401 response
+const (
+	AUTH_TOKEN_MISSING          = "token_missing"
+	AUTH_TOKEN_MALFORMED        = "token_malformed"
+	AUTH_ALGORITHM_UNSUPPORTED  = "algorithm_unsupported"
+	AUTH_KEY_NOT_FOUND          = "key_not_found"
+	AUTH_SIGNATURE_INVALID      = "signature_invalid"
+	AUTH_TOKEN_EXPIRED          = "token_expired"
+	AUTH_TOKEN_NOT_YET_VALID    = "token_not_yet_valid"
+	AUTH_TOKEN_ISSUED_IN_FUTURE = "token_issued_in_future"
+	AUTH_TOKEN_TOO_OLD          = "token_too_old"
+	AUTH_CLAIM_INVALID          = "claim_invalid"
+	AUTH_ISSUER_NOT_ALLOWED     = "issuer_not_allowed"
+	AUTH_AUDIENCE_NOT_ALLOWED   = "audience_not_allowed"
+)
+
+// Authentication failure with a machine-readable reason
+type authError struct {
+	Reason  string
+	Message string
+}
+
+func (e *authError) Error() string {
+	return e.Message
+}
+
+func newAuthError(reason string, format string, args ...interface{}) *authError {
+	return &authError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// Claim requirements applied to every verified token
+type tokenPolicy struct {
+	Issuers        []string
+	Audiences      []string
+	MaxAge         time.Duration
+	Leeway         time.Duration
+	UnsyncedLeeway time.Duration
+}
+
+var authPolicy = tokenPolicy{
+	Leeway:         30 * time.Second,
+	UnsyncedLeeway: 5 * time.Minute,
+}
+
+// Sync state last observed by the sync watcher: 0 unknown, 1 synced, 2 not synced
+var localSyncState int32
+
+func init() {
+	authPolicy.Issuers = splitList(os.Getenv("JWT_ISSUERS"))
+	authPolicy.Audiences = splitList(os.Getenv("JWT_AUDIENCE"))
+	for name, target := range map[string]*time.Duration{
+		"JWT_MAX_AGE":         &authPolicy.MaxAge,
+		"JWT_LEEWAY":          &authPolicy.Leeway,
+		"JWT_UNSYNCED_LEEWAY": &authPolicy.UnsyncedLeeway,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if parsed, err := time.ParseDuration(v); err == nil && parsed >= 0 {
+				*target = parsed
+			} else {
+				log.Printf("Invalid %s %q, using %s", name, v, *target)
+			}
+		}
+	}
+}
+
+// Helper to split a comma-separated list, dropping empty entries
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Record the local clock's sync state for leeway decisions
+func setLocalSyncState(synced bool) {
+	if synced {
+		atomic.StoreInt32(&localSyncState, 1)
+	} else {
+		atomic.StoreInt32(&localSyncState, 2)
+	}
+}
+
+// Leeway for time-based claims. While our own clock is not known to be
+// synchronized it may be off by more than usual, so a wider leeway is
+// used to avoid locking out every client.
+func (p tokenPolicy) effectiveLeeway() time.Duration {
+	if atomic.LoadInt32(&localSyncState) == 1 {
+		return p.Leeway
+	}
+	if p.UnsyncedLeeway > p.Leeway {
+		return p.UnsyncedLeeway
+	}
+	return p.Leeway
+}
+
+func logAuthPolicy() {
+	if len(authPolicy.Issuers) == 0 && len(authPolicy.Audiences) == 0 {
+		log.Println("WARNING: JWT_ISSUERS and JWT_AUDIENCE are not set; tokens for any issuer and audience are accepted")
+	}
+}
+
+// Read a NumericDate claim; ok is false when the claim is absent
+func numericDateClaim(claims jwt.MapClaims, name string) (time.Time, bool, error) {
+	raw, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+	var seconds float64
+	switch v := raw.(type) {
+	case float64:
+		seconds = v
+	case json.Number:
+		parsed, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false, newAuthError(AUTH_CLAIM_INVALID, "claim %q is not a number", name)
+		}
+		seconds = parsed
+	default:
+		return time.Time{}, false, newAuthError(AUTH_CLAIM_INVALID, "claim %q is not a number", name)
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(frac*1e9)), true, nil
+}
+
+// Read the aud claim, which may be a string or an array of strings
+func audienceClaim(claims jwt.MapClaims) ([]string, error) {
+	switch v := claims["aud"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var result []string
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, newAuthError(AUTH_CLAIM_INVALID, "claim \"aud\" contains a non-string value")
+			}
+			result = append(result, s)
+		}
+		return result, nil
+	}
+	return nil, newAuthError(AUTH_CLAIM_INVALID, "claim \"aud\" must be a string or array of strings")
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Check time-based, issuer and audience claims against the policy
+func (p tokenPolicy) validate(claims jwt.MapClaims, now time.Time) error {
+	leeway := p.effectiveLeeway()
+
+	exp, hasExp, err := numericDateClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if hasExp && now.After(exp.Add(leeway)) {
+		return newAuthError(AUTH_TOKEN_EXPIRED, "token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+
+	nbf, hasNbf, err := numericDateClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if hasNbf && now.Add(leeway).Before(nbf) {
+		return newAuthError(AUTH_TOKEN_NOT_YET_VALID, "token not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+
+	iat, hasIat, err := numericDateClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if hasIat && now.Add(leeway).Before(iat) {
+		return newAuthError(AUTH_TOKEN_ISSUED_IN_FUTURE, "token issued in the future (%s)", iat.UTC().Format(time.RFC3339))
+	}
+	if p.MaxAge > 0 {
+		if !hasIat {
+			return newAuthError(AUTH_CLAIM_INVALID, "token has no \"iat\" claim but a maximum age of %s is enforced", p.MaxAge)
+		}
+		if now.Sub(iat) > p.MaxAge+leeway {
+			return newAuthError(AUTH_TOKEN_TOO_OLD, "token issued at %s exceeds the maximum age of %s", iat.UTC().Format(time.RFC3339), p.MaxAge)
+		}
+	}
+
+	if len(p.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !containsString(p.Issuers, iss) {
+			if iss == "" {
+				return newAuthError(AUTH_ISSUER_NOT_ALLOWED, "token has no issuer")
+			}
+			return newAuthError(AUTH_ISSUER_NOT_ALLOWED, "issuer %q is not allowed", iss)
+		}
+	}
+
+	if len(p.Audiences) > 0 {
+		audiences, err := audienceClaim(claims)
+		if err != nil {
+			return err
+		}
+		matched := false
+		for _, aud := range audiences {
+			if containsString(p.Audiences, aud) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return newAuthError(AUTH_AUDIENCE_NOT_ALLOWED, "token audience %v does not include %s", audiences, strings.Join(p.Audiences, " or "))
+		}
+	}
+	return nil
+}
+
+// Write a 401 envelope, including the failure reason when known
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	var details interface{}
+	if ae, ok := err.(*authError); ok {
+		details = map[string]string{"reason": ae.Reason}
+	}
+	writeError(w, r, http.StatusUnauthorized, ERR_UNAUTHORIZED, err.Error(), details)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestTokenPolicyValidate(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	// NumericDate claim relative to now, as decoded from JSON
+	at := func(offset time.Duration) float64 { return float64(now.Add(offset).Unix()) }
+	policy := tokenPolicy{Leeway: 30 * time.Second, UnsyncedLeeway: 5 * time.Minute}
+	withMaxAge := policy
+	withMaxAge.MaxAge = time.Hour
+	restricted := policy
+	restricted.Issuers = []string{"https://id.example"}
+	restricted.Audiences = []string{"brick-clock", "brick"}
+
+	tests := []struct {
+		name   string
+		policy tokenPolicy
+		synced bool
+		claims jwt.MapClaims
+		want   string
+	}{
+		{"valid", policy, true, jwt.MapClaims{"exp": at(time.Hour), "nbf": at(-time.Minute), "iat": at(-time.Minute)}, ""},
+		{"no time claims", policy, true, jwt.MapClaims{}, ""},
+		{"claim not a number", policy, true, jwt.MapClaims{"exp": "tomorrow"}, AUTH_CLAIM_INVALID},
+
+		{"expired within leeway", policy, true, jwt.MapClaims{"exp": at(-20 * time.Second)}, ""},
+		{"expired beyond leeway", policy, true, jwt.MapClaims{"exp": at(-time.Minute)}, AUTH_TOKEN_EXPIRED},
+		{"expired within unsynced leeway", policy, false, jwt.MapClaims{"exp": at(-time.Minute)}, ""},
+		{"expired beyond unsynced leeway", policy, false, jwt.MapClaims{"exp": at(-10 * time.Minute)}, AUTH_TOKEN_EXPIRED},
+
+		{"nbf within leeway", policy, true, jwt.MapClaims{"nbf": at(20 * time.Second)}, ""},
+		{"nbf beyond leeway", policy, true, jwt.MapClaims{"nbf": at(time.Minute)}, AUTH_TOKEN_NOT_YET_VALID},
+		{"nbf within unsynced leeway", policy, false, jwt.MapClaims{"nbf": at(time.Minute)}, ""},
+		{"nbf beyond unsynced leeway", policy, false, jwt.MapClaims{"nbf": at(10 * time.Minute)}, AUTH_TOKEN_NOT_YET_VALID},
+
+		{"iat within leeway", policy, true, jwt.MapClaims{"iat": at(20 * time.Second)}, ""},
+		{"iat beyond leeway", policy, true, jwt.MapClaims{"iat": at(time.Minute)}, AUTH_TOKEN_ISSUED_IN_FUTURE},
+		{"iat within unsynced leeway", policy, false, jwt.MapClaims{"iat": at(time.Minute)}, ""},
+		{"iat beyond unsynced leeway", policy, false, jwt.MapClaims{"iat": at(10 * time.Minute)}, AUTH_TOKEN_ISSUED_IN_FUTURE},
+
+		{"within max age", withMaxAge, true, jwt.MapClaims{"iat": at(-50 * time.Minute)}, ""},
+		{"max age within leeway", withMaxAge, true, jwt.MapClaims{"iat": at(-time.Hour - 20*time.Second)}, ""},
+		{"beyond max age", withMaxAge, true, jwt.MapClaims{"iat": at(-time.Hour - time.Minute)}, AUTH_TOKEN_TOO_OLD},
+		{"beyond max age within unsynced leeway", withMaxAge, false, jwt.MapClaims{"iat": at(-time.Hour - time.Minute)}, ""},
+		{"max age without iat", withMaxAge, true, jwt.MapClaims{"exp": at(time.Hour)}, AUTH_CLAIM_INVALID},
+
+		{"allowed issuer and audience", restricted, true, jwt.MapClaims{"iss": "https://id.example", "aud": "brick"}, ""},
+		{"audience list", restricted, true, jwt.MapClaims{"iss": "https://id.example", "aud": []interface{}{"other", "brick-clock"}}, ""},
+		{"other issuer", restricted, true, jwt.MapClaims{"iss": "https://evil.example", "aud": "brick"}, AUTH_ISSUER_NOT_ALLOWED},
+		{"no issuer", restricted, true, jwt.MapClaims{"aud": "brick"}, AUTH_ISSUER_NOT_ALLOWED},
+		{"other audience", restricted, true, jwt.MapClaims{"iss": "https://id.example", "aud": []interface{}{"other"}}, AUTH_AUDIENCE_NOT_ALLOWED},
+		{"no audience", restricted, true, jwt.MapClaims{"iss": "https://id.example"}, AUTH_AUDIENCE_NOT_ALLOWED},
+		{"audience not a string", restricted, true, jwt.MapClaims{"iss": "https://id.example", "aud": 7.0}, AUTH_CLAIM_INVALID},
+		{"any issuer without a policy", policy, true, jwt.MapClaims{"iss": "https://evil.example", "aud": "other"}, ""},
+	}
+
+	saved := atomic.LoadInt32(&localSyncState)
+	defer atomic.StoreInt32(&localSyncState, saved)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setLocalSyncState(tt.synced)
+			err := tt.policy.validate(tt.claims, now)
+			if got := authReason(err); got != tt.want || (tt.want == "") != (err == nil) {
+				t.Errorf("validate = %v (reason %q), want reason %q", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownSyncStateUsesUnsyncedLeeway(t *testing.T) {
+	saved := atomic.LoadInt32(&localSyncState)
+	defer atomic.StoreInt32(&localSyncState, saved)
+	atomic.StoreInt32(&localSyncState, 0)
+
+	policy := tokenPolicy{Leeway: 30 * time.Second, UnsyncedLeeway: 5 * time.Minute}
+	if got := policy.effectiveLeeway(); got != 5*time.Minute {
+		t.Errorf("leeway before the first sync check = %v, want the unsynced leeway", got)
+	}
+	policy.UnsyncedLeeway = time.Second
+	if got := policy.effectiveLeeway(); got != 30*time.Second {
+		t.Errorf("leeway with a smaller unsynced leeway = %v, want the normal leeway", got)
+	}
+}
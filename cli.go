@@ -0,0 +1,994 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"el/brick-clock/client"
+)
+
+const cliUsage = `Usage: chrony-api-app [options] <command> [args]
+
+Commands:
+  serve                      Run the API server (default when no command is given)
+  status [--flags N] [--fresh]
+                             Show tracking, sources, activity and server mode
+  sources                    Show NTP sources
+  probe [SERVER...]          Query servers over SNTP and compare with chronyd
+                             (default the configured servers)
+  servers get                List configured servers
+  servers set HOST...        Replace the configured servers
+  servers profiles           List server profiles
+  servers apply PROFILE      Replace the configured servers with a profile's
+  servers candidates [HOST...]
+                             Probe and rank candidate servers
+  servers selection          Show the automatic selection policy and last run
+  servers failover           Show the failover policy and active server group
+  servers discovery [refresh]
+                             Show (or refresh) the servers found by discovery
+  server-mode [get|on|off]   Show or change server mode
+  cluster                    Show the local reference and the state of each peer
+  config get                 Print the configuration document (JSON)
+  config plan FILE           Show what applying a configuration document would change
+  config apply FILE          Apply a configuration document ("-" reads stdin)
+  config pending             Show the change awaiting confirmation
+  config confirm             Keep the change awaiting confirmation
+  config revert              Revert the change awaiting confirmation now
+  config history             List stored configuration revisions
+  config diff FROM [TO]      Compare two revisions (TO defaults to the current one)
+  config restore REVISION    Make an older revision the current configuration
+  events tail [--types T,T]  Follow the event stream
+
+Options (accepted before or after the command):
+  --url URL          API base URL (env BRICK_CLOCK_URL)
+  --socket PATH      Unix socket of a local instance (env BRICK_CLOCK_SOCKET, default ` + DEFAULT_SOCKET_PATH + `)
+  --token TOKEN      Bearer token (env BRICK_TOKEN; not needed on the local socket with SOCKET_TRUSTED=on)
+  -o, --output FMT   Output format: table or json (default table)
+  -w, --watch DUR    Refresh the output every DUR (e.g. 2s) until interrupted
+  --if-match ETAG    Apply a change only if the configuration is still at this revision
+                     (default: the revision read right before the change)
+
+Without --url, the local socket is used when present, otherwise http://localhost:$PORT.
+`
+
+// Options shared by all CLI subcommands
+type cliOptions struct {
+	url    string
+	socket string
+	token  string
+	output string
+	watch  time.Duration
+	// --if-match
+	etag string
+}
+
+// Register the shared flags, keeping values parsed by an earlier flag set as defaults
+func (o *cliOptions) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.url, "url", o.url, "API base URL")
+	fs.StringVar(&o.socket, "socket", o.socket, "Unix socket path")
+	fs.StringVar(&o.token, "token", o.token, "Bearer token")
+	fs.StringVar(&o.output, "output", o.output, "Output format: table or json")
+	fs.StringVar(&o.output, "o", o.output, "Output format: table or json")
+	fs.DurationVar(&o.watch, "watch", o.watch, "Refresh interval")
+	fs.DurationVar(&o.watch, "w", o.watch, "Refresh interval")
+	fs.StringVar(&o.etag, "if-match", o.etag, "Configuration revision (ETag) a change is based on")
+}
+
+func newCLIFlagSet(name string, opts *cliOptions) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts.register(fs)
+	return fs
+}
+
+// Build an API client for the selected transport
+func (o *cliOptions) client() (*client.Client, error) {
+	var clientOpts []client.Option
+	if o.token != "" {
+		clientOpts = append(clientOpts, client.WithTokenSource(client.StaticToken(o.token)))
+	}
+	if o.url != "" {
+		return client.New(o.url, clientOpts...)
+	}
+	if o.socket != "" {
+		if _, err := os.Stat(o.socket); err == nil {
+			socket := o.socket
+			transport := &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			}
+			clientOpts = append(clientOpts, client.WithHTTPClient(&http.Client{Transport: transport, Timeout: 30 * time.Second}))
+			return client.New("http://localhost", clientOpts...)
+		}
+	}
+	port := "17003"
+	if envPort := os.Getenv("PORT"); envPort != "" {
+		port = envPort
+	}
+	return client.New("http://localhost:"+port, clientOpts...)
+}
+
+// Make configuration changes conditional on --if-match, or else on the
+// revision current right before the change, so that a change made by
+// someone else in between fails with 412 instead of being overwritten
+func (o *cliOptions) conditional(ctx context.Context, c *client.Client) (context.Context, error) {
+	etag := o.etag
+	if etag == "" {
+		var err error
+		if etag, err = c.ConfigETag(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return client.WithIfMatch(ctx, etag), nil
+}
+
+// Run the CLI and return the process exit code
+func runCLI(args []string) int {
+	opts := &cliOptions{
+		url:    os.Getenv("BRICK_CLOCK_URL"),
+		socket: DEFAULT_SOCKET_PATH,
+		token:  os.Getenv("BRICK_TOKEN"),
+		output: "table",
+	}
+	if v := os.Getenv("BRICK_CLOCK_SOCKET"); v != "" {
+		opts.socket = v
+	}
+
+	global := newCLIFlagSet("chrony-api-app", opts)
+	if err := global.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n\n%s", err, cliUsage)
+		return 2
+	}
+	rest := global.Args()
+	if len(rest) == 0 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	command, rest := rest[0], rest[1:]
+
+	switch command {
+	case "serve":
+		serve()
+		return 0
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var err error
+	switch command {
+	case "status":
+		err = cliStatus(ctx, opts, rest)
+	case "sources":
+		err = cliSources(ctx, opts, rest)
+	case "probe":
+		err = cliProbe(ctx, opts, rest)
+	case "servers":
+		err = cliServers(ctx, opts, rest)
+	case "server-mode":
+		err = cliServerMode(ctx, opts, rest)
+	case "cluster":
+		err = cliCluster(ctx, opts, rest)
+	case "config":
+		err = cliConfig(ctx, opts, rest)
+	case "events":
+		err = cliEvents(ctx, opts, rest)
+	default:
+		fmt.Fprintf(os.Stderr, "error: unknown command %q\n\n%s", command, cliUsage)
+		return 2
+	}
+	if err != nil && err != context.Canceled {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// Parse subcommand flags and validate the shared options
+func parseCLIArgs(name string, opts *cliOptions, args []string, extra func(fs *flag.FlagSet)) ([]string, error) {
+	fs := newCLIFlagSet(name, opts)
+	if extra != nil {
+		extra(fs)
+	}
+	// Flags may be interspersed with positional arguments
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if opts.output != "table" && opts.output != "json" {
+		return nil, fmt.Errorf("unsupported output format %q (use table or json)", opts.output)
+	}
+	return positional, nil
+}
+
+// Run render once, or repeatedly when --watch is set
+func cliRender(ctx context.Context, opts *cliOptions, render func(ctx context.Context, w io.Writer) error) error {
+	if opts.watch <= 0 {
+		return render(ctx, os.Stdout)
+	}
+	for {
+		var buf strings.Builder
+		err := render(ctx, &buf)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Clear the screen and redraw in place
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("Every %s: %s\n\n", opts.watch, time.Now().Format(time.RFC3339))
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+		} else {
+			fmt.Print(buf.String())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(opts.watch):
+		}
+	}
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// Tracking keys in chronyc order; compatibility aliases are skipped
+var cliTrackingKeys = []string{
+	"ReferenceID", "Stratum", "Ref time (UTC)", "System time", "Last offset", "RMS offset",
+	"Frequency", "Residual freq", "Skew", "Root delay", "Root dispersion", "Update interval", "Leap status",
+}
+
+func writeTrackingTable(w io.Writer, tracking map[string]string) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	shown := map[string]bool{"UpdateRate": true, "LeapStatus": true}
+	for _, key := range cliTrackingKeys {
+		if value, ok := tracking[key]; ok {
+			fmt.Fprintf(tw, "%s\t%s\n", key, value)
+			shown[key] = true
+		}
+	}
+	var others []string
+	for key := range tracking {
+		if !shown[key] {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	for _, key := range others {
+		fmt.Fprintf(tw, "%s\t%s\n", key, tracking[key])
+	}
+	tw.Flush()
+}
+
+func writeSourcesTable(w io.Writer, sources []map[string]string) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATE\tNAME\tSTRATUM\tPOLL\tREACH\tLASTRX\tOFFSET")
+	for _, s := range sources {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s["state"], s["name"], s["stratum"], s["poll"], s["reach"], s["lastrx"], s["offset"])
+	}
+	tw.Flush()
+}
+
+func cliStatus(ctx context.Context, opts *cliOptions, args []string) error {
+	flags := STATUS_ALL
+	fresh := false
+	if _, err := parseCLIArgs("status", opts, args, func(fs *flag.FlagSet) {
+		fs.IntVar(&flags, "flags", flags, "Status sections bitmask")
+		fs.BoolVar(&fresh, "fresh", fresh, "Bypass the server's cache")
+	}); err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	if fresh {
+		ctx = client.WithFresh(ctx)
+	}
+	return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+		status, err := c.Status(ctx, flags)
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(w, status)
+		}
+		if flags&STATUS_TRACKING != 0 {
+			fmt.Fprintln(w, sectionHeading("TRACKING", status.Meta["tracking"]))
+			writeTrackingTable(w, status.Tracking)
+			fmt.Fprintln(w)
+		}
+		if flags&STATUS_SOURCES != 0 {
+			fmt.Fprintln(w, sectionHeading("SOURCES", status.Meta["sources"]))
+			writeSourcesTable(w, status.Sources)
+			fmt.Fprintln(w)
+		}
+		if flags&STATUS_ACTIVITY != 0 {
+			fmt.Fprintln(w, sectionHeading("ACTIVITY", status.Meta["activity"]))
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			for _, key := range []string{"ok_count", "failed_count", "bogus_count", "timeout_count"} {
+				if value, ok := status.Activity[key]; ok {
+					fmt.Fprintf(tw, "%s\t%s\n", key, value)
+				}
+			}
+			tw.Flush()
+			fmt.Fprintln(w)
+		}
+		if flags&STATUS_CLIENTS != 0 {
+			fmt.Fprintf(w, "%s\n%d connected\n\n", sectionHeading("CLIENTS", status.Meta["clients"]), len(status.Clients))
+		}
+		if flags&STATUS_SERVER_MODE != 0 {
+			fmt.Fprintf(w, "%s\n%s\n", sectionHeading("SERVER MODE", status.Meta["server_mode"]), enabledString(status.ServerModeEnabled))
+		}
+		if flags&STATUS_HEALTH != 0 && status.Health != nil {
+			fmt.Fprintf(w, "\nHEALTH\n%s (score %d) since %s\n", status.Health.State, status.Health.Score, status.Health.Since.Local().Format(time.RFC3339))
+			for _, reason := range status.Health.Reasons {
+				fmt.Fprintf(w, "  %s\n", reason)
+			}
+		}
+		return nil
+	})
+}
+
+// Helper to title a status section with how old its data is
+func sectionHeading(title string, meta client.DatasetMeta) string {
+	switch {
+	case meta.Error != "":
+		return fmt.Sprintf("%s (error: %s)", title, meta.Error)
+	case meta.Source == "live":
+		return title + " (live)"
+	case meta.Age != nil:
+		return fmt.Sprintf("%s (%.0fs old)", title, *meta.Age)
+	}
+	return title
+}
+
+func cliSources(ctx context.Context, opts *cliOptions, args []string) error {
+	if _, err := parseCLIArgs("sources", opts, args, nil); err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+		sources, err := c.Sources(ctx)
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(w, sources)
+		}
+		writeSourcesTable(w, sources)
+		return nil
+	})
+}
+
+func cliProbe(ctx context.Context, opts *cliOptions, args []string) error {
+	servers, err := parseCLIArgs("probe", opts, args, nil)
+	if err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+		probe, err := c.Probe(ctx, servers...)
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(w, probe)
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "SERVER\tSTRATUM\tREFERENCE\tOFFSET\tDELAY\tLEAP")
+		for _, result := range probe.Results {
+			if result.Error != "" {
+				fmt.Fprintf(tw, "%s\t-\t-\t-\t-\terror: %s\n", result.Server, result.Error)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%+.3fms\t%.3fms\t%s\n", result.Server, result.Stratum, result.Reference,
+				result.OffsetMs, result.DelayMs, result.LeapStatus)
+		}
+		tw.Flush()
+		if probe.ChronydOffsetMs != nil {
+			fmt.Fprintf(w, "\nchronyd offset: %+.3fms\n", *probe.ChronydOffsetMs)
+		} else if probe.ChronydError != "" {
+			fmt.Fprintf(w, "\nchronyd offset: unknown (%s)\n", probe.ChronydError)
+		}
+		return nil
+	})
+}
+
+func cliServers(ctx context.Context, opts *cliOptions, args []string) error {
+	rest, err := parseCLIArgs("servers", opts, args, nil)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return fmt.Errorf("usage: servers get | servers set HOST... | servers profiles | servers apply PROFILE | servers candidates [HOST...] | servers selection | servers failover | servers discovery [refresh]")
+	}
+	action, rest := rest[0], rest[1:]
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "get":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			servers, err := c.Servers(ctx)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, servers)
+			}
+			for _, server := range servers {
+				fmt.Fprintln(w, server)
+			}
+			return nil
+		})
+	case "set":
+		if len(rest) == 0 {
+			return fmt.Errorf("usage: servers set HOST...")
+		}
+		changeCtx, err := opts.conditional(ctx, c)
+		if err != nil {
+			return err
+		}
+		result, err := c.SetServers(changeCtx, rest)
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(os.Stdout, result)
+		}
+		fmt.Printf("servers set: %s (restart %s)\n", strings.Join(result.Result, ", "), okString(result.RestartSuccess))
+		return nil
+	case "profiles":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			profiles, err := c.ServerProfiles(ctx)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, profiles)
+			}
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "NAME\tDEFAULT\tSERVERS\tDESCRIPTION")
+			for _, profile := range profiles.Profiles {
+				isDefault := ""
+				if profile.Default {
+					isDefault = "*"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", profile.Name, isDefault, strings.Join(profile.Servers, ","), profile.Description)
+			}
+			return tw.Flush()
+		})
+	case "apply":
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: servers apply PROFILE")
+		}
+		changeCtx, err := opts.conditional(ctx, c)
+		if err != nil {
+			return err
+		}
+		result, err := c.ApplyServerProfile(changeCtx, rest[0])
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(os.Stdout, result)
+		}
+		fmt.Printf("profile %s applied: %s (restart %s)\n", result.Profile, strings.Join(result.Result, ", "), okString(result.RestartSuccess))
+		return nil
+	case "candidates":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			ranking, err := c.RankCandidates(ctx, 0, rest...)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, ranking)
+			}
+			writeCandidatesTable(w, ranking.Candidates)
+			fmt.Fprintf(w, "\nselected: %s\n", strings.Join(ranking.Selected, ", "))
+			return nil
+		})
+	case "selection":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			selection, err := c.ServerSelection(ctx)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, selection)
+			}
+			policy := selection.Policy
+			fmt.Fprintf(w, "automatic selection: %s\n", enabledString(policy.Enabled))
+			fmt.Fprintf(w, "candidates: %s\n", strings.Join(policy.Candidates, ", "))
+			fmt.Fprintf(w, "count %d, every %s, min improvement %.1f, hold-down %s\n", policy.Count, policy.Interval, policy.MinImprovement, policy.HoldDown)
+			if run := selection.LastRun; run != nil {
+				fmt.Fprintf(w, "last run %s: %s\n", run.At.Local().Format(time.RFC3339), run.Decision)
+				if run.Error != "" {
+					fmt.Fprintf(w, "error: %s\n", run.Error)
+				}
+			}
+			if selection.NextRun != nil {
+				fmt.Fprintf(w, "next run %s\n", selection.NextRun.Local().Format(time.RFC3339))
+			}
+			if selection.Ranking != nil {
+				fmt.Fprintln(w)
+				writeCandidatesTable(w, selection.Ranking.Candidates)
+			}
+			return nil
+		})
+	case "failover":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			status, err := c.Failover(ctx)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, status)
+			}
+			policy := status.Policy
+			fmt.Fprintf(w, "failover: %s\n", enabledString(policy.Enabled))
+			fmt.Fprintf(w, "primary: %s\n", strings.Join(policy.Primary, ", "))
+			fmt.Fprintf(w, "backup: %s\n", strings.Join(policy.Backup, ", "))
+			fmt.Fprintf(w, "outage window %s, recovery window %s\n", policy.OutageWindow, policy.RecoveryWindow)
+			fmt.Fprintf(w, "active: %s\n", status.Active)
+			if status.OutageSince != nil {
+				fmt.Fprintf(w, "primaries unreachable since %s\n", status.OutageSince.Local().Format(time.RFC3339))
+			}
+			if status.RecoveringSince != nil {
+				fmt.Fprintf(w, "primaries answering since %s\n", status.RecoveringSince.Local().Format(time.RFC3339))
+			}
+			if status.Error != "" {
+				fmt.Fprintf(w, "error: %s\n", status.Error)
+			}
+			if last := status.LastSwitch; last != nil {
+				fmt.Fprintf(w, "last switch %s: %s -> %s (%s)\n", last.At.Local().Format(time.RFC3339), last.From, last.To, last.Reason)
+			}
+			return nil
+		})
+	case "discovery":
+		if len(rest) > 0 && rest[0] != "refresh" {
+			return fmt.Errorf("usage: servers discovery [refresh]")
+		}
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			fetch := c.Discovery
+			if len(rest) > 0 {
+				fetch = c.RefreshDiscovery
+			}
+			status, err := fetch(ctx)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, status)
+			}
+			fmt.Fprintf(w, "discovery: %s (at most %d servers)\n", enabledString(status.Policy.Enabled), status.Policy.MaxServers)
+			fmt.Fprintf(w, "servers: %s\n", strings.Join(status.Servers, ", "))
+			if status.Error != "" {
+				fmt.Fprintf(w, "error: %s\n", status.Error)
+			}
+			if last := status.LastChange; last != nil {
+				note := "already configured"
+				if last.Applied {
+					note = "restart " + okString(last.RestartSuccess)
+				}
+				fmt.Fprintf(w, "last change %s: %s (%s)\n", last.At.Local().Format(time.RFC3339), strings.Join(last.Servers, ", "), note)
+			}
+			if len(status.Providers) == 0 {
+				return nil
+			}
+			fmt.Fprintln(w)
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "TYPE\tSOURCE\tSERVERS\tREFRESHED\tNOTES")
+			for _, provider := range status.Providers {
+				refreshed := "-"
+				if provider.RefreshedAt != nil {
+					refreshed = provider.RefreshedAt.Local().Format(time.RFC3339)
+				}
+				notes := provider.Warnings
+				if provider.Error != "" {
+					notes = append([]string{"error: " + provider.Error}, notes...)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", provider.Type, provider.Source, strings.Join(provider.Servers, ","), refreshed, strings.Join(notes, "; "))
+			}
+			return tw.Flush()
+		})
+	}
+	return fmt.Errorf("unknown servers action %q (use get, set, profiles, apply, candidates, selection, failover or discovery)", action)
+}
+
+// Helper to format an optional millisecond value
+func msString(value *float64) string {
+	if value == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.3fms", *value)
+}
+
+// Helper to show "-" for an empty table cell
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func writeCandidatesTable(w io.Writer, candidates []client.CandidateRank) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tSERVER\tSCORE\tSTRATUM\tDELAY\tJITTER\tOFFSET\tNOTES")
+	for _, candidate := range candidates {
+		rank := "-"
+		if candidate.Rank > 0 {
+			rank = strconv.Itoa(candidate.Rank)
+		}
+		server := candidate.Server
+		if candidate.Current {
+			server += " *"
+		}
+		stratum := "-"
+		if candidate.Answered > 0 {
+			stratum = strconv.Itoa(candidate.Stratum)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\t%s\t%s\t%s\t%s\t%s\n", rank, server, candidate.Score, stratum,
+			msString(candidate.DelayMs), msString(candidate.JitterMs), msString(candidate.OffsetMs), strings.Join(candidate.Problems, "; "))
+	}
+	tw.Flush()
+}
+
+func cliServerMode(ctx context.Context, opts *cliOptions, args []string) error {
+	rest, err := parseCLIArgs("server-mode", opts, args, nil)
+	if err != nil {
+		return err
+	}
+	action := "get"
+	if len(rest) > 0 {
+		action = rest[0]
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "get":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			enabled, err := c.ServerMode(ctx)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, map[string]bool{"server_mode_enabled": enabled})
+			}
+			fmt.Fprintf(w, "server mode %s\n", enabledString(enabled))
+			return nil
+		})
+	case "on", "off":
+		changeCtx, err := opts.conditional(ctx, c)
+		if err != nil {
+			return err
+		}
+		result, err := c.SetServerMode(changeCtx, action == "on")
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(os.Stdout, result)
+		}
+		fmt.Printf("server mode %s\n", enabledString(result.ServerModeEnabled))
+		return nil
+	}
+	return fmt.Errorf("unknown server-mode action %q (use get, on or off)", action)
+}
+
+func cliCluster(ctx context.Context, opts *cliOptions, args []string) error {
+	if _, err := parseCLIArgs("cluster", opts, args, nil); err != nil {
+		return err
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+		cluster, err := c.Cluster(ctx)
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(w, cluster)
+		}
+		local := "not configured"
+		if cluster.Local != nil {
+			local = fmt.Sprintf("stratum %d", cluster.Local.Stratum)
+			if cluster.Local.Orphan {
+				local += " (orphan)"
+			}
+		}
+		stratum := "-"
+		if cluster.Stratum != nil {
+			stratum = strconv.Itoa(*cluster.Stratum)
+		}
+		fmt.Fprintf(w, "local reference: %s\n", local)
+		fmt.Fprintf(w, "synchronized: %t, stratum %s", cluster.Synchronized, stratum)
+		if cluster.Reference != "" {
+			fmt.Fprintf(w, ", reference %s", cluster.Reference)
+		}
+		fmt.Fprintln(w)
+		if cluster.Error != "" {
+			fmt.Fprintf(w, "chronyd: %s\n", cluster.Error)
+		}
+		fmt.Fprintln(w)
+		if len(cluster.Peers) == 0 {
+			fmt.Fprintln(w, "no peers configured")
+			return nil
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tSOURCE\tSTATE\tREACH\tSTRATUM\tLASTRX\tOFFSET")
+		for _, peer := range cluster.Peers {
+			peerStratum := "-"
+			if peer.Stratum != nil {
+				peerStratum = strconv.Itoa(*peer.Stratum)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", peer.Host, dashIfEmpty(peer.Source), peer.State,
+				dashIfEmpty(peer.Reach), peerStratum, dashIfEmpty(peer.LastRx), dashIfEmpty(peer.Offset))
+		}
+		return tw.Flush()
+	})
+}
+
+func cliConfig(ctx context.Context, opts *cliOptions, args []string) error {
+	rest, err := parseCLIArgs("config", opts, args, nil)
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return fmt.Errorf("usage: config get | plan FILE | apply FILE | pending | confirm | revert | history | diff FROM [TO] | restore REVISION")
+	}
+	action, rest := rest[0], rest[1:]
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	if action == "get" {
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			config, err := c.Config(ctx)
+			if err != nil {
+				return err
+			}
+			return printJSON(w, config)
+		})
+	}
+	switch action {
+	case "pending":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			pending, err := c.PendingChange(ctx)
+			if client.IsStatus(err, http.StatusNotFound) {
+				fmt.Fprintln(w, "no change awaiting confirmation")
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, pending)
+			}
+			fmt.Fprintf(w, "%s %s %s by %s, reverts in %.0fs\n", pending.ID, pending.Method, pending.Path, pending.Actor, pending.RemainingSeconds)
+			fmt.Fprint(w, pending.Diff)
+			return nil
+		})
+	case "confirm":
+		if err := c.ConfirmChange(ctx, ""); err != nil {
+			return err
+		}
+		fmt.Println("change confirmed")
+		return nil
+	case "revert":
+		result, err := c.RevertChange(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("change %s reverted (restart %s)\n", result.ID, okString(result.RestartSuccess))
+		return nil
+	case "history":
+		return cliRender(ctx, opts, func(ctx context.Context, w io.Writer) error {
+			revisions, err := c.ConfigRevisions(ctx, 0)
+			if err != nil {
+				return err
+			}
+			if opts.output == "json" {
+				return printJSON(w, revisions)
+			}
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "REVISION\tTIME\tAUTHOR\tCHANGE\tMESSAGE")
+			for _, revision := range revisions {
+				marker := ""
+				if revision.Current {
+					marker = " *"
+				}
+				change := strings.TrimSpace(revision.Method + " " + revision.Path)
+				fmt.Fprintf(tw, "%d%s\t%s\t%s\t%s\t%s\n", revision.Revision, marker, revision.Timestamp.Local().Format(time.RFC3339), revision.Author, change, revision.Message)
+			}
+			return tw.Flush()
+		})
+	case "diff":
+		if len(rest) < 1 || len(rest) > 2 {
+			return fmt.Errorf("usage: config diff FROM [TO]")
+		}
+		var revisions []int64
+		for _, arg := range rest {
+			revision, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid revision %q", arg)
+			}
+			revisions = append(revisions, revision)
+		}
+		revisions = append(revisions, 0)
+		diff, err := c.DiffConfigRevisions(ctx, revisions[0], revisions[1])
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(os.Stdout, diff)
+		}
+		fmt.Print(diff.Diff)
+		return nil
+	case "restore":
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: config restore REVISION")
+		}
+		revision, err := strconv.ParseInt(rest[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid revision %q", rest[0])
+		}
+		changeCtx, err := opts.conditional(ctx, c)
+		if err != nil {
+			return err
+		}
+		result, err := c.RestoreConfigRevision(changeCtx, revision)
+		if err != nil {
+			return err
+		}
+		if opts.output == "json" {
+			return printJSON(os.Stdout, result)
+		}
+		fmt.Print(result.Diff)
+		if result.RestartSuccess != nil {
+			fmt.Printf("revision %d restored (restart %s)\n", revision, okString(*result.RestartSuccess))
+		} else {
+			fmt.Printf("revision %d matches the current configuration\n", revision)
+		}
+		return nil
+	case "plan", "apply":
+	default:
+		return fmt.Errorf("unknown config action %q (use get, plan, apply, pending, confirm, revert, history, diff or restore)", action)
+	}
+	if len(rest) != 1 {
+		return fmt.Errorf("usage: config %s FILE", action)
+	}
+	var data []byte
+	if rest[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(rest[0])
+	}
+	if err != nil {
+		return err
+	}
+	var config client.Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid configuration document: %v", err)
+	}
+
+	var result *client.ConfigResult
+	if action == "plan" {
+		result, err = c.PlanConfig(ctx, config)
+	} else {
+		var changeCtx context.Context
+		if changeCtx, err = opts.conditional(ctx, c); err != nil {
+			return err
+		}
+		result, err = c.SetConfig(changeCtx, config)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(os.Stdout, result)
+	}
+	if !result.Changed {
+		fmt.Println("configuration unchanged")
+		return nil
+	}
+	for _, change := range result.Changes {
+		fmt.Printf("%s: %s -> %s\n", change.Field, change.From, change.To)
+	}
+	fmt.Print(result.Diff)
+	if result.RestartSuccess != nil {
+		fmt.Printf("configuration applied (restart %s)\n", okString(*result.RestartSuccess))
+	}
+	return nil
+}
+
+func cliEvents(ctx context.Context, opts *cliOptions, args []string) error {
+	var types string
+	rest, err := parseCLIArgs("events", opts, args, func(fs *flag.FlagSet) {
+		fs.StringVar(&types, "types", "", "Comma-separated event types")
+	})
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 || rest[0] != "tail" {
+		return fmt.Errorf("usage: events tail [--types T,T]")
+	}
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	var typeList []string
+	if types != "" {
+		typeList = strings.Split(types, ",")
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	return c.StreamEvents(ctx, typeList, func(event client.Event) error {
+		if opts.output == "json" {
+			return encoder.Encode(event)
+		}
+		data, _ := json.Marshal(event.Data)
+		fmt.Printf("%s  %-22s %s\n", event.Timestamp.Format(time.RFC3339), event.Type, data)
+		return nil
+	})
+}
+
+func enabledString(enabled bool) string {
+	if enabled {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func okString(ok bool) string {
+	if ok {
+		return "ok"
+	}
+	return "failed"
+}
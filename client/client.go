@@ -0,0 +1,329 @@
+// Package client is a Go SDK for the Brick Clock API.
+//
+// Typical usage:
+//
+//	c, err := client.New("http://localhost:17003",
+//		client.WithTokenSource(client.StaticToken(os.Getenv("BRICK_TOKEN"))))
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	status, err := c.Status(ctx, client.STATUS_ALL)
+//
+// Configuration changes name the revision they were based on, so that a
+// change made meanwhile by someone else is not overwritten:
+//
+//	etag, err := c.ConfigETag(ctx)
+//	...
+//	result, err := c.SetServers(client.WithIfMatch(ctx, etag), servers)
+//
+// All methods take a context, talk to the versioned /v1 API and return
+// *APIError for responses carrying the service's error envelope.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	API_PREFIX          = "/v1"
+	DEFAULT_MAX_RETRIES = 3
+	DEFAULT_BACKOFF     = 200 * time.Millisecond
+	MAX_BACKOFF         = 5 * time.Second
+)
+
+// TokenSource supplies the bearer token for each request
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// StaticToken is a TokenSource that always returns the same token
+type StaticToken string
+
+func (t StaticToken) Token(ctx context.Context) (string, error) {
+	return string(t), nil
+}
+
+// TokenFunc adapts a function to the TokenSource interface
+type TokenFunc func(ctx context.Context) (string, error)
+
+func (f TokenFunc) Token(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// APIError is returned for non-2xx responses
+type APIError struct {
+	StatusCode int             `json:"-"`
+	Code       string          `json:"code"`
+	Message    string          `json:"message"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	RequestID  string          `json:"request_id"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("brick-clock: HTTP %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("brick-clock: HTTP %d %s: %s (request %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+// IsStatus reports whether err is an *APIError with the given HTTP status
+func IsStatus(err error, status int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+// Client talks to a single Brick Clock instance
+type Client struct {
+	baseURL     *url.URL
+	httpClient  *http.Client
+	tokenSource TokenSource
+	maxRetries  int
+	backoff     time.Duration
+	userAgent   string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient sets the underlying HTTP client (e.g. one dialing a Unix socket)
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTokenSource sets the source of bearer tokens
+func WithTokenSource(ts TokenSource) Option {
+	return func(c *Client) { c.tokenSource = ts }
+}
+
+// WithRetries sets how often failed requests are retried and the initial backoff
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// WithUserAgent overrides the User-Agent header
+func WithUserAgent(ua string) Option {
+	return func(c *Client) { c.userAgent = ua }
+}
+
+// New creates a client for the service at baseURL (e.g. "http://localhost:17003")
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: scheme must be http or https", baseURL)
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: DEFAULT_MAX_RETRIES,
+		backoff:    DEFAULT_BACKOFF,
+		userAgent:  "brick-clock-client",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+type ifMatchKey struct{}
+
+// WithIfMatch makes configuration changes issued with ctx conditional on
+// etag (as returned by ConfigETag or the ETag of an earlier read). A change
+// made after someone else's then fails with HTTP 412. The service requires
+// If-Match on configuration changes and answers 428 without it; pass "*" to
+// overwrite unconditionally.
+func WithIfMatch(ctx context.Context, etag string) context.Context {
+	return context.WithValue(ctx, ifMatchKey{}, etag)
+}
+
+type confirmKey struct{}
+
+type confirmOptions struct {
+	timeout     time.Duration
+	autoConfirm bool
+}
+
+// WithConfirm makes configuration changes issued with ctx provisional: the
+// service reverts them unless ConfirmChange is called within timeout. With
+// autoConfirm the service also confirms on its own once chronyd is
+// synchronized to a selected source.
+func WithConfirm(ctx context.Context, timeout time.Duration, autoConfirm bool) context.Context {
+	return context.WithValue(ctx, confirmKey{}, confirmOptions{timeout: timeout, autoConfirm: autoConfirm})
+}
+
+type messageKey struct{}
+
+// WithMessage attaches a description to configuration changes issued with
+// ctx; it is stored with the resulting revision (see ConfigRevisions)
+func WithMessage(ctx context.Context, message string) context.Context {
+	return context.WithValue(ctx, messageKey{}, message)
+}
+
+type freshKey struct{}
+
+// WithFresh makes status reads issued with ctx bypass the server's cache;
+// the caller needs the clock/status_fresh permission
+func WithFresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, freshKey{}, true)
+}
+
+func (c *Client) endpoint(path string, query url.Values) string {
+	u := *c.baseURL
+	u.Path = c.baseURL.Path + API_PREFIX + path
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, path string, query url.Values, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	if method != http.MethodGet {
+		merged := url.Values{}
+		for k, v := range query {
+			merged[k] = v
+		}
+		if confirm, ok := ctx.Value(confirmKey{}).(confirmOptions); ok {
+			merged.Set("confirm_timeout", confirm.timeout.String())
+			if confirm.autoConfirm {
+				merged.Set("auto_confirm", "true")
+			}
+		}
+		if message, _ := ctx.Value(messageKey{}).(string); message != "" {
+			merged.Set("message", message)
+		}
+		query = merged
+	} else if fresh, _ := ctx.Value(freshKey{}).(bool); fresh && strings.HasPrefix(path, "/status") {
+		merged := url.Values{"fresh": {"true"}}
+		for k, v := range query {
+			merged[k] = v
+		}
+		query = merged
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint(path, query), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if etag, _ := ctx.Value(ifMatchKey{}).(string); etag != "" && method != http.MethodGet {
+		req.Header.Set("If-Match", etag)
+	}
+	if c.tokenSource != nil {
+		token, err := c.tokenSource.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("token source: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return req, nil
+}
+
+// Reads are retried on network errors, 429, 503 and 504. Changes may
+// restart chronyd, so they are only retried on 429, which the service sends
+// before doing anything.
+func retryable(method string, resp *http.Response, err error) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return err == nil && resp.StatusCode == http.StatusTooManyRequests
+	}
+	if err != nil {
+		var netErr net.Error
+		return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Parse an error envelope, falling back to the raw body
+func decodeError(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var envelope struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.Error != nil {
+		envelope.Error.StatusCode = resp.StatusCode
+		return envelope.Error
+	}
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(data)),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+}
+
+// do sends a request with retries and decodes a JSON response into out (if non-nil)
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, method, path, query, body)
+		if err != nil {
+			return err
+		}
+		resp, err := c.httpClient.Do(req)
+		if attempt < c.maxRetries && retryable(method, resp, err) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > MAX_BACKOFF {
+				backoff = MAX_BACKOFF
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return decodeError(resp)
+		}
+		if out == nil || resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+		if raw, ok := out.(*[]byte); ok {
+			*raw, err = ioutil.ReadAll(resp.Body)
+			return err
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+}
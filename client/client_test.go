@@ -0,0 +1,279 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Start a server and a client for it with fast retries
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c, err := New(server.URL, append([]Option{WithRetries(2, time.Millisecond)}, opts...)...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return c
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%q,"message":"test failure","request_id":"req-1"}}`, code)
+}
+
+func TestNewRejectsInvalidBaseURL(t *testing.T) {
+	for _, base := range []string{"localhost:17003", "ftp://host", "://"} {
+		if _, err := New(base); err == nil {
+			t.Errorf("New(%q) succeeded, want an error", base)
+		}
+	}
+}
+
+func TestTokenInjection(t *testing.T) {
+	var calls int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer tok-1" {
+			t.Errorf("Authorization = %q, want the token from the source", got)
+		}
+		if r.URL.Path != "/v1/servers" {
+			t.Errorf("path = %q, want /v1/servers", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"servers":["a.example","b.example"]}`)
+	}, WithTokenSource(TokenFunc(func(ctx context.Context) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "tok-1", nil
+	})))
+
+	servers, err := c.Servers(context.Background())
+	if err != nil {
+		t.Fatalf("Servers: %v", err)
+	}
+	if strings.Join(servers, ",") != "a.example,b.example" {
+		t.Errorf("servers = %v", servers)
+	}
+	if calls != 1 {
+		t.Errorf("token source called %d times, want once per request", calls)
+	}
+}
+
+func TestTokenSourceErrorStopsRequest(t *testing.T) {
+	var requests int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}, WithTokenSource(TokenFunc(func(ctx context.Context) (string, error) {
+		return "", errors.New("expired")
+	})))
+
+	if _, err := c.Servers(context.Background()); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("err = %v, want the token source error", err)
+	}
+	if requests != 0 {
+		t.Errorf("server got %d requests, want none", requests)
+	}
+}
+
+func TestAPIErrorDecoding(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeEnvelope(w, http.StatusForbidden, "forbidden")
+	})
+
+	_, err := c.Servers(context.Background())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusForbidden || apiErr.Code != "forbidden" || apiErr.RequestID != "req-1" {
+		t.Errorf("APIError = %+v", apiErr)
+	}
+	if !IsStatus(err, http.StatusForbidden) {
+		t.Error("IsStatus(err, 403) = false")
+	}
+}
+
+func TestReadsAreRetried(t *testing.T) {
+	var requests int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			writeEnvelope(w, http.StatusServiceUnavailable, "backend_error")
+			return
+		}
+		fmt.Fprint(w, `{"server_mode_enabled":true}`)
+	})
+
+	enabled, err := c.ServerMode(context.Background())
+	if err != nil || !enabled {
+		t.Fatalf("ServerMode = %v, %v; want true after retries", enabled, err)
+	}
+	if requests != 3 {
+		t.Errorf("server got %d requests, want 3", requests)
+	}
+}
+
+func TestReadsGiveUpAfterMaxRetries(t *testing.T) {
+	var requests int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		writeEnvelope(w, http.StatusGatewayTimeout, "backend_timeout")
+	})
+
+	if _, err := c.ServerMode(context.Background()); !IsStatus(err, http.StatusGatewayTimeout) {
+		t.Fatalf("err = %v, want the final 504", err)
+	}
+	if requests != 3 {
+		t.Errorf("server got %d requests, want 1 + 2 retries", requests)
+	}
+}
+
+func TestChangesAreNotRetriedAfterReachingTheServer(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			var requests int32
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				writeEnvelope(w, status, "backend_error")
+			})
+
+			_, err := c.SetServerMode(WithIfMatch(context.Background(), `"7"`), true)
+			if !IsStatus(err, status) {
+				t.Fatalf("err = %v, want %d", err, status)
+			}
+			if requests != 1 {
+				t.Errorf("server got %d requests, want 1: a change may already have restarted chronyd", requests)
+			}
+		})
+	}
+}
+
+func TestChangesAreRetriedOnTooManyRequests(t *testing.T) {
+	var requests int32
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			writeEnvelope(w, http.StatusTooManyRequests, "rate_limited")
+			return
+		}
+		fmt.Fprint(w, `{"success":true,"server_mode_enabled":false}`)
+	})
+
+	result, err := c.SetServerMode(WithIfMatch(context.Background(), `"7"`), false)
+	if err != nil || !result.Success {
+		t.Fatalf("SetServerMode = %+v, %v", result, err)
+	}
+	if requests != 2 {
+		t.Errorf("server got %d requests, want 2", requests)
+	}
+}
+
+func TestIfMatchOnlyWhenSupplied(t *testing.T) {
+	var mutex sync.Mutex
+	var got []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		got = append(got, r.Header.Get("If-Match"))
+		mutex.Unlock()
+		if r.Method == http.MethodGet {
+			w.Header().Set("ETag", `"12"`)
+			fmt.Fprint(w, `{"servers":[]}`)
+			return
+		}
+		fmt.Fprint(w, `{"success":true,"result":["a.example"]}`)
+	})
+	ctx := context.Background()
+
+	if _, err := c.SetServers(ctx, []string{"a.example"}); err != nil {
+		t.Fatalf("SetServers: %v", err)
+	}
+	etag, err := c.ConfigETag(ctx)
+	if err != nil || etag != `"12"` {
+		t.Fatalf("ConfigETag = %q, %v", etag, err)
+	}
+	if _, err := c.SetServers(WithIfMatch(ctx, etag), []string{"a.example"}); err != nil {
+		t.Fatalf("SetServers: %v", err)
+	}
+
+	want := []string{"", "", `"12"`}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("If-Match headers = %q, want %q", got, want)
+	}
+}
+
+func TestChangeOptionsBecomeQueryParameters(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("confirm_timeout") != "2m0s" || query.Get("auto_confirm") != "true" || query.Get("message") != "rollout" {
+			t.Errorf("query = %q", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"success":true,"server_mode_enabled":true}`)
+	})
+
+	ctx := WithIfMatch(context.Background(), "*")
+	ctx = WithMessage(WithConfirm(ctx, 2*time.Minute, true), "rollout")
+	if _, err := c.SetServerMode(ctx, true); err != nil {
+		t.Fatalf("SetServerMode: %v", err)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("types") != "sync.lost,sync.restored" {
+			t.Errorf("types = %q", r.URL.Query().Get("types"))
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, ": connected\n\n")
+		io.WriteString(w, "id: e1\nevent: sync.lost\ndata: {\"id\":\"e1\",\"type\":\"sync.lost\",\"data\":{\"stratum\":\"3\"}}\n\n")
+		io.WriteString(w, ": keepalive\n\n")
+		io.WriteString(w, "id: e2\nevent: sync.restored\ndata: {\"id\":\"e2\",\"type\":\"sync.restored\",\"data\":{}}\n\n")
+	})
+
+	var received []Event
+	err := c.StreamEvents(context.Background(), []string{"sync.lost", "sync.restored"}, func(e Event) error {
+		received = append(received, e)
+		return nil
+	})
+	if err != io.EOF {
+		t.Fatalf("StreamEvents = %v, want io.EOF when the server closes the stream", err)
+	}
+	if len(received) != 2 || received[0].Type != "sync.lost" || received[0].Data["stratum"] != "3" || received[1].ID != "e2" {
+		t.Errorf("received = %+v", received)
+	}
+}
+
+func TestStreamEventsStopsOnHandlerError(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: {\"id\":\"e%d\",\"type\":\"health.changed\"}\n\n", i)
+		}
+	})
+
+	stop := errors.New("stop")
+	count := 0
+	err := c.StreamEvents(context.Background(), nil, func(e Event) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("StreamEvents = %v after %d events, want the handler's error after 1", err, count)
+	}
+}
+
+func TestStreamEventsRejectsErrors(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeEnvelope(w, http.StatusUnauthorized, "unauthorized")
+	})
+
+	err := c.StreamEvents(context.Background(), nil, func(e Event) error { return nil })
+	if !IsStatus(err, http.StatusUnauthorized) {
+		t.Errorf("StreamEvents = %v, want 401", err)
+	}
+}
@@ -0,0 +1,471 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Health returns the body of GET /health ("OK" when healthy)
+func (c *Client) Health(ctx context.Context) (string, error) {
+	var body []byte
+	err := c.do(ctx, http.MethodGet, "/health", nil, nil, &body)
+	return strings.TrimSpace(string(body)), err
+}
+
+func (c *Client) Version(ctx context.Context) (*VersionInfo, error) {
+	var out VersionInfo
+	return &out, c.do(ctx, http.MethodGet, "/version", nil, nil, &out)
+}
+
+func (c *Client) AppVersion(ctx context.Context) (*AppVersion, error) {
+	var out AppVersion
+	return &out, c.do(ctx, http.MethodGet, "/app-version", nil, nil, &out)
+}
+
+// WhoAmI returns the caller's identity and effective permissions
+func (c *Client) WhoAmI(ctx context.Context) (*WhoAmI, error) {
+	var out WhoAmI
+	return &out, c.do(ctx, http.MethodGet, "/whoami", nil, nil, &out)
+}
+
+// OpenAPI returns the raw OpenAPI document
+func (c *Client) OpenAPI(ctx context.Context) ([]byte, error) {
+	var body []byte
+	return body, c.do(ctx, http.MethodGet, "/openapi.json", nil, nil, &body)
+}
+
+// Status returns the sections selected by flags (see STATUS_* constants)
+func (c *Client) Status(ctx context.Context, flags int) (*Status, error) {
+	query := url.Values{}
+	if flags != 0 {
+		query.Set("flags", strconv.Itoa(flags))
+	}
+	var out Status
+	return &out, c.do(ctx, http.MethodGet, "/status", query, nil, &out)
+}
+
+func (c *Client) Tracking(ctx context.Context) (map[string]string, error) {
+	var out struct {
+		Tracking map[string]string `json:"tracking"`
+	}
+	err := c.do(ctx, http.MethodGet, "/status/tracking", nil, nil, &out)
+	return out.Tracking, err
+}
+
+func (c *Client) Sources(ctx context.Context) ([]map[string]string, error) {
+	var out struct {
+		Sources []map[string]string `json:"sources"`
+	}
+	err := c.do(ctx, http.MethodGet, "/status/sources", nil, nil, &out)
+	return out.Sources, err
+}
+
+func (c *Client) Activity(ctx context.Context) (map[string]string, error) {
+	var out struct {
+		Activity map[string]string `json:"activity"`
+	}
+	err := c.do(ctx, http.MethodGet, "/status/activity", nil, nil, &out)
+	return out.Activity, err
+}
+
+func (c *Client) Clients(ctx context.Context) ([]map[string]string, error) {
+	var out struct {
+		Clients []map[string]string `json:"clients"`
+	}
+	err := c.do(ctx, http.MethodGet, "/status/clients", nil, nil, &out)
+	return out.Clients, err
+}
+
+// SyncHealth returns the health state with its recent transitions
+func (c *Client) SyncHealth(ctx context.Context) (*SyncHealth, error) {
+	var out SyncHealth
+	return &out, c.do(ctx, http.MethodGet, "/status/health", nil, nil, &out)
+}
+
+// Probe queries servers over SNTP from the API host; with no servers it
+// probes the configured reference servers
+func (c *Client) Probe(ctx context.Context, servers ...string) (*ProbeResults, error) {
+	query := url.Values{}
+	for _, server := range servers {
+		query.Add("server", server)
+	}
+	var out ProbeResults
+	return &out, c.do(ctx, http.MethodGet, "/probe", query, nil, &out)
+}
+
+// Servers returns the servers configured in chrony.conf
+func (c *Client) Servers(ctx context.Context) ([]string, error) {
+	var out struct {
+		Servers []string `json:"servers"`
+	}
+	err := c.do(ctx, http.MethodGet, "/servers", nil, nil, &out)
+	return out.Servers, err
+}
+
+// ConfigETag returns the current configuration revision for use with WithIfMatch
+func (c *Client) ConfigETag(ctx context.Context) (string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/servers", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", decodeError(resp)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *Client) SetServers(ctx context.Context, servers []string) (*SetServersResult, error) {
+	var out SetServersResult
+	in := map[string][]string{"servers": servers}
+	return &out, c.do(ctx, http.MethodPut, "/servers", nil, in, &out)
+}
+
+func (c *Client) DeleteServers(ctx context.Context) (*DeleteServersResult, error) {
+	var out DeleteServersResult
+	return &out, c.do(ctx, http.MethodDelete, "/servers", nil, nil, &out)
+}
+
+// DefaultServerProfile returns the profile ResetDefaultServers restores
+func (c *Client) DefaultServerProfile(ctx context.Context) (*ServerProfile, error) {
+	var out ServerProfile
+	return &out, c.do(ctx, http.MethodGet, "/servers/default", nil, nil, &out)
+}
+
+// ResetDefaultServers replaces the server list with the default profile's servers
+func (c *Client) ResetDefaultServers(ctx context.Context) (*SetServersResult, error) {
+	var out SetServersResult
+	return &out, c.do(ctx, http.MethodPut, "/servers/default", nil, nil, &out)
+}
+
+func (c *Client) ServerProfiles(ctx context.Context) (*ServerProfiles, error) {
+	var out ServerProfiles
+	return &out, c.do(ctx, http.MethodGet, "/servers/profiles", nil, nil, &out)
+}
+
+func (c *Client) ServerProfile(ctx context.Context, name string) (*ServerProfile, error) {
+	var out ServerProfile
+	return &out, c.do(ctx, http.MethodGet, "/servers/profiles/"+url.PathEscape(name), nil, nil, &out)
+}
+
+func (c *Client) CreateServerProfile(ctx context.Context, req ServerProfileRequest) (*ServerProfile, error) {
+	var out ServerProfile
+	return &out, c.do(ctx, http.MethodPost, "/servers/profiles", nil, req, &out)
+}
+
+// PutServerProfile creates or replaces the named profile
+func (c *Client) PutServerProfile(ctx context.Context, name string, req ServerProfileRequest) (*ServerProfile, error) {
+	var out ServerProfile
+	return &out, c.do(ctx, http.MethodPut, "/servers/profiles/"+url.PathEscape(name), nil, req, &out)
+}
+
+func (c *Client) DeleteServerProfile(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/servers/profiles/"+url.PathEscape(name), nil, nil, nil)
+}
+
+// ApplyServerProfile replaces the server list with the profile's servers
+func (c *Client) ApplyServerProfile(ctx context.Context, name string) (*SetServersResult, error) {
+	var out SetServersResult
+	return &out, c.do(ctx, http.MethodPost, "/servers/profiles/"+url.PathEscape(name)+"/apply", nil, nil, &out)
+}
+
+// RankCandidates probes candidate servers and ranks them; with no candidates
+// it ranks the selection candidates and the configured servers. A count of 0
+// selects as many as the selection policy does.
+func (c *Client) RankCandidates(ctx context.Context, count int, candidates ...string) (*CandidateRanking, error) {
+	query := url.Values{}
+	for _, candidate := range candidates {
+		query.Add("candidate", candidate)
+	}
+	if count != 0 {
+		query.Set("count", strconv.Itoa(count))
+	}
+	var out CandidateRanking
+	return &out, c.do(ctx, http.MethodGet, "/servers/candidates", query, nil, &out)
+}
+
+// ServerSelection returns the automatic selection policy and its last run
+func (c *Client) ServerSelection(ctx context.Context) (*ServerSelection, error) {
+	var out ServerSelection
+	return &out, c.do(ctx, http.MethodGet, "/servers/selection", nil, nil, &out)
+}
+
+// SetServerSelection replaces the automatic selection policy
+func (c *Client) SetServerSelection(ctx context.Context, policy ServerSelectionPolicy) (*ServerSelectionPolicy, error) {
+	var out struct {
+		Policy ServerSelectionPolicy `json:"policy"`
+	}
+	err := c.do(ctx, http.MethodPut, "/servers/selection", nil, policy, &out)
+	return &out.Policy, err
+}
+
+// Failover returns the failover policy and where it stands
+func (c *Client) Failover(ctx context.Context) (*FailoverStatus, error) {
+	var out FailoverStatus
+	return &out, c.do(ctx, http.MethodGet, "/servers/failover", nil, nil, &out)
+}
+
+// SetFailover replaces the failover policy
+func (c *Client) SetFailover(ctx context.Context, policy FailoverPolicy) (*FailoverPolicy, error) {
+	var out struct {
+		Policy FailoverPolicy `json:"policy"`
+	}
+	err := c.do(ctx, http.MethodPut, "/servers/failover", nil, policy, &out)
+	return &out.Policy, err
+}
+
+// Discovery returns the discovery policy and what each provider found
+func (c *Client) Discovery(ctx context.Context) (*DiscoveryStatus, error) {
+	var out DiscoveryStatus
+	return &out, c.do(ctx, http.MethodGet, "/servers/discovery", nil, nil, &out)
+}
+
+// RefreshDiscovery asks every discovery provider again now
+func (c *Client) RefreshDiscovery(ctx context.Context) (*DiscoveryStatus, error) {
+	var out DiscoveryStatus
+	return &out, c.do(ctx, http.MethodPost, "/servers/discovery", nil, nil, &out)
+}
+
+// SetDiscovery replaces the discovery policy
+func (c *Client) SetDiscovery(ctx context.Context, policy DiscoveryPolicy) (*DiscoveryPolicy, error) {
+	var out struct {
+		Policy DiscoveryPolicy `json:"policy"`
+	}
+	err := c.do(ctx, http.MethodPut, "/servers/discovery", nil, policy, &out)
+	return &out.Policy, err
+}
+
+func (c *Client) ServerMode(ctx context.Context) (bool, error) {
+	var out struct {
+		ServerModeEnabled bool `json:"server_mode_enabled"`
+	}
+	err := c.do(ctx, http.MethodGet, "/server-mode", nil, nil, &out)
+	return out.ServerModeEnabled, err
+}
+
+func (c *Client) SetServerMode(ctx context.Context, enabled bool) (*SetServerModeResult, error) {
+	var out SetServerModeResult
+	in := map[string]bool{"enabled": enabled}
+	return &out, c.do(ctx, http.MethodPut, "/server-mode", nil, in, &out)
+}
+
+// Config returns the configuration document
+func (c *Client) Config(ctx context.Context) (*Config, error) {
+	var out Config
+	return &out, c.do(ctx, http.MethodGet, "/config", nil, nil, &out)
+}
+
+// SetConfig replaces the configuration document, reloading chronyd once if anything changed
+func (c *Client) SetConfig(ctx context.Context, config Config) (*ConfigResult, error) {
+	var out ConfigResult
+	return &out, c.do(ctx, http.MethodPut, "/config", nil, config, &out)
+}
+
+// PlanConfig returns the changes and chrony.conf diff SetConfig would make, without applying them
+func (c *Client) PlanConfig(ctx context.Context, config Config) (*ConfigResult, error) {
+	var out ConfigResult
+	query := url.Values{"dry_run": {"true"}}
+	return &out, c.do(ctx, http.MethodPut, "/config", query, config, &out)
+}
+
+// Cluster returns the local reference and the state of each peer
+func (c *Client) Cluster(ctx context.Context) (*ClusterStatus, error) {
+	var out ClusterStatus
+	return &out, c.do(ctx, http.MethodGet, "/cluster", nil, nil, &out)
+}
+
+// SetCluster replaces the peers and the local reference
+func (c *Client) SetCluster(ctx context.Context, config ClusterConfig) (*ConfigResult, error) {
+	var out ConfigResult
+	return &out, c.do(ctx, http.MethodPut, "/cluster", nil, config, &out)
+}
+
+// PlanCluster returns the changes SetCluster would make, without applying them
+func (c *Client) PlanCluster(ctx context.Context, config ClusterConfig) (*ConfigResult, error) {
+	var out ConfigResult
+	query := url.Values{"dry_run": {"true"}}
+	return &out, c.do(ctx, http.MethodPut, "/cluster", query, config, &out)
+}
+
+// PendingChange returns the change awaiting confirmation; the error is a 404 APIError when there is none
+func (c *Client) PendingChange(ctx context.Context) (*PendingChange, error) {
+	var out PendingChange
+	return &out, c.do(ctx, http.MethodGet, "/config/pending", nil, nil, &out)
+}
+
+// ConfirmChange keeps a change made with WithConfirm. An empty id confirms whichever change is pending.
+func (c *Client) ConfirmChange(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/config/confirm", nil, map[string]string{"id": id}, nil)
+}
+
+// RevertChange restores the configuration from before the pending change without waiting for the deadline
+func (c *Client) RevertChange(ctx context.Context) (*RevertResult, error) {
+	var out RevertResult
+	return &out, c.do(ctx, http.MethodDelete, "/config/pending", nil, nil, &out)
+}
+
+// ConfigRevisions lists stored revisions, newest first (limit 0 for all)
+func (c *Client) ConfigRevisions(ctx context.Context, limit int) ([]ConfigRevision, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var out struct {
+		Revisions []ConfigRevision `json:"revisions"`
+	}
+	err := c.do(ctx, http.MethodGet, "/config/revisions", query, nil, &out)
+	return out.Revisions, err
+}
+
+func (c *Client) ConfigRevision(ctx context.Context, revision int64) (*ConfigRevision, error) {
+	var out ConfigRevision
+	return &out, c.do(ctx, http.MethodGet, "/config/revisions/"+strconv.FormatInt(revision, 10), nil, nil, &out)
+}
+
+// DiffConfigRevisions compares two revisions; to 0 compares against the current configuration
+func (c *Client) DiffConfigRevisions(ctx context.Context, from int64, to int64) (*ConfigRevisionDiff, error) {
+	query := url.Values{"from": {strconv.FormatInt(from, 10)}}
+	if to > 0 {
+		query.Set("to", strconv.FormatInt(to, 10))
+	}
+	var out ConfigRevisionDiff
+	return &out, c.do(ctx, http.MethodGet, "/config/revisions/diff", query, nil, &out)
+}
+
+// RestoreConfigRevision makes an older revision the current configuration
+func (c *Client) RestoreConfigRevision(ctx context.Context, revision int64) (*ConfigResult, error) {
+	var out ConfigResult
+	path := "/config/revisions/" + strconv.FormatInt(revision, 10) + "/restore"
+	return &out, c.do(ctx, http.MethodPost, path, nil, nil, &out)
+}
+
+func (c *Client) Webhooks(ctx context.Context) ([]Webhook, error) {
+	var out struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+	err := c.do(ctx, http.MethodGet, "/webhooks", nil, nil, &out)
+	return out.Webhooks, err
+}
+
+func (c *Client) Webhook(ctx context.Context, id string) (*Webhook, error) {
+	var out Webhook
+	return &out, c.do(ctx, http.MethodGet, "/webhooks/"+url.PathEscape(id), nil, nil, &out)
+}
+
+func (c *Client) CreateWebhook(ctx context.Context, req WebhookRequest) (*Webhook, error) {
+	var out Webhook
+	return &out, c.do(ctx, http.MethodPost, "/webhooks", nil, req, &out)
+}
+
+func (c *Client) UpdateWebhook(ctx context.Context, id string, req WebhookRequest) (*Webhook, error) {
+	var out Webhook
+	return &out, c.do(ctx, http.MethodPut, "/webhooks/"+url.PathEscape(id), nil, req, &out)
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/webhooks/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// TestWebhook sends a single synchronous test delivery
+func (c *Client) TestWebhook(ctx context.Context, id string) (*WebhookDelivery, error) {
+	var out WebhookDelivery
+	return &out, c.do(ctx, http.MethodPost, "/webhooks/"+url.PathEscape(id)+"/test", nil, nil, &out)
+}
+
+func (c *Client) WebhookDeadLetters(ctx context.Context) ([]WebhookDelivery, error) {
+	var out struct {
+		DeadLetters []WebhookDelivery `json:"dead_letters"`
+	}
+	err := c.do(ctx, http.MethodGet, "/webhooks/dead-letters", nil, nil, &out)
+	return out.DeadLetters, err
+}
+
+func (c *Client) ClearWebhookDeadLetters(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/webhooks/dead-letters", nil, nil, nil)
+}
+
+func (c *Client) Alerts(ctx context.Context, includeResolved bool) (*Alerts, error) {
+	query := url.Values{}
+	if includeResolved {
+		query.Set("include_resolved", "1")
+	}
+	var out Alerts
+	return &out, c.do(ctx, http.MethodGet, "/alerts", query, nil, &out)
+}
+
+func (c *Client) AlertRules(ctx context.Context) (*AlertRules, error) {
+	var out AlertRules
+	return &out, c.do(ctx, http.MethodGet, "/alerts/rules", nil, nil, &out)
+}
+
+func (c *Client) SetAlertRules(ctx context.Context, rules []AlertRule) (*AlertRules, error) {
+	var out AlertRules
+	in := AlertRules{Rules: rules}
+	return &out, c.do(ctx, http.MethodPut, "/alerts/rules", nil, in, &out)
+}
+
+func (c *Client) Silences(ctx context.Context) ([]Silence, error) {
+	var out struct {
+		Silences []Silence `json:"silences"`
+	}
+	err := c.do(ctx, http.MethodGet, "/alerts/silences", nil, nil, &out)
+	return out.Silences, err
+}
+
+func (c *Client) CreateSilence(ctx context.Context, req SilenceRequest) (*Silence, error) {
+	var out Silence
+	return &out, c.do(ctx, http.MethodPost, "/alerts/silences", nil, req, &out)
+}
+
+func (c *Client) DeleteSilence(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/alerts/silences/"+url.PathEscape(id), nil, nil, nil)
+}
+
+func (q AuditQuery) values() url.Values {
+	query := url.Values{}
+	if q.Actor != "" {
+		query.Set("actor", q.Actor)
+	}
+	if q.Action != "" {
+		query.Set("action", q.Action)
+	}
+	if q.RequestID != "" {
+		query.Set("request_id", q.RequestID)
+	}
+	if q.Success != nil {
+		query.Set("success", strconv.FormatBool(*q.Success))
+	}
+	if !q.Since.IsZero() {
+		query.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		query.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return query
+}
+
+// Audit returns matching audit entries, newest first
+func (c *Client) Audit(ctx context.Context, q AuditQuery) (*AuditLog, error) {
+	var out AuditLog
+	return &out, c.do(ctx, http.MethodGet, "/audit", q.values(), nil, &out)
+}
+
+// ExportAudit returns every matching entry, oldest first, as JSON Lines
+func (c *Client) ExportAudit(ctx context.Context, q AuditQuery) ([]byte, error) {
+	query := q.values()
+	query.Del("limit")
+	query.Set("format", "jsonl")
+	var body []byte
+	return body, c.do(ctx, http.MethodGet, "/audit", query, nil, &body)
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// StreamEvents subscribes to the server-sent event stream and calls handler
+// for every event. It blocks until ctx is cancelled (returning ctx.Err()),
+// the handler returns an error, or the server closes the stream
+// (returning io.EOF). Establishing the connection is retried with backoff.
+func (c *Client) StreamEvents(ctx context.Context, types []string, handler func(Event) error) error {
+	query := url.Values{}
+	if len(types) > 0 {
+		query.Set("types", strings.Join(types, ","))
+	}
+
+	// The stream is long-lived, so the client-wide timeout must not apply
+	streamClient := *c.httpClient
+	streamClient.Timeout = 0
+
+	var resp *http.Response
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, http.MethodGet, "/events", query, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		resp, err = streamClient.Do(req)
+		if attempt < c.maxRetries && retryable(http.MethodGet, resp, err) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > MAX_BACKOFF {
+				backoff = MAX_BACKOFF
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		return fmt.Errorf("unexpected content type %q for event stream", ct)
+	}
+
+	err := readEventStream(resp.Body, handler)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Parse a text/event-stream body, dispatching each complete event
+func readEventStream(body io.Reader, handler func(Event) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(data.String()), &event); err != nil {
+				return fmt.Errorf("invalid event payload: %v", err)
+			}
+			data.Reset()
+			if err := handler(event); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, ":"):
+			// Comment / keepalive
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// id: and event: are carried inside the JSON payload as well
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
@@ -0,0 +1,602 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Section flags for Status
+const (
+	STATUS_TRACKING    = 1
+	STATUS_SOURCES     = 2
+	STATUS_ACTIVITY    = 4
+	STATUS_CLIENTS     = 8
+	STATUS_SERVER_MODE = 16
+	STATUS_HEALTH      = 32
+	STATUS_ALL         = STATUS_TRACKING | STATUS_SOURCES | STATUS_ACTIVITY | STATUS_CLIENTS | STATUS_SERVER_MODE | STATUS_HEALTH
+)
+
+type BuildInfo struct {
+	Version        string `json:"version"`
+	BuildDateTime  string `json:"buildDateTime"`
+	BuildTimestamp int64  `json:"buildTimestamp"`
+	Environment    string `json:"environment"`
+	Service        string `json:"service"`
+	Description    string `json:"description"`
+}
+
+type VersionInfo struct {
+	Version   string     `json:"version"`
+	BuildInfo *BuildInfo `json:"buildInfo,omitempty"`
+	Error     string     `json:"error"`
+}
+
+type AppVersion struct {
+	Version       string `json:"version"`
+	BuildDateTime string `json:"build_datetime"`
+}
+
+// Status holds the sections selected by the flags passed to Status
+type Status struct {
+	Tracking          map[string]string   `json:"tracking,omitempty"`
+	Sources           []map[string]string `json:"sources,omitempty"`
+	Activity          map[string]string   `json:"activity,omitempty"`
+	Clients           []map[string]string `json:"clients,omitempty"`
+	ServerModeEnabled bool                `json:"server_mode_enabled,omitempty"`
+	Health            *SyncHealth         `json:"health,omitempty"`
+	// Freshness of each included section, keyed by section name
+	// ("tracking", "sources", "activity", "clients", "server_mode")
+	Meta map[string]DatasetMeta `json:"meta,omitempty"`
+	// Sections that could not be read, keyed by section name
+	Errors map[string]BackendError `json:"errors,omitempty"`
+}
+
+// Sync health states
+const (
+	HEALTH_UNSYNCHRONIZED = "unsynchronized"
+	HEALTH_ACQUIRING      = "acquiring"
+	HEALTH_SYNCHRONIZED   = "synchronized"
+	HEALTH_DEGRADED       = "degraded"
+	HEALTH_HOLDOVER       = "holdover"
+)
+
+// SyncHealth answers whether the clock can be trusted: a state, a 0-100
+// score and the reasons the state is not "synchronized"
+type SyncHealth struct {
+	State            string            `json:"state"`
+	Score            int               `json:"score"`
+	Reasons          []string          `json:"reasons"`
+	Since            time.Time         `json:"since"`
+	EvaluatedAt      time.Time         `json:"evaluated_at"`
+	LastSynchronized *time.Time        `json:"last_synchronized,omitempty"`
+	Observed         HealthObservation `json:"observed"`
+	// Most recent first; only filled in by SyncHealth
+	Transitions []HealthTransition `json:"transitions,omitempty"`
+}
+
+type HealthObservation struct {
+	Synchronized     bool     `json:"synchronized"`
+	SelectedSource   string   `json:"selected_source,omitempty"`
+	ReachableSources int      `json:"reachable_sources"`
+	OffsetMs         *float64 `json:"offset_ms,omitempty"`
+	LeapStatus       string   `json:"leap_status,omitempty"`
+	Stratum          string   `json:"stratum,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+type HealthTransition struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	At      time.Time `json:"at"`
+	Score   int       `json:"score"`
+	Reasons []string  `json:"reasons"`
+}
+
+// ProbeResult is one server's answer to an SNTP query. OffsetMs is how far
+// the server's clock is ahead of the local clock; Error is set when the
+// server did not answer usefully.
+type ProbeResult struct {
+	Server           string     `json:"server"`
+	Address          string     `json:"address,omitempty"`
+	Stratum          int        `json:"stratum,omitempty"`
+	ReferenceID      string     `json:"reference_id,omitempty"`
+	Reference        string     `json:"reference,omitempty"`
+	LeapStatus       string     `json:"leap_status,omitempty"`
+	Version          int        `json:"version,omitempty"`
+	OffsetMs         float64    `json:"offset_ms"`
+	DelayMs          float64    `json:"delay_ms"`
+	RootDelayMs      float64    `json:"root_delay_ms"`
+	RootDispersionMs float64    `json:"root_dispersion_ms"`
+	ServerTime       *time.Time `json:"server_time,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// ProbeResults holds the SNTP answers next to chronyd's own offset estimate
+type ProbeResults struct {
+	Results         []ProbeResult `json:"results"`
+	ChronydOffsetMs *float64      `json:"chronyd_offset_ms,omitempty"`
+	ChronydError    string        `json:"chronyd_error,omitempty"`
+}
+
+// DatasetMeta tells how old a status section is. Source is "live" when the
+// data was fetched for this request and "cache" otherwise; CollectedAt and
+// Age are nil when the data was never collected.
+type DatasetMeta struct {
+	CollectedAt *time.Time `json:"collected_at"`
+	Age         *float64   `json:"age"`
+	Stale       bool       `json:"stale"`
+	Source      string     `json:"source"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// BackendError describes a status section the server could not read; Code is
+// "backend_timeout" when chronyd did not answer in time
+type BackendError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type SetServersResult struct {
+	// Set when the servers came from a server profile
+	Profile        string   `json:"profile,omitempty"`
+	Result         []string `json:"result"`
+	RestartSuccess bool     `json:"restart_success"`
+}
+
+// ServerProfile is a named server list; the default profile is what
+// ResetDefaultServers restores and what a new node starts with
+type ServerProfile struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Servers     []string `json:"servers"`
+	Default     bool     `json:"default"`
+}
+
+type ServerProfiles struct {
+	DefaultProfile string          `json:"default_profile"`
+	Profiles       []ServerProfile `json:"profiles"`
+}
+
+// ServerProfileRequest creates or replaces a profile. Name is only used by
+// CreateServerProfile. Default true makes the profile the default; nil
+// leaves that as it is.
+type ServerProfileRequest struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description"`
+	Servers     []string `json:"servers"`
+	Default     *bool    `json:"default,omitempty"`
+}
+
+// CandidateRank is how one server fared in a candidate ranking. Score is
+// 0-100 and only set for usable candidates; Problems explains the rest.
+type CandidateRank struct {
+	Server      string   `json:"server"`
+	Rank        int      `json:"rank,omitempty"`
+	Score       float64  `json:"score"`
+	Usable      bool     `json:"usable"`
+	Current     bool     `json:"current"`
+	Samples     int      `json:"samples"`
+	Answered    int      `json:"answered"`
+	Stratum     int      `json:"stratum,omitempty"`
+	Reference   string   `json:"reference,omitempty"`
+	OffsetMs    *float64 `json:"offset_ms,omitempty"`
+	DelayMs     *float64 `json:"delay_ms,omitempty"`
+	JitterMs    *float64 `json:"jitter_ms,omitempty"`
+	DeviationMs *float64 `json:"deviation_ms,omitempty"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+// CandidateRanking lists candidates best first; Selected holds the best
+// usable ones
+type CandidateRanking struct {
+	RankedAt          time.Time       `json:"ranked_at"`
+	Candidates        []CandidateRank `json:"candidates"`
+	ConsensusOffsetMs *float64        `json:"consensus_offset_ms,omitempty"`
+	Selected          []string        `json:"selected"`
+}
+
+// ServerSelectionPolicy controls automatic server selection; durations are
+// strings such as "1h"
+type ServerSelectionPolicy struct {
+	Enabled        bool     `json:"enabled"`
+	Candidates     []string `json:"candidates"`
+	Count          int      `json:"count"`
+	Interval       string   `json:"interval"`
+	MinImprovement float64  `json:"min_improvement"`
+	HoldDown       string   `json:"hold_down"`
+}
+
+// SelectionRun is the outcome of a scheduled selection run
+type SelectionRun struct {
+	At            time.Time `json:"at"`
+	Applied       bool      `json:"applied"`
+	Decision      string    `json:"decision"`
+	Current       []string  `json:"current"`
+	Selected      []string  `json:"selected"`
+	CurrentScore  float64   `json:"current_score"`
+	SelectedScore float64   `json:"selected_score"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type ServerSelection struct {
+	Policy     ServerSelectionPolicy `json:"policy"`
+	LastRun    *SelectionRun         `json:"last_run,omitempty"`
+	LastSwitch *time.Time            `json:"last_switch,omitempty"`
+	NextRun    *time.Time            `json:"next_run,omitempty"`
+	Ranking    *CandidateRanking     `json:"ranking,omitempty"`
+}
+
+const (
+	FAILOVER_PRIMARY = "primary"
+	FAILOVER_BACKUP  = "backup"
+	// The configured servers are neither group, so failover is suspended
+	FAILOVER_NONE = "none"
+)
+
+// FailoverPolicy switches to the Backup servers after every primary source
+// has been unreachable for OutageWindow, and back once a primary has
+// answered for RecoveryWindow
+type FailoverPolicy struct {
+	Enabled        bool     `json:"enabled"`
+	Primary        []string `json:"primary"`
+	Backup         []string `json:"backup"`
+	OutageWindow   string   `json:"outage_window"`
+	RecoveryWindow string   `json:"recovery_window"`
+}
+
+type FailoverSwitch struct {
+	From           string    `json:"from"`
+	To             string    `json:"to"`
+	At             time.Time `json:"at"`
+	Reason         string    `json:"reason"`
+	Servers        []string  `json:"servers"`
+	RestartSuccess bool      `json:"restart_success"`
+}
+
+// FailoverStatus tells which group is active and how close a switch is
+type FailoverStatus struct {
+	Policy          FailoverPolicy  `json:"policy"`
+	Active          string          `json:"active"`
+	CheckedAt       *time.Time      `json:"checked_at,omitempty"`
+	OutageSince     *time.Time      `json:"outage_since,omitempty"`
+	RecoveringSince *time.Time      `json:"recovering_since,omitempty"`
+	PrimaryProbes   []ProbeResult   `json:"primary_probes,omitempty"`
+	LastSwitch      *FailoverSwitch `json:"last_switch,omitempty"`
+	Error           string          `json:"error,omitempty"`
+}
+
+const (
+	DISCOVERY_SRV    = "srv"
+	DISCOVERY_FILE   = "file"
+	DISCOVERY_STATIC = "static"
+)
+
+// DiscoveryProvider is one source of server names: an SRV record (Name), a
+// file (Path) or a static list (Servers). Refresh defaults to 5m for SRV
+// records and 10s for files.
+type DiscoveryProvider struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Servers []string `json:"servers,omitempty"`
+	Refresh string   `json:"refresh,omitempty"`
+}
+
+// DiscoveryPolicy merges the servers of its providers, in order and without
+// duplicates, into the configured servers
+type DiscoveryPolicy struct {
+	Enabled    bool                `json:"enabled"`
+	Providers  []DiscoveryProvider `json:"providers"`
+	MaxServers int                 `json:"max_servers"`
+}
+
+type DiscoveryProviderStatus struct {
+	Type        string     `json:"type"`
+	Source      string     `json:"source"`
+	Servers     []string   `json:"servers"`
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"`
+	NextRefresh *time.Time `json:"next_refresh,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Warnings    []string   `json:"warnings,omitempty"`
+}
+
+type DiscoveryChange struct {
+	At             time.Time `json:"at"`
+	Servers        []string  `json:"servers"`
+	Previous       []string  `json:"previous"`
+	Applied        bool      `json:"applied"`
+	RestartSuccess bool      `json:"restart_success"`
+}
+
+// DiscoveryStatus tells what each provider found and which servers were
+// taken over
+type DiscoveryStatus struct {
+	Policy     DiscoveryPolicy           `json:"policy"`
+	Providers  []DiscoveryProviderStatus `json:"providers"`
+	Servers    []string                  `json:"servers"`
+	CheckedAt  *time.Time                `json:"checked_at,omitempty"`
+	LastChange *DiscoveryChange          `json:"last_change,omitempty"`
+	Error      string                    `json:"error,omitempty"`
+}
+
+type DeleteServersResult struct {
+	Output         string `json:"output"`
+	Error          string `json:"error"`
+	RestartSuccess bool   `json:"restart_success"`
+}
+
+type SetServerModeResult struct {
+	Success           bool `json:"success"`
+	ServerModeEnabled bool `json:"server_mode_enabled"`
+}
+
+// Config is the desired-state document served by GET /config. Directives it
+// does not cover are left untouched in chrony.conf; empty fields remove
+// their directives.
+type Config struct {
+	Servers    []ServerConfig  `json:"servers"`
+	Peers      []PeerConfig    `json:"peers"`
+	ServerMode bool            `json:"server_mode"`
+	Allow      []string        `json:"allow"`
+	Deny       []string        `json:"deny"`
+	MakeStep   *MakeStepConfig `json:"makestep"`
+	Local      *LocalConfig    `json:"local"`
+	Logging    LoggingConfig   `json:"logging"`
+}
+
+type ServerConfig struct {
+	Host    string   `json:"host"`
+	Pool    bool     `json:"pool,omitempty"`
+	IBurst  bool     `json:"iburst"`
+	Prefer  bool     `json:"prefer,omitempty"`
+	MinPoll *int     `json:"minpoll,omitempty"`
+	MaxPoll *int     `json:"maxpoll,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// PeerConfig is a symmetric association with another node
+type PeerConfig struct {
+	Host    string   `json:"host"`
+	MinPoll *int     `json:"minpoll,omitempty"`
+	MaxPoll *int     `json:"maxpoll,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// LocalConfig serves the local clock at Stratum when no source is
+// synchronised; Orphan lets peers at the same stratum agree on one reference
+type LocalConfig struct {
+	Stratum  int      `json:"stratum"`
+	Orphan   bool     `json:"orphan,omitempty"`
+	Distance *float64 `json:"distance,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// ClusterConfig replaces the peers and the local reference; a nil Local
+// removes the "local" directive
+type ClusterConfig struct {
+	Peers []PeerConfig `json:"peers"`
+	Local *LocalConfig `json:"local"`
+}
+
+// PeerStatus is how chronyd sees a configured peer. State is one of
+// selected, combined, not combined, unreachable, falseticker, too variable
+// or not seen.
+type PeerStatus struct {
+	Host      string `json:"host"`
+	Source    string `json:"source,omitempty"`
+	State     string `json:"state"`
+	Reachable bool   `json:"reachable"`
+	Reach     string `json:"reach,omitempty"`
+	Stratum   *int   `json:"stratum,omitempty"`
+	LastRx    string `json:"last_rx,omitempty"`
+	Offset    string `json:"offset,omitempty"`
+}
+
+type ClusterStatus struct {
+	Local        *LocalConfig `json:"local"`
+	Synchronized bool         `json:"synchronized"`
+	Stratum      *int         `json:"stratum,omitempty"`
+	Reference    string       `json:"reference,omitempty"`
+	Peers        []PeerStatus `json:"peers"`
+	Error        string       `json:"error,omitempty"`
+}
+
+type MakeStepConfig struct {
+	Threshold float64 `json:"threshold"`
+	Limit     int     `json:"limit"`
+}
+
+type LoggingConfig struct {
+	Dir  string   `json:"dir,omitempty"`
+	Logs []string `json:"logs"`
+}
+
+type ConfigChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
+}
+
+// ConfigResult describes a planned (dry run) or applied configuration
+type ConfigResult struct {
+	DryRun         bool           `json:"dry_run"`
+	Changed        bool           `json:"changed"`
+	Changes        []ConfigChange `json:"changes"`
+	Diff           string         `json:"diff"`
+	RestartSuccess *bool          `json:"restart_success"`
+	Config         Config         `json:"config"`
+	Confirmation   *PendingChange `json:"confirmation"`
+}
+
+// PendingChange is a configuration change that is reverted unless confirmed before Deadline
+type PendingChange struct {
+	ID               string    `json:"id"`
+	Actor            string    `json:"actor"`
+	RequestID        string    `json:"request_id"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	Revision         int64     `json:"revision"`
+	StartedAt        time.Time `json:"started_at"`
+	Deadline         time.Time `json:"deadline"`
+	AutoConfirm      bool      `json:"auto_confirm"`
+	RemainingSeconds float64   `json:"remaining_seconds"`
+	Diff             string    `json:"diff"`
+}
+
+// ConfigRevision is a stored version of chrony.conf. Content and Config are
+// only set by ConfigRevision, not in listings.
+type ConfigRevision struct {
+	Revision  int64     `json:"revision"`
+	Timestamp time.Time `json:"timestamp"`
+	Author    string    `json:"author"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash"`
+	Current   bool      `json:"current"`
+	Content   string    `json:"content"`
+	Config    *Config   `json:"config"`
+}
+
+type ConfigRevisionDiff struct {
+	From    int64          `json:"from"`
+	To      int64          `json:"to"`
+	Changes []ConfigChange `json:"changes"`
+	Diff    string         `json:"diff"`
+}
+
+type RevertResult struct {
+	ID             string `json:"id"`
+	Reverted       bool   `json:"reverted"`
+	RestartSuccess bool   `json:"restart_success"`
+}
+
+// AuditEntry is one recorded configuration change
+type AuditEntry struct {
+	ID             string          `json:"id"`
+	Timestamp      time.Time       `json:"timestamp"`
+	Action         string          `json:"action"`
+	Actor          string          `json:"actor"`
+	SourceIP       string          `json:"source_ip"`
+	RequestID      string          `json:"request_id"`
+	Method         string          `json:"method"`
+	Path           string          `json:"path"`
+	Request        json.RawMessage `json:"request,omitempty"`
+	Diff           string          `json:"diff,omitempty"`
+	Success        bool            `json:"success"`
+	RestartSuccess *bool           `json:"restart_success,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// AuditQuery filters GET /audit; zero values are not sent
+type AuditQuery struct {
+	Actor     string
+	Action    string
+	RequestID string
+	Success   *bool
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+type AuditLog struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+}
+
+// WhoAmI describes the caller as seen by the service
+type WhoAmI struct {
+	Subject                string   `json:"subject"`
+	Issuer                 string   `json:"issuer,omitempty"`
+	Roles                  []string `json:"roles"`
+	Granted                []string `json:"granted"`
+	Permissions            []string `json:"permissions"`
+	PermissionCheckEnabled bool     `json:"permission_check_enabled"`
+	LocalSocket            bool     `json:"local_socket"`
+}
+
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	HasSecret bool      `json:"has_secret"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookRequest struct {
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret,omitempty"`
+	Enabled *bool    `json:"enabled,omitempty"`
+}
+
+type WebhookDelivery struct {
+	ID         string    `json:"id"`
+	WebhookID  string    `json:"webhook_id"`
+	URL        string    `json:"url"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
+	Delivered  bool      `json:"delivered"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+type AlertRule struct {
+	Name        string  `json:"name"`
+	Metric      string  `json:"metric"`
+	Operator    string  `json:"operator"`
+	Threshold   float64 `json:"threshold"`
+	For         string  `json:"for"`
+	Severity    string  `json:"severity"`
+	Description string  `json:"description"`
+}
+
+type Alert struct {
+	Rule        string     `json:"rule"`
+	State       string     `json:"state"`
+	Severity    string     `json:"severity"`
+	Description string     `json:"description"`
+	Metric      string     `json:"metric"`
+	Operator    string     `json:"operator"`
+	Threshold   float64    `json:"threshold"`
+	Value       float64    `json:"value"`
+	ActiveSince time.Time  `json:"active_since"`
+	FiringSince *time.Time `json:"firing_since,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+	Silenced    bool       `json:"silenced"`
+}
+
+type Alerts struct {
+	Alerts   []Alert `json:"alerts"`
+	Resolved []Alert `json:"resolved,omitempty"`
+}
+
+type AlertRules struct {
+	Rules   []AlertRule       `json:"rules"`
+	Metrics map[string]string `json:"metrics,omitempty"`
+}
+
+type Silence struct {
+	ID        string    `json:"id"`
+	Rule      string    `json:"rule"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Comment   string    `json:"comment"`
+	CreatedBy string    `json:"created_by"`
+}
+
+type SilenceRequest struct {
+	Rule     string `json:"rule"`
+	Duration string `json:"duration"`
+	Comment  string `json:"comment,omitempty"`
+}
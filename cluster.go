@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Meaning of the second column of chronyc sources
+var sourceStates = map[byte]string{
+	'*': "selected",
+	'+': "combined",
+	'-': "not combined",
+	'?': "unreachable",
+	'x': "falseticker",
+	'~': "too variable",
+}
+
+// The peers and local reference of a node; body of PUT /cluster
+type ClusterConfig struct {
+	Peers []PeerConfig `json:"peers"`
+	Local *LocalConfig `json:"local"`
+}
+
+// How chronyd sees one configured peer
+type PeerStatus struct {
+	Host string `json:"host"`
+	// Name chronyd lists the peer under, when it lists it
+	Source string `json:"source,omitempty"`
+	// selected, combined, not combined, unreachable, falseticker, too
+	// variable, or "not seen" when chronyd does not list the peer
+	State     string `json:"state"`
+	Reachable bool   `json:"reachable"`
+	Reach     string `json:"reach,omitempty"`
+	Stratum   *int   `json:"stratum,omitempty"`
+	LastRx    string `json:"last_rx,omitempty"`
+	Offset    string `json:"offset,omitempty"`
+}
+
+// Payload of GET /cluster
+type ClusterStatus struct {
+	Local        *LocalConfig `json:"local"`
+	Synchronized bool         `json:"synchronized"`
+	Stratum      *int         `json:"stratum,omitempty"`
+	Reference    string       `json:"reference,omitempty"`
+	Peers        []PeerStatus `json:"peers"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// Helper to find the peer among chronyd's sources, which may list it by
+// address rather than by the configured name
+func findPeerSource(ctx context.Context, host string, sources []map[string]string) map[string]string {
+	var peers []map[string]string
+	for _, source := range sources {
+		if strings.HasPrefix(source["state"], "=") {
+			if source["name"] == host {
+				return source
+			}
+			peers = append(peers, source)
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, source := range peers {
+		if containsString(addresses, source["name"]) {
+			return source
+		}
+	}
+	return nil
+}
+
+// GET /cluster shows the local reference and each peer's state; PUT
+// replaces the peers and the local reference (?dry_run=1 only plans it)
+func handleCluster(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		config := parseClockConfig(readChronyConf())
+		ctx, cancel := backendContext(r)
+		defer cancel()
+		initializeCaches()
+		// One read, so tracking and sources can share a chronyc run
+		snapshots := snapshotCaches(ctx, trackingCache, sourcesCache)
+		tracking, sources := snapshots[trackingCache], snapshots[sourcesCache]
+
+		status := ClusterStatus{Local: config.Local, Peers: []PeerStatus{}}
+		if data, ok := tracking.Data.(map[string]string); ok {
+			status.Synchronized = isTrackingSynchronized(data)
+			if stratum, err := strconv.Atoi(data["Stratum"]); err == nil {
+				status.Stratum = &stratum
+			}
+			status.Reference = data["ReferenceID"]
+		}
+		rows, _ := sources.Data.([]map[string]string)
+		for _, err := range []error{tracking.Err, sources.Err} {
+			if err != nil && status.Error == "" {
+				status.Error = err.Error()
+			}
+		}
+		for _, peer := range config.Peers {
+			peerStatus := PeerStatus{Host: peer.Host, State: "not seen"}
+			if source := findPeerSource(ctx, peer.Host, rows); source != nil {
+				peerStatus.Source = source["name"]
+				if state := source["state"]; len(state) > 1 {
+					peerStatus.State = sourceStates[state[1]]
+				}
+				peerStatus.Reach = source["reach"]
+				peerStatus.Reachable = countReachableSources([]map[string]string{source}) > 0
+				if stratum, err := strconv.Atoi(source["stratum"]); err == nil && stratum > 0 {
+					peerStatus.Stratum = &stratum
+				}
+				peerStatus.LastRx = source["lastrx"]
+				peerStatus.Offset = source["offset"]
+			}
+			status.Peers = append(status.Peers, peerStatus)
+		}
+		setConfigETag(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodPut:
+		var req ClusterConfig
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		desired := parseClockConfig(readChronyConf())
+		desired.Peers = req.Peers
+		desired.Local = req.Local
+		normalizeClockConfig(&desired)
+		if problems := validateClockConfig(desired); len(problems) > 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid cluster configuration", problems)
+			return
+		}
+		applyConfigContent(w, r, func(current string) string {
+			config := parseClockConfig(current)
+			config.Peers = desired.Peers
+			config.Local = desired.Local
+			return renderClockConfig(current, config)
+		}, AUDIT_CLUSTER_SET, req)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
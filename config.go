@@ -0,0 +1,858 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const CONFIG_STATE_PATH = "/etc/brick/clock/config-state.json"
+
+// Revision bookkeeping for chrony.conf. The revision increases whenever the
+// file content changes, including edits made outside the API.
+type configState struct {
+	Revision int64  `json:"revision"`
+	Hash     string `json:"hash"`
+}
+
+var (
+	chronyConfPath  = CHRONY_CONF_PATH
+	configStatePath = CONFIG_STATE_PATH
+	ifMatchRequired = true
+
+	// Serializes every read-modify-write of chrony.conf
+	configMutex sync.Mutex
+
+	state      configState
+	stateMutex sync.Mutex
+	stateReady bool
+)
+
+func init() {
+	if v := os.Getenv("CHRONY_CONF_PATH"); v != "" {
+		chronyConfPath = v
+	}
+	if v := os.Getenv("CONFIG_STATE_PATH"); v != "" {
+		configStatePath = v
+	}
+	if os.Getenv("IF_MATCH_REQUIRED") == "off" {
+		ifMatchRequired = false
+	}
+}
+
+func hashConfig(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Bring the revision up to date with chrony.conf and return it
+func syncConfigRevision() int64 {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if !stateReady {
+		if data, err := ioutil.ReadFile(configStatePath); err == nil {
+			if err := json.Unmarshal(data, &state); err != nil {
+				log.Printf("Failed to parse config state: %v", err)
+			}
+		}
+		stateReady = true
+	}
+	content := readChronyConf()
+	hash := hashConfig(content)
+	initial := &revisionInfo{Author: AUDIT_SYSTEM_ACTOR, Message: "Configuration found when revision history started"}
+	if hash != state.Hash {
+		info := activeChange
+		if state.Hash == "" && info == nil {
+			info = initial
+		}
+		state.Revision++
+		state.Hash = hash
+		if err := saveConfigStateLocked(); err != nil {
+			log.Printf("Failed to save config state: %v", err)
+		}
+		saveRevisionLocked(state.Revision, content, info)
+	} else if !historyReady {
+		// Keep the configuration from before history was kept restorable
+		if _, err := os.Stat(revisionPath(state.Revision)); os.IsNotExist(err) {
+			saveRevisionLocked(state.Revision, content, initial)
+		}
+	}
+	historyReady = true
+	return state.Revision
+}
+
+func saveConfigStateLocked() error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(configStatePath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configStatePath, data, 0644)
+}
+
+func configETag(revision int64) string {
+	return fmt.Sprintf("\"%d\"", revision)
+}
+
+// Set the ETag header for the current configuration revision
+func setConfigETag(w http.ResponseWriter) {
+	w.Header().Set("ETag", configETag(syncConfigRevision()))
+}
+
+// Helper to check an If-Match header value against an ETag
+func ifMatchSatisfied(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// An in-progress configuration change, holding the config lock
+type configChange struct {
+	before  string
+	r       *http.Request
+	confirm *confirmOptions
+
+	// Set by commit when the change must be confirmed
+	pending *PendingConfirmation
+}
+
+// Lock the configuration and check If-Match against the current revision.
+// On failure the error response has been written and the lock released;
+// otherwise the caller must defer release and call commit before writing
+// its response.
+func beginConfigChange(w http.ResponseWriter, r *http.Request) (*configChange, bool) {
+	confirm, err := parseConfirmOptions(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+		return nil, false
+	}
+	if len(r.URL.Query().Get("message")) > MAX_REVISION_MESSAGE {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, fmt.Sprintf("message must not exceed %d bytes", MAX_REVISION_MESSAGE), nil)
+		return nil, false
+	}
+	configMutex.Lock()
+	if pendingConfirm != nil {
+		pending := pendingConfirm
+		configMutex.Unlock()
+		writeError(w, r, http.StatusConflict, ERR_CONFLICT,
+			"A configuration change is awaiting confirmation; confirm or revert it first",
+			map[string]interface{}{"pending_id": pending.ID, "deadline": pending.Deadline})
+		return nil, false
+	}
+	etag := configETag(syncConfigRevision())
+	header := r.Header.Get("If-Match")
+	if header == "" && ifMatchRequired {
+		configMutex.Unlock()
+		writeError(w, r, http.StatusPreconditionRequired, ERR_PRECONDITION_REQUIRED,
+			"If-Match header is required; send the ETag from GET /config, GET /servers, GET /server-mode or GET /cluster, or * to overwrite unconditionally",
+			map[string]string{"current_etag": etag})
+		return nil, false
+	}
+	if header != "" && !ifMatchSatisfied(header, etag) {
+		configMutex.Unlock()
+		w.Header().Set("ETag", etag)
+		writeError(w, r, http.StatusPreconditionFailed, ERR_PRECONDITION_FAILED,
+			"The configuration was changed by someone else; reload it and retry",
+			map[string]string{"current_etag": etag})
+		return nil, false
+	}
+	author, _ := requestClaims(r)["sub"].(string)
+	setActiveChange(&revisionInfo{
+		Author:    author,
+		Message:   r.URL.Query().Get("message"),
+		RequestID: requestIDFromRequest(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+	})
+	return &configChange{before: readChronyConf(), r: r, confirm: confirm}, true
+}
+
+// Record the new revision and return it as the response ETag. If a
+// confirmation was requested and chrony.conf changed, start the revert timer.
+func (c *configChange) commit(w http.ResponseWriter) {
+	revision := syncConfigRevision()
+	w.Header().Set("ETag", configETag(revision))
+	if c.confirm == nil || readChronyConf() == c.before {
+		return
+	}
+	c.pending = startPendingConfirmLocked(c.r, c.confirm, c.before, revision)
+	w.Header().Set("X-Confirm-ID", c.pending.ID)
+	w.Header().Set("X-Confirm-Deadline", c.pending.Deadline.Format(time.RFC3339))
+}
+
+func (c *configChange) release() {
+	setActiveChange(nil)
+	configMutex.Unlock()
+}
+
+// Desired-state model of the managed parts of chrony.conf. Directives not
+// represented here (driftfile, port, comments, ...) are preserved.
+type ClockConfig struct {
+	Servers    []ServerConfig  `json:"servers"`
+	Peers      []PeerConfig    `json:"peers"`
+	ServerMode bool            `json:"server_mode"`
+	Allow      []string        `json:"allow"`
+	Deny       []string        `json:"deny"`
+	MakeStep   *MakeStepConfig `json:"makestep"`
+	Local      *LocalConfig    `json:"local"`
+	Logging    LoggingConfig   `json:"logging"`
+}
+
+type ServerConfig struct {
+	Host    string   `json:"host"`
+	Pool    bool     `json:"pool,omitempty"`
+	IBurst  bool     `json:"iburst"`
+	Prefer  bool     `json:"prefer,omitempty"`
+	MinPoll *int     `json:"minpoll,omitempty"`
+	MaxPoll *int     `json:"maxpoll,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// Symmetric association with another node ("peer" directive)
+type PeerConfig struct {
+	Host    string   `json:"host"`
+	MinPoll *int     `json:"minpoll,omitempty"`
+	MaxPoll *int     `json:"maxpoll,omitempty"`
+	Options []string `json:"options,omitempty"`
+}
+
+// Serve time from the local clock at Stratum when no source is
+// synchronised ("local" directive). In orphan mode, nodes at the same local
+// stratum that peer with each other agree on one of them as the reference.
+type LocalConfig struct {
+	Stratum int  `json:"stratum"`
+	Orphan  bool `json:"orphan,omitempty"`
+	// Root distance (seconds) below which a source is preferred over the local reference
+	Distance *float64 `json:"distance,omitempty"`
+	Options  []string `json:"options,omitempty"`
+}
+
+// Step the clock when the offset exceeds Threshold seconds, during the first
+// Limit updates (-1 for always)
+type MakeStepConfig struct {
+	Threshold float64 `json:"threshold"`
+	Limit     int     `json:"limit"`
+}
+
+type LoggingConfig struct {
+	Dir  string   `json:"dir,omitempty"`
+	Logs []string `json:"logs"`
+}
+
+// A field that differs between the current and desired configuration
+type ConfigChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type ConfigApplyResponse struct {
+	DryRun         bool           `json:"dry_run"`
+	Changed        bool           `json:"changed"`
+	Changes        []ConfigChange `json:"changes"`
+	Diff           string         `json:"diff,omitempty"`
+	RestartSuccess *bool          `json:"restart_success,omitempty"`
+	Config         ClockConfig    `json:"config"`
+
+	// The change is reverted unless confirmed (see /config/confirm)
+	Confirmation *PendingConfirmationResponse `json:"confirmation,omitempty"`
+}
+
+const SERVER_MODE_ACL = "0.0.0.0/0"
+
+var (
+	hostPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._:-]*[A-Za-z0-9])?$`)
+	chronyLogs  = map[string]bool{
+		"measurements": true, "rawmeasurements": true, "statistics": true, "tracking": true,
+		"rtc": true, "refclocks": true, "tempcomp": true, "selection": true,
+	}
+)
+
+// Helper to tell whether an allow directive admits every client
+func isServerModeAllow(fields []string) bool {
+	return len(fields) == 1 || fields[1] == "all" || fields[1] == SERVER_MODE_ACL
+}
+
+// Helper to return the directive keyword of an active (uncommented) line
+func directiveOf(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "!") {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+func parseServerDirective(fields []string) ServerConfig {
+	server := ServerConfig{Host: fields[1], Pool: strings.ToLower(fields[0]) == "pool"}
+	for i := 2; i < len(fields); i++ {
+		switch fields[i] {
+		case "iburst":
+			server.IBurst = true
+		case "prefer":
+			server.Prefer = true
+		case "minpoll", "maxpoll":
+			if i+1 < len(fields) {
+				if v, err := strconv.Atoi(fields[i+1]); err == nil {
+					if fields[i] == "minpoll" {
+						server.MinPoll = &v
+					} else {
+						server.MaxPoll = &v
+					}
+					i++
+					continue
+				}
+			}
+			server.Options = append(server.Options, fields[i])
+		default:
+			server.Options = append(server.Options, fields[i])
+		}
+	}
+	return server
+}
+
+// Peers take the server options that apply to them; iburst and prefer
+// are kept as plain options
+func parsePeerDirective(fields []string) PeerConfig {
+	server := parseServerDirective(fields)
+	peer := PeerConfig{Host: server.Host, MinPoll: server.MinPoll, MaxPoll: server.MaxPoll}
+	for i := 2; i < len(fields); i++ {
+		if fields[i] == "iburst" || fields[i] == "prefer" {
+			peer.Options = append(peer.Options, fields[i])
+		}
+	}
+	peer.Options = append(peer.Options, server.Options...)
+	return peer
+}
+
+func parseLocalDirective(fields []string) LocalConfig {
+	// chronyd's default when "local" names no stratum
+	local := LocalConfig{Stratum: 10}
+	for i := 1; i < len(fields); i++ {
+		switch fields[i] {
+		case "orphan":
+			local.Orphan = true
+			continue
+		case "stratum", "distance":
+			if i+1 < len(fields) {
+				if fields[i] == "stratum" {
+					if v, err := strconv.Atoi(fields[i+1]); err == nil {
+						local.Stratum = v
+						i++
+						continue
+					}
+				} else if v, err := strconv.ParseFloat(fields[i+1], 64); err == nil {
+					local.Distance = &v
+					i++
+					continue
+				}
+			}
+		}
+		local.Options = append(local.Options, fields[i])
+	}
+	return local
+}
+
+// Parse the managed directives of chrony.conf into a ClockConfig
+func parseClockConfig(content string) ClockConfig {
+	config := ClockConfig{Servers: []ServerConfig{}, Peers: []PeerConfig{}, Allow: []string{}, Deny: []string{}, Logging: LoggingConfig{Logs: []string{}}}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		switch directiveOf(line) {
+		case "server", "pool":
+			if len(fields) >= 2 {
+				config.Servers = append(config.Servers, parseServerDirective(fields))
+			}
+		case "peer":
+			if len(fields) >= 2 {
+				config.Peers = append(config.Peers, parsePeerDirective(fields))
+			}
+		case "local":
+			local := parseLocalDirective(fields)
+			config.Local = &local
+		case "allow":
+			if isServerModeAllow(fields) {
+				config.ServerMode = true
+			} else {
+				config.Allow = append(config.Allow, fields[1])
+			}
+		case "deny":
+			if len(fields) >= 2 {
+				config.Deny = append(config.Deny, fields[1])
+			}
+		case "makestep":
+			if len(fields) >= 3 {
+				threshold, err1 := strconv.ParseFloat(fields[1], 64)
+				limit, err2 := strconv.Atoi(fields[2])
+				if err1 == nil && err2 == nil {
+					config.MakeStep = &MakeStepConfig{Threshold: threshold, Limit: limit}
+				}
+			}
+		case "log":
+			config.Logging.Logs = append(config.Logging.Logs, fields[1:]...)
+		case "logdir":
+			if len(fields) >= 2 {
+				config.Logging.Dir = fields[1]
+			}
+		}
+	}
+	return config
+}
+
+// Check a desired configuration, returning a message per problem
+func validateClockConfig(config ClockConfig) []string {
+	var problems []string
+	if len(config.Servers) == 0 {
+		problems = append(problems, "servers must not be empty")
+	}
+	seen := map[string]bool{}
+	for i, server := range config.Servers {
+		if !hostPattern.MatchString(server.Host) {
+			problems = append(problems, fmt.Sprintf("servers[%d].host %q is not a valid host name or address", i, server.Host))
+		}
+		if seen[server.Host] {
+			problems = append(problems, fmt.Sprintf("servers[%d].host %q is listed twice", i, server.Host))
+		}
+		seen[server.Host] = true
+		for _, poll := range []*int{server.MinPoll, server.MaxPoll} {
+			if poll != nil && (*poll < -6 || *poll > 24) {
+				problems = append(problems, fmt.Sprintf("servers[%d] poll interval %d must be between -6 and 24", i, *poll))
+			}
+		}
+		if server.MinPoll != nil && server.MaxPoll != nil && *server.MinPoll > *server.MaxPoll {
+			problems = append(problems, fmt.Sprintf("servers[%d].minpoll must not exceed maxpoll", i))
+		}
+		for _, option := range server.Options {
+			if strings.ContainsAny(option, " \t\n#") {
+				problems = append(problems, fmt.Sprintf("servers[%d] option %q contains whitespace or #", i, option))
+			}
+		}
+	}
+	for i, peer := range config.Peers {
+		if !hostPattern.MatchString(peer.Host) {
+			problems = append(problems, fmt.Sprintf("peers[%d].host %q is not a valid host name or address", i, peer.Host))
+		}
+		if seen[peer.Host] {
+			problems = append(problems, fmt.Sprintf("peers[%d].host %q is already listed as a server or peer", i, peer.Host))
+		}
+		seen[peer.Host] = true
+		for _, poll := range []*int{peer.MinPoll, peer.MaxPoll} {
+			if poll != nil && (*poll < -6 || *poll > 24) {
+				problems = append(problems, fmt.Sprintf("peers[%d] poll interval %d must be between -6 and 24", i, *poll))
+			}
+		}
+		if peer.MinPoll != nil && peer.MaxPoll != nil && *peer.MinPoll > *peer.MaxPoll {
+			problems = append(problems, fmt.Sprintf("peers[%d].minpoll must not exceed maxpoll", i))
+		}
+		for _, option := range peer.Options {
+			if strings.ContainsAny(option, " \t\n#") {
+				problems = append(problems, fmt.Sprintf("peers[%d] option %q contains whitespace or #", i, option))
+			}
+		}
+	}
+	if local := config.Local; local != nil {
+		if local.Stratum < 1 || local.Stratum > 15 {
+			problems = append(problems, "local.stratum must be between 1 and 15")
+		}
+		if local.Distance != nil && *local.Distance <= 0 {
+			problems = append(problems, "local.distance must be positive")
+		}
+		for _, option := range local.Options {
+			if strings.ContainsAny(option, " \t\n#") {
+				problems = append(problems, fmt.Sprintf("local option %q contains whitespace or #", option))
+			}
+		}
+	}
+	for field, subnets := range map[string][]string{"allow": config.Allow, "deny": config.Deny} {
+		for _, subnet := range subnets {
+			if !validSubnet(subnet) {
+				problems = append(problems, fmt.Sprintf("%s entry %q is not an address or CIDR subnet", field, subnet))
+			}
+		}
+	}
+	if config.MakeStep != nil && (config.MakeStep.Threshold <= 0 || config.MakeStep.Limit == 0 || config.MakeStep.Limit < -1) {
+		problems = append(problems, "makestep needs a positive threshold and a limit that is positive or -1")
+	}
+	for _, name := range config.Logging.Logs {
+		if !chronyLogs[name] {
+			problems = append(problems, fmt.Sprintf("logging.logs entry %q is not a chrony log", name))
+		}
+	}
+	if config.Logging.Dir != "" && (!filepath.IsAbs(config.Logging.Dir) || strings.ContainsAny(config.Logging.Dir, " \t\n#")) {
+		problems = append(problems, "logging.dir must be an absolute path without whitespace")
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func validSubnet(subnet string) bool {
+	if net.ParseIP(subnet) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(subnet)
+	return err == nil
+}
+
+func renderServerDirective(server ServerConfig) string {
+	parts := []string{"server", server.Host}
+	if server.Pool {
+		parts[0] = "pool"
+	}
+	if server.IBurst {
+		parts = append(parts, "iburst")
+	}
+	if server.Prefer {
+		parts = append(parts, "prefer")
+	}
+	if server.MinPoll != nil {
+		parts = append(parts, "minpoll", strconv.Itoa(*server.MinPoll))
+	}
+	if server.MaxPoll != nil {
+		parts = append(parts, "maxpoll", strconv.Itoa(*server.MaxPoll))
+	}
+	return strings.Join(append(parts, server.Options...), " ")
+}
+
+func renderPeerDirective(peer PeerConfig) string {
+	parts := []string{"peer", peer.Host}
+	if peer.MinPoll != nil {
+		parts = append(parts, "minpoll", strconv.Itoa(*peer.MinPoll))
+	}
+	if peer.MaxPoll != nil {
+		parts = append(parts, "maxpoll", strconv.Itoa(*peer.MaxPoll))
+	}
+	return strings.Join(append(parts, peer.Options...), " ")
+}
+
+func renderLocalDirective(local LocalConfig) string {
+	parts := []string{"local", "stratum", strconv.Itoa(local.Stratum)}
+	if local.Orphan {
+		parts = append(parts, "orphan")
+	}
+	if local.Distance != nil {
+		parts = append(parts, "distance", strconv.FormatFloat(*local.Distance, 'f', -1, 64))
+	}
+	return strings.Join(append(parts, local.Options...), " ")
+}
+
+// Render the desired configuration into chrony.conf. Each group of managed
+// directives replaces the first line of that group in place (later lines of
+// the group are dropped); groups not yet present are appended. An existing
+// directive enabling server mode ("allow", "allow all") is kept as written.
+func renderClockConfig(current string, config ClockConfig) string {
+	currentLines := strings.Split(strings.TrimRight(current, "\n"), "\n")
+	if current == "" {
+		currentLines = nil
+	}
+	serverModeLine := "allow " + SERVER_MODE_ACL
+	for _, line := range currentLines {
+		if directiveOf(line) == "allow" && isServerModeAllow(strings.Fields(line)) {
+			serverModeLine = line
+			break
+		}
+	}
+	groups := map[string][]string{
+		"server":   {},
+		"peer":     {},
+		"allow":    {},
+		"deny":     {},
+		"makestep": {},
+		"local":    {},
+		"log":      {},
+		"logdir":   {},
+	}
+	for _, server := range config.Servers {
+		groups["server"] = append(groups["server"], renderServerDirective(server))
+	}
+	for _, peer := range config.Peers {
+		groups["peer"] = append(groups["peer"], renderPeerDirective(peer))
+	}
+	if config.ServerMode {
+		groups["allow"] = append(groups["allow"], serverModeLine)
+	}
+	for _, subnet := range config.Allow {
+		groups["allow"] = append(groups["allow"], "allow "+subnet)
+	}
+	for _, subnet := range config.Deny {
+		groups["deny"] = append(groups["deny"], "deny "+subnet)
+	}
+	if config.MakeStep != nil {
+		groups["makestep"] = append(groups["makestep"], fmt.Sprintf("makestep %s %d", strconv.FormatFloat(config.MakeStep.Threshold, 'f', -1, 64), config.MakeStep.Limit))
+	}
+	if config.Local != nil {
+		groups["local"] = append(groups["local"], renderLocalDirective(*config.Local))
+	}
+	if len(config.Logging.Logs) > 0 {
+		groups["log"] = append(groups["log"], "log "+strings.Join(config.Logging.Logs, " "))
+	}
+	if config.Logging.Dir != "" {
+		groups["logdir"] = append(groups["logdir"], "logdir "+config.Logging.Dir)
+	}
+	groupOf := func(directive string) string {
+		if directive == "pool" {
+			return "server"
+		}
+		return directive
+	}
+
+	written := map[string]bool{}
+	var lines []string
+	serverModeComment := "#allow " + SERVER_MODE_ACL
+	for _, line := range currentLines {
+		trimmed := strings.TrimSpace(line)
+		group := groupOf(directiveOf(line))
+		if trimmed == serverModeComment && config.ServerMode {
+			// Enable server mode where it was commented out, as PUT /server-mode does
+			group = "allow"
+		}
+		block, managed := groups[group]
+		if !managed {
+			lines = append(lines, line)
+			continue
+		}
+		if !written[group] {
+			lines = append(lines, block...)
+			written[group] = true
+		}
+		if trimmed == "allow "+SERVER_MODE_ACL && !config.ServerMode {
+			lines = append(lines, serverModeComment)
+		}
+	}
+	for _, group := range []string{"server", "peer", "allow", "deny", "makestep", "local", "log", "logdir"} {
+		if !written[group] && len(groups[group]) > 0 {
+			lines = append(lines, groups[group]...)
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Compare two configurations field by field
+func diffClockConfig(from ClockConfig, to ClockConfig) []ConfigChange {
+	changes := []ConfigChange{}
+	add := func(field string, a interface{}, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			changes = append(changes, ConfigChange{Field: field, From: a, To: b})
+		}
+	}
+	add("servers", from.Servers, to.Servers)
+	add("peers", from.Peers, to.Peers)
+	add("server_mode", from.ServerMode, to.ServerMode)
+	add("allow", from.Allow, to.Allow)
+	add("deny", from.Deny, to.Deny)
+	add("makestep", from.MakeStep, to.MakeStep)
+	add("local", from.Local, to.Local)
+	add("logging.dir", from.Logging.Dir, to.Logging.Dir)
+	add("logging.logs", from.Logging.Logs, to.Logging.Logs)
+	return changes
+}
+
+// Helper to fill nil lists so a document compares equal to a parsed one
+func normalizeClockConfig(config *ClockConfig) {
+	if config.Servers == nil {
+		config.Servers = []ServerConfig{}
+	}
+	if config.Peers == nil {
+		config.Peers = []PeerConfig{}
+	}
+	if config.Allow == nil {
+		config.Allow = []string{}
+	}
+	if config.Deny == nil {
+		config.Deny = []string{}
+	}
+	if config.Logging.Logs == nil {
+		config.Logging.Logs = []string{}
+	}
+	for i := range config.Servers {
+		if len(config.Servers[i].Options) == 0 {
+			config.Servers[i].Options = nil
+		}
+	}
+	for i := range config.Peers {
+		if len(config.Peers[i].Options) == 0 {
+			config.Peers[i].Options = nil
+		}
+	}
+	if config.Local != nil && len(config.Local.Options) == 0 {
+		config.Local.Options = nil
+	}
+}
+
+// Write a new chrony.conf and restart chronyd once to load it
+func writeChronyConf(content string) (bool, error) {
+	if err := ioutil.WriteFile(chronyConfPath, []byte(content), 0644); err != nil {
+		return false, err
+	}
+	restartSuccess := restartChrony()
+	invalidateCaches()
+	return restartSuccess, nil
+}
+
+// Replace the servers in chrony.conf on the service's own initiative, e.g.
+// for automatic selection or failover. The change is audited as action with
+// the actor "system" and recorded as a revision with message. It is refused
+// while a change awaits confirmation, so an operator's rollback window is
+// never disturbed.
+func setServersAsSystem(servers []string, action string, message string, request interface{}) (bool, error) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	if pendingConfirm != nil {
+		return false, errors.New("a configuration change is awaiting confirmation")
+	}
+	setActiveChange(&revisionInfo{Author: AUDIT_SYSTEM_ACTOR, Message: message})
+	defer setActiveChange(nil)
+
+	before := readChronyConf()
+	if err := updateChronyConfServers(servers); err != nil {
+		recordSystemAudit(AuditEntry{Action: action, Request: request, Error: err.Error()}, before)
+		return false, err
+	}
+	restartSuccess := restartChrony()
+	invalidateCaches()
+	recordSystemAudit(AuditEntry{Action: action, Request: request, RestartSuccess: &restartSuccess}, before)
+	emitEvent(EVENT_SERVERS_CHANGED, map[string]interface{}{
+		"servers":         servers,
+		"restart_success": restartSuccess,
+	})
+	return restartSuccess, nil
+}
+
+// Get the configuration document, or replace it (?dry_run=1 only plans the change)
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		config := parseClockConfig(readChronyConf())
+		setConfigETag(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+
+	case http.MethodPut:
+		var desired ClockConfig
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&desired); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		normalizeClockConfig(&desired)
+		if problems := validateClockConfig(desired); len(problems) > 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid configuration", problems)
+			return
+		}
+		applyConfigContent(w, r, func(current string) string {
+			return renderClockConfig(current, desired)
+		}, AUDIT_CONFIG_SET, desired)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
+
+// Compare chrony.conf before and after a whole-document change
+func planConfigChange(current string, content string) ConfigApplyResponse {
+	response := ConfigApplyResponse{
+		Changed: content != current,
+		Changes: diffClockConfig(parseClockConfig(current), parseClockConfig(content)),
+		Config:  parseClockConfig(content),
+	}
+	if response.Changed {
+		response.Diff = unifiedDiff(current, content, chronyConfPath)
+	}
+	return response
+}
+
+// Replace chrony.conf with content rendered from the current file. With
+// ?dry_run=1 only the plan is returned; otherwise the change is locked,
+// written with a single chronyd restart, audited and announced.
+func applyConfigContent(w http.ResponseWriter, r *http.Request, render func(current string) string, action string, request interface{}) {
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun {
+		current := readChronyConf()
+		response := planConfigChange(current, render(current))
+		response.DryRun = true
+		setConfigETag(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	change, ok := beginConfigChange(w, r)
+	if !ok {
+		return
+	}
+	defer change.release()
+	content := render(change.before)
+	response := planConfigChange(change.before, content)
+	if !response.Changed {
+		change.commit(w)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	restartSuccess, err := writeChronyConf(content)
+	if err != nil {
+		recordAudit(r, AuditEntry{Action: action, Request: request, Error: err.Error()}, change.before)
+		change.commit(w)
+		writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to update configuration", err.Error())
+		return
+	}
+	response.RestartSuccess = &restartSuccess
+	recordAudit(r, AuditEntry{Action: action, Request: request, RestartSuccess: &restartSuccess}, change.before)
+	change.commit(w)
+	if change.pending != nil {
+		confirmation := pendingConfirmResponse(change.pending, content)
+		response.Confirmation = &confirmation
+	}
+	emitConfigEvents(parseClockConfig(change.before), response.Config, response.Changes, restartSuccess)
+
+	if !restartSuccess {
+		writeError(w, r, http.StatusBadGateway, ERR_RESTART_FAILED, "Configuration saved but the time service failed to restart", response)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Emit config.changed, plus the narrower events subscribers may already rely on
+func emitConfigEvents(previous ClockConfig, desired ClockConfig, changes []ConfigChange, restartSuccess bool) {
+	emitEvent(EVENT_CONFIG_CHANGED, map[string]interface{}{
+		"changes":         changes,
+		"restart_success": restartSuccess,
+	})
+	if !reflect.DeepEqual(previous.Servers, desired.Servers) {
+		hosts := make([]string, 0, len(desired.Servers))
+		for _, server := range desired.Servers {
+			hosts = append(hosts, server.Host)
+		}
+		emitEvent(EVENT_SERVERS_CHANGED, map[string]interface{}{
+			"servers":         hosts,
+			"restart_success": restartSuccess,
+		})
+	}
+	if previous.ServerMode != desired.ServerMode {
+		emitEvent(EVENT_SERVER_MODE_CHANGED, map[string]interface{}{
+			"enabled": desired.ServerMode,
+			"success": restartSuccess,
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"el/brick-clock/client"
+)
+
+func TestRenderKeepsServerModeDirective(t *testing.T) {
+	for _, directive := range []string{"allow", "allow all", "allow 0.0.0.0/0"} {
+		current := "server pool.ntp.org iburst\n" + directive + "\nlocal stratum 10\n"
+		config := parseClockConfig(current)
+		if !config.ServerMode {
+			t.Fatalf("%q: server mode not detected", directive)
+		}
+		config.Deny = []string{"10.1.0.0/16"}
+		rendered := renderClockConfig(current, config)
+		if want := "server pool.ntp.org iburst\n" + directive + "\nlocal stratum 10\ndeny 10.1.0.0/16\n"; rendered != want {
+			t.Errorf("%q: rendered\n%s\nwant\n%s", directive, rendered, want)
+		}
+	}
+
+	// Enabling server mode still writes the canonical directive
+	config := parseClockConfig("server pool.ntp.org iburst\n")
+	config.ServerMode = true
+	if rendered := renderClockConfig("server pool.ntp.org iburst\n", config); !strings.Contains(rendered, "allow "+SERVER_MODE_ACL+"\n") {
+		t.Errorf("rendered\n%s\nwant allow %s", rendered, SERVER_MODE_ACL)
+	}
+}
+
+func TestSDKSetConfigWithoutPeersRemovesThem(t *testing.T) {
+	resetTestChronyConf(t)
+	conf := testChronyConf + "peer node-b.lan\n"
+	if err := ioutil.WriteFile(chronyConfPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestSDK(t, adminClaims())
+	ctx := client.WithIfMatch(context.Background(), "*")
+
+	config, err := c.Config(ctx)
+	if err != nil || len(config.Peers) != 1 || config.Local == nil {
+		t.Fatalf("Config = %+v, %v; want one peer and a local reference", config, err)
+	}
+	config.Peers, config.Local = nil, nil
+	if _, err := c.SetConfig(ctx, *config); err != nil {
+		t.Fatalf("SetConfig: %v", err)
+	}
+	content, _ := ioutil.ReadFile(chronyConfPath)
+	if strings.Contains(string(content), "peer ") || strings.Contains(string(content), "local ") {
+		t.Errorf("chrony.conf after SetConfig without peers and local:\n%s", content)
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIRM_STATE_PATH  = "/etc/brick/clock/pending-confirm.json"
+	MIN_CONFIRM_TIMEOUT = 10 * time.Second
+	MAX_CONFIRM_TIMEOUT = time.Hour
+)
+
+// Reasons a pending change was settled
+const (
+	CONFIRM_REASON_CONFIRMED = "confirmed"
+	CONFIRM_REASON_HEALTHY   = "healthy"
+	CONFIRM_REASON_TIMEOUT   = "timeout"
+	CONFIRM_REASON_CANCELLED = "cancelled"
+)
+
+// A configuration change that is reverted unless confirmed before Deadline.
+// With AutoConfirm it is also confirmed once chronyd is synchronized to a
+// selected source on two consecutive checks.
+type PendingConfirmation struct {
+	ID          string    `json:"id"`
+	Actor       string    `json:"actor"`
+	RequestID   string    `json:"request_id"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Revision    int64     `json:"revision"`
+	StartedAt   time.Time `json:"started_at"`
+	Deadline    time.Time `json:"deadline"`
+	AutoConfirm bool      `json:"auto_confirm"`
+
+	// chrony.conf as it was before the change, restored on revert
+	Previous string `json:"previous"`
+
+	// Why the last revert failed; the revert is retried until it succeeds
+	RevertError string `json:"revert_error,omitempty"`
+}
+
+// Confirmation requested through the confirm_timeout and auto_confirm query parameters
+type confirmOptions struct {
+	timeout     time.Duration
+	autoConfirm bool
+}
+
+var (
+	confirmStatePath     = CONFIRM_STATE_PATH
+	confirmCheckInterval = 5 * time.Second
+	confirmRetryInterval = 30 * time.Second
+
+	// The change awaiting confirmation, guarded by configMutex
+	pendingConfirm *PendingConfirmation
+	pendingDone    chan struct{}
+)
+
+func init() {
+	if v := os.Getenv("CONFIRM_STATE_PATH"); v != "" {
+		confirmStatePath = v
+	}
+	if v := os.Getenv("CONFIRM_CHECK_INTERVAL"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			confirmCheckInterval = parsed
+		} else {
+			log.Printf("Invalid CONFIRM_CHECK_INTERVAL %q, using %s", v, confirmCheckInterval)
+		}
+	}
+	if v := os.Getenv("CONFIRM_RETRY_INTERVAL"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			confirmRetryInterval = parsed
+		} else {
+			log.Printf("Invalid CONFIRM_RETRY_INTERVAL %q, using %s", v, confirmRetryInterval)
+		}
+	}
+}
+
+// Parse the confirmation query parameters of a configuration change
+func parseConfirmOptions(r *http.Request) (*confirmOptions, error) {
+	query := r.URL.Query()
+	timeout := query.Get("confirm_timeout")
+	autoConfirm := false
+	if v := query.Get("auto_confirm"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("auto_confirm must be true or false")
+		}
+		autoConfirm = parsed
+	}
+	if timeout == "" {
+		if autoConfirm {
+			return nil, fmt.Errorf("auto_confirm requires confirm_timeout")
+		}
+		return nil, nil
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		if seconds, convErr := strconv.Atoi(timeout); convErr == nil {
+			duration, err = time.Duration(seconds)*time.Second, nil
+		}
+	}
+	if err != nil || duration < MIN_CONFIRM_TIMEOUT || duration > MAX_CONFIRM_TIMEOUT {
+		return nil, fmt.Errorf("confirm_timeout must be a duration between %s and %s", MIN_CONFIRM_TIMEOUT, MAX_CONFIRM_TIMEOUT)
+	}
+	return &confirmOptions{timeout: duration, autoConfirm: autoConfirm}, nil
+}
+
+// Start waiting for confirmation of a change just written; configMutex must be held
+func startPendingConfirmLocked(r *http.Request, options *confirmOptions, previous string, revision int64) *PendingConfirmation {
+	now := time.Now().UTC()
+	pending := &PendingConfirmation{
+		ID:          newID(),
+		RequestID:   requestIDFromRequest(r),
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Revision:    revision,
+		StartedAt:   now,
+		Deadline:    now.Add(options.timeout),
+		AutoConfirm: options.autoConfirm,
+		Previous:    previous,
+	}
+	pending.Actor, _ = requestClaims(r)["sub"].(string)
+	watchPendingConfirmLocked(pending)
+	log.Printf("Configuration change %s must be confirmed by %s", pending.ID, pending.Deadline.Format(time.RFC3339))
+	return pending
+}
+
+func watchPendingConfirmLocked(pending *PendingConfirmation) {
+	pendingConfirm = pending
+	pendingDone = make(chan struct{})
+	if err := savePendingConfirm(pending); err != nil {
+		log.Printf("Failed to save pending confirmation: %v", err)
+	}
+	go watchPendingConfirm(pending, pendingDone)
+}
+
+// Revert at the deadline unless the change is confirmed first. A failed
+// revert is retried every confirmRetryInterval until it succeeds or the
+// change is settled otherwise.
+func watchPendingConfirm(pending *PendingConfirmation, done chan struct{}) {
+	deadline := time.NewTimer(time.Until(pending.Deadline))
+	defer deadline.Stop()
+	var checks <-chan time.Time
+	if pending.AutoConfirm {
+		ticker := time.NewTicker(confirmCheckInterval)
+		defer ticker.Stop()
+		checks = ticker.C
+	}
+	healthyChecks := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline.C:
+			if _, reverted, _ := revertPendingConfirm(pending.ID, CONFIRM_REASON_TIMEOUT, nil); reverted {
+				return
+			}
+			// Past the deadline only a revert settles the change
+			checks = nil
+			deadline.Reset(confirmRetryInterval)
+		case <-checks:
+			if !syncHealthy() {
+				healthyChecks = 0
+				continue
+			}
+			// The first check may still see the state from before the restart
+			healthyChecks++
+			if healthyChecks >= 2 {
+				confirmPendingChange(pending.ID, CONFIRM_REASON_HEALTHY, nil)
+				return
+			}
+		}
+	}
+}
+
+// Helper to check that chronyd is synchronized to a selected source
+func syncHealthy() bool {
+	initializeCaches()
+	ctx, cancel := context.WithTimeout(context.Background(), backendRequestTimeout)
+	defer cancel()
+	return snapshotsSyncHealthy(readCaches(ctx, true, trackingCache, sourcesCache))
+}
+
+// Data kept from before a failed read says nothing about the new
+// configuration, so any error counts as not healthy
+func snapshotsSyncHealthy(snapshots map[*CachedData]CacheSnapshot) bool {
+	tracking, sources := snapshots[trackingCache], snapshots[sourcesCache]
+	if tracking.Err != nil || sources.Err != nil {
+		return false
+	}
+	trackingData, _ := tracking.Data.(map[string]string)
+	if !isTrackingSynchronized(trackingData) {
+		return false
+	}
+	sourcesData, _ := sources.Data.([]map[string]string)
+	for _, source := range sourcesData {
+		if strings.HasSuffix(source["state"], "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop watching the pending change; configMutex must be held
+func settlePendingConfirmLocked() {
+	close(pendingDone)
+	pendingConfirm = nil
+	pendingDone = nil
+	if err := os.Remove(confirmStatePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove pending confirmation: %v", err)
+	}
+}
+
+// Keep the pending change with the given ID; r is nil for automatic confirmation
+func confirmPendingChange(id string, reason string, r *http.Request) (*PendingConfirmation, bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	pending := pendingConfirm
+	if pending == nil || pending.ID != id {
+		return nil, false
+	}
+	settlePendingConfirmLocked()
+
+	entry := AuditEntry{Action: AUDIT_CONFIG_CONFIRM, Request: map[string]string{"id": pending.ID, "reason": reason}}
+	current := readChronyConf()
+	if r != nil {
+		recordAudit(r, entry, current)
+	} else {
+		recordSystemAudit(entry, current)
+	}
+	log.Printf("Configuration change %s confirmed (%s)", pending.ID, reason)
+	emitEvent(EVENT_CONFIG_CONFIRMED, map[string]interface{}{
+		"id":       pending.ID,
+		"reason":   reason,
+		"revision": pending.Revision,
+	})
+	return pending, true
+}
+
+// Restore the configuration from before the pending change; r is nil when
+// the deadline passed. If chrony.conf cannot be written the change stays
+// pending, with the error in RevertError.
+func revertPendingConfirm(id string, reason string, r *http.Request) (*PendingConfirmation, bool, bool) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	pending := pendingConfirm
+	if pending == nil || pending.ID != id {
+		return nil, false, false
+	}
+
+	author := AUDIT_SYSTEM_ACTOR
+	if r != nil {
+		author, _ = requestClaims(r)["sub"].(string)
+	}
+	setActiveChange(&revisionInfo{
+		Author:  author,
+		Message: fmt.Sprintf("Revert unconfirmed change %s (%s)", pending.ID, reason),
+	})
+	defer setActiveChange(nil)
+
+	before := readChronyConf()
+	restartSuccess, err := writeChronyConf(pending.Previous)
+	entry := AuditEntry{Action: AUDIT_CONFIG_REVERT, Request: map[string]string{"id": pending.ID, "reason": reason}, RestartSuccess: &restartSuccess}
+	if err != nil {
+		entry.RestartSuccess = nil
+		entry.Error = err.Error()
+	}
+	if r != nil {
+		recordAudit(r, entry, before)
+	} else {
+		recordSystemAudit(entry, before)
+	}
+	revision := syncConfigRevision()
+	if err != nil {
+		// Readers may hold the current record, so replace it rather than modify it
+		failed := *pending
+		failed.RevertError = err.Error()
+		pendingConfirm = &failed
+		if saveErr := savePendingConfirm(&failed); saveErr != nil {
+			log.Printf("Failed to save pending confirmation: %v", saveErr)
+		}
+		log.Printf("Failed to revert configuration change %s, keeping it pending: %v", pending.ID, err)
+	} else {
+		settlePendingConfirmLocked()
+		log.Printf("Configuration change %s reverted (%s)", pending.ID, reason)
+	}
+
+	data := map[string]interface{}{
+		"id":              pending.ID,
+		"reason":          reason,
+		"revision":        revision,
+		"restart_success": restartSuccess,
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	emitEvent(EVENT_CONFIG_REVERTED, data)
+	return pending, err == nil, restartSuccess
+}
+
+func savePendingConfirm(pending *PendingConfirmation) error {
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(confirmStatePath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(confirmStatePath, data, 0600)
+}
+
+// Pick up a change that was awaiting confirmation when the service stopped;
+// if its deadline passed in the meantime it is reverted right away
+func resumePendingConfirm() {
+	data, err := ioutil.ReadFile(confirmStatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read pending confirmation: %v", err)
+		}
+		return
+	}
+	var pending PendingConfirmation
+	if err := json.Unmarshal(data, &pending); err != nil || pending.ID == "" {
+		log.Printf("Ignoring invalid pending confirmation in %s", confirmStatePath)
+		return
+	}
+	configMutex.Lock()
+	watchPendingConfirmLocked(&pending)
+	configMutex.Unlock()
+	log.Printf("Resumed configuration change %s awaiting confirmation until %s", pending.ID, pending.Deadline.Format(time.RFC3339))
+}
+
+type PendingConfirmationResponse struct {
+	ID          string    `json:"id"`
+	Actor       string    `json:"actor"`
+	RequestID   string    `json:"request_id"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Revision    int64     `json:"revision"`
+	StartedAt   time.Time `json:"started_at"`
+	Deadline    time.Time `json:"deadline"`
+	AutoConfirm bool      `json:"auto_confirm"`
+	Remaining   float64   `json:"remaining_seconds"`
+	Diff        string    `json:"diff"`
+	RevertError string    `json:"revert_error,omitempty"`
+}
+
+func pendingConfirmResponse(pending *PendingConfirmation, current string) PendingConfirmationResponse {
+	remaining := time.Until(pending.Deadline).Seconds()
+	if remaining < 0 {
+		remaining = 0
+	}
+	return PendingConfirmationResponse{
+		ID:          pending.ID,
+		Actor:       pending.Actor,
+		RequestID:   pending.RequestID,
+		Method:      pending.Method,
+		Path:        pending.Path,
+		Revision:    pending.Revision,
+		StartedAt:   pending.StartedAt,
+		Deadline:    pending.Deadline,
+		AutoConfirm: pending.AutoConfirm,
+		Remaining:   remaining,
+		Diff:        unifiedDiff(pending.Previous, current, chronyConfPath),
+		RevertError: pending.RevertError,
+	}
+}
+
+type ConfirmRequest struct {
+	ID string `json:"id"`
+}
+
+// Show the change awaiting confirmation, or revert it now (DELETE)
+func handlePendingConfirm(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		configMutex.Lock()
+		pending := pendingConfirm
+		configMutex.Unlock()
+		if pending == nil {
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No configuration change is awaiting confirmation", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pendingConfirmResponse(pending, readChronyConf()))
+
+	case http.MethodDelete:
+		configMutex.Lock()
+		pending := pendingConfirm
+		configMutex.Unlock()
+		if pending == nil {
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No configuration change is awaiting confirmation", nil)
+			return
+		}
+		_, reverted, restartSuccess := revertPendingConfirm(pending.ID, CONFIRM_REASON_CANCELLED, r)
+		setConfigETag(w)
+		if !reverted {
+			configMutex.Lock()
+			current := pendingConfirm
+			configMutex.Unlock()
+			if current == nil || current.ID != pending.ID {
+				// Settled by the deadline or health check in the meantime
+				writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No configuration change is awaiting confirmation", nil)
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to restore the previous configuration; the change is still pending",
+				map[string]string{"id": current.ID, "error": current.RevertError})
+			return
+		}
+		response := map[string]interface{}{
+			"id":              pending.ID,
+			"reverted":        true,
+			"restart_success": restartSuccess,
+		}
+		if !restartSuccess {
+			writeError(w, r, http.StatusBadGateway, ERR_RESTART_FAILED, "Configuration restored but the time service failed to restart", response)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
+
+// Keep the change awaiting confirmation. The ID is optional and guards
+// against confirming a different change than the one the caller made.
+func handleConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	var req ConfirmRequest
+	if r.Body != http.NoBody {
+		// The body is optional; a chunked request may still turn out empty
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+	}
+	configMutex.Lock()
+	pending := pendingConfirm
+	configMutex.Unlock()
+	if pending == nil || (req.ID != "" && req.ID != pending.ID) {
+		writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No such configuration change is awaiting confirmation", nil)
+		return
+	}
+	if _, ok := confirmPendingChange(pending.ID, CONFIRM_REASON_CONFIRMED, r); !ok {
+		// Settled by the deadline or health check in the meantime
+		writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "No such configuration change is awaiting confirmation", nil)
+		return
+	}
+	setConfigETag(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":        pending.ID,
+		"confirmed": true,
+	})
+}
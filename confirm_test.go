@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Await confirmation of a change whose previous configuration is previous
+func startTestPendingConfirm(t *testing.T, deadline time.Time, previous string) *PendingConfirmation {
+	t.Helper()
+	pending := &PendingConfirmation{ID: newID(), StartedAt: time.Now().UTC(), Deadline: deadline, Previous: previous}
+	configMutex.Lock()
+	watchPendingConfirmLocked(pending)
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		if pendingConfirm != nil {
+			settlePendingConfirmLocked()
+		}
+		configMutex.Unlock()
+	})
+	return pending
+}
+
+// Make writes to chrony.conf fail until the returned function is called
+func breakChronyConf(t *testing.T) func() {
+	t.Helper()
+	saved := chronyConfPath
+	chronyConfPath = filepath.Join(t.TempDir(), "missing", "chrony.conf")
+	restore := func() { chronyConfPath = saved }
+	t.Cleanup(restore)
+	return restore
+}
+
+func currentPendingConfirm() *PendingConfirmation {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	return pendingConfirm
+}
+
+func TestFailedRevertKeepsChangePending(t *testing.T) {
+	resetTestChronyConf(t)
+	previous := testChronyConf + "deny 10.9.0.0/16\n"
+	pending := startTestPendingConfirm(t, time.Now().Add(time.Hour), previous)
+
+	restore := breakChronyConf(t)
+	if _, reverted, _ := revertPendingConfirm(pending.ID, CONFIRM_REASON_CANCELLED, nil); reverted {
+		t.Fatal("revert reported success although chrony.conf could not be written")
+	}
+	current := currentPendingConfirm()
+	if current == nil || current.ID != pending.ID || current.RevertError == "" {
+		t.Fatalf("pending after a failed revert = %+v, want the same change with revert_error", current)
+	}
+	if _, err := os.Stat(confirmStatePath); err != nil {
+		t.Errorf("state file after a failed revert: %v, want it kept", err)
+	}
+
+	restore()
+	if _, reverted, _ := revertPendingConfirm(pending.ID, CONFIRM_REASON_CANCELLED, nil); !reverted {
+		t.Fatal("second revert failed")
+	}
+	if current := currentPendingConfirm(); current != nil {
+		t.Errorf("pending after the revert = %+v, want none", current)
+	}
+	if _, err := os.Stat(confirmStatePath); !os.IsNotExist(err) {
+		t.Errorf("state file after the revert: %v, want it removed", err)
+	}
+	if content, _ := ioutil.ReadFile(chronyConfPath); string(content) != previous {
+		t.Errorf("chrony.conf after the revert:\n%s", content)
+	}
+}
+
+func TestTimedOutRevertIsRetried(t *testing.T) {
+	resetTestChronyConf(t)
+	saved := confirmRetryInterval
+	confirmRetryInterval = 10 * time.Millisecond
+	defer func() { confirmRetryInterval = saved }()
+
+	restore := breakChronyConf(t)
+	previous := testChronyConf + "deny 10.9.0.0/16\n"
+	startTestPendingConfirm(t, time.Now().Add(10*time.Millisecond), previous)
+
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for start := time.Now(); !done(); time.Sleep(5 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+		}
+	}
+	waitFor("a failed revert", func() bool {
+		current := currentPendingConfirm()
+		return current != nil && current.RevertError != ""
+	})
+	restore()
+	waitFor("the retried revert", func() bool { return currentPendingConfirm() == nil })
+	if content, _ := ioutil.ReadFile(chronyConfPath); string(content) != previous {
+		t.Errorf("chrony.conf after the retried revert:\n%s", content)
+	}
+}
+
+func TestSyncHealthyUsesCacheErrors(t *testing.T) {
+	resetTestChronyConf(t)
+	if !syncHealthy() {
+		t.Fatal("syncHealthy = false with a synchronised tracking and a selected source")
+	}
+
+	// A failed refresh keeps the last good data, which must not count
+	snapshots := map[*CachedData]CacheSnapshot{
+		trackingCache: trackingCache.Snapshot(context.Background()),
+		sourcesCache:  sourcesCache.Snapshot(context.Background()),
+	}
+	failed := snapshots[sourcesCache]
+	failed.Err = errors.New("chronyc: 506 Cannot talk to daemon")
+	snapshots[sourcesCache] = failed
+	if snapshotsSyncHealthy(snapshots) {
+		t.Error("healthy although the sources refresh failed")
+	}
+}
+
+func TestConfirmAcceptsEmptyChunkedBody(t *testing.T) {
+	for _, test := range []struct {
+		body string
+		want int
+	}{
+		// Nothing is pending, so a readable body gets 404
+		{"", http.StatusNotFound},
+		{`{"id": "abc"}`, http.StatusNotFound},
+		{"{", http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/config/confirm", strings.NewReader(test.body))
+		r.ContentLength = -1
+		w := httptest.NewRecorder()
+		handleConfirm(w, r)
+		if w.Code != test.want {
+			t.Errorf("POST /config/confirm with chunked body %q = %d, want %d", test.body, w.Code, test.want)
+		}
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DISCOVERY_PATH = "/etc/brick/clock/discovery.json"
+
+	DISCOVERY_SRV    = "srv"
+	DISCOVERY_FILE   = "file"
+	DISCOVERY_STATIC = "static"
+
+	// How often the providers are checked for a due refresh
+	DISCOVERY_CHECK_INTERVAL = 10 * time.Second
+	MAX_DISCOVERY_PROVIDERS  = 8
+	MAX_DISCOVERED_SERVERS   = 16
+)
+
+// Refresh interval of a provider that names none
+var defaultDiscoveryRefresh = map[string]string{
+	DISCOVERY_SRV:  "5m",
+	DISCOVERY_FILE: "10s",
+}
+
+// One source of server names. An srv provider looks up Name (e.g.
+// "_ntp._udp.example.com"), a file provider reads Path, a static provider
+// lists Servers.
+type DiscoveryProvider struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Servers []string `json:"servers,omitempty"`
+	Refresh string   `json:"refresh,omitempty"`
+}
+
+// Providers whose servers, merged in order and without duplicates, become
+// the configured servers (at most MaxServers of them)
+type DiscoveryPolicy struct {
+	Enabled    bool                `json:"enabled"`
+	Providers  []DiscoveryProvider `json:"providers"`
+	MaxServers int                 `json:"max_servers"`
+}
+
+// What a provider found at its last refresh
+type DiscoveryProviderStatus struct {
+	Type string `json:"type"`
+	// The SRV record, file or "static"
+	Source      string     `json:"source"`
+	Servers     []string   `json:"servers"`
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"`
+	NextRefresh *time.Time `json:"next_refresh,omitempty"`
+	// A failed refresh keeps the servers found before
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type DiscoveryChange struct {
+	At             time.Time `json:"at"`
+	Servers        []string  `json:"servers"`
+	Previous       []string  `json:"previous"`
+	Applied        bool      `json:"applied"`
+	RestartSuccess bool      `json:"restart_success"`
+}
+
+// Payload of GET /servers/discovery
+type DiscoveryStatus struct {
+	Policy    DiscoveryPolicy           `json:"policy"`
+	Providers []DiscoveryProviderStatus `json:"providers"`
+	// The merged servers last taken over
+	Servers    []string         `json:"servers"`
+	CheckedAt  *time.Time       `json:"checked_at,omitempty"`
+	LastChange *DiscoveryChange `json:"last_change,omitempty"`
+	Error      string           `json:"error,omitempty"`
+}
+
+var (
+	discoveryPath = DISCOVERY_PATH
+	// DNS server (host:port) for SRV lookups instead of the system resolver
+	discoveryDNSServer string
+
+	srvNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9._-]*[A-Za-z0-9])?\.?$`)
+
+	discoveryMutex sync.Mutex
+	// Guarded by discoveryMutex; discoveryState.Providers follows the
+	// order of discoveryPolicy.Providers
+	discoveryPolicy = defaultDiscoveryPolicy()
+	discoveryState  = DiscoveryStatus{Providers: []DiscoveryProviderStatus{}, Servers: []string{}}
+	// Bumped with every new policy, so a refresh under an old one is dropped
+	discoveryGeneration int
+	discoveryCheckMutex sync.Mutex
+)
+
+func init() {
+	if v := os.Getenv("DISCOVERY_PATH"); v != "" {
+		discoveryPath = v
+	}
+	if v := os.Getenv("DISCOVERY_DNS_SERVER"); v != "" {
+		if _, _, err := net.SplitHostPort(v); err == nil {
+			discoveryDNSServer = v
+		} else {
+			log.Printf("Invalid DISCOVERY_DNS_SERVER %q, using the system resolver", v)
+		}
+	}
+}
+
+// Policies are decoded over the defaults, so fields left out keep them
+func defaultDiscoveryPolicy() DiscoveryPolicy {
+	return DiscoveryPolicy{Providers: []DiscoveryProvider{}, MaxServers: 4}
+}
+
+// Helper to get a provider's refresh interval
+func discoveryRefresh(provider DiscoveryProvider) time.Duration {
+	value := provider.Refresh
+	if value == "" {
+		value = defaultDiscoveryRefresh[provider.Type]
+	}
+	refresh, _ := time.ParseDuration(value)
+	return refresh
+}
+
+// Helper to name what a provider reads
+func discoverySource(provider DiscoveryProvider) string {
+	switch provider.Type {
+	case DISCOVERY_SRV:
+		return provider.Name
+	case DISCOVERY_FILE:
+		return provider.Path
+	}
+	return provider.Type
+}
+
+func validateDiscoveryPolicy(policy DiscoveryPolicy) []string {
+	var problems []string
+	if policy.Enabled && len(policy.Providers) == 0 {
+		problems = append(problems, "providers must not be empty when enabled")
+	}
+	if len(policy.Providers) > MAX_DISCOVERY_PROVIDERS {
+		problems = append(problems, fmt.Sprintf("at most %d providers are allowed", MAX_DISCOVERY_PROVIDERS))
+	}
+	if policy.MaxServers < 1 || policy.MaxServers > MAX_DISCOVERED_SERVERS {
+		problems = append(problems, fmt.Sprintf("max_servers must be between 1 and %d", MAX_DISCOVERED_SERVERS))
+	}
+	for i, provider := range policy.Providers {
+		field := fmt.Sprintf("providers[%d]", i)
+		switch provider.Type {
+		case DISCOVERY_SRV:
+			if !srvNamePattern.MatchString(provider.Name) {
+				problems = append(problems, fmt.Sprintf("%s.name %q is not a valid SRV record name", field, provider.Name))
+			}
+			if provider.Path != "" || len(provider.Servers) > 0 {
+				problems = append(problems, fmt.Sprintf("%s: an srv provider takes only name and refresh", field))
+			}
+		case DISCOVERY_FILE:
+			if !filepath.IsAbs(provider.Path) {
+				problems = append(problems, fmt.Sprintf("%s.path %q must be an absolute path", field, provider.Path))
+			}
+			if provider.Name != "" || len(provider.Servers) > 0 {
+				problems = append(problems, fmt.Sprintf("%s: a file provider takes only path and refresh", field))
+			}
+		case DISCOVERY_STATIC:
+			if len(provider.Servers) == 0 {
+				problems = append(problems, fmt.Sprintf("%s.servers must not be empty", field))
+			}
+			for j, server := range provider.Servers {
+				if !hostPattern.MatchString(server) {
+					problems = append(problems, fmt.Sprintf("%s.servers[%d] %q is not a valid host name or address", field, j, server))
+				}
+			}
+			if provider.Name != "" || provider.Path != "" || provider.Refresh != "" {
+				problems = append(problems, fmt.Sprintf("%s: a static provider takes only servers", field))
+			}
+			continue
+		default:
+			problems = append(problems, fmt.Sprintf("%s.type %q must be %s, %s or %s", field, provider.Type, DISCOVERY_SRV, DISCOVERY_FILE, DISCOVERY_STATIC))
+			continue
+		}
+		if provider.Refresh != "" {
+			if refresh, err := time.ParseDuration(provider.Refresh); err != nil || refresh < DISCOVERY_CHECK_INTERVAL {
+				problems = append(problems, fmt.Sprintf("%s.refresh must be a duration of at least %s", field, DISCOVERY_CHECK_INTERVAL))
+			}
+		}
+	}
+	return problems
+}
+
+// Whether discovery sets the servers; automatic server selection cannot be
+// enabled at the same time
+func discoveryEnabled() bool {
+	discoveryMutex.Lock()
+	defer discoveryMutex.Unlock()
+	return discoveryPolicy.Enabled
+}
+
+// On-disk form of the policy
+type discoveryFile struct {
+	DiscoveryPolicy
+	Servers    []string         `json:"servers,omitempty"`
+	LastChange *DiscoveryChange `json:"last_change,omitempty"`
+}
+
+func loadDiscovery() {
+	data, err := ioutil.ReadFile(discoveryPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading %s: %v", discoveryPath, err)
+		}
+		return
+	}
+	file := discoveryFile{DiscoveryPolicy: defaultDiscoveryPolicy()}
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("Error parsing %s: %v", discoveryPath, err)
+		return
+	}
+	if problems := validateDiscoveryPolicy(file.DiscoveryPolicy); len(problems) > 0 {
+		log.Printf("Invalid discovery policy in %s: %s", discoveryPath, strings.Join(problems, "; "))
+		return
+	}
+	discoveryMutex.Lock()
+	setDiscoveryPolicyLocked(file.DiscoveryPolicy)
+	if file.Servers != nil {
+		discoveryState.Servers = file.Servers
+	}
+	discoveryState.LastChange = file.LastChange
+	discoveryMutex.Unlock()
+}
+
+// discoveryMutex must be held
+func saveDiscoveryLocked() error {
+	data, err := json.MarshalIndent(discoveryFile{
+		DiscoveryPolicy: discoveryPolicy,
+		Servers:         discoveryState.Servers,
+		LastChange:      discoveryState.LastChange,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(discoveryPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(discoveryPath, data, 0644)
+}
+
+// Install a policy with fresh provider states, so every provider is
+// refreshed at the next check (discoveryMutex must be held)
+func setDiscoveryPolicyLocked(policy DiscoveryPolicy) {
+	discoveryPolicy = policy
+	discoveryGeneration++
+	discoveryState.Providers = make([]DiscoveryProviderStatus, len(policy.Providers))
+	for i, provider := range policy.Providers {
+		discoveryState.Providers[i] = DiscoveryProviderStatus{
+			Type:    provider.Type,
+			Source:  discoverySource(provider),
+			Servers: []string{},
+		}
+	}
+}
+
+// Helper to get the resolver for SRV lookups
+func discoveryResolver() *net.Resolver {
+	if discoveryDNSServer == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, discoveryDNSServer)
+		},
+	}
+}
+
+// Look up an SRV record. Targets come in priority order, heavier weights
+// first; the order is stable so equal answers never look like a change.
+func discoverSRV(ctx context.Context, name string) ([]string, []string, error) {
+	_, records, err := discoveryResolver().LookupSRV(ctx, "", "", name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil, fmt.Errorf("no SRV record %s", name)
+		}
+		return nil, nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Priority != records[j].Priority {
+			return records[i].Priority < records[j].Priority
+		}
+		if records[i].Weight != records[j].Weight {
+			return records[i].Weight > records[j].Weight
+		}
+		return records[i].Target < records[j].Target
+	})
+	var servers, warnings []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		switch {
+		case target == "":
+			// RFC 2782: a target of "." means the service is not offered
+			continue
+		case record.Port != 123:
+			// chronyd polls the NTP port of every server in the list
+			warnings = append(warnings, fmt.Sprintf("%s skipped: port %d is not the NTP port", target, record.Port))
+		case !hostPattern.MatchString(target):
+			warnings = append(warnings, fmt.Sprintf("%q skipped: not a valid host name", target))
+		default:
+			servers = append(servers, target)
+		}
+	}
+	return servers, warnings, nil
+}
+
+// Read servers from a file. A line may be a chrony or ntpd directive
+// ("server ntp1 iburst"), a shell assignment (NTPSERVERS="ntp1 ntp2") as
+// DHCP client hooks write them, or bare names separated by spaces or commas.
+func discoverFile(path string) ([]string, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var servers, warnings []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		if i := strings.IndexByte(text, '='); i >= 0 {
+			text = strings.Trim(strings.TrimSpace(text[i+1:]), `"'`)
+		}
+		fields := strings.FieldsFunc(text, func(c rune) bool {
+			return c == ' ' || c == '\t' || c == ','
+		})
+		if len(fields) > 1 && (fields[0] == "server" || fields[0] == "pool" || fields[0] == "peer") {
+			fields = fields[1:2]
+		}
+		for _, field := range fields {
+			if hostPattern.MatchString(field) {
+				servers = append(servers, field)
+			} else {
+				warnings = append(warnings, fmt.Sprintf("line %d: %q is not a valid host name or address", line, field))
+			}
+		}
+	}
+	return servers, warnings, scanner.Err()
+}
+
+// Helper to ask one provider for its servers
+func discoverServers(ctx context.Context, provider DiscoveryProvider) ([]string, []string, error) {
+	switch provider.Type {
+	case DISCOVERY_SRV:
+		return discoverSRV(ctx, provider.Name)
+	case DISCOVERY_FILE:
+		return discoverFile(provider.Path)
+	}
+	return provider.Servers, nil, nil
+}
+
+// Refresh the providers that are due (all of them when force is set) and
+// take over the merged servers when they changed
+func refreshDiscovery(ctx context.Context, force bool) {
+	discoveryCheckMutex.Lock()
+	defer discoveryCheckMutex.Unlock()
+
+	discoveryMutex.Lock()
+	policy := discoveryPolicy
+	generation := discoveryGeneration
+	states := append([]DiscoveryProviderStatus{}, discoveryState.Providers...)
+	discoveryMutex.Unlock()
+	if !policy.Enabled {
+		return
+	}
+
+	now := time.Now().UTC()
+	for i, provider := range policy.Providers {
+		state := &states[i]
+		if !force && state.NextRefresh != nil && now.Before(*state.NextRefresh) {
+			continue
+		}
+		servers, warnings, err := discoverServers(ctx, provider)
+		refreshedAt := now
+		state.RefreshedAt = &refreshedAt
+		state.Warnings = warnings
+		if err != nil {
+			state.Error = err.Error()
+		} else {
+			state.Error = ""
+			state.Servers = servers
+			if state.Servers == nil {
+				state.Servers = []string{}
+			}
+		}
+		if refresh := discoveryRefresh(provider); refresh > 0 {
+			next := now.Add(refresh)
+			state.NextRefresh = &next
+		}
+	}
+
+	merged := []string{}
+	for _, state := range states {
+		for _, server := range state.Servers {
+			if !containsString(merged, server) && len(merged) < policy.MaxServers {
+				merged = append(merged, server)
+			}
+		}
+	}
+
+	discoveryMutex.Lock()
+	if discoveryGeneration != generation {
+		// The policy was replaced while the providers were being asked
+		discoveryMutex.Unlock()
+		return
+	}
+	discoveryState.Providers = states
+	discoveryState.CheckedAt = &now
+	discoveryState.Error = ""
+	previous := discoveryState.Servers
+	switch {
+	case len(merged) == 0:
+		discoveryState.Error = "no servers discovered; keeping the configured servers"
+	case sameServers(merged, previous):
+	case failoverOnBackup():
+		// Taken over once failover is back on the primary group
+		discoveryState.Error = "failover is using the backup servers; discovered servers not applied"
+	default:
+		discoveryMutex.Unlock()
+		applyDiscoveredServers(merged, previous, states)
+		return
+	}
+	discoveryMutex.Unlock()
+}
+
+// Make the discovered servers the configured servers, recording the change
+func applyDiscoveredServers(servers []string, previous []string, states []DiscoveryProviderStatus) {
+	sources := map[string][]string{}
+	for _, state := range states {
+		sources[state.Source] = state.Servers
+	}
+	change := DiscoveryChange{At: time.Now().UTC(), Servers: servers, Previous: previous}
+	if !sameServers(servers, getConfiguredServers()) {
+		request := map[string]interface{}{"servers": servers, "previous": previous, "sources": sources}
+		message := fmt.Sprintf("Discovered servers: %s", strings.Join(servers, ", "))
+		restartSuccess, err := setServersAsSystem(servers, AUDIT_DISCOVERY, message, request)
+		if err != nil {
+			// Nothing was changed; try again at the next check
+			log.Printf("Applying discovered servers failed: %v", err)
+			discoveryMutex.Lock()
+			discoveryState.Error = err.Error()
+			discoveryMutex.Unlock()
+			return
+		}
+		change.Applied = true
+		change.RestartSuccess = restartSuccess
+	}
+	log.Printf("Discovered servers %v (previously %v)", servers, previous)
+
+	discoveryMutex.Lock()
+	discoveryState.Servers = servers
+	discoveryState.LastChange = &change
+	if err := saveDiscoveryLocked(); err != nil {
+		log.Printf("Failed to save discovery state: %v", err)
+	}
+	discoveryMutex.Unlock()
+
+	emitEvent(EVENT_SERVERS_DISCOVERED, map[string]interface{}{
+		"servers":         servers,
+		"previous":        previous,
+		"sources":         sources,
+		"applied":         change.Applied,
+		"restart_success": change.RestartSuccess,
+	})
+}
+
+func startDiscovery() {
+	loadDiscovery()
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), backendRequestTimeout)
+			refreshDiscovery(ctx, false)
+			cancel()
+			time.Sleep(DISCOVERY_CHECK_INTERVAL)
+		}
+	}()
+}
+
+// GET /servers/discovery shows the policy and what each provider found;
+// POST refreshes every provider now; PUT replaces the policy (fields left
+// out take their defaults)
+func handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodPost:
+		if r.Method == http.MethodPost {
+			ctx, cancel := backendContext(r)
+			refreshDiscovery(ctx, true)
+			cancel()
+		}
+		discoveryMutex.Lock()
+		status := discoveryState
+		status.Policy = discoveryPolicy
+		discoveryMutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodPut:
+		policy := defaultDiscoveryPolicy()
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&policy); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if policy.Providers == nil {
+			policy.Providers = []DiscoveryProvider{}
+		}
+		if problems := validateDiscoveryPolicy(policy); len(problems) > 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid discovery policy", problems)
+			return
+		}
+		if policy.Enabled && serverSelectionEnabled() {
+			writeError(w, r, http.StatusConflict, ERR_CONFLICT, "Automatic server selection is enabled; disable it before enabling discovery", nil)
+			return
+		}
+		discoveryMutex.Lock()
+		previous := discoveryPolicy
+		previousState := discoveryState
+		setDiscoveryPolicyLocked(policy)
+		// The first refresh under the new policy takes over what it finds
+		discoveryState.Servers = []string{}
+		err := saveDiscoveryLocked()
+		if err != nil {
+			discoveryPolicy = previous
+			discoveryState = previousState
+		}
+		discoveryMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save discovery policy", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"policy": policy})
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// SRV answer served by the stub resolver
+type testSRV struct {
+	priority, weight, port uint16
+	target                 string
+}
+
+// Helper to encode a domain name as DNS labels
+func encodeDNSName(name string) []byte {
+	var out []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			out = append(out, byte(len(label)))
+			out = append(out, label...)
+		}
+	}
+	return append(out, 0)
+}
+
+// Answer SRV queries over UDP from records (keyed by name without the
+// trailing dot); other names get NXDOMAIN. Returns host:port.
+func startTestDNS(t *testing.T, records map[string][]testSRV) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		query := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(query)
+			if err != nil {
+				return
+			}
+			if n < 12 {
+				continue
+			}
+			// The question is the name up to the root label, then type and class
+			end := 12
+			var labels []string
+			for end < n && query[end] != 0 {
+				size := int(query[end])
+				if end+1+size > n {
+					break
+				}
+				labels = append(labels, string(query[end+1:end+1+size]))
+				end += 1 + size
+			}
+			end += 5
+			if end > n {
+				continue
+			}
+			answers, found := records[strings.Join(labels, ".")]
+
+			response := append([]byte(nil), query[:end]...)
+			flags := uint16(0x8580) // response, authoritative, recursion desired and available
+			if !found {
+				flags |= 3 // NXDOMAIN
+			}
+			binary.BigEndian.PutUint16(response[2:4], flags)
+			binary.BigEndian.PutUint16(response[6:8], uint16(len(answers)))
+			binary.BigEndian.PutUint16(response[8:10], 0)
+			binary.BigEndian.PutUint16(response[10:12], 0)
+			for _, srv := range answers {
+				target := encodeDNSName(srv.target)
+				rr := []byte{0xc0, 12, 0, 33, 0, 1, 0, 0, 0, 60}
+				rr = binary.BigEndian.AppendUint16(rr, uint16(6+len(target)))
+				rr = binary.BigEndian.AppendUint16(rr, srv.priority)
+				rr = binary.BigEndian.AppendUint16(rr, srv.weight)
+				rr = binary.BigEndian.AppendUint16(rr, srv.port)
+				response = append(append(response, rr...), target...)
+			}
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func useTestDNS(t *testing.T, records map[string][]testSRV) {
+	t.Helper()
+	saved := discoveryDNSServer
+	discoveryDNSServer = startTestDNS(t, records)
+	t.Cleanup(func() { discoveryDNSServer = saved })
+}
+
+func TestDiscoverSRVOrdersTargets(t *testing.T) {
+	useTestDNS(t, map[string][]testSRV{
+		"_ntp._udp.example.test": {
+			{priority: 20, weight: 0, port: 123, target: "fallback.example.test."},
+			{priority: 10, weight: 5, port: 123, target: "light.example.test."},
+			{priority: 10, weight: 50, port: 123, target: "heavy.example.test."},
+			{priority: 10, weight: 5, port: 123, target: "alpha.example.test."},
+		},
+	})
+
+	servers, warnings, err := discoverSRV(context.Background(), "_ntp._udp.example.test")
+	if err != nil {
+		t.Fatalf("discoverSRV: %v", err)
+	}
+	want := "heavy.example.test,alpha.example.test,light.example.test,fallback.example.test"
+	if got := strings.Join(servers, ","); got != want {
+		t.Errorf("servers = %s, want %s (priority, then heavier weight, then name)", got, want)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %v, want none", warnings)
+	}
+}
+
+func TestDiscoverSRVRejectsBadTargets(t *testing.T) {
+	useTestDNS(t, map[string][]testSRV{
+		"_ntp._udp.example.test": {
+			{priority: 10, weight: 0, port: 123, target: "good.example.test."},
+			{priority: 10, weight: 0, port: 4460, target: "nts.example.test."},
+			{priority: 10, weight: 0, port: 123, target: "_bad.example.test."},
+			{priority: 20, weight: 0, port: 123, target: "."},
+		},
+		"_ntp._udp.none.test": {
+			{priority: 0, weight: 0, port: 0, target: "."},
+		},
+	})
+
+	servers, warnings, err := discoverSRV(context.Background(), "_ntp._udp.example.test")
+	if err != nil {
+		t.Fatalf("discoverSRV: %v", err)
+	}
+	if strings.Join(servers, ",") != "good.example.test" {
+		t.Errorf("servers = %v, want only the valid NTP target", servers)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0]+warnings[1], "port 4460 is not the NTP port") || !strings.Contains(warnings[0]+warnings[1], `"_bad.example.test" skipped`) {
+		t.Errorf("warnings = %q, want the wrong port and the invalid name", warnings)
+	}
+
+	// "." alone means the service is deliberately not offered
+	if servers, _, err := discoverSRV(context.Background(), "_ntp._udp.none.test"); err != nil || len(servers) != 0 {
+		t.Errorf("service not offered: servers %v, err %v; want none without an error", servers, err)
+	}
+	if _, _, err := discoverSRV(context.Background(), "_ntp._udp.missing.test"); err == nil || !strings.Contains(err.Error(), "no SRV record") {
+		t.Errorf("missing record: err = %v, want no SRV record", err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types emitted by the service
+const (
+	EVENT_SYNC_LOST           = "sync.lost"
+	EVENT_SYNC_RESTORED       = "sync.restored"
+	EVENT_SERVER_MODE_CHANGED = "server_mode.changed"
+	EVENT_SERVERS_CHANGED     = "servers.changed"
+	EVENT_SERVERS_SELECTED    = "servers.selected"
+	EVENT_FAILOVER_SWITCHED   = "failover.switched"
+	EVENT_SERVERS_DISCOVERED  = "servers.discovered"
+	EVENT_CONFIG_CHANGED      = "config.changed"
+	EVENT_CONFIG_CONFIRMED    = "config.confirmed"
+	EVENT_CONFIG_REVERTED     = "config.reverted"
+	EVENT_HEALTH_CHANGED      = "health.changed"
+	EVENT_WEBHOOK_TEST        = "webhook.test"
+)
+
+// Event is a notification about a state change in the service
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+var (
+	eventSubscribers  = map[int]func(Event){}
+	nextSubscriberID  int
+	eventMutex        sync.RWMutex
+	eventKeepalive    = 15 * time.Second
+	eventClientBuffer = 64
+)
+
+// Helper to generate a random hex identifier
+func newID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return strings.ReplaceAll(time.Now().UTC().Format("20060102150405.000000000"), ".", "")
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Register a function to be called for every emitted event; returns an unsubscribe function
+func subscribeEvents(fn func(Event)) func() {
+	eventMutex.Lock()
+	defer eventMutex.Unlock()
+	id := nextSubscriberID
+	nextSubscriberID++
+	eventSubscribers[id] = fn
+	return func() {
+		eventMutex.Lock()
+		defer eventMutex.Unlock()
+		delete(eventSubscribers, id)
+	}
+}
+
+// Emit an event to all subscribers; subscribers must not block
+func emitEvent(eventType string, data map[string]interface{}) Event {
+	event := Event{
+		ID:        newID(),
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+	if event.Data == nil {
+		event.Data = map[string]interface{}{}
+	}
+
+	eventMutex.RLock()
+	subscribers := make([]func(Event), 0, len(eventSubscribers))
+	for _, fn := range eventSubscribers {
+		subscribers = append(subscribers, fn)
+	}
+	eventMutex.RUnlock()
+
+	log.Printf("Event %s (%s)", event.Type, event.ID)
+	for _, fn := range subscribers {
+		fn(event)
+	}
+	return event
+}
+
+// Helper to decide whether tracking data reports a synchronized clock
+func isTrackingSynchronized(tracking map[string]string) bool {
+	if tracking == nil || tracking["error"] != "" {
+		return false
+	}
+	leap, ok := tracking["Leap status"]
+	if !ok {
+		return false
+	}
+	return leap != "Not synchronised"
+}
+
+// Poll chronyd and emit sync.lost / sync.restored on transitions
+func startSyncWatcher() {
+	interval := 15 * time.Second
+	if v := os.Getenv("SYNC_WATCH_INTERVAL"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			interval = parsed
+		} else {
+			log.Printf("Invalid SYNC_WATCH_INTERVAL %q, using %s", v, interval)
+		}
+	}
+
+	initializeCaches()
+	go func() {
+		known := false
+		synced := false
+		for {
+			// Read through the cache so the watcher shares chronyc runs with everyone else
+			ctx, cancel := context.WithTimeout(context.Background(), backendRequestTimeout)
+			snapshot := trackingCache.Snapshot(ctx)
+			cancel()
+			tracking, _ := snapshot.Data.(map[string]string)
+			if snapshot.Err != nil {
+				tracking = map[string]string{"error": snapshot.Err.Error()}
+			}
+			current := isTrackingSynchronized(tracking)
+			setLocalSyncState(current)
+
+			if known && current != synced {
+				data := map[string]interface{}{
+					"reference_id": tracking["ReferenceID"],
+					"stratum":      tracking["Stratum"],
+					"leap_status":  tracking["Leap status"],
+				}
+				if snapshot.Err != nil {
+					data["error"] = snapshot.Err.Error()
+				}
+				if current {
+					emitEvent(EVENT_SYNC_RESTORED, data)
+				} else {
+					emitEvent(EVENT_SYNC_LOST, data)
+				}
+			}
+			known = true
+			synced = current
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Stream events as Server-Sent Events; ?types=a,b limits the event types
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Streaming not supported", nil)
+		return
+	}
+
+	types := map[string]bool{}
+	if v := r.URL.Query().Get("types"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types[t] = true
+			}
+		}
+	}
+
+	// Slow clients drop events rather than blocking emitters
+	events := make(chan Event, eventClientBuffer)
+	unsubscribe := subscribeEvents(func(event Event) {
+		if len(types) > 0 && !types[event.Type] {
+			return
+		}
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
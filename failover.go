@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FAILOVER_PATH = "/etc/brick/clock/failover.json"
+
+	FAILOVER_PRIMARY = "primary"
+	FAILOVER_BACKUP  = "backup"
+	// The configured servers are neither group, so failover is suspended
+	FAILOVER_NONE = "none"
+
+	// How often the failover policy looks at the sources
+	FAILOVER_CHECK_INTERVAL = 10 * time.Second
+)
+
+// Primary and backup server groups. When every source of the primary group
+// has been unreachable for OutageWindow, the backup group replaces it; once
+// a primary has answered SNTP queries for RecoveryWindow without a failure,
+// the primaries come back.
+type FailoverPolicy struct {
+	Enabled        bool     `json:"enabled"`
+	Primary        []string `json:"primary"`
+	Backup         []string `json:"backup"`
+	OutageWindow   string   `json:"outage_window"`
+	RecoveryWindow string   `json:"recovery_window"`
+}
+
+type FailoverSwitch struct {
+	From           string    `json:"from"`
+	To             string    `json:"to"`
+	At             time.Time `json:"at"`
+	Reason         string    `json:"reason"`
+	Servers        []string  `json:"servers"`
+	RestartSuccess bool      `json:"restart_success"`
+}
+
+// Payload of GET /servers/failover
+type FailoverStatus struct {
+	Policy FailoverPolicy `json:"policy"`
+	// Group the configured servers are: "primary", "backup", or "none"
+	// while failover is suspended because they are neither
+	Active    string     `json:"active"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	// When the primaries stopped being reachable, while on the primary group
+	OutageSince *time.Time `json:"outage_since,omitempty"`
+	// Since when a primary has answered without interruption, while on the backup group
+	RecoveringSince *time.Time `json:"recovering_since,omitempty"`
+	// The primaries' answers at the last check, while on the backup group
+	PrimaryProbes []SNTPResult    `json:"primary_probes,omitempty"`
+	LastSwitch    *FailoverSwitch `json:"last_switch,omitempty"`
+	Error         string          `json:"error,omitempty"`
+}
+
+var (
+	failoverPath = FAILOVER_PATH
+
+	failoverMutex sync.Mutex
+	// Guarded by failoverMutex
+	failoverPolicy     = defaultFailoverPolicy()
+	failoverState      = FailoverStatus{Active: FAILOVER_PRIMARY}
+	failoverCheckMutex sync.Mutex
+)
+
+func init() {
+	if v := os.Getenv("FAILOVER_PATH"); v != "" {
+		failoverPath = v
+	}
+}
+
+// Policies are decoded over the defaults, so fields left out keep them
+func defaultFailoverPolicy() FailoverPolicy {
+	return FailoverPolicy{Primary: []string{}, Backup: []string{}, OutageWindow: "5m", RecoveryWindow: "10m"}
+}
+
+func validateFailoverPolicy(policy FailoverPolicy) []string {
+	var problems []string
+	seen := map[string]string{}
+	for group, servers := range map[string][]string{FAILOVER_PRIMARY: policy.Primary, FAILOVER_BACKUP: policy.Backup} {
+		if policy.Enabled && len(servers) == 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be empty when enabled", group))
+		}
+		for i, server := range servers {
+			if !hostPattern.MatchString(server) {
+				problems = append(problems, fmt.Sprintf("%s[%d] %q is not a valid host name or address", group, i, server))
+			} else if _, _, err := net.SplitHostPort(server); err == nil {
+				problems = append(problems, fmt.Sprintf("%s[%d] %q must not include a port", group, i, server))
+			}
+			if other, ok := seen[server]; ok {
+				problems = append(problems, fmt.Sprintf("%s[%d] %q is already listed in %s", group, i, server, other))
+			}
+			seen[server] = group
+		}
+	}
+	if window, err := time.ParseDuration(policy.OutageWindow); err != nil || window < FAILOVER_CHECK_INTERVAL {
+		problems = append(problems, fmt.Sprintf("outage_window must be a duration of at least %s", FAILOVER_CHECK_INTERVAL))
+	}
+	if window, err := time.ParseDuration(policy.RecoveryWindow); err != nil || window < 0 {
+		problems = append(problems, "recovery_window must be a non-negative duration")
+	}
+	return problems
+}
+
+// On-disk form of the policy
+type failoverFile struct {
+	FailoverPolicy
+	LastSwitch *FailoverSwitch `json:"last_switch,omitempty"`
+}
+
+func loadFailover() {
+	data, err := ioutil.ReadFile(failoverPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading %s: %v", failoverPath, err)
+		}
+		return
+	}
+	file := failoverFile{FailoverPolicy: defaultFailoverPolicy()}
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("Error parsing %s: %v", failoverPath, err)
+		return
+	}
+	if problems := validateFailoverPolicy(file.FailoverPolicy); len(problems) > 0 {
+		log.Printf("Invalid failover policy in %s: %s", failoverPath, strings.Join(problems, "; "))
+		return
+	}
+	failoverMutex.Lock()
+	failoverPolicy = file.FailoverPolicy
+	failoverState.LastSwitch = file.LastSwitch
+	failoverMutex.Unlock()
+}
+
+// failoverMutex must be held
+func saveFailoverLocked() error {
+	data, err := json.MarshalIndent(failoverFile{FailoverPolicy: failoverPolicy, LastSwitch: failoverState.LastSwitch}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(failoverPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(failoverPath, data, 0644)
+}
+
+// Whether failover has switched to the backup group; automatic server
+// selection stands aside while it has
+func failoverOnBackup() bool {
+	failoverMutex.Lock()
+	defer failoverMutex.Unlock()
+	return failoverPolicy.Enabled && failoverState.Active == FAILOVER_BACKUP
+}
+
+// Helper to tell which group the configured servers are
+func failoverGroup(policy FailoverPolicy, configured []string) string {
+	switch {
+	case sameServers(configured, policy.Primary):
+		return FAILOVER_PRIMARY
+	case sameServers(configured, policy.Backup):
+		return FAILOVER_BACKUP
+	}
+	return FAILOVER_NONE
+}
+
+// Helper to tell whether any primary answers over SNTP
+func probePrimaries(ctx context.Context, primaries []string) ([]SNTPResult, bool) {
+	results := make([]SNTPResult, len(primaries))
+	var wg sync.WaitGroup
+	for i, server := range primaries {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			results[i] = sntpQuery(ctx, server)
+		}(i, server)
+	}
+	wg.Wait()
+	for _, result := range results {
+		if result.Error == "" {
+			return results, true
+		}
+	}
+	return results, false
+}
+
+// Look at the sources (or, on the backup group, probe the primaries) and
+// switch groups once the outage or recovery window has passed. Servers set
+// by someone else belong to neither group; failover then does nothing until
+// they match one again, so an operator's choice is never overwritten.
+func checkFailover(ctx context.Context) {
+	failoverCheckMutex.Lock()
+	defer failoverCheckMutex.Unlock()
+
+	failoverMutex.Lock()
+	policy := failoverPolicy
+	failoverMutex.Unlock()
+	if !policy.Enabled {
+		return
+	}
+	outageWindow, _ := time.ParseDuration(policy.OutageWindow)
+	recoveryWindow, _ := time.ParseDuration(policy.RecoveryWindow)
+
+	now := time.Now().UTC()
+	active := failoverGroup(policy, getConfiguredServers())
+
+	failoverMutex.Lock()
+	if failoverState.Active != active {
+		// The servers were changed behind our back; start over
+		failoverState.OutageSince = nil
+		failoverState.RecoveringSince = nil
+	}
+	failoverState.Active = active
+	failoverState.CheckedAt = &now
+	failoverState.Error = ""
+	if active == FAILOVER_NONE {
+		failoverState.PrimaryProbes = nil
+		failoverState.Error = "the configured servers are neither the primary nor the backup group; failover is suspended"
+		failoverMutex.Unlock()
+		return
+	}
+	failoverMutex.Unlock()
+
+	var switchTo, reason string
+	if active == FAILOVER_PRIMARY {
+		// chronyd only polls the configured servers, so their sources are the primaries
+		initializeCaches()
+		snapshot := sourcesCache.Snapshot(ctx)
+		sources, _ := snapshot.Data.([]map[string]string)
+
+		failoverMutex.Lock()
+		failoverState.PrimaryProbes = nil
+		switch {
+		case snapshot.Err != nil:
+			// Switching servers does not help when chronyd itself is not answering
+			failoverState.Error = snapshot.Err.Error()
+		case len(sources) > 0 && countReachableSources(sources) > 0:
+			failoverState.OutageSince = nil
+		case failoverState.OutageSince == nil:
+			failoverState.OutageSince = &now
+		case now.Sub(*failoverState.OutageSince) >= outageWindow:
+			switchTo = FAILOVER_BACKUP
+			reason = fmt.Sprintf("no primary source reachable for %s", now.Sub(*failoverState.OutageSince).Round(time.Second))
+		}
+		failoverMutex.Unlock()
+	} else {
+		results, answered := probePrimaries(ctx, policy.Primary)
+
+		failoverMutex.Lock()
+		failoverState.PrimaryProbes = results
+		switch {
+		case !answered:
+			failoverState.RecoveringSince = nil
+		case failoverState.RecoveringSince == nil && recoveryWindow > 0:
+			failoverState.RecoveringSince = &now
+		case recoveryWindow == 0 || now.Sub(*failoverState.RecoveringSince) >= recoveryWindow:
+			switchTo = FAILOVER_PRIMARY
+			reason = "primaries answering again"
+			if failoverState.RecoveringSince != nil {
+				reason = fmt.Sprintf("primaries answering for %s", now.Sub(*failoverState.RecoveringSince).Round(time.Second))
+			}
+		}
+		failoverMutex.Unlock()
+	}
+	if switchTo != "" {
+		switchFailover(policy, active, switchTo, reason)
+	}
+}
+
+// Make the given group the configured servers, recording the switch
+func switchFailover(policy FailoverPolicy, from string, to string, reason string) {
+	servers := policy.Primary
+	if to == FAILOVER_BACKUP {
+		servers = policy.Backup
+	}
+	request := map[string]interface{}{"from": from, "to": to, "servers": servers, "reason": reason}
+	message := fmt.Sprintf("Failover to %s servers: %s", to, reason)
+	restartSuccess, err := setServersAsSystem(servers, AUDIT_FAILOVER, message, request)
+
+	record := FailoverSwitch{From: from, To: to, At: time.Now().UTC(), Reason: reason, Servers: servers, RestartSuccess: restartSuccess}
+	if err != nil {
+		// Nothing was changed; try again at the next check
+		log.Printf("Failover to %s servers failed: %v", to, err)
+		failoverMutex.Lock()
+		failoverState.Error = err.Error()
+		failoverMutex.Unlock()
+		return
+	}
+	log.Printf("Failover switched from %s to %s servers %v: %s", from, to, servers, reason)
+
+	failoverMutex.Lock()
+	failoverState.Active = to
+	failoverState.OutageSince = nil
+	failoverState.RecoveringSince = nil
+	failoverState.LastSwitch = &record
+	if err := saveFailoverLocked(); err != nil {
+		log.Printf("Failed to save failover state: %v", err)
+	}
+	failoverMutex.Unlock()
+
+	emitEvent(EVENT_FAILOVER_SWITCHED, map[string]interface{}{
+		"from":            from,
+		"to":              to,
+		"servers":         servers,
+		"reason":          reason,
+		"restart_success": restartSuccess,
+	})
+}
+
+func startFailover() {
+	loadFailover()
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), backendRequestTimeout)
+			checkFailover(ctx)
+			cancel()
+			time.Sleep(FAILOVER_CHECK_INTERVAL)
+		}
+	}()
+}
+
+// GET /servers/failover shows the policy and where it stands; PUT replaces
+// the policy (fields left out take their defaults)
+func handleFailover(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		failoverMutex.Lock()
+		status := failoverState
+		status.Policy = failoverPolicy
+		failoverMutex.Unlock()
+		status.Active = failoverGroup(status.Policy, getConfiguredServers())
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodPut:
+		policy := defaultFailoverPolicy()
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&policy); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if policy.Primary == nil {
+			policy.Primary = []string{}
+		}
+		if policy.Backup == nil {
+			policy.Backup = []string{}
+		}
+		if problems := validateFailoverPolicy(policy); len(problems) > 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid failover policy", problems)
+			return
+		}
+		failoverMutex.Lock()
+		previous := failoverPolicy
+		failoverPolicy = policy
+		// Windows restart under the new policy
+		failoverState.OutageSince = nil
+		failoverState.RecoveringSince = nil
+		err := saveFailoverLocked()
+		if err != nil {
+			failoverPolicy = previous
+		}
+		failoverMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save failover policy", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"policy": policy})
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
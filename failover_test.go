@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Enable a failover policy whose primaries have been unreachable for an
+// hour, so a check on the primary group switches right away
+func useTestFailover(t *testing.T) FailoverPolicy {
+	t.Helper()
+	resetTestChronyConf(t)
+	sources := filepath.Join(os.Getenv("FAKE_CHRONYC_DIR"), "sources")
+	saved, err := ioutil.ReadFile(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := "MS Name/IP address         Stratum Poll Reach LastRx Last sample\n" +
+		"===============================================================================\n" +
+		"^? 10.0.0.1                      3   6     0    20   -1ms[ -1ms] +/-   30ms"
+	if err := ioutil.WriteFile(sources, []byte(unreachable), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := FailoverPolicy{Enabled: true, Primary: []string{"ntp1.example"}, Backup: []string{"ntp2.example"}, OutageWindow: "10s", RecoveryWindow: "1m"}
+	outage := time.Now().Add(-time.Hour)
+	failoverMutex.Lock()
+	savedPolicy, savedState := failoverPolicy, failoverState
+	failoverPolicy = policy
+	failoverState = FailoverStatus{Active: FAILOVER_PRIMARY, OutageSince: &outage}
+	failoverMutex.Unlock()
+	t.Cleanup(func() {
+		ioutil.WriteFile(sources, saved, 0644)
+		invalidateCaches()
+		failoverMutex.Lock()
+		failoverPolicy, failoverState = savedPolicy, savedState
+		failoverMutex.Unlock()
+	})
+	invalidateCaches()
+	return policy
+}
+
+func TestFailoverSwitchesFromPrimaryToBackup(t *testing.T) {
+	policy := useTestFailover(t)
+	if err := updateChronyConfServers(policy.Primary); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFailover(context.Background())
+	if servers := getConfiguredServers(); !sameServers(servers, policy.Backup) {
+		t.Fatalf("servers after the outage window = %v, want the backup group", servers)
+	}
+	failoverMutex.Lock()
+	defer failoverMutex.Unlock()
+	if failoverState.Active != FAILOVER_BACKUP || failoverState.LastSwitch == nil || failoverState.LastSwitch.From != FAILOVER_PRIMARY {
+		t.Errorf("state = %+v, want a switch from primary to backup", failoverState)
+	}
+}
+
+func TestFailoverIsSuspendedOnOtherServers(t *testing.T) {
+	policy := useTestFailover(t)
+	if err := updateChronyConfServers([]string{"operator.example"}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFailover(context.Background())
+	if servers := getConfiguredServers(); strings.Join(servers, ",") != "operator.example" {
+		t.Fatalf("servers = %v, want the operator's choice kept", servers)
+	}
+	failoverMutex.Lock()
+	state := failoverState
+	failoverMutex.Unlock()
+	if state.Active != FAILOVER_NONE || state.LastSwitch != nil || !strings.Contains(state.Error, "suspended") {
+		t.Errorf("state = %+v, want failover suspended", state)
+	}
+
+	// Once the servers are a group again, failover resumes from a fresh window
+	if err := updateChronyConfServers(policy.Primary); err != nil {
+		t.Fatal(err)
+	}
+	checkFailover(context.Background())
+	failoverMutex.Lock()
+	state = failoverState
+	failoverMutex.Unlock()
+	if state.Active != FAILOVER_PRIMARY || state.OutageSince == nil || time.Since(*state.OutageSince) > time.Minute || state.LastSwitch != nil {
+		t.Errorf("state = %+v, want the primary group with a new outage window", state)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sync health states; see evaluateHealthState for the transition rules
+const (
+	HEALTH_UNSYNCHRONIZED = "unsynchronized"
+	HEALTH_ACQUIRING      = "acquiring"
+	HEALTH_SYNCHRONIZED   = "synchronized"
+	HEALTH_DEGRADED       = "degraded"
+	HEALTH_HOLDOVER       = "holdover"
+
+	// Transitions kept for GET /status/health
+	HEALTH_HISTORY_SIZE = 20
+)
+
+// What the last evaluation saw
+type HealthObservation struct {
+	Synchronized     bool     `json:"synchronized"`
+	SelectedSource   string   `json:"selected_source,omitempty"`
+	ReachableSources int      `json:"reachable_sources"`
+	OffsetMs         *float64 `json:"offset_ms,omitempty"`
+	LeapStatus       string   `json:"leap_status,omitempty"`
+	Stratum          string   `json:"stratum,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+type HealthTransition struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	At      time.Time `json:"at"`
+	Score   int       `json:"score"`
+	Reasons []string  `json:"reasons"`
+}
+
+// Whether the clock can be trusted, as one state and a 0-100 score
+type SyncHealth struct {
+	State            string            `json:"state"`
+	Score            int               `json:"score"`
+	Reasons          []string          `json:"reasons"`
+	Since            time.Time         `json:"since"`
+	EvaluatedAt      time.Time         `json:"evaluated_at"`
+	LastSynchronized *time.Time        `json:"last_synchronized,omitempty"`
+	Observed         HealthObservation `json:"observed"`
+	// Most recent first; only returned by GET /status/health
+	Transitions []HealthTransition `json:"transitions,omitempty"`
+}
+
+var (
+	healthInterval      = 10 * time.Second
+	healthHoldoverLimit = time.Hour
+	healthSettleChecks  = 3
+
+	healthMutex sync.Mutex
+	// Guarded by healthMutex
+	health            *SyncHealth
+	healthGoodStreak  int
+	healthStreakData  time.Time
+	healthTransitions []HealthTransition
+)
+
+func init() {
+	if v := os.Getenv("HEALTH_EVAL_INTERVAL"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			healthInterval = parsed
+		} else {
+			log.Printf("Invalid HEALTH_EVAL_INTERVAL %q, using %s", v, healthInterval)
+		}
+	}
+	if v := os.Getenv("HEALTH_HOLDOVER_LIMIT"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			healthHoldoverLimit = parsed
+		} else {
+			log.Printf("Invalid HEALTH_HOLDOVER_LIMIT %q, using %s", v, healthHoldoverLimit)
+		}
+	}
+	if v := os.Getenv("HEALTH_SETTLE_CHECKS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			healthSettleChecks = parsed
+		} else {
+			log.Printf("Invalid HEALTH_SETTLE_CHECKS %q, using %d", v, healthSettleChecks)
+		}
+	}
+}
+
+// Helper to extract the inputs of the state machine from chrony data
+func observeHealth(tracking map[string]string, trackingErr error, sources []map[string]string, sourcesErr error) HealthObservation {
+	observed := HealthObservation{ReachableSources: countReachableSources(sources)}
+	if trackingErr != nil {
+		observed.Error = trackingErr.Error()
+	} else if sourcesErr != nil {
+		observed.Error = sourcesErr.Error()
+	}
+	if trackingErr == nil {
+		observed.Synchronized = isTrackingSynchronized(tracking)
+		observed.LeapStatus = tracking["Leap status"]
+		observed.Stratum = tracking["Stratum"]
+		if ms, ok := parseSecondsToMs(tracking["System time"]); ok {
+			offset := math.Abs(ms)
+			observed.OffsetMs = &offset
+		}
+	}
+	for _, source := range sources {
+		if strings.HasSuffix(source["state"], "*") {
+			observed.SelectedSource = source["name"]
+		}
+	}
+	return observed
+}
+
+// Decide the next state. The rules:
+//
+//   - synchronized: chronyd is synchronized to a selected source, the offset is
+//     within SYNC_MAX_OFFSET and at least SYNC_MIN_SOURCES sources are reachable
+//   - degraded: synchronized to a selected source, but the offset or the number
+//     of reachable sources is outside those limits
+//   - acquiring: not (yet) trusted but sources are reachable; also the first
+//     HEALTH_SETTLE_CHECKS good evaluations of fresh tracking data after start or
+//     after unsynchronized
+//   - holdover: was synchronized or degraded, then lost sync (or chronyd stopped
+//     answering) less than HEALTH_HOLDOVER_LIMIT ago; the clock runs on its last
+//     frequency estimate. Regaining sync from holdover needs no settling.
+//   - unsynchronized: none of the above
+func evaluateHealthState(previous string, goodStreak int, lastSynchronized *time.Time, observed HealthObservation, maxOffset time.Duration, minSources int, now time.Time) (string, []string) {
+	good := observed.Error == "" && observed.Synchronized && observed.SelectedSource != ""
+	if good {
+		wasTrusted := previous == HEALTH_SYNCHRONIZED || previous == HEALTH_DEGRADED || previous == HEALTH_HOLDOVER
+		if !wasTrusted && goodStreak < healthSettleChecks {
+			return HEALTH_ACQUIRING, []string{fmt.Sprintf("settling: %d of %d good checks", goodStreak, healthSettleChecks)}
+		}
+		var issues []string
+		if observed.OffsetMs != nil && *observed.OffsetMs > float64(maxOffset)/float64(time.Millisecond) {
+			issues = append(issues, fmt.Sprintf("offset %.3fms exceeds %s", *observed.OffsetMs, maxOffset))
+		}
+		if observed.ReachableSources < minSources {
+			issues = append(issues, fmt.Sprintf("%d reachable sources, %d required", observed.ReachableSources, minSources))
+		}
+		if len(issues) > 0 {
+			return HEALTH_DEGRADED, issues
+		}
+		return HEALTH_SYNCHRONIZED, []string{}
+	}
+
+	var reasons []string
+	switch {
+	case observed.Error != "":
+		reasons = append(reasons, "chronyd not answering: "+observed.Error)
+	case !observed.Synchronized:
+		reasons = append(reasons, "chronyd is not synchronised")
+	default:
+		reasons = append(reasons, "no selected source")
+	}
+	if lastSynchronized != nil && now.Sub(*lastSynchronized) < healthHoldoverLimit {
+		remaining := healthHoldoverLimit - now.Sub(*lastSynchronized)
+		return HEALTH_HOLDOVER, append(reasons, fmt.Sprintf("holdover ends in %s", remaining.Round(time.Second)))
+	}
+	if observed.Error == "" && observed.ReachableSources > 0 {
+		return HEALTH_ACQUIRING, append(reasons, fmt.Sprintf("%d sources reachable", observed.ReachableSources))
+	}
+	return HEALTH_UNSYNCHRONIZED, reasons
+}
+
+// Helper to condense a state into 0-100: unsynchronized 0, acquiring 25,
+// holdover 50 falling to 1 over the holdover limit, degraded 75 with one
+// issue and 10 less per further issue (at least 50), synchronized 90-100
+// depending on the offset
+func healthScore(state string, reasons []string, observed HealthObservation, lastSynchronized *time.Time, maxOffset time.Duration, now time.Time) int {
+	switch state {
+	case HEALTH_ACQUIRING:
+		return 25
+	case HEALTH_HOLDOVER:
+		remaining := 1 - float64(now.Sub(*lastSynchronized))/float64(healthHoldoverLimit)
+		return int(math.Max(1, math.Round(50*remaining)))
+	case HEALTH_DEGRADED:
+		return int(math.Max(50, float64(85-10*len(reasons))))
+	case HEALTH_SYNCHRONIZED:
+		if observed.OffsetMs == nil {
+			return 90
+		}
+		fraction := *observed.OffsetMs / (float64(maxOffset) / float64(time.Millisecond))
+		return 100 - int(math.Round(10*math.Min(1, fraction)))
+	}
+	return 0
+}
+
+// Evaluate the current data, record a transition and emit health.changed
+// when the state changes
+func evaluateHealth(ctx context.Context) SyncHealth {
+	initializeCaches()
+	snapshots := snapshotCaches(ctx, trackingCache, sourcesCache)
+	tracking, _ := snapshots[trackingCache].Data.(map[string]string)
+	sources, _ := snapshots[sourcesCache].Data.([]map[string]string)
+	observed := observeHealth(tracking, snapshots[trackingCache].Err, sources, snapshots[sourcesCache].Err)
+	now := time.Now().UTC()
+
+	healthMutex.Lock()
+	previous := ""
+	var lastSynchronized *time.Time
+	if health != nil {
+		previous = health.State
+		lastSynchronized = health.LastSynchronized
+	}
+	if observed.Error == "" && observed.Synchronized && observed.SelectedSource != "" {
+		// Evaluating the same cached tracking data again is not another good check
+		if collectedAt := snapshots[trackingCache].CollectedAt; !collectedAt.Equal(healthStreakData) {
+			healthGoodStreak++
+			healthStreakData = collectedAt
+		}
+	} else {
+		healthGoodStreak = 0
+		healthStreakData = time.Time{}
+	}
+	state, reasons := evaluateHealthState(previous, healthGoodStreak, lastSynchronized, observed, syncMaxOffset, syncMinSources, now)
+	if state == HEALTH_SYNCHRONIZED || state == HEALTH_DEGRADED {
+		lastSynchronized = &now
+	}
+
+	next := SyncHealth{
+		State:            state,
+		Score:            healthScore(state, reasons, observed, lastSynchronized, syncMaxOffset, now),
+		Reasons:          reasons,
+		Since:            now,
+		EvaluatedAt:      now,
+		LastSynchronized: lastSynchronized,
+		Observed:         observed,
+	}
+	var transition *HealthTransition
+	if health != nil && health.State == state {
+		next.Since = health.Since
+	} else {
+		transition = &HealthTransition{From: previous, To: state, At: now, Score: next.Score, Reasons: reasons}
+		healthTransitions = append([]HealthTransition{*transition}, healthTransitions...)
+		if len(healthTransitions) > HEALTH_HISTORY_SIZE {
+			healthTransitions = healthTransitions[:HEALTH_HISTORY_SIZE]
+		}
+	}
+	health = &next
+	healthMutex.Unlock()
+
+	// The first evaluation sets the baseline without an event
+	if transition != nil && previous != "" {
+		if len(reasons) > 0 {
+			log.Printf("Sync health changed from %s to %s: %s", previous, state, strings.Join(reasons, "; "))
+		} else {
+			log.Printf("Sync health changed from %s to %s", previous, state)
+		}
+		emitEvent(EVENT_HEALTH_CHANGED, map[string]interface{}{
+			"from":    previous,
+			"to":      state,
+			"score":   next.Score,
+			"reasons": reasons,
+		})
+	}
+	return next
+}
+
+// Latest evaluation, evaluating now if there is none yet
+func currentHealth(ctx context.Context) SyncHealth {
+	healthMutex.Lock()
+	current := health
+	healthMutex.Unlock()
+	if current == nil {
+		return evaluateHealth(ctx)
+	}
+	return *current
+}
+
+func startHealthMonitor() {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), backendRequestTimeout)
+			evaluateHealth(ctx)
+			cancel()
+			time.Sleep(healthInterval)
+		}
+	}()
+}
+
+func handleHealthStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	ctx, cancel := backendContext(r)
+	defer cancel()
+	current := currentHealth(ctx)
+
+	healthMutex.Lock()
+	current.Transitions = make([]HealthTransition, len(healthTransitions))
+	copy(current.Transitions, healthTransitions)
+	healthMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(current)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func resetTestHealth(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		healthMutex.Lock()
+		health, healthGoodStreak, healthStreakData, healthTransitions = nil, 0, time.Time{}, nil
+		healthMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestHealthSettlesOnFreshSamplesOnly(t *testing.T) {
+	resetTestHealth(t)
+	invalidateCaches()
+	ctx := context.Background()
+
+	// The canned chronyc output is synchronized to a selected source
+	for i := 0; i < healthSettleChecks+2; i++ {
+		if got := evaluateHealth(ctx); got.State != HEALTH_ACQUIRING {
+			t.Fatalf("evaluation %d of the same sample = %s, want %s", i+1, got.State, HEALTH_ACQUIRING)
+		}
+	}
+	if healthGoodStreak != 1 {
+		t.Fatalf("good streak = %d after re-reading one sample, want 1", healthGoodStreak)
+	}
+
+	var state string
+	for i := 1; i < healthSettleChecks; i++ {
+		invalidateCaches()
+		state = evaluateHealth(ctx).State
+	}
+	if state != HEALTH_SYNCHRONIZED {
+		t.Errorf("state after %d fresh samples = %s, want %s", healthSettleChecks, state, HEALTH_SYNCHRONIZED)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_HISTORY_PATH  = "/etc/brick/clock/revisions"
+	MAX_REVISION_MESSAGE = 500
+
+	// Author of revisions made by editing chrony.conf directly
+	REVISION_AUTHOR_EXTERNAL = "external"
+)
+
+// Who is making the configuration change in progress; recorded with the
+// revision it produces
+type revisionInfo struct {
+	Author    string
+	Message   string
+	RequestID string
+	Method    string
+	Path      string
+}
+
+// A stored version of chrony.conf
+type ConfigRevision struct {
+	Revision  int64        `json:"revision"`
+	Timestamp time.Time    `json:"timestamp"`
+	Author    string       `json:"author"`
+	Message   string       `json:"message,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+	Method    string       `json:"method,omitempty"`
+	Path      string       `json:"path,omitempty"`
+	Hash      string       `json:"hash"`
+	Current   bool         `json:"current"`
+	Content   string       `json:"content,omitempty"`
+	Config    *ClockConfig `json:"config,omitempty"`
+}
+
+type ConfigRevisionDiff struct {
+	From    int64          `json:"from"`
+	To      int64          `json:"to"`
+	Changes []ConfigChange `json:"changes"`
+	Diff    string         `json:"diff"`
+}
+
+var (
+	historyPath  = CONFIG_HISTORY_PATH
+	historyLimit = 100
+
+	// Guarded by stateMutex
+	historyReady bool
+	activeChange *revisionInfo
+)
+
+func init() {
+	if v := os.Getenv("CONFIG_HISTORY_PATH"); v != "" {
+		historyPath = v
+	}
+	if v := os.Getenv("CONFIG_HISTORY_LIMIT"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			historyLimit = parsed
+		} else {
+			log.Printf("Invalid CONFIG_HISTORY_LIMIT %q, using %d", v, historyLimit)
+		}
+	}
+}
+
+// Attribute revisions detected from now on to info (nil when no change is in progress)
+func setActiveChange(info *revisionInfo) {
+	stateMutex.Lock()
+	activeChange = info
+	stateMutex.Unlock()
+}
+
+func revisionPath(revision int64) string {
+	return filepath.Join(historyPath, fmt.Sprintf("%d.json", revision))
+}
+
+// Store chrony.conf as a revision and drop the oldest beyond the limit;
+// stateMutex must be held
+func saveRevisionLocked(revision int64, content string, info *revisionInfo) {
+	entry := ConfigRevision{
+		Revision:  revision,
+		Timestamp: time.Now().UTC(),
+		Author:    REVISION_AUTHOR_EXTERNAL,
+		Hash:      hashConfig(content),
+		Content:   content,
+	}
+	if info != nil {
+		entry.Author = info.Author
+		entry.Message = info.Message
+		entry.RequestID = info.RequestID
+		entry.Method = info.Method
+		entry.Path = info.Path
+	}
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err == nil {
+		if err = os.MkdirAll(historyPath, 0755); err == nil {
+			err = ioutil.WriteFile(revisionPath(revision), data, 0644)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to save configuration revision %d: %v", revision, err)
+		return
+	}
+
+	revisions := storedRevisions()
+	for len(revisions) > historyLimit {
+		os.Remove(revisionPath(revisions[0]))
+		revisions = revisions[1:]
+	}
+}
+
+// Stored revision numbers, oldest first
+func storedRevisions() []int64 {
+	files, err := ioutil.ReadDir(historyPath)
+	if err != nil {
+		return nil
+	}
+	var revisions []int64
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if revision, err := strconv.ParseInt(name, 10, 64); err == nil && name != file.Name() {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] < revisions[j] })
+	return revisions
+}
+
+func loadRevision(revision int64) (*ConfigRevision, error) {
+	data, err := ioutil.ReadFile(revisionPath(revision))
+	if err != nil {
+		return nil, err
+	}
+	var entry ConfigRevision
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Helper to parse a revision number from a path segment or query value
+func parseRevision(value string) (int64, bool) {
+	revision, err := strconv.ParseInt(value, 10, 64)
+	return revision, err == nil && revision > 0
+}
+
+// List stored revisions, newest first, without their content
+func handleConfigRevisions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	limit := historyLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "limit must be a positive integer", nil)
+			return
+		}
+		limit = parsed
+	}
+
+	current := syncConfigRevision()
+	stored := storedRevisions()
+	revisions := []ConfigRevision{}
+	for i := len(stored) - 1; i >= 0 && len(revisions) < limit; i-- {
+		entry, err := loadRevision(stored[i])
+		if err != nil {
+			log.Printf("Failed to read configuration revision %d: %v", stored[i], err)
+			continue
+		}
+		entry.Content = ""
+		entry.Current = entry.Revision == current
+		revisions = append(revisions, *entry)
+	}
+	setConfigETag(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":   current,
+		"revisions": revisions,
+	})
+}
+
+// GET /config/revisions/{n}, GET /config/revisions/diff and POST /config/revisions/{n}/restore
+func handleConfigRevision(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/config/revisions/"), "/")
+	parts := strings.Split(rest, "/")
+
+	if rest == "diff" {
+		if r.Method != http.MethodGet {
+			writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+			return
+		}
+		handleConfigRevisionDiff(w, r)
+		return
+	}
+
+	revision, ok := parseRevision(parts[0])
+	if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "restore") {
+		writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Not found", nil)
+		return
+	}
+	entry, err := loadRevision(revision)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, fmt.Sprintf("Revision %d is not in the history", revision), nil)
+		return
+	}
+
+	if len(parts) == 2 {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+			return
+		}
+		// Restored through the same path as PUT /config, so If-Match,
+		// dry_run and confirm_timeout apply as well
+		applyConfigContent(w, r, func(current string) string {
+			return entry.Content
+		}, AUDIT_CONFIG_RESTORE, map[string]int64{"revision": revision})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	config := parseClockConfig(entry.Content)
+	entry.Config = &config
+	entry.Current = entry.Revision == syncConfigRevision()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// Compare two revisions; to defaults to the current configuration
+func handleConfigRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, ok := parseRevision(query.Get("from"))
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "from must be a revision number", nil)
+		return
+	}
+	to := syncConfigRevision()
+	if v := query.Get("to"); v != "" {
+		if to, ok = parseRevision(v); !ok {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "to must be a revision number", nil)
+			return
+		}
+	}
+
+	var contents []string
+	for _, revision := range []int64{from, to} {
+		entry, err := loadRevision(revision)
+		if err != nil {
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, fmt.Sprintf("Revision %d is not in the history", revision), nil)
+			return
+		}
+		contents = append(contents, entry.Content)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConfigRevisionDiff{
+		From:    from,
+		To:      to,
+		Changes: diffClockConfig(parseClockConfig(contents[0]), parseClockConfig(contents[1])),
+		Diff:    unifiedDiff(contents[0], contents[1], chronyConfPath),
+	})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// chrony.conf every test that changes the configuration starts from
+const testChronyConf = `# test configuration
+server pool.ntp.org iburst
+driftfile /var/lib/chrony/drift
+allow 0.0.0.0/0
+local stratum 10
+`
+
+// Canned chronyc output, one file per command
+var testChronycOutput = map[string]string{
+	"tracking": `Reference ID    : CA760182 (202.118.1.130)
+Stratum         : 3
+Ref time (UTC)  : Mon Mar 18 10:30:45 2024
+System time     : 0.000000000 seconds slow of NTP time
+Last offset     : +0.000123456 seconds
+RMS offset      : 0.000123456 seconds
+Frequency       : 1.234 ppm slow
+Residual freq   : +0.000 ppm
+Skew            : 0.010 ppm
+Root delay      : 0.001234567 seconds
+Root dispersion : 0.000123456 seconds
+Update interval : 64.0 seconds
+Leap status     : Normal`,
+	"sources": `MS Name/IP address         Stratum Poll Reach LastRx Last sample
+===============================================================================
+^* 202.118.1.130                 2   6   377    19   +625us[ -117us] +/-   25ms
+^- 10.0.0.1                      3   6   377    20   -1ms[ -1ms] +/-   30ms`,
+	"activity": `200 OK
+2 sources online
+0 sources offline
+0 sources doing burst (return to online)
+0 sources doing burst (return to offline)
+0 sources with unknown address`,
+	"clients": `Hostname                      NTP   Drop Int IntL Last     Cmd   Drop Int  Last
+===============================================================================
+10.0.0.5                        5      0   6   -    12       0      0   -     -`,
+}
+
+// Prints the canned output of each command ("-m" runs several); unknown
+// commands answer like a successful chronyc command without output. Each
+// invocation is logged to .calls.
+const fakeChronyc = `#!/bin/sh
+echo "$*" >> "$FAKE_CHRONYC_DIR/.calls"
+out() {
+	if [ -f "$FAKE_CHRONYC_DIR/$1" ]; then cat "$FAKE_CHRONYC_DIR/$1"; echo; else echo "200 OK"; fi
+}
+if [ "$1" = "-m" ]; then shift; for c in "$@"; do out "$c"; done; exit 0; fi
+out "$1"
+`
+
+var (
+	testDir        string
+	testSigningKey *rsa.PrivateKey
+	routesOnce     sync.Once
+)
+
+// Run every test against a temporary state directory, fake chronyc,
+// chronyd and pkill binaries, and a freshly generated signing key
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "brick-clock-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := setupTestEnvironment(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func setupTestEnvironment(dir string) error {
+	testDir = dir
+	bin := filepath.Join(dir, "bin")
+	outputs := filepath.Join(dir, "chronyc")
+	for _, d := range []string{bin, outputs} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	scripts := map[string]string{
+		"chronyc": fakeChronyc,
+		"chronyd": "#!/bin/sh\nexit 0\n",
+		"pkill":   "#!/bin/sh\nexit 0\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			return err
+		}
+	}
+	for command, output := range testChronycOutput {
+		if err := ioutil.WriteFile(filepath.Join(outputs, command), []byte(output), 0644); err != nil {
+			return err
+		}
+	}
+	os.Setenv("FAKE_CHRONYC_DIR", outputs)
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	chronyConfPath = filepath.Join(dir, "chrony.conf")
+	configStatePath = filepath.Join(dir, "config-state.json")
+	confirmStatePath = filepath.Join(dir, "pending-confirm.json")
+	historyPath = filepath.Join(dir, "history")
+	auditPath = filepath.Join(dir, "audit.jsonl")
+	webhooksPath = filepath.Join(dir, "webhooks.json")
+	deadLettersPath = filepath.Join(dir, "webhook-dead-letters.json")
+	alertRulesPath = filepath.Join(dir, "alert-rules.json")
+	alertSilencesPath = filepath.Join(dir, "alert-silences.json")
+	serverSelectionPath = filepath.Join(dir, "server-selection.json")
+	failoverPath = filepath.Join(dir, "failover.json")
+	discoveryPath = filepath.Join(dir, "discovery.json")
+	serverProfilesPath = filepath.Join(dir, "server-profiles.json")
+	firstBootMarkerPath = filepath.Join(dir, "first-boot-done")
+	rolesPath = filepath.Join(dir, "roles.json")
+	socketPath = ""
+	if err := ioutil.WriteFile(chronyConfPath, []byte(testChronyConf), 0644); err != nil {
+		return err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	testSigningKey = key
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	publicKeyPath = filepath.Join(dir, "public.pem")
+	jwksPath, jwksURL = "", ""
+	if err := ioutil.WriteFile(publicKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	keys.reloadFiles()
+	initializeCaches()
+	return nil
+}
+
+// Register the API routes on the default mux once per test binary and
+// return their patterns
+func testRoutes() []string {
+	routesOnce.Do(registerRoutes)
+	return registeredRoutes
+}
+
+// Serve the real handlers, wrapped the way serve() wraps them
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	testRoutes()
+	server := httptest.NewServer(withRequestID(http.DefaultServeMux))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Sign a token with the test key; exp defaults to an hour from now
+func testToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(testSigningKey)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return token
+}
+
+// Restore the baseline chrony.conf, and again when the test ends
+func resetTestChronyConf(t *testing.T) {
+	t.Helper()
+	restore := func() {
+		if err := ioutil.WriteFile(chronyConfPath, []byte(testChronyConf), 0644); err != nil {
+			t.Fatalf("write chrony.conf: %v", err)
+		}
+		invalidateCaches()
+	}
+	restore()
+	t.Cleanup(restore)
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation metadata used to build the OpenAPI document
+type apiOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	Backend bool
+	// Waits on chronyc and answers 504 when it does not respond in time
+	Timeout bool
+	// Answers 503 with the success body when a check fails
+	Probe bool
+	// Reads return the configuration revision as an ETag; writes require If-Match
+	Revisioned bool
+	Params     []apiParam
+	Request    interface{}
+	Status     int
+	Response   interface{}
+}
+
+type apiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Description string
+}
+
+// Inline object schema; values are Go values whose types describe each property
+type apiObject map[string]interface{}
+
+// Raw schema passed through unchanged
+type apiSchema map[string]interface{}
+
+var (
+	//go:embed static/docs.html
+	docsHTML []byte
+
+	openAPISpec     []byte
+	openAPISpecOnce sync.Once
+
+	pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+	timeType         = reflect.TypeOf(time.Time{})
+	rawMessageType   = reflect.TypeOf(json.RawMessage{})
+)
+
+// Shared by the status endpoints
+var statusFreshParam = apiParam{Name: "fresh", In: "query", Type: "boolean",
+	Description: "Fetch the data now instead of serving it from the cache (requires `" + PERM_STATUS_FRESH + "`)"}
+
+// Every route registered in main must be described here
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/health", Tag: "System", Summary: "Health check", Response: apiSchema{"type": "string", "example": "OK"}},
+	{Method: "GET", Path: "/livez", Tag: "System", Summary: "Liveness probe: the process is serving and not stuck", Probe: true, Response: ProbeResponse{}},
+	{Method: "GET", Path: "/readyz", Tag: "System", Summary: "Readiness probe: chronyd answers and chrony.conf is readable", Probe: true, Response: ProbeResponse{}},
+	{Method: "GET", Path: "/syncz", Tag: "System", Summary: "Synchronization probe: synchronized within the offset limit with enough reachable sources", Probe: true,
+		Params: []apiParam{
+			{Name: "max_offset", In: "query", Type: "string", Description: "Largest acceptable offset (default SYNC_MAX_OFFSET)"},
+			{Name: "min_sources", In: "query", Type: "integer", Description: "Fewest acceptable reachable sources (default SYNC_MIN_SOURCES)"},
+		},
+		Response: ProbeResponse{}},
+	{Method: "GET", Path: "/version", Tag: "System", Summary: "Application version and build info", Response: VersionResponse{}},
+	{Method: "GET", Path: "/app-version", Tag: "System", Summary: "Compiled-in version and build datetime", Response: apiObject{"version": "", "build_datetime": ""}},
+	{Method: "GET", Path: "/openapi.json", Tag: "System", Summary: "This OpenAPI document", Response: apiSchema{"type": "object"}},
+	{Method: "GET", Path: "/docs", Tag: "System", Summary: "Interactive API documentation viewer", Response: apiSchema{"type": "string", "format": "html"}},
+
+	{Method: "GET", Path: "/whoami", Tag: "System", Summary: "Caller identity and effective permissions", Response: WhoAmIResponse{}},
+
+	{Method: "GET", Path: "/status", Tag: "Status", Summary: "Current synchronization status",
+		Params: []apiParam{
+			{Name: "flags", In: "query", Type: "integer", Description: "Bitmask of sections: 1 tracking, 2 sources, 4 activity, 8 clients, 16 server mode, 32 health (default 63)"},
+			statusFreshParam,
+		},
+		Response: StatusResponse{}},
+	{Method: "GET", Path: "/status/tracking", Tag: "Status", Summary: "Detailed tracking information", Params: []apiParam{statusFreshParam},
+		Response: apiObject{"tracking": map[string]string{}, "meta": map[string]DatasetMeta{}, "errors": map[string]BackendError{}}},
+	{Method: "GET", Path: "/status/sources", Tag: "Status", Summary: "NTP source information", Params: []apiParam{statusFreshParam},
+		Response: apiObject{"sources": []map[string]string{}, "meta": map[string]DatasetMeta{}, "errors": map[string]BackendError{}}},
+	{Method: "GET", Path: "/status/activity", Tag: "Status", Summary: "Activity statistics", Params: []apiParam{statusFreshParam},
+		Response: apiObject{"activity": map[string]string{}, "meta": map[string]DatasetMeta{}, "errors": map[string]BackendError{}}},
+	{Method: "GET", Path: "/status/clients", Tag: "Status", Summary: "Connected client information", Params: []apiParam{statusFreshParam},
+		Response: apiObject{"clients": []map[string]string{}, "meta": map[string]DatasetMeta{}, "errors": map[string]BackendError{}}},
+	{Method: "GET", Path: "/status/health", Tag: "Status", Summary: "Sync health state, score and recent transitions", Response: SyncHealth{}},
+	{Method: "GET", Path: "/probe", Tag: "Status", Summary: "Query NTP servers over SNTP to cross-check chronyd's offset",
+		Params: []apiParam{{Name: "server", In: "query", Type: "string",
+			Description: "Server to query as host or host:port, repeatable (default the configured servers; others require `" + PERM_PROBE_ANY + "`)"}},
+		Response: ProbeResultsResponse{}},
+
+	{Method: "GET", Path: "/servers", Tag: "Servers", Summary: "List configured NTP servers and pools", Revisioned: true, Response: apiObject{"servers": []string{}}},
+	{Method: "PUT", Path: "/servers", Tag: "Servers", Summary: "Replace the configured NTP servers and pools", Revisioned: true, Backend: true,
+		Request: SetServersRequest{}, Response: apiObject{"result": []string{}, "restart_success": true}},
+	{Method: "DELETE", Path: "/servers", Tag: "Servers", Summary: "Delete all sources and restart chronyd", Revisioned: true, Backend: true, Timeout: true,
+		Response: apiObject{"output": "", "error": "", "restart_success": true}},
+	{Method: "GET", Path: "/servers/default", Tag: "Servers", Summary: "Get the default server profile", Response: ServerProfile{}},
+	{Method: "PUT", Path: "/servers/default", Tag: "Servers", Summary: "Reset to the servers of the default profile", Revisioned: true, Backend: true,
+		Response: apiObject{"profile": "", "result": []string{}, "restart_success": true}},
+	{Method: "GET", Path: "/servers/profiles", Tag: "Servers", Summary: "List server profiles", Response: ServerProfilesResponse{}},
+	{Method: "POST", Path: "/servers/profiles", Tag: "Servers", Summary: "Create a server profile",
+		Request: ServerProfileRequest{}, Status: http.StatusCreated, Response: ServerProfile{}},
+	{Method: "GET", Path: "/servers/profiles/{name}", Tag: "Servers", Summary: "Get a server profile", Response: ServerProfile{}},
+	{Method: "PUT", Path: "/servers/profiles/{name}", Tag: "Servers", Summary: "Create or replace a server profile",
+		Request: ServerProfileRequest{}, Response: ServerProfile{}},
+	{Method: "DELETE", Path: "/servers/profiles/{name}", Tag: "Servers", Summary: "Delete a server profile",
+		Status: http.StatusNoContent},
+	{Method: "POST", Path: "/servers/profiles/{name}/apply", Tag: "Servers", Summary: "Make a profile's servers the configured servers", Revisioned: true, Backend: true,
+		Response: apiObject{"profile": "", "result": []string{}, "restart_success": true}},
+	{Method: "GET", Path: "/servers/candidates", Tag: "Servers", Summary: "Probe candidate servers over SNTP and rank them",
+		Params: []apiParam{
+			{Name: "candidate", In: "query", Type: "string",
+				Description: "Candidate as host or host:port, repeatable (default the selection candidates and configured servers; others require `" + PERM_PROBE_ANY + "`)"},
+			{Name: "count", In: "query", Type: "integer", Description: "How many of the best candidates to select (default the policy's count)"},
+		},
+		Response: CandidateRanking{}},
+	{Method: "GET", Path: "/servers/selection", Tag: "Servers", Summary: "Automatic server selection policy and its last run", Response: ServerSelectionResponse{}},
+	{Method: "PUT", Path: "/servers/selection", Tag: "Servers", Summary: "Replace the automatic server selection policy",
+		Request: ServerSelectionPolicy{}, Response: apiObject{"policy": ServerSelectionPolicy{}}},
+	{Method: "GET", Path: "/servers/failover", Tag: "Servers", Summary: "Failover policy, active server group and last switch", Response: FailoverStatus{}},
+	{Method: "PUT", Path: "/servers/failover", Tag: "Servers", Summary: "Replace the primary/backup failover policy",
+		Request: FailoverPolicy{}, Response: apiObject{"policy": FailoverPolicy{}}},
+	{Method: "GET", Path: "/servers/discovery", Tag: "Servers", Summary: "Discovery policy and the servers each provider found", Response: DiscoveryStatus{}},
+	{Method: "POST", Path: "/servers/discovery", Tag: "Servers", Summary: "Refresh every discovery provider now", Response: DiscoveryStatus{}},
+	{Method: "PUT", Path: "/servers/discovery", Tag: "Servers", Summary: "Replace the server discovery policy",
+		Request: DiscoveryPolicy{}, Response: apiObject{"policy": DiscoveryPolicy{}}},
+	{Method: "GET", Path: "/server-mode", Tag: "Server mode", Summary: "Get server mode status", Revisioned: true, Response: ServerModeResponse{}},
+	{Method: "PUT", Path: "/server-mode", Tag: "Server mode", Summary: "Enable or disable server mode", Revisioned: true,
+		Request: SetServerModeRequest{}, Response: SetServerModeResponse{}},
+	{Method: "GET", Path: "/cluster", Tag: "Cluster", Summary: "Local reference and the state of each peer", Revisioned: true, Response: ClusterStatus{}},
+	{Method: "PUT", Path: "/cluster", Tag: "Cluster", Summary: "Replace the peers and the local reference", Revisioned: true, Backend: true,
+		Params:  []apiParam{{Name: "dry_run", In: "query", Type: "boolean", Description: "Only return the planned changes and diff (no If-Match needed)"}},
+		Request: ClusterConfig{}, Response: ConfigApplyResponse{}},
+
+	{Method: "GET", Path: "/config", Tag: "Configuration", Summary: "Get the configuration document", Revisioned: true, Response: ClockConfig{}},
+	{Method: "PUT", Path: "/config", Tag: "Configuration", Summary: "Replace the configuration document and reload chronyd once", Revisioned: true, Backend: true,
+		Params:  []apiParam{{Name: "dry_run", In: "query", Type: "boolean", Description: "Only return the planned changes and diff (no If-Match needed)"}},
+		Request: ClockConfig{}, Response: ConfigApplyResponse{}},
+	{Method: "GET", Path: "/config/pending", Tag: "Configuration", Summary: "Show the change awaiting confirmation", Response: PendingConfirmationResponse{}},
+	{Method: "DELETE", Path: "/config/pending", Tag: "Configuration", Summary: "Revert the change awaiting confirmation now", Backend: true,
+		Response: apiObject{"id": "", "reverted": true, "restart_success": true}},
+	{Method: "POST", Path: "/config/confirm", Tag: "Configuration", Summary: "Confirm the change awaiting confirmation",
+		Request: ConfirmRequest{}, Response: apiObject{"id": "", "confirmed": true}},
+	{Method: "GET", Path: "/config/revisions", Tag: "Configuration", Summary: "List stored configuration revisions (newest first)",
+		Params:   []apiParam{{Name: "limit", In: "query", Type: "integer", Description: "Maximum revisions returned"}},
+		Response: apiObject{"current": 0, "revisions": []ConfigRevision{}}},
+	{Method: "GET", Path: "/config/revisions/{revision}", Tag: "Configuration", Summary: "Get a revision with its chrony.conf content", Response: ConfigRevision{}},
+	{Method: "GET", Path: "/config/revisions/diff", Tag: "Configuration", Summary: "Compare two revisions",
+		Params: []apiParam{
+			{Name: "from", In: "query", Type: "integer", Description: "Older revision (required)"},
+			{Name: "to", In: "query", Type: "integer", Description: "Newer revision (default current)"},
+		},
+		Response: ConfigRevisionDiff{}},
+	{Method: "POST", Path: "/config/revisions/{revision}/restore", Tag: "Configuration", Summary: "Restore a revision as the current configuration", Revisioned: true, Backend: true,
+		Params:   []apiParam{{Name: "dry_run", In: "query", Type: "boolean", Description: "Only return the planned changes and diff (no If-Match needed)"}},
+		Response: ConfigApplyResponse{}},
+
+	{Method: "GET", Path: "/events", Tag: "Events", Summary: "Stream events as Server-Sent Events",
+		Params:   []apiParam{{Name: "types", In: "query", Type: "string", Description: "Comma-separated event types to receive (default all)"}},
+		Response: Event{}},
+
+	{Method: "GET", Path: "/webhooks", Tag: "Webhooks", Summary: "List webhook subscriptions", Response: apiObject{"webhooks": []WebhookResponse{}}},
+	{Method: "POST", Path: "/webhooks", Tag: "Webhooks", Summary: "Create a webhook subscription",
+		Request: WebhookRequest{}, Status: http.StatusCreated, Response: WebhookResponse{}},
+	{Method: "GET", Path: "/webhooks/{id}", Tag: "Webhooks", Summary: "Get a webhook subscription", Response: WebhookResponse{}},
+	{Method: "PUT", Path: "/webhooks/{id}", Tag: "Webhooks", Summary: "Update a webhook subscription",
+		Request: WebhookRequest{}, Response: WebhookResponse{}},
+	{Method: "DELETE", Path: "/webhooks/{id}", Tag: "Webhooks", Summary: "Delete a webhook subscription",
+		Status: http.StatusNoContent},
+	{Method: "POST", Path: "/webhooks/{id}/test", Tag: "Webhooks", Summary: "Send a test delivery",
+		Response: WebhookDelivery{}},
+	{Method: "GET", Path: "/webhooks/dead-letters", Tag: "Webhooks", Summary: "List failed deliveries",
+		Response: apiObject{"dead_letters": []WebhookDelivery{}}},
+	{Method: "DELETE", Path: "/webhooks/dead-letters", Tag: "Webhooks", Summary: "Clear failed deliveries",
+		Status: http.StatusNoContent},
+
+	{Method: "GET", Path: "/audit", Tag: "Audit", Summary: "Query the configuration audit log (newest first)",
+		Params: []apiParam{
+			{Name: "actor", In: "query", Type: "string", Description: "Only entries by this token subject"},
+			{Name: "action", In: "query", Type: "string", Description: "Only this action (" + strings.Join(auditActions, ", ") + ")"},
+			{Name: "request_id", In: "query", Type: "string", Description: "Only the entry for this request ID"},
+			{Name: "success", In: "query", Type: "boolean", Description: "Only successful (true) or failed (false) changes"},
+			{Name: "since", In: "query", Type: "string", Description: "RFC 3339 timestamp, inclusive"},
+			{Name: "until", In: "query", Type: "string", Description: "RFC 3339 timestamp, exclusive"},
+			{Name: "limit", In: "query", Type: "integer", Description: "Maximum entries returned (default 100, max 1000)"},
+			{Name: "format", In: "query", Type: "string", Description: "jsonl exports every match, oldest first, as JSON Lines"},
+		},
+		Response: apiObject{"entries": []AuditEntry{}, "total": 0}},
+
+	{Method: "GET", Path: "/alerts", Tag: "Alerts", Summary: "List active alerts",
+		Params:   []apiParam{{Name: "include_resolved", In: "query", Type: "integer", Description: "Set to 1 to include recently resolved alerts"}},
+		Response: apiObject{"alerts": []Alert{}, "resolved": []Alert{}}},
+	{Method: "GET", Path: "/alerts/rules", Tag: "Alerts", Summary: "List alert rules and available metrics",
+		Response: apiObject{"rules": []AlertRule{}, "metrics": map[string]string{}}},
+	{Method: "PUT", Path: "/alerts/rules", Tag: "Alerts", Summary: "Replace alert rules",
+		Request: SetAlertRulesRequest{}, Response: SetAlertRulesRequest{}},
+	{Method: "GET", Path: "/alerts/silences", Tag: "Alerts", Summary: "List active silences", Response: apiObject{"silences": []Silence{}}},
+	{Method: "POST", Path: "/alerts/silences", Tag: "Alerts", Summary: "Silence a rule for a duration",
+		Request: CreateSilenceRequest{}, Status: http.StatusCreated, Response: Silence{}},
+	{Method: "DELETE", Path: "/alerts/silences/{id}", Tag: "Alerts", Summary: "Remove a silence",
+		Status: http.StatusNoContent},
+}
+
+// Builds JSON schemas from Go types, collecting named structs as components
+type schemaGenerator struct {
+	components map[string]interface{}
+}
+
+func (g *schemaGenerator) schema(v interface{}) interface{} {
+	switch s := v.(type) {
+	case apiSchema:
+		return map[string]interface{}(s)
+	case apiObject:
+		props := map[string]interface{}{}
+		for name, value := range s {
+			props[name] = g.schema(value)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	}
+	return g.schemaForType(reflect.TypeOf(v))
+}
+
+func (g *schemaGenerator) schemaForType(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	if t == rawMessageType {
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			// Placeholder guards against recursive types
+			g.components[t.Name()] = map[string]interface{}{}
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaForType(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schemaForType(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	g.addStructFields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (g *schemaGenerator) addStructFields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				g.addStructFields(embedded, props)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = g.schemaForType(field.Type)
+	}
+}
+
+func operationID(op apiOperation) string {
+	id := strings.ToLower(op.Method)
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		id += "_" + part
+	}
+	return id
+}
+
+func errorResponse(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/ErrorResponse"},
+			},
+		},
+	}
+}
+
+// Build the OpenAPI 3 document from apiOperations
+func buildOpenAPISpec() map[string]interface{} {
+	gen := &schemaGenerator{components: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+
+	for _, op := range apiOperations {
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if op.Response != nil {
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": gen.schema(op.Response)},
+			}
+		}
+		responses := map[string]interface{}{strconv.Itoa(status): success}
+		if op.Probe {
+			responses["503"] = map[string]interface{}{
+				"description": "A check failed",
+				"content":     success["content"],
+			}
+		}
+
+		operation := map[string]interface{}{
+			"operationId": operationID(op),
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"responses":   responses,
+		}
+
+		var params []map[string]interface{}
+		for _, match := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, p := range op.Params {
+			params = append(params, map[string]interface{}{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Description,
+				"schema":      map[string]interface{}{"type": p.Type},
+			})
+		}
+		if op.Revisioned {
+			success["headers"] = map[string]interface{}{
+				"ETag": map[string]interface{}{
+					"description": "Configuration revision",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+			}
+			if op.Method != "GET" {
+				params = append(params, map[string]interface{}{
+					"name":        "If-Match",
+					"in":          "header",
+					"required":    ifMatchRequired,
+					"description": "ETag from a previous read, or * to overwrite unconditionally",
+					"schema":      map[string]interface{}{"type": "string"},
+				})
+				params = append(params,
+					map[string]interface{}{
+						"name":        "message",
+						"in":          "query",
+						"description": "Description stored with the resulting configuration revision",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+					map[string]interface{}{
+						"name":        "confirm_timeout",
+						"in":          "query",
+						"description": "Revert the change unless it is confirmed within this duration (e.g. 2m)",
+						"schema":      map[string]interface{}{"type": "string"},
+					},
+					map[string]interface{}{
+						"name":        "auto_confirm",
+						"in":          "query",
+						"description": "Also confirm once chronyd is synchronized to a selected source",
+						"schema":      map[string]interface{}{"type": "boolean"},
+					})
+				responses["409"] = errorResponse("Another change is awaiting confirmation")
+				responses["412"] = errorResponse("The configuration changed since the ETag was read")
+				responses["428"] = errorResponse("If-Match header is missing")
+			}
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if strings.Contains(op.Path, "{") {
+			responses["404"] = errorResponse("Not found")
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": gen.schema(op.Request)},
+				},
+			}
+			responses["400"] = errorResponse("Invalid request")
+		}
+
+		// Access requirements come from the route policy table
+		policy, _ := policyForPath(op.Method, op.Path)
+		if !policy.Public {
+			operation["security"] = []map[string][]string{{"bearerAuth": {}}}
+			responses["401"] = errorResponse("Missing or invalid bearer token")
+		} else {
+			operation["security"] = []map[string][]string{}
+		}
+		if policy.Permission != "" {
+			operation["description"] = "Requires the `" + policy.Permission + "` permission."
+			operation["x-required-permission"] = policy.Permission
+			responses["403"] = errorResponse("Insufficient permissions")
+		}
+		if op.Method != "GET" {
+			responses["500"] = errorResponse("Failed to apply the change")
+		}
+		if op.Backend {
+			responses["502"] = errorResponse("The time service failed to apply the change")
+		}
+		if op.Timeout {
+			responses["504"] = errorResponse("The time service did not respond in time")
+		}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]interface{}{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	gen.schemaForType(reflect.TypeOf(ErrorResponse{}))
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "Brick Clock API",
+			"description": "NTP time synchronization service backed by chronyd",
+			"version":     getVersion(),
+		},
+		"servers": []map[string]interface{}{
+			{"url": API_PREFIX},
+			{"url": "/", "description": "Legacy unversioned aliases"},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": gen.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+				},
+			},
+		},
+	}
+}
+
+// Check a documented path against a registered mux pattern
+func routeCoversPath(route string, path string) bool {
+	if route == path {
+		return true
+	}
+	return strings.HasSuffix(route, "/") && strings.HasPrefix(path, route)
+}
+
+// Compare registered routes with apiOperations in both directions
+func checkOpenAPICoverage(routes []string) (undocumented []string, unrouted []string) {
+	for _, route := range routes {
+		documented := false
+		for _, op := range apiOperations {
+			if routeCoversPath(route, op.Path) {
+				documented = true
+				break
+			}
+		}
+		if !documented {
+			undocumented = append(undocumented, route)
+		}
+	}
+	seen := map[string]bool{}
+	for _, op := range apiOperations {
+		if seen[op.Path] {
+			continue
+		}
+		seen[op.Path] = true
+		routed := false
+		for _, route := range routes {
+			if routeCoversPath(route, op.Path) {
+				routed = true
+				break
+			}
+		}
+		if !routed {
+			unrouted = append(unrouted, op.Path)
+		}
+	}
+	sort.Strings(undocumented)
+	sort.Strings(unrouted)
+	return undocumented, unrouted
+}
+
+// Log any drift between the registered routes and the OpenAPI document
+func logOpenAPICoverage(routes []string) {
+	undocumented, unrouted := checkOpenAPICoverage(routes)
+	for _, route := range undocumented {
+		log.Printf("WARNING: route %s is not documented in the OpenAPI spec", route)
+	}
+	for _, path := range unrouted {
+		log.Printf("WARNING: OpenAPI path %s has no registered route", path)
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	openAPISpecOnce.Do(func() {
+		data, err := json.MarshalIndent(buildOpenAPISpec(), "", "  ")
+		if err != nil {
+			log.Printf("Failed to build OpenAPI spec: %v", err)
+			return
+		}
+		openAPISpec = data
+	})
+	if openAPISpec == nil {
+		writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "OpenAPI spec unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsHTML)
+}
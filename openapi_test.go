@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEveryRouteIsDocumented(t *testing.T) {
+	undocumented, unrouted := checkOpenAPICoverage(testRoutes())
+	for _, route := range undocumented {
+		t.Errorf("route %s is registered but has no entry in apiOperations", route)
+	}
+	for _, path := range unrouted {
+		t.Errorf("apiOperations documents %s, which matches no registered route", path)
+	}
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	data, err := json.Marshal(buildOpenAPISpec())
+	if err != nil {
+		t.Fatalf("marshal spec: %v", err)
+	}
+	var spec struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("unmarshal spec: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi = %q, want 3.x", spec.OpenAPI)
+	}
+
+	operationIDs := map[string]string{}
+	for _, op := range apiOperations {
+		operation, ok := spec.Paths[op.Path][strings.ToLower(op.Method)]
+		if !ok {
+			t.Errorf("%s %s is missing from the spec", op.Method, op.Path)
+			continue
+		}
+		id, _ := operation["operationId"].(string)
+		if previous, dup := operationIDs[id]; dup {
+			t.Errorf("operationId %q is used by %s and %s %s", id, previous, op.Method, op.Path)
+		}
+		operationIDs[id] = op.Method + " " + op.Path
+	}
+
+	for _, name := range []string{"StatusResponse", "SetServersRequest", "ServerModeResponse", "ErrorResponse"} {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s is missing from components", name)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PROBE_PASS = "pass"
+	PROBE_FAIL = "fail"
+
+	// The cache refresher ticks every second; this much silence means it is stuck
+	REFRESHER_STALL_TIMEOUT = 30 * time.Second
+)
+
+// Result of one check of a probe
+type ProbeCheck struct {
+	Name     string      `json:"name"`
+	Status   string      `json:"status"`
+	Message  string      `json:"message,omitempty"`
+	Observed interface{} `json:"observed,omitempty"`
+	Limit    interface{} `json:"limit,omitempty"`
+}
+
+// Body of /livez, /readyz and /syncz; the HTTP status is 200 when every
+// check passes and 503 otherwise
+type ProbeResponse struct {
+	Status    string       `json:"status"`
+	CheckedAt time.Time    `json:"checked_at"`
+	Checks    []ProbeCheck `json:"checks"`
+}
+
+var (
+	startedAt = time.Now()
+
+	// Unix nanoseconds of the cache refresher's last tick
+	refresherHeartbeat int64
+
+	syncMaxOffset  = 100 * time.Millisecond
+	syncMinSources = 1
+)
+
+func init() {
+	if v := os.Getenv("SYNC_MAX_OFFSET"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			syncMaxOffset = parsed
+		} else {
+			log.Printf("Invalid SYNC_MAX_OFFSET %q, using %s", v, syncMaxOffset)
+		}
+	}
+	if v := os.Getenv("SYNC_MIN_SOURCES"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			syncMinSources = parsed
+		} else {
+			log.Printf("Invalid SYNC_MIN_SOURCES %q, using %d", v, syncMinSources)
+		}
+	}
+}
+
+func beatRefresher() {
+	atomic.StoreInt64(&refresherHeartbeat, time.Now().UnixNano())
+}
+
+// Helper to build a check from a condition
+func probeCheck(name string, ok bool, message string) ProbeCheck {
+	check := ProbeCheck{Name: name, Status: PROBE_PASS}
+	if !ok {
+		check.Status = PROBE_FAIL
+	}
+	check.Message = message
+	return check
+}
+
+// Helper to answer a probe: 200 if every check passed, 503 otherwise
+func writeProbe(w http.ResponseWriter, checks []ProbeCheck) {
+	response := ProbeResponse{Status: PROBE_PASS, CheckedAt: time.Now().UTC(), Checks: checks}
+	for _, check := range checks {
+		if check.Status == PROBE_FAIL {
+			response.Status = PROBE_FAIL
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status != PROBE_PASS {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// The process is able to serve and its background work is not stuck
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	uptime := time.Since(startedAt)
+	process := probeCheck("process", true, "")
+	process.Observed = fmt.Sprintf("up %s", uptime.Round(time.Second))
+
+	silence := time.Since(time.Unix(0, atomic.LoadInt64(&refresherHeartbeat)))
+	// Give the refresher time to start
+	refresher := probeCheck("cache_refresher", silence < REFRESHER_STALL_TIMEOUT || uptime < REFRESHER_STALL_TIMEOUT, "")
+	if refresher.Status == PROBE_FAIL {
+		refresher.Message = fmt.Sprintf("no refresh cycle for %s", silence.Round(time.Second))
+	} else if silence < uptime {
+		refresher.Observed = fmt.Sprintf("last cycle %s ago", silence.Round(time.Second))
+	}
+	writeProbe(w, []ProbeCheck{process, refresher})
+}
+
+// chronyd answers and chrony.conf can be read
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	initializeCaches()
+	ctx, cancel := backendContext(r)
+	defer cancel()
+	tracking := trackingCache.Snapshot(ctx)
+
+	chronyd := probeCheck("chronyd", tracking.Err == nil, "")
+	if tracking.Err != nil {
+		chronyd.Message = tracking.Err.Error()
+	} else {
+		chronyd.Observed = fmt.Sprintf("answered %s ago", tracking.Age.Round(time.Second))
+	}
+
+	config := probeCheck("config", true, "")
+	if content, err := ioutil.ReadFile(chronyConfPath); err != nil {
+		config = probeCheck("config", false, err.Error())
+	} else {
+		parsed := parseClockConfig(string(content))
+		config.Observed = fmt.Sprintf("servers configured: %d", len(parsed.Servers))
+	}
+	writeProbe(w, []ProbeCheck{chronyd, config})
+}
+
+// The clock is synchronized, close to its reference and has enough sources.
+// ?max_offset=DURATION and ?min_sources=N override the configured limits.
+func handleSyncz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	maxOffset := syncMaxOffset
+	minSources := syncMinSources
+	query := r.URL.Query()
+	if v := query.Get("max_offset"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "max_offset must be a positive duration", nil)
+			return
+		}
+		maxOffset = parsed
+	}
+	if v := query.Get("min_sources"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "min_sources must be a non-negative integer", nil)
+			return
+		}
+		minSources = parsed
+	}
+
+	initializeCaches()
+	ctx, cancel := backendContext(r)
+	defer cancel()
+	snapshots := snapshotCaches(ctx, trackingCache, sourcesCache)
+	trackingSnapshot := snapshots[trackingCache]
+	sourcesSnapshot := snapshots[sourcesCache]
+	tracking, _ := trackingSnapshot.Data.(map[string]string)
+	sources, _ := sourcesSnapshot.Data.([]map[string]string)
+
+	synced := probeCheck("synchronized", trackingSnapshot.Err == nil && isTrackingSynchronized(tracking), "")
+	if trackingSnapshot.Err != nil {
+		synced.Message = trackingSnapshot.Err.Error()
+	} else {
+		synced.Observed = tracking["Leap status"]
+	}
+
+	offset := ProbeCheck{Name: "offset", Limit: maxOffset.String()}
+	if ms, ok := parseSecondsToMs(tracking["System time"]); ok && trackingSnapshot.Err == nil {
+		observed := time.Duration(math.Abs(ms) * float64(time.Millisecond))
+		offset = probeCheck("offset", observed <= maxOffset, "")
+		offset.Observed = observed.String()
+		offset.Limit = maxOffset.String()
+	} else {
+		offset.Status = PROBE_FAIL
+		offset.Message = "offset unknown"
+	}
+
+	reachable := countReachableSources(sources)
+	sourcesCheck := probeCheck("reachable_sources", sourcesSnapshot.Err == nil && reachable >= minSources, "")
+	if sourcesSnapshot.Err != nil {
+		sourcesCheck.Message = sourcesSnapshot.Err.Error()
+	}
+	sourcesCheck.Observed = reachable
+	sourcesCheck.Limit = minSources
+
+	writeProbe(w, []ProbeCheck{synced, offset, sourcesCheck})
+}
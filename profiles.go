@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SERVER_PROFILES_PATH = "/etc/brick/clock/server-profiles.json"
+	// Written once the first-boot profile check has run
+	FIRST_BOOT_MARKER_PATH = "/etc/brick/clock/first-boot-done"
+
+	// Profile used while no profiles have been stored
+	BUILTIN_PROFILE = "public"
+
+	MAX_SERVER_PROFILES = 32
+	MAX_PROFILE_SERVERS = 16
+	MAX_PROFILE_DESC    = 200
+)
+
+// A named server list, e.g. the servers of one data center. The default
+// profile is what PUT /servers/default restores and what a node starts
+// with at first boot.
+type ServerProfile struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Servers     []string `json:"servers"`
+	Default     bool     `json:"default"`
+}
+
+// Payload of GET /servers/profiles, also the on-disk form
+type ServerProfilesResponse struct {
+	DefaultProfile string          `json:"default_profile"`
+	Profiles       []ServerProfile `json:"profiles"`
+}
+
+// Body of POST /servers/profiles and PUT /servers/profiles/{name}; Name
+// is only read by POST
+type ServerProfileRequest struct {
+	Name        string   `json:"name,omitempty"`
+	Description string   `json:"description"`
+	Servers     []string `json:"servers"`
+	// true makes this the default profile; left out, a replaced profile
+	// stays the default if it was
+	Default *bool `json:"default,omitempty"`
+}
+
+var (
+	serverProfilesPath  = SERVER_PROFILES_PATH
+	firstBootMarkerPath = FIRST_BOOT_MARKER_PATH
+
+	// Servers in the chrony.conf shipped with the image
+	shippedServers = []string{"pool.ntp.org"}
+
+	profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+	profilesMutex sync.Mutex
+	// Guarded by profilesMutex, in creation order
+	serverProfiles = builtinServerProfiles()
+	defaultProfile = BUILTIN_PROFILE
+)
+
+func init() {
+	if v := os.Getenv("SERVER_PROFILES_PATH"); v != "" {
+		serverProfilesPath = v
+	}
+	if v := os.Getenv("FIRST_BOOT_MARKER_PATH"); v != "" {
+		firstBootMarkerPath = v
+	}
+}
+
+func builtinServerProfiles() []ServerProfile {
+	return []ServerProfile{{Name: BUILTIN_PROFILE, Description: "Public NTP pool", Servers: []string{"pool.ntp.org"}}}
+}
+
+// Helper to check a profile's fields, prefixing problems with field
+func validateServerProfile(field string, profile ServerProfile) []string {
+	var problems []string
+	if !profileNamePattern.MatchString(profile.Name) {
+		problems = append(problems, fmt.Sprintf("%sname %q must be 1-63 lower-case letters, digits, '.', '_' or '-'", field, profile.Name))
+	}
+	if len(profile.Description) > MAX_PROFILE_DESC {
+		problems = append(problems, fmt.Sprintf("%sdescription must not exceed %d bytes", field, MAX_PROFILE_DESC))
+	}
+	if len(profile.Servers) == 0 || len(profile.Servers) > MAX_PROFILE_SERVERS {
+		problems = append(problems, fmt.Sprintf("%sservers must list 1 to %d servers", field, MAX_PROFILE_SERVERS))
+	}
+	for i, server := range profile.Servers {
+		if !hostPattern.MatchString(server) {
+			problems = append(problems, fmt.Sprintf("%sservers[%d] %q is not a valid host name or address", field, i, server))
+		} else if _, _, err := net.SplitHostPort(server); err == nil {
+			problems = append(problems, fmt.Sprintf("%sservers[%d] %q must not include a port", field, i, server))
+		}
+		if containsString(profile.Servers[:i], server) {
+			problems = append(problems, fmt.Sprintf("%sservers[%d] %q is listed twice", field, i, server))
+		}
+	}
+	return problems
+}
+
+func loadServerProfiles() {
+	data, err := ioutil.ReadFile(serverProfilesPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading %s: %v", serverProfilesPath, err)
+		}
+		return
+	}
+	var file ServerProfilesResponse
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("Error parsing %s: %v", serverProfilesPath, err)
+		return
+	}
+	var problems []string
+	seen := map[string]bool{}
+	for i, profile := range file.Profiles {
+		problems = append(problems, validateServerProfile(fmt.Sprintf("profiles[%d].", i), profile)...)
+		if seen[profile.Name] {
+			problems = append(problems, fmt.Sprintf("profiles[%d] %q is defined twice", i, profile.Name))
+		}
+		seen[profile.Name] = true
+	}
+	if !seen[file.DefaultProfile] {
+		problems = append(problems, fmt.Sprintf("default_profile %q is not defined", file.DefaultProfile))
+	}
+	if len(problems) > 0 {
+		log.Printf("Invalid server profiles in %s: %s", serverProfilesPath, strings.Join(problems, "; "))
+		return
+	}
+	profilesMutex.Lock()
+	serverProfiles = file.Profiles
+	defaultProfile = file.DefaultProfile
+	profilesMutex.Unlock()
+}
+
+// profilesMutex must be held
+func saveServerProfilesLocked() error {
+	data, err := json.MarshalIndent(serverProfilesLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(serverProfilesPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(serverProfilesPath, data, 0644)
+}
+
+// Copy of the profiles with Default set (profilesMutex must be held)
+func serverProfilesLocked() ServerProfilesResponse {
+	response := ServerProfilesResponse{DefaultProfile: defaultProfile, Profiles: make([]ServerProfile, len(serverProfiles))}
+	for i, profile := range serverProfiles {
+		profile.Default = profile.Name == defaultProfile
+		response.Profiles[i] = profile
+	}
+	return response
+}
+
+// profilesMutex must be held
+func findServerProfileLocked(name string) int {
+	for i, profile := range serverProfiles {
+		if profile.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Helper to look up a profile; an empty name means the default one
+func getServerProfile(name string) (ServerProfile, bool) {
+	profilesMutex.Lock()
+	defer profilesMutex.Unlock()
+	if name == "" {
+		name = defaultProfile
+	}
+	idx := findServerProfileLocked(name)
+	if idx < 0 {
+		return ServerProfile{}, false
+	}
+	profile := serverProfiles[idx]
+	profile.Default = profile.Name == defaultProfile
+	return profile, true
+}
+
+// Give a new node the default profile's servers instead of whatever the
+// image shipped in chrony.conf. This runs once, until the first-boot
+// marker is written, and leaves servers an operator configured alone.
+func applyFirstBootProfile() {
+	if _, err := os.Stat(firstBootMarkerPath); !os.IsNotExist(err) {
+		return
+	}
+	profile, _ := getServerProfile("")
+	configured := getConfiguredServers()
+	if len(configured) > 0 && !sameServers(configured, shippedServers) {
+		log.Printf("Keeping configured servers %v at first boot", configured)
+	} else if !sameServers(profile.Servers, configured) {
+		// Keep the shipped configuration as the first revision
+		syncConfigRevision()
+		request := map[string]interface{}{"profile": profile.Name, "servers": profile.Servers}
+		message := fmt.Sprintf("Default server profile %s at first boot", profile.Name)
+		restartSuccess, err := setServersAsSystem(profile.Servers, AUDIT_SERVERS_DEFAULT, message, request)
+		if err != nil {
+			// No marker, so the next start tries again
+			log.Printf("Failed to apply default server profile %s: %v", profile.Name, err)
+			return
+		}
+		log.Printf("Applied default server profile %s %v at first boot (restart %v)", profile.Name, profile.Servers, restartSuccess)
+	}
+	if err := writeFirstBootMarker(); err != nil {
+		log.Printf("Error writing %s: %v", firstBootMarkerPath, err)
+	}
+}
+
+func writeFirstBootMarker() error {
+	if err := os.MkdirAll(filepath.Dir(firstBootMarkerPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(firstBootMarkerPath, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+}
+
+// Make a profile's servers the configured servers, as PUT /servers does
+func applyServerProfile(w http.ResponseWriter, r *http.Request, profile ServerProfile, action string) {
+	change, ok := beginConfigChange(w, r)
+	if !ok {
+		return
+	}
+	defer change.release()
+	request := map[string]interface{}{"profile": profile.Name, "servers": profile.Servers}
+	if err := updateChronyConfServers(profile.Servers); err != nil {
+		recordAudit(r, AuditEntry{Action: action, Request: request, Error: err.Error()}, change.before)
+		change.commit(w)
+		writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to update configuration", err.Error())
+		return
+	}
+	restartSuccess := restartChrony()
+	invalidateCaches()
+	recordAudit(r, AuditEntry{Action: action, Request: request, RestartSuccess: &restartSuccess}, change.before)
+	change.commit(w)
+	emitEvent(EVENT_SERVERS_CHANGED, map[string]interface{}{
+		"servers":         profile.Servers,
+		"profile":         profile.Name,
+		"restart_success": restartSuccess,
+	})
+
+	response := map[string]interface{}{
+		"profile":         profile.Name,
+		"result":          profile.Servers,
+		"restart_success": restartSuccess,
+	}
+	if !restartSuccess {
+		writeError(w, r, http.StatusBadGateway, ERR_RESTART_FAILED, "Configuration saved but the time service failed to restart", response)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Helper to decode and check a profile body; name comes from the path for PUT
+func decodeServerProfile(w http.ResponseWriter, r *http.Request, name string) (ServerProfileRequest, bool) {
+	var req ServerProfileRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+		return req, false
+	}
+	if name != "" {
+		if req.Name != "" && req.Name != name {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "name does not match the path", nil)
+			return req, false
+		}
+		req.Name = name
+	}
+	profile := ServerProfile{Name: req.Name, Description: req.Description, Servers: req.Servers}
+	if problems := validateServerProfile("", profile); len(problems) > 0 {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid server profile", problems)
+		return req, false
+	}
+	return req, true
+}
+
+// Store a new or replaced profile
+func storeServerProfile(w http.ResponseWriter, r *http.Request, req ServerProfileRequest, create bool) {
+	profile := ServerProfile{Name: req.Name, Description: req.Description, Servers: req.Servers}
+
+	profilesMutex.Lock()
+	idx := findServerProfileLocked(profile.Name)
+	var conflict string
+	switch {
+	case create && idx >= 0:
+		conflict = "A server profile with this name already exists"
+	case idx < 0 && len(serverProfiles) >= MAX_SERVER_PROFILES:
+		conflict = fmt.Sprintf("At most %d server profiles can be stored", MAX_SERVER_PROFILES)
+	case req.Default != nil && !*req.Default && profile.Name == defaultProfile:
+		conflict = "This is the default profile; make another profile the default first"
+	}
+	if conflict != "" {
+		profilesMutex.Unlock()
+		writeError(w, r, http.StatusConflict, ERR_CONFLICT, conflict, nil)
+		return
+	}
+	previous := append([]ServerProfile{}, serverProfiles...)
+	previousDefault := defaultProfile
+	if idx >= 0 {
+		serverProfiles[idx] = profile
+	} else {
+		serverProfiles = append(serverProfiles, profile)
+	}
+	if req.Default != nil && *req.Default {
+		defaultProfile = profile.Name
+	}
+	err := saveServerProfilesLocked()
+	if err != nil {
+		serverProfiles = previous
+		defaultProfile = previousDefault
+	}
+	profile.Default = profile.Name == defaultProfile
+	profilesMutex.Unlock()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save server profiles", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if idx < 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(profile)
+}
+
+// GET /servers/profiles lists the profiles; POST creates one
+func handleServerProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		profilesMutex.Lock()
+		response := serverProfilesLocked()
+		profilesMutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+	case http.MethodPost:
+		req, ok := decodeServerProfile(w, r, "")
+		if !ok {
+			return
+		}
+		storeServerProfile(w, r, req, true)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
+
+// GET, PUT (create or replace) or DELETE /servers/profiles/{name}, and
+// POST /servers/profiles/{name}/apply
+func handleServerProfile(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/servers/profiles/"), "/")
+	parts := strings.Split(rest, "/")
+	if rest == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "apply") {
+		handleNotFound(w, r)
+		return
+	}
+	name := parts[0]
+	if len(parts) == 2 {
+		if r.Method != http.MethodPost {
+			writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+			return
+		}
+		profile, ok := getServerProfile(name)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Server profile not found", nil)
+			return
+		}
+		applyServerProfile(w, r, profile, AUDIT_SERVERS_PROFILE)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		profile, ok := getServerProfile(name)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Server profile not found", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+
+	case http.MethodPut:
+		req, ok := decodeServerProfile(w, r, name)
+		if !ok {
+			return
+		}
+		storeServerProfile(w, r, req, false)
+
+	case http.MethodDelete:
+		profilesMutex.Lock()
+		idx := findServerProfileLocked(name)
+		if idx < 0 {
+			profilesMutex.Unlock()
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Server profile not found", nil)
+			return
+		}
+		if name == defaultProfile {
+			profilesMutex.Unlock()
+			writeError(w, r, http.StatusConflict, ERR_CONFLICT, "The default profile cannot be deleted; make another profile the default first", nil)
+			return
+		}
+		previous := append([]ServerProfile{}, serverProfiles...)
+		serverProfiles = append(serverProfiles[:idx:idx], serverProfiles[idx+1:]...)
+		err := saveServerProfilesLocked()
+		if err != nil {
+			serverProfiles = previous
+		}
+		profilesMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save server profiles", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
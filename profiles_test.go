@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Make site the default profile and remove the first-boot marker until
+// the test ends
+func useTestProfiles(t *testing.T) ServerProfile {
+	t.Helper()
+	resetTestChronyConf(t)
+	site := ServerProfile{Name: "site", Servers: []string{"10.1.0.10", "10.1.0.11"}}
+	profilesMutex.Lock()
+	savedProfiles, savedDefault := serverProfiles, defaultProfile
+	serverProfiles = append(builtinServerProfiles(), site)
+	defaultProfile = site.Name
+	profilesMutex.Unlock()
+	os.Remove(firstBootMarkerPath)
+	t.Cleanup(func() {
+		profilesMutex.Lock()
+		serverProfiles, defaultProfile = savedProfiles, savedDefault
+		profilesMutex.Unlock()
+		os.Remove(firstBootMarkerPath)
+	})
+	return site
+}
+
+func TestFirstBootAppliesDefaultProfileToShippedServers(t *testing.T) {
+	site := useTestProfiles(t)
+
+	applyFirstBootProfile()
+	if servers := getConfiguredServers(); !sameServers(servers, site.Servers) {
+		t.Errorf("servers after first boot = %v, want the default profile %v", servers, site.Servers)
+	}
+	if _, err := os.Stat(firstBootMarkerPath); err != nil {
+		t.Errorf("first-boot marker: %v", err)
+	}
+}
+
+func TestFirstBootKeepsCustomServers(t *testing.T) {
+	useTestProfiles(t)
+	// A node upgraded from a release without config-state.json
+	os.Remove(configStatePath)
+	custom := "server ntp1.operator.example iburst\nserver ntp2.operator.example iburst\nlocal stratum 10\n"
+	if err := ioutil.WriteFile(chronyConfPath, []byte(custom), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	applyFirstBootProfile()
+	if content, _ := ioutil.ReadFile(chronyConfPath); string(content) != custom {
+		t.Errorf("chrony.conf after first boot:\n%s\nwant the operator's servers left alone", content)
+	}
+	if _, err := os.Stat(firstBootMarkerPath); err != nil {
+		t.Errorf("first-boot marker: %v", err)
+	}
+}
+
+func TestFirstBootRunsOnce(t *testing.T) {
+	useTestProfiles(t)
+	if err := writeFirstBootMarker(); err != nil {
+		t.Fatal(err)
+	}
+
+	applyFirstBootProfile()
+	if content, _ := ioutil.ReadFile(chronyConfPath); string(content) != testChronyConf {
+		t.Errorf("chrony.conf after a later start:\n%s\nwant it unchanged", content)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const ROLES_PATH = "/etc/brick/clock/roles.json"
+
+// Bypassing the status cache with ?fresh=1
+const PERM_STATUS_FRESH = "clock/status_fresh"
+
+const claimsContextKey contextKey = "claims"
+
+// Access rule for one method on a registered route. Method "*" applies to
+// every method without a more specific rule; methods without any rule are
+// refused with 405. A rule that is neither Public nor carries a Permission
+// only requires a valid token.
+type routePolicy struct {
+	Path       string
+	Method     string
+	Public     bool
+	Permission string
+}
+
+// Every registered route must have a rule. Read-only routes list GET
+// (HEAD follows it); "*" rules and mutating methods must require a
+// permission (enforced by TestRoutePolicies).
+var routePolicies = []routePolicy{
+	{Path: "/health", Method: "GET", Public: true},
+	{Path: "/livez", Method: "GET", Public: true},
+	{Path: "/readyz", Method: "GET", Public: true},
+	{Path: "/syncz", Method: "GET", Public: true},
+	{Path: "/version", Method: "GET", Public: true},
+	{Path: "/app-version", Method: "GET", Public: true},
+	{Path: "/openapi.json", Method: "GET", Public: true},
+	{Path: "/docs", Method: "GET", Public: true},
+
+	{Path: "/whoami", Method: "GET"},
+	{Path: "/status", Method: "GET"},
+	{Path: "/status/tracking", Method: "GET"},
+	{Path: "/status/sources", Method: "GET"},
+	{Path: "/status/activity", Method: "GET"},
+	{Path: "/status/clients", Method: "GET"},
+	{Path: "/status/health", Method: "GET"},
+	{Path: "/probe", Method: "GET"},
+	{Path: "/events", Method: "GET"},
+
+	{Path: "/servers", Method: "GET"},
+	{Path: "/servers", Method: "*", Permission: "clock/servers"},
+	{Path: "/servers/default", Method: "GET"},
+	{Path: "/servers/default", Method: "*", Permission: "clock/servers"},
+	{Path: "/servers/profiles", Method: "GET"},
+	{Path: "/servers/profiles", Method: "*", Permission: "clock/servers"},
+	{Path: "/servers/profiles/", Method: "GET"},
+	{Path: "/servers/profiles/", Method: "*", Permission: "clock/servers"},
+	{Path: "/servers/candidates", Method: "GET"},
+	{Path: "/servers/selection", Method: "GET"},
+	{Path: "/servers/selection", Method: "*", Permission: "clock/servers"},
+	{Path: "/servers/failover", Method: "GET"},
+	{Path: "/servers/failover", Method: "*", Permission: "clock/servers"},
+	{Path: "/servers/discovery", Method: "GET"},
+	{Path: "/servers/discovery", Method: "*", Permission: "clock/servers"},
+	{Path: "/server-mode", Method: "GET"},
+	{Path: "/server-mode", Method: "*", Permission: "clock/server_mode"},
+	{Path: "/cluster", Method: "GET"},
+	{Path: "/cluster", Method: "*", Permission: "clock/config"},
+	{Path: "/config", Method: "GET"},
+	{Path: "/config", Method: "*", Permission: "clock/config"},
+	{Path: "/config/pending", Method: "GET"},
+	{Path: "/config/pending", Method: "*", Permission: "clock/confirm"},
+	{Path: "/config/confirm", Method: "*", Permission: "clock/confirm"},
+	{Path: "/config/revisions", Method: "GET"},
+	{Path: "/config/revisions/", Method: "GET"},
+	{Path: "/config/revisions/", Method: "*", Permission: "clock/config"},
+
+	{Path: "/webhooks", Method: "GET"},
+	{Path: "/webhooks", Method: "*", Permission: "clock/webhooks"},
+	{Path: "/webhooks/", Method: "GET"},
+	{Path: "/webhooks/", Method: "*", Permission: "clock/webhooks"},
+
+	{Path: "/audit", Method: "GET", Permission: "clock/audit"},
+
+	{Path: "/alerts", Method: "GET"},
+	{Path: "/alerts/rules", Method: "GET"},
+	{Path: "/alerts/rules", Method: "*", Permission: "clock/alerts"},
+	{Path: "/alerts/silences", Method: "GET"},
+	{Path: "/alerts/silences", Method: "*", Permission: "clock/alerts"},
+	{Path: "/alerts/silences/", Method: "*", Permission: "clock/alerts"},
+}
+
+// Permissions that handlers check for optional behaviour of an otherwise
+// allowed request; the route table does not know about them
+var handlerPermissions = []string{PERM_STATUS_FRESH, PERM_PROBE_ANY}
+
+// Built-in roles, used when no roles file exists
+var defaultRoles = map[string][]string{
+	"clock-admin":    {"clock/*"},
+	"clock-operator": {"clock/servers", "clock/server_mode", "clock/confirm", PERM_STATUS_FRESH},
+	"clock-viewer":   {},
+}
+
+var (
+	rolesPath    = ROLES_PATH
+	roles        = defaultRoles
+	rolesMutex   sync.RWMutex
+	mutatingVerb = map[string]bool{"POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+)
+
+var permissionCheckEnabled = true
+
+func init() {
+	if os.Getenv("PERMISSION_CHECK") == "off" {
+		permissionCheckEnabled = false
+		log.Println("WARNING: Permission checks are DISABLED! Only authentication is enforced.")
+	} else {
+		permissionCheckEnabled = true
+	}
+	if v := os.Getenv("ROLES_PATH"); v != "" {
+		rolesPath = v
+	}
+}
+
+// Load role definitions ({"role": ["perm", ...]}); keeps the built-in roles if the file is absent
+func loadRoles() {
+	data, err := ioutil.ReadFile(rolesPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read roles: %v", err)
+		}
+		return
+	}
+	var loaded map[string][]string
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("Failed to parse roles: %v", err)
+		return
+	}
+	rolesMutex.Lock()
+	roles = loaded
+	rolesMutex.Unlock()
+	log.Printf("Loaded %d role(s) from %s", len(loaded), rolesPath)
+}
+
+// Helper to read a claim holding a list of strings ([]interface{}, []string or comma-separated)
+func stringListClaim(claims map[string]interface{}, name string) []string {
+	var result []string
+	switch v := claims[name].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+	case []string:
+		result = append(result, v...)
+	case string:
+		result = splitList(v)
+	}
+	return result
+}
+
+// Permissions granted by the token directly and through its roles, possibly with wildcards
+func grantedPermissions(claims map[string]interface{}) []string {
+	seen := map[string]bool{}
+	var granted []string
+	add := func(perm string) {
+		if !seen[perm] {
+			seen[perm] = true
+			granted = append(granted, perm)
+		}
+	}
+	for _, perm := range stringListClaim(claims, "permissions") {
+		add(perm)
+	}
+	rolesMutex.RLock()
+	for _, role := range stringListClaim(claims, "roles") {
+		for _, perm := range roles[role] {
+			add(perm)
+		}
+	}
+	rolesMutex.RUnlock()
+	sort.Strings(granted)
+	return granted
+}
+
+// Check a granted permission against a required one; "clock/*" covers
+// everything below clock/, and "*" covers everything
+func permissionMatches(granted string, required string) bool {
+	if granted == required || granted == "*" {
+		return true
+	}
+	if strings.HasSuffix(granted, "/*") {
+		return strings.HasPrefix(required, strings.TrimSuffix(granted, "*"))
+	}
+	return false
+}
+
+// Helper to check if a user has a permission in JWT claims
+func hasPermission(claims map[string]interface{}, perm string) bool {
+	for _, granted := range grantedPermissions(claims) {
+		if permissionMatches(granted, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the rule for a method on a registered route; HEAD follows GET
+func lookupRoutePolicy(pattern string, method string) (routePolicy, bool) {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	var fallback *routePolicy
+	for i, policy := range routePolicies {
+		if policy.Path != pattern {
+			continue
+		}
+		if policy.Method == method {
+			return policy, true
+		}
+		if policy.Method == "*" {
+			fallback = &routePolicies[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return routePolicy{}, false
+}
+
+// Helper to tell whether a registered route has a rule for any method
+func routeHasPolicy(pattern string) bool {
+	for _, policy := range routePolicies {
+		if policy.Path == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve the rule for a documented path, matching it to the most specific registered route
+func policyForPath(method string, path string) (routePolicy, bool) {
+	best := ""
+	for _, policy := range routePolicies {
+		if routeCoversPath(policy.Path, path) && len(policy.Path) > len(best) {
+			best = policy.Path
+		}
+	}
+	if best == "" {
+		return routePolicy{}, false
+	}
+	return lookupRoutePolicy(best, method)
+}
+
+// All permissions referenced by the route table and by handlers
+func knownPermissions() []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, policy := range routePolicies {
+		if policy.Permission != "" && !seen[policy.Permission] {
+			seen[policy.Permission] = true
+			result = append(result, policy.Permission)
+		}
+	}
+	for _, perm := range handlerPermissions {
+		if !seen[perm] {
+			seen[perm] = true
+			result = append(result, perm)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Enforce the route table before the handler runs; verified claims are
+// available to the handler through requestClaims
+func withRoutePolicy(pattern string, handler func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := lookupRoutePolicy(pattern, r.Method)
+		if !ok && routeHasPolicy(pattern) {
+			writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+			return
+		}
+		if !ok {
+			// TestRoutePolicies prevents this; fail closed regardless
+			writeError(w, r, http.StatusForbidden, ERR_FORBIDDEN, "No access policy for this route", nil)
+			return
+		}
+		if policy.Public {
+			handler(w, r)
+			return
+		}
+		claims, err := getClaimsFromRequest(r)
+		if err != nil {
+			writeUnauthorized(w, r, err)
+			return
+		}
+		if policy.Permission != "" && permissionCheckEnabled && !hasPermission(claims, policy.Permission) {
+			writeError(w, r, http.StatusForbidden, ERR_FORBIDDEN, "Insufficient permissions", map[string]string{"required_permission": policy.Permission})
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	}
+}
+
+// Check a handler permission the way withRoutePolicy checks route permissions;
+// writes the 403 response and returns false when it is missing
+func requirePermission(w http.ResponseWriter, r *http.Request, perm string) bool {
+	if !permissionCheckEnabled || hasPermission(requestClaims(r), perm) {
+		return true
+	}
+	writeError(w, r, http.StatusForbidden, ERR_FORBIDDEN, "Insufficient permissions", map[string]string{"required_permission": perm})
+	return false
+}
+
+// Claims of the authenticated caller, or nil on public routes
+func requestClaims(r *http.Request) map[string]interface{} {
+	claims, _ := r.Context().Value(claimsContextKey).(map[string]interface{})
+	return claims
+}
+
+// Check the route table against the registered routes and the documented
+// operations; returns a description of every gap
+func checkRoutePolicies(routes []string) []string {
+	var problems []string
+	for _, route := range routes {
+		if !routeHasPolicy(route) {
+			problems = append(problems, "route "+route+" has no access rule")
+		}
+	}
+	for _, op := range apiOperations {
+		if !mutatingVerb[op.Method] {
+			continue
+		}
+		policy, ok := policyForPath(op.Method, op.Path)
+		if !ok || policy.Public || policy.Permission == "" {
+			problems = append(problems, op.Method+" "+op.Path+" is not protected by a permission")
+		}
+	}
+	for _, policy := range routePolicies {
+		if (policy.Method == "*" || mutatingVerb[policy.Method]) && policy.Permission == "" {
+			problems = append(problems, policy.Method+" "+policy.Path+" is not protected by a permission")
+		}
+	}
+	return problems
+}
+
+// Log any gap in the route access policy; requests on such routes are denied
+func logRoutePolicyProblems(routes []string) {
+	for _, problem := range checkRoutePolicies(routes) {
+		log.Printf("WARNING: access policy: %s", problem)
+	}
+}
+
+type WhoAmIResponse struct {
+	Subject                string   `json:"subject"`
+	Issuer                 string   `json:"issuer,omitempty"`
+	Roles                  []string `json:"roles"`
+	Granted                []string `json:"granted"`
+	Permissions            []string `json:"permissions"`
+	PermissionCheckEnabled bool     `json:"permission_check_enabled"`
+	LocalSocket            bool     `json:"local_socket"`
+}
+
+// Show the caller's identity and which permissions they effectively hold
+func handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	claims := requestClaims(r)
+	response := WhoAmIResponse{
+		Roles:                  stringListClaim(claims, "roles"),
+		Granted:                grantedPermissions(claims),
+		Permissions:            []string{},
+		PermissionCheckEnabled: permissionCheckEnabled,
+		LocalSocket:            isLocalSocketRequest(r),
+	}
+	response.Subject, _ = claims["sub"].(string)
+	response.Issuer, _ = claims["iss"].(string)
+	if response.Roles == nil {
+		response.Roles = []string{}
+	}
+	if response.Granted == nil {
+		response.Granted = []string{}
+	}
+	for _, perm := range knownPermissions() {
+		if !permissionCheckEnabled || hasPermission(claims, perm) {
+			response.Permissions = append(response.Permissions, perm)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
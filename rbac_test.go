@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutePolicies(t *testing.T) {
+	for _, problem := range checkRoutePolicies(testRoutes()) {
+		t.Error(problem)
+	}
+}
+
+func TestRoutePolicyGapsAreReported(t *testing.T) {
+	saved := routePolicies
+	defer func() { routePolicies = saved }()
+	routePolicies = append(append([]routePolicy(nil), saved...),
+		routePolicy{Path: "/unguarded", Method: "DELETE"},
+		routePolicy{Path: "/open", Method: "*"})
+
+	problems := strings.Join(checkRoutePolicies(append(append([]string(nil), testRoutes()...), "/unlisted")), "\n")
+	for _, want := range []string{
+		"route /unlisted has no access rule",
+		"DELETE /unguarded is not protected by a permission",
+		"* /open is not protected by a permission",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("problems do not mention %q:\n%s", want, problems)
+		}
+	}
+}
+
+// Read-only routes refuse other methods before the handler runs
+func TestRoutePolicyRefusesUnlistedMethods(t *testing.T) {
+	called := false
+	handler := withRoutePolicy("/status", func(w http.ResponseWriter, r *http.Request) { called = true })
+	token := testToken(t, adminClaims())
+
+	for _, test := range []struct {
+		method string
+		want   int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodPost, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+	} {
+		called = false
+		r := httptest.NewRequest(test.method, "/status", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.want || called != (test.want == http.StatusOK) {
+			t.Errorf("%s /status = %d (handler called %v), want %d", test.method, w.Code, called, test.want)
+		}
+	}
+}
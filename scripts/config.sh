@@ -70,7 +70,7 @@ run_container() {
 wait_for_api() {
     print_info "Waiting for API to be ready..."
     for i in {1..30}; do
-        if curl -s http://localhost:$API_PORT/status > /dev/null 2>&1; then
+        if curl -sf http://localhost:$API_PORT/health > /dev/null 2>&1; then
             print_info "API is ready!"
             return 0
         fi
@@ -83,7 +83,7 @@ wait_for_api() {
 }
 
 check_api_health() {
-    if curl -s http://localhost:$API_PORT/status > /dev/null 2>&1; then
+    if curl -sf http://localhost:$API_PORT/health > /dev/null 2>&1; then
         echo "✅ API is responding"
     else
         echo "❌ API is not responding"
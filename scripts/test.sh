@@ -39,41 +39,206 @@ if [ "$USER_TOKEN" = "null" ] || [ -z "$USER_TOKEN" ]; then fail "User login fai
 pass "User login"
 
 echo -e "\n# 3. Test all major endpoints with admin token (should all succeed)"
-for endpoint in "/status" "/servers" "/server-mode" "/status/tracking" "/status/sources" "/status/activity" "/status/clients"; do
+for endpoint in "/status" "/servers" "/server-mode" "/status/tracking" "/status/sources" "/status/activity" "/status/clients" "/status/health"; do
   echo -e "\n## GET $endpoint (admin) ..."
   code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL$endpoint")
   expect_code 200 "GET $endpoint (admin)" "$code"
 done
 
 echo -e "\n## PUT /server-mode (admin, enable) ..."
-code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "Content-Type: application/json" -d '{"enabled":true}' "$CLOCK_URL/server-mode")
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d '{"enabled":true}' "$CLOCK_URL/server-mode")
 expect_code 200 "PUT /server-mode (admin, enable)" "$code"
 
 echo -e "\n## PUT /servers (admin, set servers) ..."
-code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "Content-Type: application/json" -d '{"servers":["pool.ntp.org","time.google.com"]}' "$CLOCK_URL/servers")
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d '{"servers":["pool.ntp.org","time.google.com"]}' "$CLOCK_URL/servers")
 expect_code 200 "PUT /servers (admin)" "$code"
 
 echo -e "\n## DELETE /servers (admin, reset servers) ..."
-code=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/servers")
+code=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: *" "$CLOCK_URL/servers")
 expect_code 200 "DELETE /servers (admin)" "$code"
 
 echo -e "\n# 4. Test endpoints with user token (should be limited by permissions)"
-for endpoint in "/status" "/servers" "/server-mode" "/status/tracking" "/status/sources" "/status/activity" "/status/clients"; do
+for endpoint in "/status" "/servers" "/server-mode" "/status/tracking" "/status/sources" "/status/activity" "/status/clients" "/status/health"; do
   echo -e "\n## GET $endpoint (user) ..."
   code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL$endpoint")
   expect_code 200 "GET $endpoint (user)" "$code"
 done
 
 echo -e "\n## PUT /server-mode (user, should be forbidden) ..."
-code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -H "Content-Type: application/json" -d '{"enabled":true}' "$CLOCK_URL/server-mode")
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d '{"enabled":true}' "$CLOCK_URL/server-mode")
 expect_code 403 "PUT /server-mode (user, forbidden)" "$code"
 
 echo -e "\n## PUT /servers (user, should be forbidden) ..."
-code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -H "Content-Type: application/json" -d '{"servers":["pool.ntp.org"]}' "$CLOCK_URL/servers")
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d '{"servers":["pool.ntp.org"]}' "$CLOCK_URL/servers")
 expect_code 403 "PUT /servers (user, forbidden)" "$code"
 
 echo -e "\n## DELETE /servers (user, should be forbidden) ..."
-code=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers")
+code=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer $USER_TOKEN" -H "If-Match: *" "$CLOCK_URL/servers")
 expect_code 403 "DELETE /servers (user, forbidden)" "$code"
 
+echo -e "\n## PUT /servers/default (user, forbidden) ..."
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -H "If-Match: *" "$CLOCK_URL/servers/default")
+expect_code 403 "PUT /servers/default (user, forbidden)" "$code"
+
+echo -e "\n## Unauthenticated requests ..."
+for endpoint in "/status" "/servers" "/server-mode" "/whoami"; do
+  code=$(curl -s -o /dev/null -w "%{http_code}" "$CLOCK_URL$endpoint")
+  expect_code 401 "GET $endpoint (no token)" "$code"
+done
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT "$CLOCK_URL/servers/default")
+expect_code 401 "PUT /servers/default (no token)" "$code"
+
+echo -e "\n## GET /whoami (user) ..."
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/whoami")
+expect_code 200 "GET /whoami (user)" "$code"
+
+echo -e "\n## GET /audit (user, forbidden) ..."
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/audit")
+expect_code 403 "GET /audit (user, forbidden)" "$code"
+
+echo -e "\n## Optimistic concurrency on configuration ..."
+etag=$(curl -s -D - -o /dev/null -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/servers" | tr -d '\r' | awk 'tolower($1)=="etag:" {print $2}')
+if [ -n "$etag" ]; then pass "GET /servers returns an ETag"; else fail "GET /servers returns an ETag"; fi
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "Content-Type: application/json" -d '{"enabled":false}' "$CLOCK_URL/server-mode")
+expect_code 428 "PUT /server-mode without If-Match" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: $etag" -H "Content-Type: application/json" -d '{"enabled":false}' "$CLOCK_URL/server-mode")
+expect_code 200 "PUT /server-mode with current ETag" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: $etag" -H "Content-Type: application/json" -d '{"enabled":true}' "$CLOCK_URL/server-mode")
+expect_code 412 "PUT /server-mode with stale ETag" "$code"
+
+echo -e "\n## Configuration document ..."
+config=$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config")
+expect_code true "GET /config returns servers" "$(echo "$config" | jq '.servers | type == "array"')"
+changed=$(curl -s -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "Content-Type: application/json" -d "$config" "$CLOCK_URL/config?dry_run=1" | jq '.changed')
+expect_code false "PUT /config?dry_run=1 with the current document" "$changed"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d "$config" "$CLOCK_URL/config")
+expect_code 403 "PUT /config (user, forbidden)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d '{"servers":[{"host":"bad host"}]}' "$CLOCK_URL/config")
+expect_code 400 "PUT /config with an invalid document" "$code"
+
+echo -e "\n## Changes awaiting confirmation ..."
+mode=$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/server-mode" | jq '.server_mode_enabled | not')
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d "{\"enabled\":$mode}" "$CLOCK_URL/server-mode?confirm_timeout=1m")
+expect_code 200 "PUT /server-mode?confirm_timeout=1m" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/pending")
+expect_code 200 "GET /config/pending" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: *" -H "Content-Type: application/json" -d '{"enabled":true}' "$CLOCK_URL/server-mode")
+expect_code 409 "PUT /server-mode while a change is pending" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/pending")
+expect_code 200 "DELETE /config/pending (revert)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/confirm")
+expect_code 404 "POST /config/confirm with nothing pending" "$code"
+
+echo -e "\n## Configuration revisions ..."
+current=$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/revisions" | jq '.current')
+expect_code true "GET /config/revisions lists the current revision" "$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/revisions" | jq --argjson c "$current" 'any(.revisions[]; .revision == $c and .current)')"
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/revisions/$current")
+expect_code 200 "GET /config/revisions/$current" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/revisions/diff?from=$current")
+expect_code 200 "GET /config/revisions/diff" "$code"
+changed=$(curl -s -X POST -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/config/revisions/$current/restore?dry_run=1" | jq '.changed')
+expect_code false "POST /config/revisions/$current/restore?dry_run=1" "$changed"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer $USER_TOKEN" -H "If-Match: *" "$CLOCK_URL/config/revisions/$current/restore")
+expect_code 403 "Restore a revision (user, forbidden)" "$code"
+
+echo -e "\n## Cached status data ..."
+age=$(curl -s -D - -o /dev/null -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/status" | tr -d '\r' | awk -F': ' 'tolower($1) == "age" {print $2}')
+expect_code true "GET /status reports an Age header" "$([ -n "$age" ] && echo true || echo false)"
+has_meta=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/status" | jq '.meta.tracking | has("collected_at") and has("source")')
+expect_code true "GET /status reports dataset freshness" "$has_meta"
+source=$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/status/tracking?fresh=1" | jq -r '.meta.tracking.source')
+expect_code live "GET /status/tracking?fresh=1 (admin)" "$source"
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/status?fresh=1")
+expect_code 403 "GET /status?fresh=1 (user, forbidden)" "$code"
+
+echo -e "\n## Sync health ..."
+state=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/status/health" | jq -r '.state')
+expect_code true "GET /status/health reports a state" "$(echo "$state" | grep -qE '^(unsynchronized|acquiring|synchronized|degraded|holdover)$' && echo true || echo false)"
+included=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/status?flags=32" | jq 'has("health")')
+expect_code true "GET /status?flags=32 includes health" "$included"
+
+echo -e "\n## SNTP probe ..."
+# chronyd in the container answers NTP on localhost; error is set if it does not
+answered=$(curl -s -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/probe?server=127.0.0.1" | jq '.results[0] | has("stratum") or has("error")')
+expect_code true "GET /probe?server=127.0.0.1 (admin)" "$answered"
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/probe?server=127.0.0.1")
+expect_code 403 "GET /probe with an unconfigured server (user, forbidden)" "$code"
+
+echo -e "\n## Server candidates and selection ..."
+listed=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers/candidates" | jq '.candidates | type == "array"')
+expect_code true "GET /servers/candidates (user)" "$listed"
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers/candidates?candidate=127.0.0.1")
+expect_code 403 "GET /servers/candidates with an unconfigured candidate (user, forbidden)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -d '{"enabled":false}' "$CLOCK_URL/servers/selection")
+expect_code 403 "PUT /servers/selection (user, forbidden)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"enabled":true,"candidates":[],"interval":"1s"}' "$CLOCK_URL/servers/selection")
+expect_code 400 "PUT /servers/selection with an invalid policy" "$code"
+hold_down=$(curl -s -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"enabled":false}' "$CLOCK_URL/servers/selection" | jq -r '.policy.hold_down')
+expect_code 6h "PUT /servers/selection keeps defaults for left-out fields" "$hold_down"
+
+echo -e "\n## Server profiles ..."
+default=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers/default" | jq -r '.default')
+expect_code true "GET /servers/default (user)" "$default"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer $USER_TOKEN" -d '{"name":"test-profile","servers":["time.google.com"]}' "$CLOCK_URL/servers/profiles")
+expect_code 403 "POST /servers/profiles (user, forbidden)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"name":"Test Profile","servers":[]}' "$CLOCK_URL/servers/profiles")
+expect_code 400 "POST /servers/profiles with an invalid profile" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"name":"test-profile","servers":["time.google.com"]}' "$CLOCK_URL/servers/profiles")
+expect_code 201 "POST /servers/profiles" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"name":"test-profile","servers":["time.google.com"]}' "$CLOCK_URL/servers/profiles")
+expect_code 409 "POST /servers/profiles with an existing name" "$code"
+default_name=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers/default" | jq -r '.name')
+code=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/servers/profiles/$default_name")
+expect_code 409 "DELETE /servers/profiles/{default}" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "Authorization: Bearer $ADMIN_TOKEN" "$CLOCK_URL/servers/profiles/test-profile")
+expect_code 204 "DELETE /servers/profiles/test-profile" "$code"
+
+echo -e "\n## Failover ..."
+active=$(curl -s -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers/failover" | jq -r '.active')
+expect_code none "GET /servers/failover (user, servers match neither group)" "$active"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -d '{"enabled":false}' "$CLOCK_URL/servers/failover")
+expect_code 403 "PUT /servers/failover (user, forbidden)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"enabled":true,"primary":["pool.ntp.org"],"backup":["pool.ntp.org"]}' "$CLOCK_URL/servers/failover")
+expect_code 400 "PUT /servers/failover with a server in both groups" "$code"
+window=$(curl -s -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"enabled":false,"primary":["pool.ntp.org"],"backup":["time.google.com"]}' "$CLOCK_URL/servers/failover" | jq -r '.policy.outage_window')
+expect_code 5m "PUT /servers/failover keeps defaults for left-out fields" "$window"
+
+echo -e "\n## Discovery ..."
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers/discovery")
+expect_code 200 "GET /servers/discovery (user)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/servers/discovery")
+expect_code 403 "POST /servers/discovery (user, forbidden)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"enabled":true,"providers":[{"type":"file","path":"relative"}]}' "$CLOCK_URL/servers/discovery")
+expect_code 400 "PUT /servers/discovery with a relative file path" "$code"
+max=$(curl -s -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"enabled":false,"providers":[{"type":"srv","name":"_ntp._udp.example.com"}]}' "$CLOCK_URL/servers/discovery" | jq -r '.policy.max_servers')
+expect_code 4 "PUT /servers/discovery keeps defaults for left-out fields" "$max"
+
+echo -e "\n## Cluster (peers and orphan mode) ..."
+code=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $USER_TOKEN" "$CLOCK_URL/cluster")
+expect_code 200 "GET /cluster (user)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $USER_TOKEN" -H "If-Match: *" -d '{"peers":[],"local":{"stratum":10}}' "$CLOCK_URL/cluster")
+expect_code 403 "PUT /cluster (user, forbidden)" "$code"
+code=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -H "If-Match: *" -d '{"peers":[],"local":{"stratum":16}}' "$CLOCK_URL/cluster")
+expect_code 400 "PUT /cluster with an invalid local stratum" "$code"
+changes=$(curl -s -X PUT -H "Authorization: Bearer $ADMIN_TOKEN" -d '{"peers":[{"host":"node-b.example"}],"local":{"stratum":10,"orphan":true}}' "$CLOCK_URL/cluster?dry_run=1" | jq -c '[.changes[].field]')
+expect_code '["peers","local"]' "PUT /cluster?dry_run=1 plans peers and local" "$changes"
+
+echo -e "\n## Probes ..."
+for probe in "/livez" "/readyz"; do
+  code=$(curl -s -o /dev/null -w "%{http_code}" "$CLOCK_URL$probe")
+  expect_code 200 "GET $probe (no token)" "$code"
+done
+status=$(curl -s "$CLOCK_URL/syncz" | jq -r '.status')
+expect_code true "GET /syncz reports a status" "$([ "$status" = pass ] || [ "$status" = fail ] && echo true || echo false)"
+code=$(curl -s -o /dev/null -w "%{http_code}" "$CLOCK_URL/syncz?min_sources=1000")
+expect_code 503 "GET /syncz with an unreachable source minimum" "$code"
+
+echo -e "\n# 5. API documentation"
+code=$(curl -s -o /dev/null -w "%{http_code}" "$CLOCK_URL/openapi.json")
+expect_code 200 "GET /openapi.json" "$code"
+for path in "/status" "/servers" "/server-mode" "/config" "/webhooks" "/alerts" "/audit"; do
+  documented=$(curl -s "$CLOCK_URL/openapi.json" | jq --arg p "$path" '.paths | has($p)')
+  expect_code true "OpenAPI documents $path" "$documented"
+done
+
 echo -e "\nAll tests completed." 
\ No newline at end of file
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"el/brick-clock/client"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// SDK client for the real handlers, authenticated with the given claims
+// (nil for no token)
+func newTestSDK(t *testing.T, claims jwt.MapClaims) *client.Client {
+	t.Helper()
+	server := newTestServer(t)
+	var opts []client.Option
+	if claims != nil {
+		opts = append(opts, client.WithTokenSource(client.StaticToken(testToken(t, claims))))
+	}
+	c, err := client.New(server.URL, append(opts, client.WithRetries(0, time.Millisecond))...)
+	if err != nil {
+		t.Fatalf("client.New: %v", err)
+	}
+	return c
+}
+
+func adminClaims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "admin", "permissions": []string{"clock/*"}}
+}
+
+func TestSDKReadsStatus(t *testing.T) {
+	resetTestChronyConf(t)
+	c := newTestSDK(t, jwt.MapClaims{"sub": "viewer"})
+	ctx := context.Background()
+
+	status, err := c.Status(ctx, client.STATUS_TRACKING|client.STATUS_SOURCES|client.STATUS_SERVER_MODE)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.Tracking["ReferenceID"] != "CA760182 (202.118.1.130)" || status.Tracking["Stratum"] != "3" {
+		t.Errorf("tracking = %v", status.Tracking)
+	}
+	if len(status.Sources) != 2 || status.Sources[0]["name"] != "202.118.1.130" {
+		t.Errorf("sources = %v", status.Sources)
+	}
+	if !status.ServerModeEnabled {
+		t.Error("server mode disabled, want enabled (allow 0.0.0.0/0)")
+	}
+	if meta, ok := status.Meta["tracking"]; !ok || meta.CollectedAt == nil {
+		t.Errorf("meta = %+v, want tracking collected_at", status.Meta)
+	}
+
+	servers, err := c.Servers(ctx)
+	if err != nil || strings.Join(servers, ",") != "pool.ntp.org" {
+		t.Errorf("Servers = %v, %v", servers, err)
+	}
+	config, err := c.Config(ctx)
+	if err != nil || config.Local == nil || config.Local.Stratum != 10 {
+		t.Errorf("Config = %+v, %v", config, err)
+	}
+	whoami, err := c.WhoAmI(ctx)
+	if err != nil || whoami.Subject != "viewer" {
+		t.Errorf("WhoAmI = %+v, %v", whoami, err)
+	}
+	spec, err := c.OpenAPI(ctx)
+	if err != nil || !strings.Contains(string(spec), `"openapi"`) {
+		t.Errorf("OpenAPI = %.40s, %v", spec, err)
+	}
+	if health, err := c.Health(ctx); err != nil || health != "OK" {
+		t.Errorf("Health = %q, %v", health, err)
+	}
+}
+
+func TestSDKRequiresToken(t *testing.T) {
+	c := newTestSDK(t, nil)
+	_, err := c.Servers(context.Background())
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != ERR_UNAUTHORIZED {
+		t.Fatalf("Servers without a token = %v, want a 401 envelope", err)
+	}
+	if string(apiErr.Details) != `{"reason":"token_missing"}` {
+		t.Errorf("details = %s", apiErr.Details)
+	}
+}
+
+func TestSDKChangesNeedIfMatch(t *testing.T) {
+	resetTestChronyConf(t)
+	c := newTestSDK(t, adminClaims())
+	ctx := context.Background()
+
+	if _, err := c.SetServers(ctx, []string{"time.example.com"}); !client.IsStatus(err, http.StatusPreconditionRequired) {
+		t.Fatalf("SetServers without If-Match = %v, want 428", err)
+	}
+
+	etag, err := c.ConfigETag(ctx)
+	if err != nil || etag == "" {
+		t.Fatalf("ConfigETag = %q, %v", etag, err)
+	}
+	result, err := c.SetServers(client.WithIfMatch(ctx, etag), []string{"time.example.com"})
+	if err != nil || !result.RestartSuccess {
+		t.Fatalf("SetServers = %+v, %v", result, err)
+	}
+	content, _ := ioutil.ReadFile(chronyConfPath)
+	if !strings.Contains(string(content), "server time.example.com iburst") || strings.Contains(string(content), "pool.ntp.org") {
+		t.Errorf("chrony.conf after SetServers:\n%s", content)
+	}
+
+	// The revision moved on, so the old ETag is stale
+	if _, err := c.SetServerMode(client.WithIfMatch(ctx, etag), false); !client.IsStatus(err, http.StatusPreconditionFailed) {
+		t.Fatalf("SetServerMode with a stale ETag = %v, want 412", err)
+	}
+	etag, _ = c.ConfigETag(ctx)
+	mode, err := c.SetServerMode(client.WithIfMatch(ctx, etag), false)
+	if err != nil || mode.ServerModeEnabled {
+		t.Fatalf("SetServerMode = %+v, %v", mode, err)
+	}
+}
+
+func TestSDKPlansAndAppliesConfig(t *testing.T) {
+	resetTestChronyConf(t)
+	c := newTestSDK(t, adminClaims())
+	ctx := context.Background()
+
+	config, err := c.Config(ctx)
+	if err != nil {
+		t.Fatalf("Config: %v", err)
+	}
+	config.Deny = []string{"10.1.0.0/16"}
+	plan, err := c.PlanConfig(ctx, *config)
+	if err != nil || !plan.Changed || !strings.Contains(plan.Diff, "+deny 10.1.0.0/16") {
+		t.Fatalf("PlanConfig = %+v, %v", plan, err)
+	}
+	if content, _ := ioutil.ReadFile(chronyConfPath); strings.Contains(string(content), "deny") {
+		t.Fatal("PlanConfig wrote chrony.conf")
+	}
+
+	result, err := c.SetConfig(client.WithIfMatch(ctx, "*"), *config)
+	if err != nil || !result.Changed {
+		t.Fatalf("SetConfig = %+v, %v", result, err)
+	}
+	if content, _ := ioutil.ReadFile(chronyConfPath); !strings.Contains(string(content), "deny 10.1.0.0/16") {
+		t.Errorf("chrony.conf after SetConfig:\n%s", content)
+	}
+}
+
+func TestSDKChangesNeedPermission(t *testing.T) {
+	resetTestChronyConf(t)
+	c := newTestSDK(t, jwt.MapClaims{"sub": "viewer"})
+	_, err := c.SetServers(client.WithIfMatch(context.Background(), "*"), []string{"time.example.com"})
+	if !client.IsStatus(err, http.StatusForbidden) {
+		t.Fatalf("SetServers without clock/servers = %v, want 403", err)
+	}
+}
+
+func TestSDKStreamsEvents(t *testing.T) {
+	c := newTestSDK(t, jwt.MapClaims{"sub": "viewer"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan client.Event, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.StreamEvents(ctx, []string{EVENT_WEBHOOK_TEST}, func(e client.Event) error {
+			received <- e
+			return errors.New("stop")
+		})
+	}()
+
+	// Emit until the stream has subscribed; other types must be filtered out
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-received:
+			if e.Type != EVENT_WEBHOOK_TEST || e.Data["n"] != "1" {
+				t.Fatalf("received %+v, want only %s events", e, EVENT_WEBHOOK_TEST)
+			}
+			if err := <-done; err == nil || err.Error() != "stop" {
+				t.Errorf("StreamEvents = %v, want the handler's error", err)
+			}
+			return
+		case err := <-done:
+			t.Fatalf("StreamEvents ended early: %v", err)
+		case <-ticker.C:
+			emitEvent(EVENT_CONFIG_CHANGED, nil)
+			emitEvent(EVENT_WEBHOOK_TEST, map[string]interface{}{"n": "1"})
+		case <-ctx.Done():
+			t.Fatal("no event received")
+		}
+	}
+}
+
+func TestSDKRejectsInvalidServers(t *testing.T) {
+	resetTestChronyConf(t)
+	c := newTestSDK(t, adminClaims())
+	ctx := client.WithIfMatch(context.Background(), "*")
+
+	for _, servers := range [][]string{
+		{"time.example.com iburst\nallow all"},
+		{"time.example.com:123"},
+		{"a.example", "a.example"},
+	} {
+		_, err := c.SetServers(ctx, servers)
+		var apiErr *client.APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != ERR_INVALID_REQUEST {
+			t.Errorf("SetServers(%q) = %v, want 400", servers, err)
+		}
+	}
+	if content, _ := ioutil.ReadFile(chronyConfPath); string(content) != testChronyConf {
+		t.Errorf("chrony.conf changed by rejected requests:\n%s", content)
+	}
+}
+
+func TestSDKServersIncludePools(t *testing.T) {
+	resetTestChronyConf(t)
+	conf := "pool 2.pool.ntp.org iburst maxsources 4\nserver time.example.com iburst\n#server old.example\nlocal stratum 10\n"
+	if err := ioutil.WriteFile(chronyConfPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestSDK(t, adminClaims())
+	ctx := context.Background()
+
+	servers, err := c.Servers(ctx)
+	if err != nil || strings.Join(servers, ",") != "2.pool.ntp.org,time.example.com" {
+		t.Fatalf("Servers = %v, %v; want the pool and the server", servers, err)
+	}
+	if _, err := c.SetServers(client.WithIfMatch(ctx, "*"), []string{"ntp.example.org"}); err != nil {
+		t.Fatalf("SetServers: %v", err)
+	}
+	content, _ := ioutil.ReadFile(chronyConfPath)
+	if strings.Contains(string(content), "pool ") || !strings.Contains(string(content), "#server old.example") || !strings.Contains(string(content), "server ntp.example.org iburst") {
+		t.Errorf("chrony.conf after SetServers:\n%s", content)
+	}
+}
+
+func TestSDKReadsCluster(t *testing.T) {
+	resetTestChronyConf(t)
+	c := newTestSDK(t, jwt.MapClaims{"sub": "viewer"})
+
+	cluster, err := c.Cluster(context.Background())
+	if err != nil {
+		t.Fatalf("Cluster: %v", err)
+	}
+	if cluster.Reference != "CA760182 (202.118.1.130)" || cluster.Stratum == nil || *cluster.Stratum != 3 || !cluster.Synchronized {
+		t.Errorf("cluster = %+v, want the local tracking reference and stratum", cluster)
+	}
+	if cluster.Local == nil || cluster.Local.Stratum != 10 || cluster.Error != "" {
+		t.Errorf("cluster = %+v, want local stratum 10 without an error", cluster)
+	}
+}
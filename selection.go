@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SERVER_SELECTION_PATH = "/etc/brick/clock/server-selection.json"
+
+	// SNTP queries per candidate, and the pause between them
+	CANDIDATE_SAMPLES        = 4
+	CANDIDATE_SAMPLE_SPACING = 250 * time.Millisecond
+	MAX_CANDIDATES           = 16
+	MAX_SELECTED_SERVERS     = 8
+
+	// A candidate this far from the consensus of the others is a falseticker
+	CANDIDATE_MAX_DEVIATION = 100 * time.Millisecond
+
+	// How often the scheduler checks whether a selection run is due
+	SELECTION_CHECK_INTERVAL = 10 * time.Second
+	MIN_SELECTION_INTERVAL   = time.Minute
+)
+
+// Policy for choosing the active servers from a candidate list. When
+// enabled, the candidates are ranked every Interval and the best Count
+// replace the configured servers if their mean score beats the current
+// servers' by at least MinImprovement points and the last switch is more
+// than HoldDown ago.
+type ServerSelectionPolicy struct {
+	Enabled        bool     `json:"enabled"`
+	Candidates     []string `json:"candidates"`
+	Count          int      `json:"count"`
+	Interval       string   `json:"interval"`
+	MinImprovement float64  `json:"min_improvement"`
+	HoldDown       string   `json:"hold_down"`
+}
+
+// How one candidate fared in a ranking
+type CandidateRank struct {
+	Server      string   `json:"server"`
+	Rank        int      `json:"rank,omitempty"`
+	Score       float64  `json:"score"`
+	Usable      bool     `json:"usable"`
+	Current     bool     `json:"current"`
+	Samples     int      `json:"samples"`
+	Answered    int      `json:"answered"`
+	Stratum     int      `json:"stratum,omitempty"`
+	Reference   string   `json:"reference,omitempty"`
+	OffsetMs    *float64 `json:"offset_ms,omitempty"`
+	DelayMs     *float64 `json:"delay_ms,omitempty"`
+	JitterMs    *float64 `json:"jitter_ms,omitempty"`
+	DeviationMs *float64 `json:"deviation_ms,omitempty"`
+	Problems    []string `json:"problems,omitempty"`
+}
+
+// Payload of GET /servers/candidates
+type CandidateRanking struct {
+	RankedAt          time.Time       `json:"ranked_at"`
+	Candidates        []CandidateRank `json:"candidates"`
+	ConsensusOffsetMs *float64        `json:"consensus_offset_ms,omitempty"`
+	// The best Count usable candidates
+	Selected []string `json:"selected"`
+}
+
+// Outcome of the last scheduled selection run
+type SelectionRun struct {
+	At       time.Time `json:"at"`
+	Applied  bool      `json:"applied"`
+	Decision string    `json:"decision"`
+	Current  []string  `json:"current"`
+	Selected []string  `json:"selected"`
+	// Mean scores of the current and the selected servers
+	CurrentScore  float64 `json:"current_score"`
+	SelectedScore float64 `json:"selected_score"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// Payload of GET /servers/selection
+type ServerSelectionResponse struct {
+	Policy     ServerSelectionPolicy `json:"policy"`
+	LastRun    *SelectionRun         `json:"last_run,omitempty"`
+	LastSwitch *time.Time            `json:"last_switch,omitempty"`
+	NextRun    *time.Time            `json:"next_run,omitempty"`
+	Ranking    *CandidateRanking     `json:"ranking,omitempty"`
+}
+
+var (
+	serverSelectionPath = SERVER_SELECTION_PATH
+
+	selectionMutex sync.Mutex
+	// Guarded by selectionMutex
+	selectionPolicy  = defaultSelectionPolicy()
+	selectionLastRun *SelectionRun
+	selectionRanking *CandidateRanking
+	// Last automatic switch; kept in the policy file so hold-down survives restarts
+	selectionLastSwitch *time.Time
+	// Serializes selection runs
+	selectionRunMutex sync.Mutex
+)
+
+func init() {
+	if v := os.Getenv("SERVER_SELECTION_PATH"); v != "" {
+		serverSelectionPath = v
+	}
+}
+
+// Policies are decoded over the defaults, so fields left out keep them
+func defaultSelectionPolicy() ServerSelectionPolicy {
+	return ServerSelectionPolicy{Candidates: []string{}, Count: 3, Interval: "1h", MinImprovement: 10, HoldDown: "6h"}
+}
+
+func validateSelectionPolicy(policy ServerSelectionPolicy) []string {
+	var problems []string
+	if len(policy.Candidates) > MAX_CANDIDATES {
+		problems = append(problems, fmt.Sprintf("at most %d candidates are allowed", MAX_CANDIDATES))
+	}
+	seen := map[string]bool{}
+	for i, candidate := range policy.Candidates {
+		if !hostPattern.MatchString(candidate) {
+			problems = append(problems, fmt.Sprintf("candidates[%d] %q is not a valid host name or address", i, candidate))
+		} else if _, _, err := net.SplitHostPort(candidate); err == nil {
+			problems = append(problems, fmt.Sprintf("candidates[%d] %q must not include a port", i, candidate))
+		}
+		if seen[candidate] {
+			problems = append(problems, fmt.Sprintf("candidates[%d] %q is listed twice", i, candidate))
+		}
+		seen[candidate] = true
+	}
+	if policy.Enabled && len(policy.Candidates) == 0 {
+		problems = append(problems, "candidates must not be empty when enabled")
+	}
+	if policy.Count < 1 || policy.Count > MAX_SELECTED_SERVERS {
+		problems = append(problems, fmt.Sprintf("count must be between 1 and %d", MAX_SELECTED_SERVERS))
+	}
+	if interval, err := time.ParseDuration(policy.Interval); err != nil || interval < MIN_SELECTION_INTERVAL {
+		problems = append(problems, fmt.Sprintf("interval must be a duration of at least %s", MIN_SELECTION_INTERVAL))
+	}
+	if holdDown, err := time.ParseDuration(policy.HoldDown); err != nil || holdDown < 0 {
+		problems = append(problems, "hold_down must be a non-negative duration")
+	}
+	if policy.MinImprovement < 0 || policy.MinImprovement > 100 {
+		problems = append(problems, "min_improvement must be between 0 and 100")
+	}
+	return problems
+}
+
+// On-disk form of the policy
+type selectionFile struct {
+	ServerSelectionPolicy
+	LastSwitch *time.Time `json:"last_switch,omitempty"`
+}
+
+func loadServerSelection() {
+	data, err := ioutil.ReadFile(serverSelectionPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading %s: %v", serverSelectionPath, err)
+		}
+		return
+	}
+	file := selectionFile{ServerSelectionPolicy: defaultSelectionPolicy()}
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Printf("Error parsing %s: %v", serverSelectionPath, err)
+		return
+	}
+	if problems := validateSelectionPolicy(file.ServerSelectionPolicy); len(problems) > 0 {
+		log.Printf("Invalid server selection policy in %s: %s", serverSelectionPath, strings.Join(problems, "; "))
+		return
+	}
+	selectionMutex.Lock()
+	selectionPolicy = file.ServerSelectionPolicy
+	selectionLastSwitch = file.LastSwitch
+	selectionMutex.Unlock()
+}
+
+// Write the policy and the last switch time; selectionMutex must be held
+func saveServerSelectionLocked() error {
+	data, err := json.MarshalIndent(selectionFile{ServerSelectionPolicy: selectionPolicy, LastSwitch: selectionLastSwitch}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(serverSelectionPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(serverSelectionPath, data, 0644)
+}
+
+// Helper to take the median of values (which it sorts)
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// Helper to round to three decimals, as the SNTP results are
+func roundMs(value float64) *float64 {
+	rounded := math.Round(value*1000) / 1000
+	return &rounded
+}
+
+// Query a candidate CANDIDATE_SAMPLES times and summarise the answers
+func sampleCandidate(ctx context.Context, server string) CandidateRank {
+	rank := CandidateRank{Server: server, Samples: CANDIDATE_SAMPLES}
+	var offsets, delays []float64
+	var lastError string
+	for i := 0; i < CANDIDATE_SAMPLES; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(CANDIDATE_SAMPLE_SPACING):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			lastError = "ranking ran out of time"
+			break
+		}
+		result := sntpQuery(ctx, server)
+		if result.Error != "" {
+			lastError = result.Error
+			// The server asked us to go away; don't ask again
+			if strings.HasPrefix(result.Error, errKissOfDeath.Error()) {
+				break
+			}
+			continue
+		}
+		rank.Answered++
+		rank.Stratum = result.Stratum
+		rank.Reference = result.Reference
+		offsets = append(offsets, result.OffsetMs)
+		delays = append(delays, result.DelayMs)
+	}
+	if rank.Answered == 0 {
+		rank.Problems = append(rank.Problems, lastError)
+		return rank
+	}
+
+	mean := 0.0
+	for _, offset := range offsets {
+		mean += offset
+	}
+	mean /= float64(len(offsets))
+	variance := 0.0
+	for _, offset := range offsets {
+		variance += (offset - mean) * (offset - mean)
+	}
+	rank.JitterMs = roundMs(math.Sqrt(variance / float64(len(offsets))))
+	rank.OffsetMs = roundMs(median(offsets))
+	rank.DelayMs = roundMs(median(delays))
+	rank.Usable = true
+	if rank.Answered < rank.Samples {
+		rank.Problems = append(rank.Problems, fmt.Sprintf("%d of %d queries unanswered: %s", rank.Samples-rank.Answered, rank.Samples, lastError))
+	}
+	return rank
+}
+
+// Helper to score a usable candidate from 100 down. Penalties: delay 1 per
+// 10ms (at most 30), jitter 2 per ms (20), stratum 5 per level below 1 (20),
+// distance from the consensus 1 per 2ms (30) and lost queries 20 for all lost.
+func candidateScore(rank CandidateRank) float64 {
+	score := 100.0
+	score -= math.Min(30, *rank.DelayMs/10)
+	score -= math.Min(20, *rank.JitterMs*2)
+	score -= math.Min(20, float64(rank.Stratum-1)*5)
+	if rank.DeviationMs != nil {
+		score -= math.Min(30, *rank.DeviationMs/2)
+	}
+	score -= 20 * float64(rank.Samples-rank.Answered) / float64(rank.Samples)
+	return math.Round(math.Max(0, score)*10) / 10
+}
+
+// Probe the candidates in parallel and rank them; count is how many of the
+// best usable candidates to select
+func rankCandidates(ctx context.Context, candidates []string, count int) CandidateRanking {
+	current := map[string]bool{}
+	for _, server := range getConfiguredServers() {
+		current[server] = true
+	}
+	ranks := make([]CandidateRank, len(candidates))
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		go func(i int, candidate string) {
+			defer wg.Done()
+			ranks[i] = sampleCandidate(ctx, candidate)
+			ranks[i].Current = current[candidate]
+		}(i, candidate)
+	}
+	wg.Wait()
+
+	ranking := CandidateRanking{RankedAt: time.Now().UTC(), Selected: []string{}}
+	var offsets []float64
+	for _, rank := range ranks {
+		if rank.Usable {
+			offsets = append(offsets, *rank.OffsetMs)
+		}
+	}
+	// With fewer than three answers there is no majority to disagree with
+	if len(offsets) >= 3 {
+		consensus := median(offsets)
+		ranking.ConsensusOffsetMs = roundMs(consensus)
+		for i := range ranks {
+			if !ranks[i].Usable {
+				continue
+			}
+			deviation := math.Abs(*ranks[i].OffsetMs - consensus)
+			ranks[i].DeviationMs = roundMs(deviation)
+			if deviation > float64(CANDIDATE_MAX_DEVIATION)/float64(time.Millisecond) {
+				ranks[i].Usable = false
+				ranks[i].Problems = append(ranks[i].Problems, fmt.Sprintf("falseticker: %.3fms from the consensus of the others", deviation))
+			}
+		}
+	}
+	for i := range ranks {
+		if ranks[i].Usable {
+			ranks[i].Score = candidateScore(ranks[i])
+		}
+	}
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if ranks[i].Usable != ranks[j].Usable {
+			return ranks[i].Usable
+		}
+		if ranks[i].Score != ranks[j].Score {
+			return ranks[i].Score > ranks[j].Score
+		}
+		return ranks[i].Usable && *ranks[i].DelayMs < *ranks[j].DelayMs
+	})
+	for i := range ranks {
+		if !ranks[i].Usable {
+			continue
+		}
+		ranks[i].Rank = i + 1
+		if len(ranking.Selected) < count {
+			ranking.Selected = append(ranking.Selected, ranks[i].Server)
+		}
+	}
+	ranking.Candidates = ranks
+	return ranking
+}
+
+// Helper to average the scores of servers in a ranking; unranked servers count as 0
+func meanScore(ranking CandidateRanking, servers []string) float64 {
+	if len(servers) == 0 {
+		return 0
+	}
+	scores := map[string]float64{}
+	for _, rank := range ranking.Candidates {
+		scores[rank.Server] = rank.Score
+	}
+	total := 0.0
+	for _, server := range servers {
+		total += scores[server]
+	}
+	return math.Round(total/float64(len(servers))*10) / 10
+}
+
+// Whether automatic server selection is enabled; discovery cannot be
+// enabled at the same time
+func serverSelectionEnabled() bool {
+	selectionMutex.Lock()
+	defer selectionMutex.Unlock()
+	return selectionPolicy.Enabled
+}
+
+// Helper to compare server lists ignoring order
+func sameServers(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, server := range a {
+		set[server] = true
+	}
+	for _, server := range b {
+		if !set[server] {
+			return false
+		}
+	}
+	return true
+}
+
+// Rank the policy's candidates together with the current servers and switch
+// to the best ones if the hysteresis rules allow it
+func runServerSelection(ctx context.Context) SelectionRun {
+	selectionRunMutex.Lock()
+	defer selectionRunMutex.Unlock()
+
+	selectionMutex.Lock()
+	policy := selectionPolicy
+	lastSwitch := selectionLastSwitch
+	selectionMutex.Unlock()
+	holdDown, _ := time.ParseDuration(policy.HoldDown)
+
+	current := getConfiguredServers()
+	probed := append([]string{}, policy.Candidates...)
+	for _, server := range current {
+		if !containsString(probed, server) {
+			probed = append(probed, server)
+		}
+	}
+	// Only candidates may be selected; current servers are ranked for comparison
+	ranking := rankCandidates(ctx, probed, len(probed))
+	var selected []string
+	for _, server := range ranking.Selected {
+		if containsString(policy.Candidates, server) && len(selected) < policy.Count {
+			selected = append(selected, server)
+		}
+	}
+
+	now := time.Now().UTC()
+	run := SelectionRun{
+		At:            now,
+		Current:       current,
+		Selected:      selected,
+		CurrentScore:  meanScore(ranking, current),
+		SelectedScore: meanScore(ranking, selected),
+	}
+	if run.Selected == nil {
+		run.Selected = []string{}
+	}
+	improvement := run.SelectedScore - run.CurrentScore
+	switch {
+	case failoverOnBackup():
+		run.Decision = "keep: failover is using the backup servers"
+	case len(selected) == 0:
+		run.Decision = "keep: no usable candidates"
+	case sameServers(selected, current):
+		run.Decision = "keep: the current servers are the best candidates"
+	case improvement < policy.MinImprovement && len(current) > 0:
+		run.Decision = fmt.Sprintf("keep: improvement %.1f is below min_improvement %.1f", improvement, policy.MinImprovement)
+	case lastSwitch != nil && now.Sub(*lastSwitch) < holdDown:
+		run.Decision = fmt.Sprintf("keep: hold-down until %s", lastSwitch.Add(holdDown).Format(time.RFC3339))
+	default:
+		run.Decision = fmt.Sprintf("switch: improvement %.1f", improvement)
+		run.Applied, run.Error = applySelectedServers(run)
+	}
+
+	selectionMutex.Lock()
+	selectionLastRun = &run
+	selectionRanking = &ranking
+	if run.Applied {
+		selectionLastSwitch = &now
+		if err := saveServerSelectionLocked(); err != nil {
+			log.Printf("Failed to save server selection state: %v", err)
+		}
+	}
+	selectionMutex.Unlock()
+	return run
+}
+
+// Write the selected servers to chrony.conf. Returns whether chrony.conf
+// was changed and why not, or why chronyd failed to restart.
+func applySelectedServers(run SelectionRun) (bool, string) {
+	request := map[string]interface{}{
+		"servers":        run.Selected,
+		"previous":       run.Current,
+		"current_score":  run.CurrentScore,
+		"selected_score": run.SelectedScore,
+	}
+	message := fmt.Sprintf("Automatic server selection (score %.1f -> %.1f)", run.CurrentScore, run.SelectedScore)
+	restartSuccess, err := setServersAsSystem(run.Selected, AUDIT_SERVERS_SELECT, message, request)
+	if err != nil {
+		return false, err.Error()
+	}
+	log.Printf("Automatic server selection switched from %v to %v (score %.1f -> %.1f)", run.Current, run.Selected, run.CurrentScore, run.SelectedScore)
+
+	emitEvent(EVENT_SERVERS_SELECTED, map[string]interface{}{
+		"servers":         run.Selected,
+		"previous":        run.Current,
+		"current_score":   run.CurrentScore,
+		"selected_score":  run.SelectedScore,
+		"restart_success": restartSuccess,
+	})
+	if !restartSuccess {
+		return true, "configuration saved but the time service failed to restart"
+	}
+	return true, ""
+}
+
+// Helper to compute when the next scheduled run is due; nil when disabled
+func nextSelectionRunLocked() *time.Time {
+	if !selectionPolicy.Enabled {
+		return nil
+	}
+	next := time.Now().UTC()
+	if selectionLastRun != nil {
+		interval, _ := time.ParseDuration(selectionPolicy.Interval)
+		next = selectionLastRun.At.Add(interval)
+	}
+	return &next
+}
+
+func startServerSelection() {
+	loadServerSelection()
+	go func() {
+		for {
+			selectionMutex.Lock()
+			next := nextSelectionRunLocked()
+			selectionMutex.Unlock()
+			if next != nil && !time.Now().Before(*next) {
+				ctx, cancel := context.WithTimeout(context.Background(), backendRequestTimeout)
+				run := runServerSelection(ctx)
+				cancel()
+				if run.Error != "" {
+					log.Printf("Automatic server selection: %s (%s)", run.Decision, run.Error)
+				}
+			}
+			time.Sleep(SELECTION_CHECK_INTERVAL)
+		}
+	}()
+}
+
+// GET /servers/candidates ranks the policy's candidates and the configured
+// servers, or the hosts named by ?candidate= (repeatable, host or host:port)
+func handleServerCandidates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	selectionMutex.Lock()
+	policy := selectionPolicy
+	selectionMutex.Unlock()
+
+	known := append([]string{}, policy.Candidates...)
+	for _, server := range getConfiguredServers() {
+		if !containsString(known, server) {
+			known = append(known, server)
+		}
+	}
+	candidates := known
+	var requested []string
+	for _, value := range r.URL.Query()["candidate"] {
+		for _, candidate := range strings.Split(value, ",") {
+			if candidate = strings.TrimSpace(candidate); candidate != "" && !containsString(requested, candidate) {
+				requested = append(requested, candidate)
+			}
+		}
+	}
+	if len(requested) > 0 {
+		for _, candidate := range requested {
+			if !containsString(known, candidate) && !requirePermission(w, r, PERM_PROBE_ANY) {
+				return
+			}
+		}
+		candidates = requested
+	}
+	if len(candidates) == 0 {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "No candidates configured; name them with ?candidate=", nil)
+		return
+	}
+	if len(candidates) > MAX_CANDIDATES {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, fmt.Sprintf("At most %d candidates can be ranked at once", MAX_CANDIDATES), nil)
+		return
+	}
+	count := policy.Count
+	if v := r.URL.Query().Get("count"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 1 || parsed > MAX_SELECTED_SERVERS {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, fmt.Sprintf("count must be between 1 and %d", MAX_SELECTED_SERVERS), nil)
+			return
+		}
+		count = parsed
+	}
+
+	ctx, cancel := backendContext(r)
+	defer cancel()
+	ranking := rankCandidates(ctx, candidates, count)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ranking)
+}
+
+// GET /servers/selection shows the policy and the last run; PUT replaces the
+// policy (fields left out take their defaults)
+func handleServerSelection(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		selectionMutex.Lock()
+		response := ServerSelectionResponse{
+			Policy:     selectionPolicy,
+			LastRun:    selectionLastRun,
+			LastSwitch: selectionLastSwitch,
+			NextRun:    nextSelectionRunLocked(),
+			Ranking:    selectionRanking,
+		}
+		selectionMutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+	case http.MethodPut:
+		policy := defaultSelectionPolicy()
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&policy); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if policy.Candidates == nil {
+			policy.Candidates = []string{}
+		}
+		if problems := validateSelectionPolicy(policy); len(problems) > 0 {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "Invalid server selection policy", problems)
+			return
+		}
+		if policy.Enabled && discoveryEnabled() {
+			writeError(w, r, http.StatusConflict, ERR_CONFLICT, "Server discovery is enabled; disable it before enabling automatic selection", nil)
+			return
+		}
+		selectionMutex.Lock()
+		previous := selectionPolicy
+		selectionPolicy = policy
+		// A changed policy is evaluated at the next check rather than after a full interval
+		selectionLastRun = nil
+		err := saveServerSelectionLocked()
+		if err != nil {
+			selectionPolicy = previous
+		}
+		selectionMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save server selection policy", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"policy": policy})
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
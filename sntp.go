@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	NTP_PORT        = "123"
+	NTP_PACKET_SIZE = 48
+	// Seconds between the NTP era 0 epoch (1900) and the Unix epoch
+	NTP_EPOCH_OFFSET = 2208988800
+
+	// Servers probed by one request at most
+	MAX_PROBE_SERVERS = 8
+
+	// Probing hosts other than the configured reference servers
+	PERM_PROBE_ANY = "clock/probe"
+)
+
+// Answer of one server to an SNTP query (RFC 4330). Offset is how far the
+// server's clock is ahead of the local clock.
+type SNTPResult struct {
+	Server           string     `json:"server"`
+	Address          string     `json:"address,omitempty"`
+	Stratum          int        `json:"stratum,omitempty"`
+	ReferenceID      string     `json:"reference_id,omitempty"`
+	Reference        string     `json:"reference,omitempty"`
+	LeapStatus       string     `json:"leap_status,omitempty"`
+	Version          int        `json:"version,omitempty"`
+	OffsetMs         float64    `json:"offset_ms"`
+	DelayMs          float64    `json:"delay_ms"`
+	RootDelayMs      float64    `json:"root_delay_ms"`
+	RootDispersionMs float64    `json:"root_dispersion_ms"`
+	ServerTime       *time.Time `json:"server_time,omitempty"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// Payload of GET /probe: the SNTP results next to chronyd's own estimate
+type ProbeResultsResponse struct {
+	Results []SNTPResult `json:"results"`
+	// chronyd's estimate of the same quantity, from "System time" in tracking
+	ChronydOffsetMs *float64 `json:"chronyd_offset_ms,omitempty"`
+	ChronydError    string   `json:"chronyd_error,omitempty"`
+}
+
+var (
+	sntpTimeout = 2 * time.Second
+	// Reference servers probed when the request names none; defaults to the
+	// servers in chrony.conf
+	probeServers []string
+
+	errKissOfDeath = errors.New("kiss-of-death")
+)
+
+func init() {
+	if v := os.Getenv("PROBE_TIMEOUT"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			sntpTimeout = parsed
+		} else {
+			log.Printf("Invalid PROBE_TIMEOUT %q, using %s", v, sntpTimeout)
+		}
+	}
+	if v := os.Getenv("PROBE_SERVERS"); v != "" {
+		for _, server := range strings.Split(v, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				probeServers = append(probeServers, server)
+			}
+		}
+	}
+}
+
+// Helper to convert a 64-bit NTP timestamp
+func ntpTime(value uint64) time.Time {
+	seconds := int64(value>>32) - NTP_EPOCH_OFFSET
+	nanos := (int64(value&0xffffffff) * 1e9) >> 32
+	return time.Unix(seconds, nanos)
+}
+
+// Helper to convert a 32-bit NTP short format value (16.16 seconds)
+func ntpShortMs(value uint32) float64 {
+	return float64(value) / 65536 * 1000
+}
+
+// Helper to name the leap indicator the way chronyc does
+func leapStatusName(leap byte) string {
+	switch leap {
+	case 0:
+		return "Normal"
+	case 1:
+		return "Insert second"
+	case 2:
+		return "Delete second"
+	}
+	return "Not synchronised"
+}
+
+// Helper to add the default NTP port unless the server names one
+func ntpAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(strings.Trim(server, "[]"), NTP_PORT)
+}
+
+// Send one SNTP request to server (host or host:port) and check the answer
+func sntpQuery(ctx context.Context, server string) SNTPResult {
+	result := SNTPResult{Server: server}
+	fail := func(err error) SNTPResult {
+		result.Error = err.Error()
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sntpTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", ntpAddress(server))
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	result.Address = conn.RemoteAddr().String()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// A random transmit timestamp identifies our request without revealing
+	// the local clock; the server must echo it as the origin timestamp
+	request := make([]byte, NTP_PACKET_SIZE)
+	request[0] = 0<<6 | 4<<3 | 3 // no leap warning, version 4, client mode
+	if _, err := rand.Read(request[40:48]); err != nil {
+		return fail(err)
+	}
+	nonce := binary.BigEndian.Uint64(request[40:48])
+
+	sent := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return fail(err)
+	}
+	response := make([]byte, 512)
+	var n int
+	for {
+		n, err = conn.Read(response)
+		if err != nil {
+			// The socket deadline is the context's, and may expire first
+			if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				return fail(fmt.Errorf("no answer within %s", sntpTimeout))
+			}
+			return fail(err)
+		}
+		// Ignore stray packets that do not answer our request
+		if n >= NTP_PACKET_SIZE && binary.BigEndian.Uint64(response[24:32]) == nonce {
+			break
+		}
+	}
+	received := time.Now()
+
+	leap := response[0] >> 6
+	result.Version = int(response[0] >> 3 & 0x7)
+	mode := response[0] & 0x7
+	result.Stratum = int(response[1])
+	refID := response[12:16]
+	result.ReferenceID = fmt.Sprintf("%08X", binary.BigEndian.Uint32(refID))
+	result.LeapStatus = leapStatusName(leap)
+
+	if mode != 4 {
+		return fail(fmt.Errorf("unexpected mode %d in answer", mode))
+	}
+	if result.Stratum == 0 {
+		// Stratum 0 answers carry a kiss code such as RATE or DENY
+		return fail(fmt.Errorf("%w: %s", errKissOfDeath, strings.TrimRight(string(refID), "\x00")))
+	}
+	if leap == 3 {
+		return fail(errors.New("server is not synchronised"))
+	}
+	if result.Stratum == 1 {
+		result.Reference = strings.TrimRight(string(refID), "\x00")
+	} else {
+		result.Reference = net.IP(refID).String()
+	}
+
+	receiveTime := ntpTime(binary.BigEndian.Uint64(response[32:40]))
+	transmitTime := ntpTime(binary.BigEndian.Uint64(response[40:48]))
+	if binary.BigEndian.Uint64(response[40:48]) == 0 {
+		return fail(errors.New("answer has no transmit timestamp"))
+	}
+	serverTime := transmitTime.UTC()
+	result.ServerTime = &serverTime
+	result.RootDelayMs = ntpShortMs(binary.BigEndian.Uint32(response[4:8]))
+	result.RootDispersionMs = ntpShortMs(binary.BigEndian.Uint32(response[8:12]))
+
+	// RFC 4330: offset = ((T2 - T1) + (T3 - T4)) / 2, delay = (T4 - T1) - (T3 - T2).
+	// The round trip uses the monotonic clock so a step during the query
+	// cannot distort it.
+	offset := (receiveTime.Sub(sent) + transmitTime.Sub(received)) / 2
+	delay := received.Sub(sent) - transmitTime.Sub(receiveTime)
+	result.OffsetMs = math.Round(float64(offset)/float64(time.Microsecond)) / 1000
+	result.DelayMs = math.Round(float64(delay)/float64(time.Microsecond)) / 1000
+	return result
+}
+
+// Helper to list the reference servers probed by default
+func defaultProbeServers() []string {
+	if len(probeServers) > 0 {
+		return probeServers
+	}
+	content, err := ioutil.ReadFile(chronyConfPath)
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	for _, server := range parseClockConfig(string(content)).Servers {
+		servers = append(servers, server.Host)
+	}
+	return servers
+}
+
+// GET /probe queries the reference servers, or the servers named by
+// ?server= (repeatable, host or host:port), and reports chronyd's estimate
+// alongside
+func handleProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	servers := defaultProbeServers()
+	var requested []string
+	for _, value := range r.URL.Query()["server"] {
+		for _, server := range strings.Split(value, ",") {
+			if server = strings.TrimSpace(server); server != "" {
+				requested = append(requested, server)
+			}
+		}
+	}
+	if len(requested) > 0 {
+		known := map[string]bool{}
+		for _, server := range servers {
+			known[server] = true
+		}
+		for _, server := range requested {
+			if !known[server] && !requirePermission(w, r, PERM_PROBE_ANY) {
+				return
+			}
+		}
+		servers = requested
+	}
+	if len(servers) == 0 {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, "No reference servers configured; name one with ?server=", nil)
+		return
+	}
+	if len(servers) > MAX_PROBE_SERVERS {
+		writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, fmt.Sprintf("At most %d servers can be probed at once", MAX_PROBE_SERVERS), nil)
+		return
+	}
+
+	ctx, cancel := backendContext(r)
+	defer cancel()
+	response := ProbeResultsResponse{Results: make([]SNTPResult, len(servers))}
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			response.Results[i] = sntpQuery(ctx, server)
+		}(i, server)
+	}
+
+	initializeCaches()
+	tracking := trackingCache.Snapshot(ctx)
+	wg.Wait()
+	if tracking.Err != nil {
+		response.ChronydError = tracking.Err.Error()
+	} else if data, ok := tracking.Data.(map[string]string); ok {
+		// "slow of NTP time" means the servers are ahead, as a positive SNTP offset says
+		if ms, ok := parseSecondsToMs(data["System time"]); ok {
+			if strings.Contains(data["System time"], "fast") {
+				ms = -ms
+			}
+			response.ChronydOffsetMs = &ms
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
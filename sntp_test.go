@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// How the loopback responder answers an SNTP request
+type testNTPServer struct {
+	clockOffset time.Duration // server clock minus local clock
+	hold        time.Duration // between receiving and answering
+	stratum     byte
+	leap        byte
+	refID       string
+	stray       bool // send an answer to another request first
+	silent      bool
+}
+
+// Helper to encode a 64-bit NTP timestamp
+func toNTPTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + NTP_EPOCH_OFFSET)
+	fraction := (uint64(t.Nanosecond()) << 32) / 1e9
+	return seconds<<32 | fraction
+}
+
+// Answer SNTP requests on a loopback port until the test ends
+func startTestNTPServer(t *testing.T, s testNTPServer) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		request := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(request)
+			if err != nil {
+				return
+			}
+			receive := time.Now().Add(s.clockOffset)
+			if s.silent || n < NTP_PACKET_SIZE {
+				continue
+			}
+			time.Sleep(s.hold)
+			response := make([]byte, NTP_PACKET_SIZE)
+			response[0] = s.leap<<6 | 4<<3 | 4 // version 4, server mode
+			response[1] = s.stratum
+			binary.BigEndian.PutUint32(response[4:8], 0x00008000)  // 500 ms root delay
+			binary.BigEndian.PutUint32(response[8:12], 0x00000666) // ~25 ms root dispersion
+			copy(response[12:16], s.refID)
+			copy(response[24:32], request[40:48])
+			binary.BigEndian.PutUint64(response[32:40], toNTPTime(receive))
+			if s.stray {
+				stray := append([]byte(nil), response...)
+				stray[31] ^= 0xff
+				conn.WriteTo(stray, addr)
+			}
+			binary.BigEndian.PutUint64(response[40:48], toNTPTime(time.Now().Add(s.clockOffset)))
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestSNTPQueryMeasuresOffsetAndDelay(t *testing.T) {
+	server := startTestNTPServer(t, testNTPServer{
+		clockOffset: 2 * time.Second,
+		hold:        50 * time.Millisecond,
+		stratum:     2,
+		refID:       string([]byte{192, 0, 2, 1}),
+		stray:       true,
+	})
+
+	result := sntpQuery(context.Background(), server)
+	if result.Error != "" {
+		t.Fatalf("sntpQuery: %s", result.Error)
+	}
+	if math.Abs(result.OffsetMs-2000) > 25 {
+		t.Errorf("offset = %.3f ms, want about 2000", result.OffsetMs)
+	}
+	// The time the server held the request is not part of the network delay
+	if result.DelayMs < 0 || result.DelayMs > 25 {
+		t.Errorf("delay = %.3f ms, want the loopback round trip without the 50 ms hold", result.DelayMs)
+	}
+	if result.Stratum != 2 || result.Reference != "192.0.2.1" || result.ReferenceID != "C0000201" || result.LeapStatus != "Normal" || result.Version != 4 {
+		t.Errorf("result = %+v", result)
+	}
+	if result.RootDelayMs != 500 || math.Abs(result.RootDispersionMs-25) > 0.1 {
+		t.Errorf("root delay %.3f ms, dispersion %.3f ms; want 500 and about 25", result.RootDelayMs, result.RootDispersionMs)
+	}
+}
+
+func TestSNTPQueryRejectsBadAnswers(t *testing.T) {
+	tests := []struct {
+		name   string
+		server testNTPServer
+		want   string
+	}{
+		{"kiss of death", testNTPServer{stratum: 0, refID: "RATE"}, "kiss-of-death: RATE"},
+		{"deny", testNTPServer{stratum: 0, refID: "DENY"}, "kiss-of-death: DENY"},
+		{"unsynchronised", testNTPServer{stratum: 3, leap: 3}, "not synchronised"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := sntpQuery(context.Background(), startTestNTPServer(t, tt.server))
+			if !strings.Contains(result.Error, tt.want) {
+				t.Errorf("error = %q, want %q", result.Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestSNTPQueryTimesOut(t *testing.T) {
+	saved := sntpTimeout
+	sntpTimeout = 50 * time.Millisecond
+	defer func() { sntpTimeout = saved }()
+
+	result := sntpQuery(context.Background(), startTestNTPServer(t, testNTPServer{silent: true}))
+	if !strings.Contains(result.Error, "no answer within") {
+		t.Errorf("error = %q, want a timeout", result.Error)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const DEFAULT_SOCKET_PATH = "/run/brick-clock/api.sock"
+
+const localSocketContextKey contextKey = "local_socket"
+
+var (
+	socketPath    = DEFAULT_SOCKET_PATH
+	socketTrusted = false
+)
+
+// Permissions granted to requests arriving over the trusted local socket
+var localSocketPermissions = []interface{}{"clock/*"}
+
+func init() {
+	if v, ok := os.LookupEnv("SOCKET_PATH"); ok {
+		socketPath = v
+		if v == "off" {
+			socketPath = ""
+		}
+	}
+	if os.Getenv("SOCKET_TRUSTED") == "on" {
+		socketTrusted = true
+	}
+}
+
+// Mark requests that arrived over the local Unix socket
+func withLocalSocket(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localSocketContextKey, true)))
+	})
+}
+
+func isLocalSocketRequest(r *http.Request) bool {
+	local, _ := r.Context().Value(localSocketContextKey).(bool)
+	return local
+}
+
+// Claims used for local socket requests when SOCKET_TRUSTED=on. The socket
+// is only accessible to root, who can edit chrony.conf directly anyway.
+func localSocketClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":         "local-socket",
+		"permissions": localSocketPermissions,
+	}
+}
+
+// Serve the API on a root-only Unix socket for the built-in CLI. The socket
+// is never reachable by anyone else: it is created under a umask that
+// leaves it owner-only, and it is not served if it cannot be restricted.
+func startSocketListener(handler http.Handler) {
+	if socketPath == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		log.Printf("Failed to create socket directory: %v", err)
+		return
+	}
+	// Remove a stale socket left by a previous run
+	os.Remove(socketPath)
+	listener, err := listenOwnerOnly(socketPath)
+	if err != nil {
+		log.Printf("Failed to listen on %s: %v", socketPath, err)
+		return
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		log.Printf("Failed to restrict %s, not serving it: %v", socketPath, err)
+		listener.Close()
+		return
+	}
+	log.Printf("Listening on unix socket %s (trusted: %v)", socketPath, socketTrusted)
+	go func() {
+		log.Printf("Unix socket server stopped: %v", http.Serve(listener, withLocalSocket(handler)))
+	}()
+}
+
+// Helper to create a Unix socket that is owner-only from the moment it
+// exists. The umask is process-wide, so this only runs at startup.
+func listenOwnerOnly(path string) (net.Listener, error) {
+	previous := syscall.Umask(0177)
+	defer syscall.Umask(previous)
+	return net.Listen("unix", path)
+}
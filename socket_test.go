@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSocketIsOwnerOnly(t *testing.T) {
+	saved := socketPath
+	socketPath = filepath.Join(t.TempDir(), "run", "api.sock")
+	defer func() { socketPath = saved }()
+
+	startSocketListener(http.NotFoundHandler())
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("socket not created: %v", err)
+	}
+	if mode := info.Mode(); mode&os.ModeSocket == 0 || mode.Perm() != 0600 {
+		t.Errorf("socket mode = %v, want an owner-only socket", mode)
+	}
+	dir, err := os.Stat(filepath.Dir(socketPath))
+	if err != nil || dir.Mode().Perm() != 0700 {
+		t.Errorf("socket directory = %v, %v; want 0700", dir.Mode(), err)
+	}
+}
+
+func TestSocketIsUntrustedByDefault(t *testing.T) {
+	if socketTrusted {
+		t.Error("socketTrusted defaults to on, want tokens required on the socket")
+	}
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOKS_PATH             = "/etc/brick/clock/webhooks.json"
+	WEBHOOK_DEAD_LETTERS_PATH = "/etc/brick/clock/webhook-dead-letters.json"
+	WEBHOOK_DEAD_LETTER_LIMIT = 100
+)
+
+// Webhook subscription as persisted on disk
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookRequest struct {
+	URL     string   `json:"url"`
+	Events  []string `json:"events"`
+	Secret  string   `json:"secret"`
+	Enabled *bool    `json:"enabled"`
+}
+
+// Webhook as returned by the API (secret is never echoed back)
+type WebhookResponse struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	HasSecret bool      `json:"has_secret"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Result of a delivery; failed deliveries end up in the dead-letter list
+type WebhookDelivery struct {
+	ID         string    `json:"id"`
+	WebhookID  string    `json:"webhook_id"`
+	URL        string    `json:"url"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
+	Delivered  bool      `json:"delivered"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+var (
+	webhooks            []Webhook
+	webhookDeadLetters  []WebhookDelivery
+	webhookMutex        sync.RWMutex
+	webhooksPath        = WEBHOOKS_PATH
+	deadLettersPath     = WEBHOOK_DEAD_LETTERS_PATH
+	webhookMaxAttempts  = 5
+	webhookInitialDelay = 1 * time.Second
+	webhookMaxDelay     = 60 * time.Second
+	webhookHTTPClient   = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	if v := os.Getenv("WEBHOOKS_PATH"); v != "" {
+		webhooksPath = v
+	}
+	if v := os.Getenv("WEBHOOK_DEAD_LETTERS_PATH"); v != "" {
+		deadLettersPath = v
+	}
+	if v := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			webhookMaxAttempts = parsed
+		}
+	}
+	if v := os.Getenv("WEBHOOK_RETRY_DELAY"); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			webhookInitialDelay = parsed
+		}
+	}
+}
+
+func (wh Webhook) response() WebhookResponse {
+	return WebhookResponse{
+		ID:        wh.ID,
+		URL:       wh.URL,
+		Events:    wh.Events,
+		HasSecret: wh.Secret != "",
+		Enabled:   wh.Enabled,
+		CreatedAt: wh.CreatedAt,
+	}
+}
+
+// Check whether a subscription wants a given event type
+func (wh Webhook) matches(eventType string) bool {
+	if !wh.Enabled {
+		return false
+	}
+	for _, e := range wh.Events {
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Load webhook subscriptions from disk and subscribe to the event bus
+func loadWebhooks() {
+	data, err := ioutil.ReadFile(webhooksPath)
+	if err == nil {
+		var loaded []Webhook
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			log.Printf("Error parsing %s: %v", webhooksPath, err)
+		} else {
+			webhookMutex.Lock()
+			webhooks = loaded
+			webhookMutex.Unlock()
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading %s: %v", webhooksPath, err)
+	}
+
+	loadDeadLetters()
+	subscribeEvents(dispatchWebhooks)
+}
+
+// Load the dead letters kept by a previous run
+func loadDeadLetters() {
+	data, err := ioutil.ReadFile(deadLettersPath)
+	if err == nil {
+		var loaded []WebhookDelivery
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			log.Printf("Error parsing %s: %v", deadLettersPath, err)
+		} else {
+			webhookMutex.Lock()
+			webhookDeadLetters = loaded
+			webhookMutex.Unlock()
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error reading %s: %v", deadLettersPath, err)
+	}
+}
+
+// Persist subscriptions; caller must hold webhookMutex
+func saveWebhooksLocked() error {
+	data, err := json.MarshalIndent(webhooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(webhooksPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(webhooksPath, data, 0600)
+}
+
+// Persist the dead-letter list so it survives a restart; caller must hold webhookMutex
+func saveDeadLettersLocked() error {
+	data, err := json.MarshalIndent(webhookDeadLetters, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(deadLettersPath), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(deadLettersPath, data, 0600)
+}
+
+// Event bus subscriber: fan the event out to matching webhooks
+func dispatchWebhooks(event Event) {
+	webhookMutex.RLock()
+	var targets []Webhook
+	for _, wh := range webhooks {
+		if wh.matches(event.Type) {
+			targets = append(targets, wh)
+		}
+	}
+	webhookMutex.RUnlock()
+
+	for _, wh := range targets {
+		go deliverWebhookWithRetry(wh, event)
+	}
+}
+
+// Sign a payload as HMAC-SHA256 over "<timestamp>.<body>"
+func signWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Make a single delivery attempt
+func sendWebhook(wh Webhook, deliveryID string, event Event) (int, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "brick-clock/"+getVersion())
+	req.Header.Set("X-Brick-Event", event.Type)
+	req.Header.Set("X-Brick-Delivery", deliveryID)
+	req.Header.Set("X-Brick-Timestamp", timestamp)
+	if wh.Secret != "" {
+		req.Header.Set("X-Brick-Signature", signWebhookPayload(wh.Secret, timestamp, body))
+	}
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Deliver with exponential backoff, dead-lettering after the last attempt
+func deliverWebhookWithRetry(wh Webhook, event Event) WebhookDelivery {
+	delivery := WebhookDelivery{
+		ID:        newID(),
+		WebhookID: wh.ID,
+		URL:       wh.URL,
+		Event:     event,
+	}
+	delay := webhookInitialDelay
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		delivery.Attempts = attempt
+		status, err := sendWebhook(wh, delivery.ID, event)
+		delivery.StatusCode = status
+		if err == nil {
+			delivery.Error = ""
+			delivery.Delivered = true
+			delivery.FinishedAt = time.Now().UTC()
+			return delivery
+		}
+		delivery.Error = err.Error()
+		log.Printf("Webhook %s delivery %s attempt %d failed: %v", wh.ID, delivery.ID, attempt, err)
+		if attempt < webhookMaxAttempts {
+			time.Sleep(delay)
+			delay *= 2
+			if delay > webhookMaxDelay {
+				delay = webhookMaxDelay
+			}
+		}
+	}
+
+	delivery.FinishedAt = time.Now().UTC()
+	webhookMutex.Lock()
+	webhookDeadLetters = append(webhookDeadLetters, delivery)
+	if len(webhookDeadLetters) > WEBHOOK_DEAD_LETTER_LIMIT {
+		webhookDeadLetters = webhookDeadLetters[len(webhookDeadLetters)-WEBHOOK_DEAD_LETTER_LIMIT:]
+	}
+	if err := saveDeadLettersLocked(); err != nil {
+		log.Printf("Failed to save webhook dead letters: %v", err)
+	}
+	webhookMutex.Unlock()
+	return delivery
+}
+
+// Validate a webhook request and fill in defaults
+func validateWebhookRequest(req WebhookRequest) error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	if len(req.Events) == 0 {
+		return fmt.Errorf("events must be a non-empty list")
+	}
+	for _, e := range req.Events {
+		if strings.TrimSpace(e) == "" {
+			return fmt.Errorf("events must not contain empty entries")
+		}
+	}
+	return nil
+}
+
+func findWebhookLocked(id string) int {
+	for i, wh := range webhooks {
+		if wh.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		webhookMutex.RLock()
+		list := make([]WebhookResponse, 0, len(webhooks))
+		for _, wh := range webhooks {
+			list = append(list, wh.response())
+		}
+		webhookMutex.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": list})
+
+	case http.MethodPost:
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if err := validateWebhookRequest(req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+			return
+		}
+		wh := Webhook{
+			ID:        newID(),
+			URL:       req.URL,
+			Events:    req.Events,
+			Secret:    req.Secret,
+			Enabled:   req.Enabled == nil || *req.Enabled,
+			CreatedAt: time.Now().UTC(),
+		}
+		webhookMutex.Lock()
+		webhooks = append(webhooks, wh)
+		err := saveWebhooksLocked()
+		webhookMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save webhooks", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(wh.response())
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
+
+// Handles /webhooks/{id}, /webhooks/{id}/test and /webhooks/dead-letters
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	if rest == "dead-letters" {
+		handleWebhookDeadLetters(w, r)
+		return
+	}
+	parts := strings.Split(rest, "/")
+	if rest == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "test") {
+		handleNotFound(w, r)
+		return
+	}
+	id := parts[0]
+	if len(parts) == 2 {
+		handleWebhookTest(w, r, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		webhookMutex.RLock()
+		idx := findWebhookLocked(id)
+		var wh Webhook
+		if idx >= 0 {
+			wh = webhooks[idx]
+		}
+		webhookMutex.RUnlock()
+		if idx < 0 {
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Webhook not found", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wh.response())
+
+	case http.MethodPut:
+		var req WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_JSON, "Invalid JSON", err.Error())
+			return
+		}
+		if err := validateWebhookRequest(req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ERR_INVALID_REQUEST, err.Error(), nil)
+			return
+		}
+		webhookMutex.Lock()
+		idx := findWebhookLocked(id)
+		if idx < 0 {
+			webhookMutex.Unlock()
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Webhook not found", nil)
+			return
+		}
+		wh := webhooks[idx]
+		wh.URL = req.URL
+		wh.Events = req.Events
+		// An empty secret keeps the existing one so clients need not resend it
+		if req.Secret != "" {
+			wh.Secret = req.Secret
+		}
+		if req.Enabled != nil {
+			wh.Enabled = *req.Enabled
+		}
+		webhooks[idx] = wh
+		err := saveWebhooksLocked()
+		webhookMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save webhooks", err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wh.response())
+
+	case http.MethodDelete:
+		webhookMutex.Lock()
+		idx := findWebhookLocked(id)
+		if idx < 0 {
+			webhookMutex.Unlock()
+			writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Webhook not found", nil)
+			return
+		}
+		webhooks = append(webhooks[:idx], webhooks[idx+1:]...)
+		err := saveWebhooksLocked()
+		webhookMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save webhooks", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
+
+// Send a single synchronous test event and report the outcome
+func handleWebhookTest(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+		return
+	}
+	webhookMutex.RLock()
+	idx := findWebhookLocked(id)
+	var wh Webhook
+	if idx >= 0 {
+		wh = webhooks[idx]
+	}
+	webhookMutex.RUnlock()
+	if idx < 0 {
+		writeError(w, r, http.StatusNotFound, ERR_NOT_FOUND, "Webhook not found", nil)
+		return
+	}
+
+	event := Event{
+		ID:        newID(),
+		Type:      EVENT_WEBHOOK_TEST,
+		Timestamp: time.Now().UTC(),
+		Data:      map[string]interface{}{"webhook_id": wh.ID},
+	}
+	delivery := WebhookDelivery{
+		ID:        newID(),
+		WebhookID: wh.ID,
+		URL:       wh.URL,
+		Event:     event,
+		Attempts:  1,
+	}
+	status, err := sendWebhook(wh, delivery.ID, event)
+	delivery.StatusCode = status
+	delivery.Delivered = err == nil
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	delivery.FinishedAt = time.Now().UTC()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+func handleWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		webhookMutex.RLock()
+		list := make([]WebhookDelivery, len(webhookDeadLetters))
+		copy(list, webhookDeadLetters)
+		webhookMutex.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"dead_letters": list})
+
+	case http.MethodDelete:
+		webhookMutex.Lock()
+		webhookDeadLetters = nil
+		err := saveDeadLettersLocked()
+		webhookMutex.Unlock()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ERR_INTERNAL, "Failed to save webhook dead letters", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ERR_METHOD_NOT_ALLOWED, "Method not allowed", nil)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Point webhook storage at a temporary directory and make retries fast
+func useTestWebhookState(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	savedPath, savedDeadPath := webhooksPath, deadLettersPath
+	savedAttempts, savedDelay := webhookMaxAttempts, webhookInitialDelay
+	webhooksPath = filepath.Join(dir, "webhooks.json")
+	deadLettersPath = filepath.Join(dir, "dead-letters.json")
+	webhookMaxAttempts = 3
+	webhookInitialDelay = time.Millisecond
+	webhookMutex.Lock()
+	webhooks, webhookDeadLetters = nil, nil
+	webhookMutex.Unlock()
+	t.Cleanup(func() {
+		webhooksPath, deadLettersPath = savedPath, savedDeadPath
+		webhookMaxAttempts, webhookInitialDelay = savedAttempts, savedDelay
+		webhookMutex.Lock()
+		webhooks, webhookDeadLetters = nil, nil
+		webhookMutex.Unlock()
+	})
+}
+
+// A delivery received by the test receiver
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// Start a receiver that answers with the given status codes in turn,
+// repeating the last one
+func startWebhookReceiver(t *testing.T, statuses ...int) (*httptest.Server, func() []receivedWebhook) {
+	t.Helper()
+	var mutex sync.Mutex
+	var received []receivedWebhook
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		received = append(received, receivedWebhook{header: r.Header.Clone(), body: body})
+		status := statuses[len(statuses)-1]
+		if len(received) <= len(statuses) {
+			status = statuses[len(received)-1]
+		}
+		mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []receivedWebhook {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]receivedWebhook(nil), received...)
+	}
+}
+
+func TestWebhookDeliveryIsSignedAndRetried(t *testing.T) {
+	useTestWebhookState(t)
+	server, received := startWebhookReceiver(t, http.StatusInternalServerError, http.StatusOK)
+
+	wh := Webhook{ID: "wh1", URL: server.URL, Events: []string{EVENT_SYNC_LOST}, Secret: "s3cret", Enabled: true}
+	event := Event{ID: "ev1", Type: EVENT_SYNC_LOST, Timestamp: time.Now().UTC(), Data: map[string]interface{}{"stratum": "3"}}
+	delivery := deliverWebhookWithRetry(wh, event)
+
+	if !delivery.Delivered || delivery.Attempts != 2 || delivery.StatusCode != http.StatusOK {
+		t.Fatalf("delivery = %+v, want delivered on attempt 2", delivery)
+	}
+	requests := received()
+	if len(requests) != 2 {
+		t.Fatalf("receiver got %d requests, want 2", len(requests))
+	}
+	for i, req := range requests {
+		if got := req.header.Get("X-Brick-Event"); got != EVENT_SYNC_LOST {
+			t.Errorf("request %d: X-Brick-Event = %q", i, got)
+		}
+		if got := req.header.Get("X-Brick-Delivery"); got != delivery.ID {
+			t.Errorf("request %d: X-Brick-Delivery = %q, want the same ID on every attempt (%q)", i, got, delivery.ID)
+		}
+		want := signWebhookPayload(wh.Secret, req.header.Get("X-Brick-Timestamp"), req.body)
+		if got := req.header.Get("X-Brick-Signature"); got != want {
+			t.Errorf("request %d: X-Brick-Signature = %q, want %q", i, got, want)
+		}
+		var payload Event
+		if err := json.Unmarshal(req.body, &payload); err != nil || payload.ID != event.ID || payload.Type != event.Type {
+			t.Errorf("request %d: payload %s does not carry the event (%v)", i, req.body, err)
+		}
+	}
+
+	webhookMutex.RLock()
+	defer webhookMutex.RUnlock()
+	if len(webhookDeadLetters) != 0 {
+		t.Errorf("dead letters = %+v, want none", webhookDeadLetters)
+	}
+}
+
+func TestWebhookWithoutSecretIsUnsigned(t *testing.T) {
+	useTestWebhookState(t)
+	server, received := startWebhookReceiver(t, http.StatusNoContent)
+
+	delivery := deliverWebhookWithRetry(Webhook{ID: "wh1", URL: server.URL, Enabled: true}, Event{ID: "ev1", Type: EVENT_WEBHOOK_TEST})
+	if !delivery.Delivered {
+		t.Fatalf("delivery = %+v, want delivered", delivery)
+	}
+	if got := received()[0].header.Get("X-Brick-Signature"); got != "" {
+		t.Errorf("X-Brick-Signature = %q, want none without a secret", got)
+	}
+}
+
+func TestWebhookDeadLettersSurviveRestart(t *testing.T) {
+	useTestWebhookState(t)
+	server, received := startWebhookReceiver(t, http.StatusServiceUnavailable)
+
+	delivery := deliverWebhookWithRetry(Webhook{ID: "wh1", URL: server.URL, Enabled: true}, Event{ID: "ev1", Type: EVENT_SYNC_LOST})
+	if delivery.Delivered || delivery.Attempts != webhookMaxAttempts || delivery.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("delivery = %+v, want %d failed attempts", delivery, webhookMaxAttempts)
+	}
+	if got := len(received()); got != webhookMaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", got, webhookMaxAttempts)
+	}
+
+	// A restart starts with an empty list and reloads it from disk
+	webhookMutex.Lock()
+	webhookDeadLetters = nil
+	webhookMutex.Unlock()
+	loadDeadLetters()
+
+	webhookMutex.RLock()
+	defer webhookMutex.RUnlock()
+	if len(webhookDeadLetters) != 1 || webhookDeadLetters[0].ID != delivery.ID || webhookDeadLetters[0].Event.ID != "ev1" {
+		t.Fatalf("dead letters after reload = %+v, want the failed delivery %s", webhookDeadLetters, delivery.ID)
+	}
+}
+
+func TestWebhookMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		webhook Webhook
+		event   string
+		want    bool
+	}{
+		{"listed type", Webhook{Enabled: true, Events: []string{EVENT_SYNC_LOST, EVENT_SYNC_RESTORED}}, EVENT_SYNC_RESTORED, true},
+		{"other type", Webhook{Enabled: true, Events: []string{EVENT_SYNC_LOST}}, EVENT_CONFIG_CHANGED, false},
+		{"wildcard", Webhook{Enabled: true, Events: []string{"*"}}, EVENT_CONFIG_CHANGED, true},
+		{"disabled", Webhook{Enabled: false, Events: []string{"*"}}, EVENT_SYNC_LOST, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.webhook.matches(tt.event); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.event, got, tt.want)
+			}
+		})
+	}
+}